@@ -80,6 +80,13 @@ elif [ "$1" = "mqtt_tests" ]; then
 
     go test -race -v -run=TestMQTT ./server -count=1 -vet=off -timeout=30m -failfast
 
+elif [ "$1" = "wasm_policy_tests" ]; then
+
+    # Run the tests of the WASM policy runtime, which is a separate module
+    # so that the server does not depend on it.
+
+    cd wasmpolicy && go test -race -v ./... -count=1 -vet=off -timeout=30m -failfast
+
 elif [ "$1" = "srv_pkg_non_js_tests" ]; then
 
     # Run all non JetStream tests in the server package. We exclude the
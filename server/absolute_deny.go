@@ -0,0 +1,67 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "fmt"
+
+// newAbsoluteDeny builds the sublist of the absolutely denied subjects.
+// Returns nil if there are none.
+func newAbsoluteDeny(subjects []string) *Sublist {
+	if len(subjects) == 0 {
+		return nil
+	}
+	sl := NewSublistWithCache()
+	for _, subject := range subjects {
+		sl.Insert(&subscription{subject: []byte(subject)})
+	}
+	return sl
+}
+
+// validateAbsoluteDeny checks the absolutely denied subjects.
+func validateAbsoluteDeny(subjects []string) error {
+	for _, subject := range subjects {
+		if !IsValidSubject(subject) {
+			return fmt.Errorf("invalid absolute deny subject %q", subject)
+		}
+	}
+	return nil
+}
+
+// absoluteDeny returns the sublist of the absolutely denied subjects, or
+// nil if there are none.
+func (s *Server) absoluteDeny() *Sublist {
+	sl, _ := s.absDeny.Load().(*Sublist)
+	return sl
+}
+
+// absoluteDenyList returns the sublist of the subjects absolutely denied
+// to the connection, or nil if there are none. The deny applies to client,
+// leafnode and route connections: messages on denied subjects are neither
+// accepted from nor delivered to them, and no interest on denied subjects
+// is exchanged with leafnodes and routes. Internal connections, such as
+// the system and JetStream ones, are not affected. The hot paths check it
+// before converting the subject to a string to match it.
+func (c *client) absoluteDenyList() *Sublist {
+	if (c.kind != CLIENT && c.kind != LEAF && c.kind != ROUTER) || c.srv == nil {
+		return nil
+	}
+	return c.srv.absoluteDeny()
+}
+
+// absolutelyDenied returns true if the subject is absolutely denied to
+// the connection, which no permission can override.
+func (c *client) absolutelyDenied(subject string) bool {
+	sl := c.absoluteDenyList()
+	return sl != nil && len(sl.Match(subject).psubs) > 0
+}
@@ -92,6 +92,7 @@ type Account struct {
 	eventIds     *nuid.NUID
 	eventIdsMu   sync.Mutex
 	defaultPerms *Permissions
+	authToken    string
 	tags         jwt.TagList
 	nameTag      string
 	lastLimErr   int64
@@ -315,6 +316,37 @@ func (a *Account) shallowCopy(na *Account) {
 	na.jsLimits = a.jsLimits
 	// Server config account limits.
 	na.limits = a.limits
+	na.defaultPerms = a.defaultPerms
+	na.authToken = a.authToken
+}
+
+// SetDefaultPermissions sets the permissions inherited by the users of this
+// account. Users that have their own permissions only inherit the parts they
+// don't define themselves. Like the account's users, this is taken into
+// account when the server configures its authorization.
+func (a *Account) SetDefaultPermissions(p *Permissions) {
+	a.mu.Lock()
+	a.defaultPerms = p
+	a.mu.Unlock()
+}
+
+// SetAuthToken sets a token shared by the clients of this account, for
+// tenants that do not want credentials for each of their users. Clients
+// presenting it are authorized as anonymous members of the account, with
+// the account's default permissions. Account tokens are looked up by their
+// value, so unlike other tokens they can't be bcrypt hashes. An empty token
+// removes it. When the account is registered with a server, the
+// change applies to the clients connecting afterwards.
+func (a *Account) SetAuthToken(token string) {
+	a.mu.Lock()
+	a.authToken = token
+	s := a.srv
+	a.mu.Unlock()
+	if s != nil {
+		s.mu.Lock()
+		s.configureTokenAccounts()
+		s.mu.Unlock()
+	}
 }
 
 // nextEventID uses its own lock for better concurrency.
@@ -3755,3 +3755,109 @@ func TestAccountReloadServiceImportPanic(t *testing.T) {
 		return fmt.Errorf("Have not received all responses, want %d got %d", totalRequests, resp)
 	})
 }
+
+func TestAccountMaxConnectionsAcrossUsers(t *testing.T) {
+	tmpl := `
+	port: -1
+	accounts {
+		A {
+			users = [
+				{user: u1, password: pwd}
+				{user: u2, password: pwd}
+			]
+			limits { max_connections: %d }
+		}
+	}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, 2)))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc1 := natsConnect(t, s.ClientURL(), nats.UserInfo("u1", "pwd"))
+	defer nc1.Close()
+	nc2 := natsConnect(t, s.ClientURL(), nats.UserInfo("u2", "pwd"))
+	defer nc2.Close()
+
+	// The cap is shared by all users of the account.
+	for _, user := range []string{"u1", "u2"} {
+		if nc, err := nats.Connect(s.ClientURL(), nats.UserInfo(user, "pwd"), nats.NoReconnect()); err == nil {
+			nc.Close()
+			t.Fatalf("Expected connection for %q to fail", user)
+		}
+	}
+
+	// Lowering the cap does not close existing connections.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, 1))
+	natsFlush(t, nc1)
+	natsFlush(t, nc2)
+	require_False(t, nc1.IsClosed())
+	require_False(t, nc2.IsClosed())
+
+	nc2.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumClients(); n != 1 {
+			return fmt.Errorf("expected 1 client, got %d", n)
+		}
+		return nil
+	})
+	// Still at the cap with the remaining connection.
+	if nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("u2", "pwd"), nats.NoReconnect()); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to fail")
+	}
+
+	nc1.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumClients(); n != 0 {
+			return fmt.Errorf("expected no client, got %d", n)
+		}
+		return nil
+	})
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("u2", "pwd"))
+	nc.Close()
+}
+
+func TestAccountMappedStreamImportPrefixRemap(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				exports: [{stream: "a.public.>"}]
+			}
+			B {
+				users: [{user: b, password: pwd}]
+				imports: [{stream: {account: A, subject: "a.public.>"}, to: "shared.>"}]
+			}
+		}
+	`))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncb := natsConnect(t, s.ClientURL(), nats.UserInfo("b", "pwd"))
+	defer ncb.Close()
+	sub := natsSubSync(t, ncb, "shared.>")
+	natsFlush(t, ncb)
+
+	nca := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	defer nca.Close()
+	natsPub(t, nca, "a.private.secret", []byte("private"))
+	natsPub(t, nca, "a.public.foo.bar", []byte("public"))
+	natsFlush(t, nca)
+
+	msg := natsNexMsg(t, sub, time.Second)
+	require_Equal(t, msg.Subject, "shared.foo.bar")
+	require_Equal(t, string(msg.Data), "public")
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+
+	// Subjects that are not exported can not be imported.
+	accA, err := s.LookupAccount("A")
+	require_NoError(t, err)
+	accB, err := s.LookupAccount("B")
+	require_NoError(t, err)
+	if err := accB.AddMappedStreamImport(accA, "a.private.>", "shared.private.>"); err != ErrStreamImportAuthorization {
+		t.Fatalf("Expected %v, got %v", ErrStreamImportAuthorization, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AdaptiveAuthOpts are the options of the adaptive authentication, which
+// requires stronger authentication methods while the rate of new client
+// connections is abnormally high, for instance during an attack.
+type AdaptiveAuthOpts struct {
+	// ConnectRate is the number of client connections per second above
+	// which the strict mode is entered.
+	ConnectRate int `json:"connect_rate"`
+	// Methods are the authentication methods accepted in strict mode from
+	// new connections, connected clients are not affected.
+	// Defaults to "nkey", "jwt" and "tls".
+	Methods []string `json:"methods,omitempty"`
+	// Cooldown is how long the connection rate has to stay at or below
+	// ConnectRate before the strict mode is left.
+	// Defaults to DEFAULT_ADAPTIVE_AUTH_COOLDOWN.
+	Cooldown time.Duration `json:"cooldown,omitempty"`
+}
+
+// Authentication methods accepted in strict mode by default.
+var defaultAdaptiveAuthMethods = []string{authMethodNkey, authMethodJWT, authMethodTLS}
+
+// validateAdaptiveAuth checks the adaptive authentication options.
+func validateAdaptiveAuth(aa *AdaptiveAuthOpts) error {
+	if aa == nil {
+		return nil
+	}
+	if aa.ConnectRate <= 0 {
+		return fmt.Errorf("adaptive authentication connect rate must be positive, got %d", aa.ConnectRate)
+	}
+	if aa.Cooldown < 0 {
+		return fmt.Errorf("adaptive authentication cooldown can not be negative, got %v", aa.Cooldown)
+	}
+	return validateEnabledAuthMethods(aa.Methods)
+}
+
+// adaptiveAuth measures the rate of client connections over one second
+// windows and tracks whether the strict mode is active.
+type adaptiveAuth struct {
+	mu          sync.Mutex
+	rate        int
+	methods     []string
+	cooldown    time.Duration
+	windowStart time.Time
+	count       int
+	strict      bool
+	strictUntil time.Time
+}
+
+// newAdaptiveAuth returns the adaptive authentication state for the
+// options, or nil if they are not set.
+func newAdaptiveAuth(o *AdaptiveAuthOpts) *adaptiveAuth {
+	if o == nil {
+		return nil
+	}
+	aa := &adaptiveAuth{rate: o.ConnectRate, methods: o.Methods, cooldown: o.Cooldown}
+	if len(aa.methods) == 0 {
+		aa.methods = defaultAdaptiveAuthMethods
+	}
+	if aa.cooldown == 0 {
+		aa.cooldown = DEFAULT_ADAPTIVE_AUTH_COOLDOWN
+	}
+	return aa
+}
+
+// sameConfig returns true if both have the same configuration.
+func (aa *adaptiveAuth) sameConfig(o *adaptiveAuth) bool {
+	if aa.rate != o.rate || aa.cooldown != o.cooldown || len(aa.methods) != len(o.methods) {
+		return false
+	}
+	for i, m := range aa.methods {
+		if m != o.methods[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// connected records a new client connection. Returns true if the
+// connection rate caused the strict mode to be entered.
+func (aa *adaptiveAuth) connected(now time.Time) bool {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	if now.Sub(aa.windowStart) >= time.Second {
+		aa.windowStart, aa.count = now, 0
+	}
+	aa.count++
+	if aa.count <= aa.rate {
+		return false
+	}
+	// Stay strict for the cooldown after the last connection above the rate.
+	aa.strictUntil = now.Add(aa.cooldown)
+	entered := !aa.strict
+	aa.strict = true
+	return entered
+}
+
+// isStrict returns whether the strict mode is active, and whether it has
+// just been left because the cooldown elapsed.
+func (aa *adaptiveAuth) isStrict(now time.Time) (strict, left bool) {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	if aa.strict && !now.Before(aa.strictUntil) {
+		aa.strict = false
+		return false, true
+	}
+	return aa.strict, false
+}
+
+// adaptiveAuth returns the adaptive authentication state, if configured.
+func (s *Server) adaptiveAuth() *adaptiveAuth {
+	aa, _ := s.adaptive.Load().(*adaptiveAuth)
+	return aa
+}
+
+// configureAdaptiveAuth sets up the adaptive authentication. The current
+// state, such as an active strict mode, is kept if the configuration did
+// not change, so that reloading the authorization during an attack does
+// not lower the requirements.
+func (s *Server) configureAdaptiveAuth(o *AdaptiveAuthOpts) {
+	aa := newAdaptiveAuth(o)
+	if cur := s.adaptiveAuth(); cur != nil && aa != nil && cur.sameConfig(aa) {
+		return
+	}
+	s.adaptive.Store(aa)
+}
+
+// trackConnectRate records a new client connection for the adaptive
+// authentication.
+func (s *Server) trackConnectRate() {
+	aa := s.adaptiveAuth()
+	if aa == nil {
+		return
+	}
+	if aa.connected(time.Now()) {
+		s.Warnf("Client connection rate above %d/s, only accepting authentication methods %v", aa.rate, aa.methods)
+	}
+}
+
+// adaptiveAuthAllows returns false if the strict mode of the adaptive
+// authentication is active and the method that authenticated the client is
+// not accepted in that mode. Only new connections are checked, connected
+// clients authorized again on reload are not disconnected.
+func (s *Server) adaptiveAuthAllows(c *client, method string) bool {
+	aa := s.adaptiveAuth()
+	if aa == nil || c.kind != CLIENT || c.reauthorizing() {
+		return true
+	}
+	strict, left := aa.isStrict(time.Now())
+	if left {
+		s.Noticef("Client connection rate back to normal, accepting all authentication methods")
+	}
+	if !strict {
+		return true
+	}
+	if !authMethodEnabled(aa.methods, method) {
+		c.Debugf("Authentication method %q not accepted while the connection rate is high", method)
+		return false
+	}
+	return true
+}
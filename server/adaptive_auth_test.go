@@ -0,0 +1,159 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestAdaptiveAuth(t *testing.T) {
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: alice, password: pwd}
+				{nkey: %s}
+			]
+		}
+		adaptive_auth {
+			connect_rate: 5
+			methods: [nkey]
+			cooldown: "1s"
+		}
+	`, pub)))
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	require_Equal(t, opts.AdaptiveAuth.ConnectRate, 5)
+
+	nkeyOpt := nats.Nkey(pub, func(nonce []byte) ([]byte, error) { return kp.Sign(nonce) })
+	isStrict := func() bool {
+		strict, _ := s.adaptiveAuth().isStrict(time.Now())
+		return strict
+	}
+
+	// All methods are accepted under a normal connection rate.
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("alice", "pwd"))
+	nc.Close()
+	require_False(t, isStrict())
+	connected := natsConnect(t, s.ClientURL(), nats.UserInfo("alice", "pwd"))
+	defer connected.Close()
+
+	// Flood the server with connections.
+	addr := fmt.Sprintf("127.0.0.1:%d", opts.Port)
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", addr)
+		require_NoError(t, err)
+		defer conn.Close()
+	}
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if !isStrict() {
+			return fmt.Errorf("strict mode not entered")
+		}
+		return nil
+	})
+	_, err := nats.Connect(s.ClientURL(), nats.UserInfo("alice", "pwd"))
+	require_Error(t, err)
+	nc = natsConnect(t, s.ClientURL(), nkeyOpt)
+	nc.Close()
+
+	// Connected clients are not disconnected by a reload in strict mode.
+	content, err := os.ReadFile(conf)
+	require_NoError(t, err)
+	changeCurrentConfigContentWithNewContent(t, conf, append(content, []byte("\ndebug: true\n")...))
+	require_NoError(t, s.Reload())
+	require_True(t, isStrict())
+	natsFlush(t, connected)
+	require_True(t, connected.IsConnected())
+
+	// The strict mode is left once the rate dropped for the cooldown.
+	checkFor(t, 3*time.Second, 50*time.Millisecond, func() error {
+		if isStrict() {
+			return fmt.Errorf("strict mode not left")
+		}
+		return nil
+	})
+	nc = natsConnect(t, s.ClientURL(), nats.UserInfo("alice", "pwd"))
+	nc.Close()
+}
+
+func TestAdaptiveAuthDecoyNkey(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{{Username: "u", Password: "p"}}
+	opts.AdaptiveAuth = &AdaptiveAuthOpts{ConnectRate: 1, Methods: []string{"nkey"}, Cooldown: time.Minute}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	now := time.Now()
+	s.adaptiveAuth().connected(now)
+	require_True(t, s.adaptiveAuth().connected(now))
+
+	// The password authenticated the client, not the nkey it added.
+	c, cr, _ := newClientForServer(s)
+	defer c.close()
+	c.parseAsync("CONNECT {\"user\":\"u\",\"pass\":\"p\",\"nkey\":\"UDECOY\"}\r\nPING\r\n")
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR 'Authorization Violation'") {
+		t.Fatalf("Expected an authorization violation, got %q", l)
+	}
+	// The lockout is counted for the method that authenticated the client.
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.AuthStats().Lockouts[authMethodUser]; n != 1 {
+			return fmt.Errorf("expected 1 lockout, got %d", n)
+		}
+		return nil
+	})
+}
+
+func TestAdaptiveAuthConnectRate(t *testing.T) {
+	aa := newAdaptiveAuth(&AdaptiveAuthOpts{ConnectRate: 2, Cooldown: time.Second})
+	require_Equal(t, len(aa.methods), len(defaultAdaptiveAuthMethods))
+
+	now := time.Now()
+	// The rate is measured over one second windows.
+	for i := 0; i < 4; i++ {
+		require_False(t, aa.connected(now.Add(time.Duration(i)*600*time.Millisecond)))
+	}
+	strict, _ := aa.isStrict(now.Add(2 * time.Second))
+	require_False(t, strict)
+
+	now = now.Add(10 * time.Second)
+	require_False(t, aa.connected(now))
+	require_False(t, aa.connected(now))
+	require_True(t, aa.connected(now))
+	// Already strict, connections above the rate extend the cooldown.
+	require_False(t, aa.connected(now.Add(500*time.Millisecond)))
+	strict, left := aa.isStrict(now.Add(time.Second))
+	require_True(t, strict)
+	require_False(t, left)
+	strict, left = aa.isStrict(now.Add(1500 * time.Millisecond))
+	require_False(t, strict)
+	require_True(t, left)
+
+	for _, o := range []*AdaptiveAuthOpts{
+		{ConnectRate: 0},
+		{ConnectRate: 1, Cooldown: -time.Second},
+		{ConnectRate: 1, Methods: []string{"password"}},
+	} {
+		require_Error(t, validateAdaptiveAuth(o))
+	}
+}
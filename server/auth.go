@@ -14,17 +14,23 @@
 package server
 
 import (
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -40,6 +46,39 @@ type Authentication interface {
 	Check(c ClientAuthentication) bool
 }
 
+// TransientAuthentication can be implemented by a custom Authentication
+// whose checks depend on a backend that may not be ready yet, to tell such
+// transient failures from rejected credentials.
+type TransientAuthentication interface {
+	Authentication
+	// CheckTransient checks the client like Check, but also reports if a
+	// failure is transient, in which case the check may be retried.
+	CheckTransient(c ClientAuthentication) (ok bool, transient bool)
+}
+
+// HealthCheckedAuthentication can be implemented by a custom Authentication
+// depending on a backend, to report whether the backend is reachable. The
+// server is reported unhealthy while the check fails, so that it can be
+// taken out of a load balancer, but existing connections are kept.
+type HealthCheckedAuthentication interface {
+	Authentication
+	// HealthCheck returns an error if the backend is not healthy.
+	HealthCheck() error
+}
+
+// PermissionsResolver resolves the permissions of authorized clients, for
+// backends too slow to be consulted while the client waits for its CONNECT
+// to be processed. Clients are authorized right away with permissions
+// denying everything, so anything they publish or subscribe to before the
+// permissions are resolved is rejected. Once installed, the permissions
+// are sent to clients supporting INFO updates so that they know they can
+// proceed. Clients are disconnected if their permissions can't be resolved.
+type PermissionsResolver interface {
+	// ResolvePermissions returns the permissions of the client. It is
+	// called from its own go routine. Nil permissions allow everything.
+	ResolvePermissions(c ClientAuthentication) (*Permissions, error)
+}
+
 // ClientAuthentication is an interface for client authentication
 type ClientAuthentication interface {
 	// GetOpts gets options associated with a client
@@ -56,6 +95,95 @@ type ClientAuthentication interface {
 	Kind() int
 }
 
+// Authentication methods that a client may use to connect.
+const (
+	authMethodNone   = "none"
+	authMethodCustom = "custom"
+	authMethodJWT    = "jwt"
+	authMethodNkey   = "nkey"
+	authMethodToken  = "token"
+	authMethodUser   = "user"
+	authMethodTLS    = "tls"
+)
+
+// Reasons of the authentication failures reported by RecentAuthFailures.
+const (
+	authFailDefault        = "authentication failed"
+	authFailUnknownUser    = "unknown user"
+	authFailPassword       = "invalid password"
+	authFailToken          = "invalid token"
+	authFailSignature      = "invalid signature"
+	authFailJWT            = "invalid JWT"
+	authFailRevoked        = "revoked credentials"
+	authFailTLS            = "TLS requirements not met"
+	authFailTLSVersion     = "TLS version too old"
+	authFailConnectionType = "connection type not allowed"
+	authFailMethodDisabled = "authentication method disabled"
+	authFailUnknownScheme  = "unknown authentication scheme"
+	authFailCustom         = "rejected by custom authentication"
+	authFailNotLoopback    = "not a loopback connection"
+	authFailNoAuth         = "credentials sent without authentication configured"
+	authFailCredentialLen  = "credentials too long"
+	authFailReputation     = "bad IP reputation"
+	authFailStrictMode     = "method not accepted under high connection rate"
+	authFailNamespace      = "namespace not issued"
+	authFailNameRequired   = "client name required"
+	authFailClockSkew      = "client clock skewed"
+	authFailConnsPerIP     = "too many connections from IP"
+	authFailPoW            = "insufficient proof of work"
+)
+
+// AuthFailure describes a failed authentication attempt. It never holds
+// secrets such as passwords, tokens, signatures or JWTs.
+type AuthFailure struct {
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"`
+	Kind   string    `json:"kind"`
+	// User is the attempted user name or nkey, if any.
+	User   string `json:"user,omitempty"`
+	Method string `json:"method"`
+	Reason string `json:"reason"`
+}
+
+// AuthStats are the authentication counters of the server since it started,
+// keyed by authentication method.
+type AuthStats struct {
+	Successes map[string]uint64 `json:"successes"`
+	Failures  []AuthFailureStat `json:"failures"`
+	// Active is the number of connected clients by the method they
+	// authenticated with.
+	Active map[string]int `json:"active"`
+	// Lockouts is the number of clients rejected by the method they
+	// authenticated with because it is not accepted while the adaptive
+	// authentication is in strict mode.
+	Lockouts map[string]uint64 `json:"lockouts"`
+}
+
+// AuthFailureStat is the number of authentication failures for a method
+// and reason.
+type AuthFailureStat struct {
+	Method string `json:"method"`
+	Reason string `json:"reason"`
+	Count  uint64 `json:"count"`
+}
+
+// authCounters counts the authentication successes and failures. It has its
+// own lock since they are counted from the clients' connection paths.
+type authCounters struct {
+	mu        sync.Mutex
+	successes map[string]uint64
+	failures  map[AuthFailureStat]uint64 // Count is always zero in the keys.
+	lockouts  map[string]uint64
+}
+
+func newAuthCounters() *authCounters {
+	return &authCounters{
+		successes: make(map[string]uint64),
+		failures:  make(map[AuthFailureStat]uint64),
+		lockouts:  make(map[string]uint64),
+	}
+}
+
 // NkeyUser is for multiple nkey based users
 type NkeyUser struct {
 	Nkey                   string              `json:"user"`
@@ -63,15 +191,116 @@ type NkeyUser struct {
 	Account                *Account            `json:"account,omitempty"`
 	SigningKey             string              `json:"signing_key,omitempty"`
 	AllowedConnectionTypes map[string]struct{} `json:"connection_types,omitempty"`
+	RequireTLS             bool                `json:"require_tls,omitempty"`
+	MinTLSVersion          uint16              `json:"min_tls_version,omitempty"`
+	Tags                   map[string]string   `json:"tags,omitempty"`
+	IdleTimeout            time.Duration       `json:"idle_timeout,omitempty"`
+	// RawEd25519 indicates that Nkey is a base64 encoded raw Ed25519
+	// public key instead of an nkey.
+	RawEd25519 bool `json:"raw_ed25519,omitempty"`
+	// Namespaces the user is issued. When set, the client has to claim one
+	// of them in its CONNECT and sign "<nonce>|<namespace>" instead of the
+	// nonce, binding the claim to its key. The client is then confined to
+	// the claimed namespace, see User.Namespace.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// RequireCertNkey requires the client certificate to be bound to the
+	// Nkey with a URI SAN "nkey:<Nkey>", in addition to the nonce signature.
+	RequireCertNkey bool `json:"require_cert_nkey,omitempty"`
+	// Admin flags the user as privileged, see User.Admin.
+	Admin bool `json:"admin,omitempty"`
 }
 
+// certNkeyURIScheme is the scheme of the URI SAN binding a client
+// certificate to an nkey, see NkeyUser.RequireCertNkey.
+const certNkeyURIScheme = "nkey"
+
 // User is for multiple accounts/users.
 type User struct {
 	Username               string              `json:"user"`
 	Password               string              `json:"password"`
+	Passwords              []string            `json:"passwords,omitempty"`
 	Permissions            *Permissions        `json:"permissions,omitempty"`
 	Account                *Account            `json:"account,omitempty"`
 	AllowedConnectionTypes map[string]struct{} `json:"connection_types,omitempty"`
+	RequireTLS             bool                `json:"require_tls,omitempty"`
+	MinTLSVersion          uint16              `json:"min_tls_version,omitempty"`
+	Tags                   map[string]string   `json:"tags,omitempty"`
+	IdleTimeout            time.Duration       `json:"idle_timeout,omitempty"`
+	// Nkey is the public key of the user. When RequireSignature is set,
+	// the client has to sign the nonce with the corresponding seed in
+	// addition to providing the password.
+	Nkey             string `json:"nkey,omitempty"`
+	RequireSignature bool   `json:"require_signature,omitempty"`
+	// EitherCredential lets the user authenticate with either its password
+	// or a signature of the nonce with its Nkey, to migrate users from
+	// passwords to nkeys. The method used by each client is logged.
+	EitherCredential bool `json:"either_credential,omitempty"`
+	// PSK is a pre-shared key for devices that cannot afford bcrypt or
+	// nkeys. When set, the client sends the HMAC-SHA256 of the nonce keyed
+	// with the PSK as its signature instead of the password.
+	PSK string `json:"-"`
+	// TLSPermissions, when set, replace Permissions for clients that
+	// presented a verified TLS client certificate.
+	TLSPermissions *Permissions `json:"tls_permissions,omitempty"`
+	// PasswordOptional allows the user to be configured without a password.
+	// Such a user can be impersonated by anyone knowing its name.
+	PasswordOptional bool `json:"password_optional,omitempty"`
+	// PublishRewrites maps published subjects, which may contain wildcards,
+	// to the subject the message is delivered on. Permissions are checked
+	// against both the original and the rewritten subject. When several
+	// sources match, the most specific one applies.
+	PublishRewrites map[string]string `json:"publish_rewrites,omitempty"`
+	// PinnedCertSHA256 is the hex-encoded SHA-256 fingerprint of the DER
+	// encoded client certificate the user has to present, colons allowed.
+	PinnedCertSHA256 string `json:"pinned_cert_sha256,omitempty"`
+	// Namespace is a subject prefix the user can't escape: the allowed
+	// subjects of its permissions have to be within "<namespace>.>" and
+	// anything outside of it is denied regardless of the permissions.
+	Namespace string `json:"namespace,omitempty"`
+	// MaxPayload lowers the maximum payload of the messages the user can
+	// publish. It can't exceed the server's. Zero means the server's.
+	MaxPayload int32 `json:"max_payload,omitempty"`
+	// MaxPending replaces the maximum number of bytes buffered for the
+	// user's connections before they are disconnected as slow consumers.
+	// Zero means the server's.
+	MaxPending int64 `json:"max_pending,omitempty"`
+	// MaxPublishSubjects caps the number of distinct subjects each of the
+	// user's connections can publish to, to contain publishers enumerating
+	// subjects by mistake. Subjects already published to can still be
+	// used once the cap is reached. Zero means no limit.
+	MaxPublishSubjects int `json:"max_publish_subjects,omitempty"`
+	// MaxPublishRate caps the number of messages per second each of the
+	// user's connections can publish, regardless of the subject. Messages
+	// above the rate are rejected with an error. Zero means no limit.
+	MaxPublishRate int `json:"max_publish_rate,omitempty"`
+	// MaxConnectionsPerIP caps the number of connections of the user from
+	// a single IP address, so that one host can't take all of the user's
+	// connections. Zero means no limit.
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+	// Admin flags the user as privileged, reported to the
+	// Options.PrivilegedConnectCallback when it connects.
+	Admin bool `json:"admin,omitempty"`
+	// TraceDenials logs in detail why the user's publishes and subscribes
+	// are denied, regardless of the logging level, to debug a single user
+	// without tracing the whole server.
+	TraceDenials bool `json:"trace_denials,omitempty"`
+	// Options restrict the protocol features of the user's connections.
+	Options *UserOptions `json:"options,omitempty"`
+}
+
+// UserOptions are protocol features forced off for the connections of a
+// user regardless of what they request in their CONNECT, for instance
+// for low-trust users. Features are only restored for connections made
+// after the options are relaxed.
+type UserOptions struct {
+	// NoEcho disables echo, so the user never receives its own messages.
+	NoEcho bool `json:"no_echo,omitempty"`
+	// NoVerbose disables the verbose mode, in which each protocol message
+	// is acknowledged with +OK.
+	NoVerbose bool `json:"no_verbose,omitempty"`
+	// NoHeaders disables message headers, and with them the no responders
+	// notifications that need headers.
+	NoHeaders bool `json:"no_headers,omitempty"`
 }
 
 // clone performs a deep copy of the User struct, returning a new clone with
@@ -82,10 +311,37 @@ func (u *User) clone() *User {
 	}
 	clone := &User{}
 	*clone = *u
+	if u.Passwords != nil {
+		clone.Passwords = make([]string, len(u.Passwords))
+		copy(clone.Passwords, u.Passwords)
+	}
+	clone.Tags = copyTags(u.Tags)
+	clone.PublishRewrites = copyTags(u.PublishRewrites)
 	clone.Permissions = u.Permissions.clone()
+	clone.TLSPermissions = u.TLSPermissions.clone()
+	if u.Options != nil {
+		uo := *u.Options
+		clone.Options = &uo
+	}
 	return clone
 }
 
+// checkPassword returns true if the given client password matches the
+// user's password or any of the additional passwords used for rotation.
+func (u *User) checkPassword(clientPassword string) bool {
+	// An empty password only counts when no rotation passwords are set,
+	// otherwise a client not sending a password would be accepted.
+	if (u.Password != _EMPTY_ || len(u.Passwords) == 0) && comparePasswords(u.Password, clientPassword) {
+		return true
+	}
+	for _, pwd := range u.Passwords {
+		if comparePasswords(pwd, clientPassword) {
+			return true
+		}
+	}
+	return false
+}
+
 // clone performs a deep copy of the NkeyUser struct, returning a new clone with
 // all values copied.
 func (n *NkeyUser) clone() *NkeyUser {
@@ -94,15 +350,119 @@ func (n *NkeyUser) clone() *NkeyUser {
 	}
 	clone := &NkeyUser{}
 	*clone = *n
+	clone.Tags = copyTags(n.Tags)
 	clone.Permissions = n.Permissions.clone()
+	if n.Namespaces != nil {
+		clone.Namespaces = append([]string(nil), n.Namespaces...)
+	}
 	return clone
 }
 
+// copyTags returns a copy of the given user tags, or nil if there are none.
+func copyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+// tagTemplateRE matches permission subject templates that are replaced
+// with the value of a user tag, such as "{{tag:team}}".
+var tagTemplateRE = regexp.MustCompile(`{{\s*tag:\s*([^}\s]+)\s*}}`)
+
+// denyAllPermissions returns permissions denying everything.
+func denyAllPermissions() *Permissions {
+	return &Permissions{
+		Publish:   &SubjectPermission{Deny: []string{fwcs}},
+		Subscribe: &SubjectPermission{Deny: []string{fwcs}},
+	}
+}
+
+// allowAllPermissions returns permissions allowing everything. They are
+// given explicitly so that NilPermissionsMeanDeny does not apply.
+func allowAllPermissions() *Permissions {
+	return &Permissions{
+		Publish:   &SubjectPermission{Allow: []string{fwcs}},
+		Subscribe: &SubjectPermission{Allow: []string{fwcs}},
+	}
+}
+
+// hasTagTemplates returns true if some publish or subscribe subjects
+// are tag templates.
+func (p *Permissions) hasTagTemplates() bool {
+	for _, sp := range []*SubjectPermission{p.Publish, p.Subscribe} {
+		if sp == nil {
+			continue
+		}
+		for _, subjects := range [][]string{sp.Allow, sp.Deny} {
+			for _, subj := range subjects {
+				if strings.Contains(subj, "{{") && tagTemplateRE.MatchString(subj) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// expandTagTemplates returns a copy of the permissions where the tag
+// templates in publish and subscribe subjects are replaced by the value
+// of the corresponding user tag. To fail closed, an error and permissions
+// denying everything are returned if a tag is missing or if its value is
+// not a valid literal subject token.
+func (p *Permissions) expandTagTemplates(tags map[string]string) (*Permissions, error) {
+	var err error
+	expand := func(subjects []string) []string {
+		for i, subj := range subjects {
+			subjects[i] = tagTemplateRE.ReplaceAllStringFunc(subj, func(tmpl string) string {
+				name := tagTemplateRE.FindStringSubmatch(tmpl)[1]
+				value, ok := tags[name]
+				if !ok {
+					err = fmt.Errorf("tag %q used in permissions is missing", name)
+				} else if value == _EMPTY_ || strings.ContainsAny(value, " \t\r\n.*>") {
+					err = fmt.Errorf("value %q of tag %q is not a valid subject token", value, name)
+				}
+				return value
+			})
+		}
+		return subjects
+	}
+	np := p.clone()
+	for _, sp := range []*SubjectPermission{np.Publish, np.Subscribe} {
+		if sp != nil {
+			sp.Allow = expand(sp.Allow)
+			sp.Deny = expand(sp.Deny)
+		}
+	}
+	if err != nil {
+		return denyAllPermissions(), err
+	}
+	return np, nil
+}
+
+// Allow subjects qualified with this prefix, such as "exact:foo.bar", only
+// match that literal subject and never a wildcard subscription.
+const exactSubjectPrefix = "exact:"
+
 // SubjectPermission is an individual allow and deny struct for publish
 // and subscribe authorizations.
 type SubjectPermission struct {
 	Allow []string `json:"allow,omitempty"`
 	Deny  []string `json:"deny,omitempty"`
+	// Digests of the subjects loaded from the allow_trie_file and
+	// deny_trie_file prefix trees, reported in place of the subjects since
+	// there can be many of them. They are set when the files are loaded.
+	AllowTrieDigest string `json:"allow_trie_digest,omitempty"`
+	DenyTrieDigest  string `json:"deny_trie_digest,omitempty"`
+	// Subjects loaded from the allow_trie_file and deny_trie_file prefix
+	// trees. These sublists are shared by all the clients using the
+	// permissions and are never modified.
+	allowTrie *Sublist
+	denyTrie  *Sublist
 }
 
 // ResponsePermission can be used to allow responses to any reply subject
@@ -118,6 +478,75 @@ type Permissions struct {
 	Publish   *SubjectPermission  `json:"publish"`
 	Subscribe *SubjectPermission  `json:"subscribe"`
 	Response  *ResponsePermission `json:"responses,omitempty"`
+	// MaxWildcardTokens caps the number of wildcard tokens a subscription
+	// subject can have. When set, subjects made only of wildcards such as
+	// ">" or "*.*" are rejected as well. Zero means no limit.
+	MaxWildcardTokens int `json:"max_wildcard_tokens,omitempty"`
+	// QueueRequired lists subjects that can only be subscribed to using a
+	// queue group. Plain subscriptions that could receive messages on any
+	// of those subjects are rejected.
+	QueueRequired []string `json:"queue_required,omitempty"`
+	// RequestOnly lists subjects that only accept requests. Messages
+	// published on those subjects without a reply subject are rejected.
+	RequestOnly []string `json:"request_only,omitempty"`
+	// PublishRates limit the rate at which messages can be published
+	// on the given subjects.
+	PublishRates []*PublishRate `json:"publish_rates,omitempty"`
+	// AllowOwnInbox allows subscribing to the user's own inbox prefix,
+	// "_INBOX.<user>.>", in addition to the allowed subscribe subjects.
+	// If there are none, the inbox is the only subject allowed.
+	// Clients are expected to use this as their custom inbox prefix.
+	AllowOwnInbox bool `json:"allow_own_inbox,omitempty"`
+	// DenyMessage is appended to the permissions violation errors sent to
+	// the client, for instance to tell how to request access.
+	DenyMessage string `json:"deny_message,omitempty"`
+	// RequiredHeaders lists headers that messages published on the given
+	// subjects must have.
+	RequiredHeaders []*RequiredHeader `json:"required_headers,omitempty"`
+	// SubscribeHeaderFilters restrict the messages delivered to the
+	// subscriptions on the given subjects to those carrying allowed values
+	// of a header.
+	SubscribeHeaderFilters []*HeaderFilter `json:"subscribe_header_filters,omitempty"`
+	// Grants temporarily extend the allowed publish and subscribe subjects.
+	// They are dropped from the permissions once expired.
+	Grants []*PermissionGrant `json:"grants,omitempty"`
+}
+
+// PermissionGrant allows publishing and subscribing on additional subjects
+// until Expires. Grants extend the allow lists, so they have no effect when
+// everything is allowed. When a grant expires, the subscriptions that are no
+// longer allowed are removed.
+type PermissionGrant struct {
+	Publish   []string  `json:"publish,omitempty"`
+	Subscribe []string  `json:"subscribe,omitempty"`
+	Expires   time.Time `json:"expires"`
+}
+
+// RequiredHeader requires messages published on subjects matching Subject
+// to have the Header header set. Since only clients supporting headers can
+// set them, other clients can not publish on those subjects.
+type RequiredHeader struct {
+	Subject string `json:"subject"`
+	Header  string `json:"header"`
+}
+
+// HeaderFilter only lets messages on subjects matching Subject be delivered
+// to a client if their Header header has one of the Values. Other messages,
+// including the ones without the header, are dropped by the server.
+type HeaderFilter struct {
+	Subject string   `json:"subject"`
+	Header  string   `json:"header"`
+	Values  []string `json:"values"`
+}
+
+// PublishRate limits the number of messages per second that a client can
+// publish on subjects matching Subject. Bursts of up to Rate messages are
+// accepted. Messages above the rate are rejected with an error, or dropped
+// silently if Drop is set.
+type PublishRate struct {
+	Subject string `json:"subject"`
+	Rate    int    `json:"rate"`
+	Drop    bool   `json:"drop,omitempty"`
 }
 
 // RoutePermissions are similar to user permissions
@@ -126,6 +555,9 @@ type Permissions struct {
 type RoutePermissions struct {
 	Import *SubjectPermission `json:"import"`
 	Export *SubjectPermission `json:"export"`
+	// ImportRates throttle the messages a route can send us on the given
+	// subjects, messages beyond the rate are dropped.
+	ImportRates []*PublishRate `json:"import_rates,omitempty"`
 }
 
 // clone will clone an individual subject permission.
@@ -142,214 +574,2093 @@ func (p *SubjectPermission) clone() *SubjectPermission {
 		clone.Deny = make([]string, len(p.Deny))
 		copy(clone.Deny, p.Deny)
 	}
-	return clone
+	clone.AllowTrieDigest, clone.DenyTrieDigest = p.AllowTrieDigest, p.DenyTrieDigest
+	clone.allowTrie, clone.denyTrie = p.allowTrie, p.denyTrie
+	return clone
+}
+
+// sublistDigest returns the hex encoded sha256 of the sorted subjects of the
+// sublist, which only depends on the subjects and not on how they were
+// listed.
+func sublistDigest(sl *Sublist) string {
+	var subs []*subscription
+	sl.All(&subs)
+	subjects := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		subjects = append(subjects, string(sub.subject))
+	}
+	sort.Strings(subjects)
+	h := sha256.New()
+	for _, subject := range subjects {
+		h.Write([]byte(subject))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CheckPermissions evaluates the publish permission against each of the
+// given subjects, returning whether each one is allowed. The subjects are
+// checked with the same logic as the publishes of a client given this
+// permission, including the exact subjects and the allow and deny prefix
+// trees. A nil permission allows everything.
+func CheckPermissions(perm *SubjectPermission, subjects []string) map[string]bool {
+	c := &client{}
+	c.setPermissions(&Permissions{Publish: perm})
+	results := make(map[string]bool, len(subjects))
+	for _, subj := range subjects {
+		// Reply permissions do not apply, and the client is not shared.
+		results[subj] = c.pubAllowedFullCheck(subj, false, true)
+	}
+	return results
+}
+
+// clone performs a deep copy of the Permissions struct, returning a new clone
+// with all values copied.
+func (p *Permissions) clone() *Permissions {
+	if p == nil {
+		return nil
+	}
+	clone := &Permissions{
+		MaxWildcardTokens: p.MaxWildcardTokens,
+		AllowOwnInbox:     p.AllowOwnInbox,
+		DenyMessage:       p.DenyMessage,
+	}
+	if p.QueueRequired != nil {
+		clone.QueueRequired = make([]string, len(p.QueueRequired))
+		copy(clone.QueueRequired, p.QueueRequired)
+	}
+	if p.RequestOnly != nil {
+		clone.RequestOnly = make([]string, len(p.RequestOnly))
+		copy(clone.RequestOnly, p.RequestOnly)
+	}
+	for _, pr := range p.PublishRates {
+		r := *pr
+		clone.PublishRates = append(clone.PublishRates, &r)
+	}
+	for _, rh := range p.RequiredHeaders {
+		h := *rh
+		clone.RequiredHeaders = append(clone.RequiredHeaders, &h)
+	}
+	for _, hf := range p.SubscribeHeaderFilters {
+		clone.SubscribeHeaderFilters = append(clone.SubscribeHeaderFilters, &HeaderFilter{
+			Subject: hf.Subject,
+			Header:  hf.Header,
+			Values:  append([]string(nil), hf.Values...),
+		})
+	}
+	for _, g := range p.Grants {
+		clone.Grants = append(clone.Grants, &PermissionGrant{
+			Publish:   append([]string(nil), g.Publish...),
+			Subscribe: append([]string(nil), g.Subscribe...),
+			Expires:   g.Expires,
+		})
+	}
+	if p.Publish != nil {
+		clone.Publish = p.Publish.clone()
+	}
+	if p.Subscribe != nil {
+		clone.Subscribe = p.Subscribe.clone()
+	}
+	if p.Response != nil {
+		clone.Response = &ResponsePermission{
+			MaxMsgs: p.Response.MaxMsgs,
+			Expires: p.Response.Expires,
+		}
+	}
+	return clone
+}
+
+// checkAuthforWarnings will look for insecure settings and log concerns.
+// Lock should not be held.
+func (s *Server) checkAuthforWarnings() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	warn := false
+	opts := s.getOpts()
+	if opts.Password != _EMPTY_ && !isBcrypt(opts.Password) {
+		warn = true
+	}
+	for _, u := range s.users {
+		// Skip warn if using TLS certs based auth
+		// unless a password has been left in the config.
+		if u.Password == _EMPTY_ && opts.TLSMap {
+			continue
+		}
+		// Check if this is our internal sys client created on the fly.
+		if s.sysAccOnlyNoAuthUser != _EMPTY_ && u.Username == s.sysAccOnlyNoAuthUser {
+			continue
+		}
+		if !isBcrypt(u.Password) {
+			warn = true
+			break
+		}
+		for _, pwd := range u.Passwords {
+			if !isBcrypt(pwd) {
+				warn = true
+			}
+		}
+		if warn {
+			break
+		}
+	}
+	if warn {
+		// Warning about using plaintext passwords.
+		s.Warnf("Plaintext passwords detected, use nkeys or bcrypt")
+	}
+	if s.numAutoHashed > 0 {
+		s.Noticef("Replaced %d plaintext password(s) or token(s) with bcrypt hashes", s.numAutoHashed)
+	}
+
+	// Warn about overly permissive configurations.
+	if !s.info.AuthRequired && !isLoopbackHost(opts.Host) {
+		s.Warnf("No authentication configured while listening on %q, any client can connect", opts.Host)
+	}
+	for _, err := range validateEmptyPasswords(opts) {
+		s.Warnf("%v, anyone knowing the user name can connect", err)
+	}
+	for _, err := range validateStrictModePlaintext(opts) {
+		s.Warnf("%v", err)
+	}
+	perms := make(map[string]*Permissions, len(s.users)+len(s.nkeys))
+	for _, u := range s.users {
+		perms[u.Username] = u.Permissions
+	}
+	for _, u := range s.nkeys {
+		perms[u.Nkey] = u.Permissions
+	}
+	names := make([]string, 0, len(perms))
+	for name := range perms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, w := range permissiveWarnings(perms[name]) {
+			s.Warnf("User %q %s", name, w)
+		}
+	}
+}
+
+// isLoopbackHost returns true if the listen host only accepts local
+// connections.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// permissiveWarnings returns descriptions of the overly permissive parts
+// of the given permissions: full access to all subjects through ">", or
+// broad wildcards allowed without any deny clause.
+func permissiveWarnings(p *Permissions) []string {
+	if p == nil {
+		return nil
+	}
+	allowsAll := func(sp *SubjectPermission) bool {
+		if sp == nil {
+			return false
+		}
+		for _, subj := range sp.Allow {
+			if subj == fwcs {
+				return true
+			}
+		}
+		return false
+	}
+	if allowsAll(p.Publish) && allowsAll(p.Subscribe) && len(p.Publish.Deny) == 0 && len(p.Subscribe.Deny) == 0 {
+		return []string{"is allowed to publish and subscribe to \">\", granting full access"}
+	}
+	var warnings []string
+	for _, c := range []struct {
+		kind string
+		sp   *SubjectPermission
+	}{{"publish", p.Publish}, {"subscribe", p.Subscribe}} {
+		if c.sp == nil || len(c.sp.Deny) > 0 {
+			continue
+		}
+		for _, subj := range c.sp.Allow {
+			// Broad wildcards are the ones starting with a wildcard token.
+			if subj == fwcs || subj == pwcs || strings.HasPrefix(subj, pwcs+tsep) {
+				warnings = append(warnings, fmt.Sprintf("is allowed to %s to broad wildcard %q without any deny", c.kind, subj))
+			}
+		}
+	}
+	return warnings
+}
+
+// If Users or Nkeys options have definitions without an account defined,
+// assign them to the default global account.
+// Lock should be held.
+func (s *Server) assignGlobalAccountToOrphanUsers(nkeys map[string]*NkeyUser, users map[string]*User) {
+	for _, u := range users {
+		if u.Account == nil {
+			u.Account = s.gacc
+		}
+	}
+	for _, u := range nkeys {
+		if u.Account == nil {
+			u.Account = s.gacc
+		}
+	}
+}
+
+// If the given permissions has a ResponsePermission
+// set, ensure that defaults are set (if values are 0)
+// and that a Publish permission is set, and Allow
+// is disabled if not explicitly set.
+func validateResponsePermissions(p *Permissions) {
+	if p == nil || p.Response == nil {
+		return
+	}
+	if p.Publish == nil {
+		p.Publish = &SubjectPermission{}
+	}
+	if p.Publish.Allow == nil {
+		// We turn off the blanket allow statement.
+		p.Publish.Allow = []string{}
+	}
+	// If there is a response permission, ensure
+	// that if value is 0, we set the default value.
+	if p.Response.MaxMsgs == 0 {
+		p.Response.MaxMsgs = DEFAULT_ALLOW_RESPONSE_MAX_MSGS
+	}
+	if p.Response.Expires == 0 {
+		p.Response.Expires = DEFAULT_ALLOW_RESPONSE_EXPIRATION
+	}
+}
+
+// configureAuthorization will do any setup needed for authorization.
+// Lock is assumed held.
+func (s *Server) configureAuthorization() {
+	opts := s.getOpts()
+	if opts == nil {
+		return
+	}
+
+	// Check for multiple users first
+	// This just checks and sets up the user map if we have multiple users.
+	if opts.CustomClientAuthentication != nil {
+		s.info.AuthRequired = true
+	} else if s.trustedKeys != nil {
+		s.info.AuthRequired = true
+	} else if opts.Nkeys != nil || opts.Users != nil || s.remoteNkeys != nil || s.remoteUsers != nil {
+		nkeys, users := opts.Nkeys, opts.Users
+		// Configured users take precedence over the remote ones.
+		if s.remoteNkeys != nil {
+			nkeys = append(append([]*NkeyUser(nil), s.remoteNkeys...), nkeys...)
+		}
+		if s.remoteUsers != nil {
+			users = append(append([]*User(nil), s.remoteUsers...), users...)
+		}
+		s.nkeys, s.users = s.buildNkeysAndUsersFromOptions(nkeys, users)
+		s.info.AuthRequired = true
+	} else if opts.Username != "" || opts.Authorization != "" || opts.TokenSigningKey != "" || opts.TokenValidator != nil {
+		s.info.AuthRequired = true
+	} else {
+		s.users = nil
+		s.nkeys = nil
+		s.info.AuthRequired = false
+	}
+	s.optsAuthRequired = s.info.AuthRequired
+	s.configureTokenAccounts()
+
+	s.usersRequireSig = false
+	for _, u := range s.users {
+		if u.RequireSignature || u.EitherCredential || u.PSK != _EMPTY_ {
+			s.usersRequireSig = true
+			break
+		}
+	}
+
+	s.pubACL.Store(newPublishACL(opts.PublishACL))
+	s.absDeny.Store(newAbsoluteDeny(opts.AbsoluteDeny))
+	s.configureAdaptiveAuth(opts.AdaptiveAuth)
+
+	// Validated tokens are cached again after a reload, since the
+	// validator may return different permissions.
+	s.tokenCache = nil
+	if opts.TokenValidator != nil && opts.TokenValidatorCacheTTL >= 0 {
+		ttl := opts.TokenValidatorCacheTTL
+		if ttl == 0 {
+			ttl = DEFAULT_TOKEN_VALIDATOR_CACHE_TTL
+		}
+		s.tokenCache = newTokenCache(ttl, maxTokenCacheSize)
+	}
+
+	// Decrypt the secrets stored encrypted in the configuration.
+	s.decryptedToken, s.decryptedPassword = _EMPTY_, _EMPTY_
+	if opts.SecretDecryptor != nil {
+		s.decryptSecrets(opts)
+	}
+
+	// The secrets have been hashed by autoHashOptions, only keep the
+	// hashes that are still in use.
+	s.pruneAutoHashes(opts)
+
+	// Do similar for websocket config
+	s.wsConfigAuth(&opts.Websocket)
+	// And for mqtt config
+	s.mqttConfigAuth(&opts.MQTT)
+}
+
+// configureTokenAccounts collects the accounts that have an auth token,
+// which clients have to authenticate to use. They are indexed by the keyed
+// digest of their token so that the token of a client is looked up instead
+// of being compared with each of them. This is also invoked when the token
+// of an account is set at runtime.
+// Lock is assumed held.
+func (s *Server) configureTokenAccounts() {
+	s.tokenAccounts = nil
+	s.accounts.Range(func(_, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		token := acc.authToken
+		acc.mu.RUnlock()
+		if token != _EMPTY_ {
+			if s.tokenAccounts == nil {
+				s.tokenAccounts = make(map[string]*Account)
+			}
+			s.tokenAccounts[s.tokenDigest(token)] = acc
+		}
+		return true
+	})
+	s.info.AuthRequired = s.optsAuthRequired || len(s.tokenAccounts) > 0
+}
+
+// autoHashOptions returns the options with their plaintext authorization
+// token and user passwords replaced by bcrypt hashes when AutoHashTokens is
+// set, so that the plaintext is not kept by the server. This is done once,
+// on a copy of the options, before the authorization is set up with them.
+// The options are returned as is when there is nothing to hash. Users that
+// may be selected as a no_auth_user are skipped since their password is not
+// presented by the client. The number of hashed secrets is returned as well.
+// Lock should not be held since hashing is costly.
+func (s *Server) autoHashOptions(opts *Options) (*Options, int) {
+	if !opts.AutoHashTokens {
+		return opts, 0
+	}
+	nopts := opts.Clone()
+	secrets := []*string{&nopts.Authorization}
+	for _, u := range nopts.Users {
+		secrets = append(secrets, autoHashedUserSecrets(nopts, u)...)
+	}
+	n := s.autoHashSecrets(opts.SecretDecryptor, secrets...)
+	if n == 0 {
+		return opts, 0
+	}
+	return nopts, n
+}
+
+// autoHashedUserSecrets returns the passwords of the user that are replaced
+// by their hash when AutoHashTokens is set.
+func autoHashedUserSecrets(opts *Options, u *User) []*string {
+	switch u.Username {
+	case opts.NoAuthUser, opts.Websocket.NoAuthUser, opts.MQTT.NoAuthUser:
+		return nil
+	}
+	secrets := []*string{&u.Password}
+	for i := range u.Passwords {
+		secrets = append(secrets, &u.Passwords[i])
+	}
+	return secrets
+}
+
+// autoHashSecrets replaces the plaintext, possibly encrypted, secrets with
+// their bcrypt hash and returns the number of secrets replaced. Empty
+// secrets and bcrypt hashes are left as is. The hashes are cached by the
+// digest of the plaintext, so that a secret that did not change, such as on
+// reload, is given the same hash without hashing it again. Hashing is done
+// without the lock, which is only held to access the cache.
+// Lock should not be held.
+func (s *Server) autoHashSecrets(decrypt func(string) (string, error), secrets ...*string) int {
+	digests := make([]string, len(secrets))
+	plains := make(map[string]string)
+	for i, secret := range secrets {
+		plain, err := decryptSecret(decrypt, *secret)
+		if err != nil || plain == _EMPTY_ || isBcrypt(plain) {
+			continue
+		}
+		digests[i] = s.secretDigest(plain)
+		plains[digests[i]] = plain
+	}
+	if len(plains) == 0 {
+		return 0
+	}
+	s.mu.RLock()
+	hashes := make(map[string]string, len(plains))
+	for d := range plains {
+		if h, ok := s.autoHashes[d]; ok {
+			hashes[d] = h
+		}
+	}
+	s.mu.RUnlock()
+	var added bool
+	for d, plain := range plains {
+		if _, ok := hashes[d]; ok {
+			continue
+		}
+		h, err := bcrypt.GenerateFromPassword([]byte(plain), bcrypt.DefaultCost)
+		if err != nil {
+			s.Errorf("Unable to hash plaintext credential: %v", err)
+			continue
+		}
+		hashes[d], added = string(h), true
+	}
+	if added {
+		s.mu.Lock()
+		// The map is replaced instead of updated so that it can be pruned
+		// by configureAuthorization without copying it.
+		cache := make(map[string]string, len(s.autoHashes)+len(hashes))
+		for d, h := range s.autoHashes {
+			cache[d] = h
+		}
+		for d, h := range hashes {
+			cache[d] = h
+		}
+		s.autoHashes = cache
+		s.mu.Unlock()
+	}
+	var n int
+	for i, secret := range secrets {
+		if h, ok := hashes[digests[i]]; ok && digests[i] != _EMPTY_ {
+			*secret = h
+			n++
+		}
+	}
+	return n
+}
+
+// pruneAutoHashes drops from the cache of the auto-hashed secrets the hashes
+// that are no longer in use by the users, the authorization token, or the
+// configured token that a token set at runtime replaced.
+// Lock is assumed held.
+func (s *Server) pruneAutoHashes(opts *Options) {
+	if len(s.autoHashes) == 0 {
+		return
+	}
+	inUse := map[string]struct{}{opts.Authorization: {}, s.configuredToken: {}}
+	for _, u := range s.users {
+		inUse[u.Password] = struct{}{}
+		for _, pwd := range u.Passwords {
+			inUse[pwd] = struct{}{}
+		}
+	}
+	cache := make(map[string]string, len(s.autoHashes))
+	for d, h := range s.autoHashes {
+		if _, ok := inUse[h]; ok {
+			cache[d] = h
+		}
+	}
+	s.autoHashes = cache
+}
+
+// keepRuntimeSecrets puts back in the new options the secrets set at runtime
+// when the configuration still holds the secrets they replaced, so that a
+// reload does not revert them and disconnect the clients using them. When
+// the configured secrets changed, they take over the runtime ones.
+func (s *Server) keepRuntimeSecrets(opts *Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.runtimeToken != _EMPTY_ {
+		// The options are hashed with the same cache, so an unchanged
+		// plaintext token has the same hash.
+		if s.configuredToken == opts.Authorization {
+			opts.Authorization = s.runtimeToken
+		} else {
+			s.runtimeToken, s.configuredToken = _EMPTY_, _EMPTY_
+		}
+	}
+	if s.runtimeClusterPasswords != nil {
+		if sameStrings(s.configuredClusterPasswords, clusterPasswords(&opts.Cluster)) {
+			setClusterPasswords(&opts.Cluster, s.runtimeClusterPasswords)
+		} else {
+			s.runtimeClusterPasswords, s.configuredClusterPasswords = nil, nil
+		}
+	}
+}
+
+// clusterPasswords returns the password and the additional passwords of the cluster.
+func clusterPasswords(c *ClusterOpts) []string {
+	return append([]string{c.Password}, c.Passwords...)
+}
+
+// setClusterPasswords sets the password of the cluster to the first one,
+// and the additional passwords to the others.
+func setClusterPasswords(c *ClusterOpts, passwords []string) {
+	c.Password, c.Passwords = passwords[0], nil
+	if len(passwords) > 1 {
+		c.Passwords = copyStrings(passwords[1:])
+	}
+}
+
+// sameStrings returns true if both slices hold the same strings in the same order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Prefix of the secrets that are stored encrypted in the configuration.
+const encryptedSecretPrefix = "enc:"
+
+// decryptSecret returns the plaintext of a secret prefixed with
+// encryptedSecretPrefix, or the secret itself when it is not encrypted.
+// Without a decryptor the prefix has no special meaning and the secret is
+// returned as is.
+func decryptSecret(decrypt func(string) (string, error), secret string) (string, error) {
+	if decrypt == nil || !strings.HasPrefix(secret, encryptedSecretPrefix) {
+		return secret, nil
+	}
+	plain, err := decrypt(strings.TrimPrefix(secret, encryptedSecretPrefix))
+	if err != nil {
+		return _EMPTY_, fmt.Errorf("unable to decrypt secret: %v", err)
+	}
+	return plain, nil
+}
+
+// validateEncryptedSecrets makes sure that the encrypted authorization
+// token, password and user passwords and pre-shared keys can be decrypted.
+// Nothing is encrypted when there is no SecretDecryptor.
+func validateEncryptedSecrets(o *Options) error {
+	if o.SecretDecryptor == nil {
+		return nil
+	}
+	if _, err := decryptSecret(o.SecretDecryptor, o.Authorization); err != nil {
+		return fmt.Errorf("authorization token: %v", err)
+	}
+	if _, err := decryptSecret(o.SecretDecryptor, o.Password); err != nil {
+		return fmt.Errorf("authorization password: %v", err)
+	}
+	for _, u := range o.Users {
+		for _, pwd := range append([]string{u.Password, u.PSK}, u.Passwords...) {
+			if _, err := decryptSecret(o.SecretDecryptor, pwd); err != nil {
+				return fmt.Errorf("user %q: %v", u.Username, err)
+			}
+		}
+	}
+	return nil
+}
+
+// decryptSecrets decrypts the authorization token, password and user
+// passwords and pre-shared keys that are stored encrypted in the
+// configuration. They have been
+// checked by validateEncryptedSecrets, so failures are only logged and the
+// secret is left untouched.
+// Lock is assumed held.
+func (s *Server) decryptSecrets(opts *Options) {
+	decrypt := func(secret string) (string, bool) {
+		if !strings.HasPrefix(secret, encryptedSecretPrefix) {
+			return _EMPTY_, false
+		}
+		plain, err := decryptSecret(opts.SecretDecryptor, secret)
+		if err != nil {
+			s.Errorf("Unable to decrypt secret: %v", err)
+			return _EMPTY_, false
+		}
+		return plain, true
+	}
+	if plain, ok := decrypt(opts.Authorization); ok {
+		s.decryptedToken = plain
+	}
+	if plain, ok := decrypt(opts.Password); ok {
+		s.decryptedPassword = plain
+	}
+	for _, u := range s.users {
+		if plain, ok := decrypt(u.Password); ok {
+			u.Password = plain
+		}
+		for i, pwd := range u.Passwords {
+			if plain, ok := decrypt(pwd); ok {
+				u.Passwords[i] = plain
+			}
+		}
+		if plain, ok := decrypt(u.PSK); ok {
+			u.PSK = plain
+		}
+	}
+}
+
+// AddUser adds a user to a server configured with users, without a
+// configuration reload. The user is not persisted and is dropped on the
+// next reload. ErrTooManyUsers is returned if the server already has
+// Options.MaxUsers users. Encrypted secrets are decrypted and plaintext
+// passwords are hashed as for the configured users.
+func (s *Server) AddUser(user *User) error {
+	if user == nil || user.Username == _EMPTY_ {
+		return fmt.Errorf("user name can not be empty")
+	}
+	// Apply the same checks as for the configured users.
+	if err := validateAuth(&Options{Users: []*User{user}}); err != nil {
+		return err
+	}
+	opts := s.getOpts()
+	if err := checkLocalAdminClash(opts, []*User{user}); err != nil {
+		return err
+	}
+	user, hashed, err := s.processUserSecrets(opts, user)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	opts = s.getOpts()
+	if (s.users == nil && s.nkeys == nil) || s.trustedKeys != nil || opts.CustomClientAuthentication != nil {
+		return fmt.Errorf("server is not configured for users authentication")
+	}
+	if _, ok := s.users[user.Username]; ok {
+		return fmt.Errorf("user %q already exists", user.Username)
+	}
+	if opts.MaxUsers > 0 && len(s.users)+len(s.nkeys) >= opts.MaxUsers {
+		return ErrTooManyUsers
+	}
+	_, added := s.buildNkeysAndUsersFromOptions(nil, []*User{user})
+	if s.users == nil {
+		s.users = make(map[string]*User)
+	}
+	s.users[user.Username] = added[user.Username]
+	if user.RequireSignature || user.EitherCredential || user.PSK != _EMPTY_ {
+		s.usersRequireSig = true
+	}
+	s.numAutoHashed += hashed
+	return nil
+}
+
+// processUserSecrets returns a copy of the user with its encrypted secrets
+// decrypted and, when AutoHashTokens is set, its plaintext passwords replaced
+// by their bcrypt hash, as autoHashOptions does for the configured users.
+// The number of hashed passwords is returned as well.
+// Lock should not be held since hashing is costly.
+func (s *Server) processUserSecrets(opts *Options, user *User) (*User, int, error) {
+	user = user.clone()
+	decrypt := func(secret *string) error {
+		plain, err := decryptSecret(opts.SecretDecryptor, *secret)
+		if err != nil {
+			return fmt.Errorf("user %q: %v", user.Username, err)
+		}
+		*secret = plain
+		return nil
+	}
+	if err := decrypt(&user.Password); err != nil {
+		return nil, 0, err
+	}
+	for i := range user.Passwords {
+		if err := decrypt(&user.Passwords[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := decrypt(&user.PSK); err != nil {
+		return nil, 0, err
+	}
+	if !opts.AutoHashTokens {
+		return user, 0, nil
+	}
+	return user, s.autoHashSecrets(nil, autoHashedUserSecrets(opts, user)...), nil
+}
+
+// SetAuthorizationToken replaces the authorization token accepted by the
+// server without a configuration reload. The token can be plaintext or a
+// bcrypt hash. Only new connections are affected, clients that are already
+// connected stay connected but are sent a credential expiring advisory.
+// The token is kept across configuration reloads until the configured
+// token changes, in which case the configured one is used again.
+// Returns an error if the server is not configured for token authentication.
+func (s *Server) SetAuthorizationToken(token string) error {
+	if token == _EMPTY_ {
+		return fmt.Errorf("authorization token can not be empty")
+	}
+	if isBcrypt(token) {
+		if _, err := bcrypt.Cost([]byte(token)); err != nil {
+			return fmt.Errorf("invalid bcrypt authorization token: %v", err)
+		}
+	}
+
+	// Hash outside of the server lock since this is expensive.
+	if s.getOpts().AutoHashTokens {
+		s.autoHashSecrets(nil, &token)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	opts := s.getOpts()
+	if opts.Authorization == _EMPTY_ || s.trustedKeys != nil || opts.CustomClientAuthentication != nil {
+		return fmt.Errorf("server is not configured for token authentication")
+	}
+	nopts := opts.Clone()
+	nopts.Authorization = token
+	s.setOpts(nopts)
+	if s.runtimeToken == _EMPTY_ {
+		s.configuredToken = opts.Authorization
+	}
+	s.runtimeToken = nopts.Authorization
+	s.decryptedToken = _EMPTY_
+	// Let clients using the previous token know that it is going away.
+	s.sendCredentialExpiring(func(c *client) bool {
+		return c.opts.Token != _EMPTY_ && c.getAuthIdentity() == _EMPTY_
+	})
+	return nil
+}
+
+// NotifyCredentialExpiring sends an INFO update with the credential_expiring
+// flag to the clients connected with the given user, nkey or JWT public key,
+// telling them to reconnect with new credentials before the current ones are
+// revoked. Clients are not disconnected.
+// Returns the number of clients that were notified.
+func (s *Server) NotifyCredentialExpiring(user string) int {
+	if user == _EMPTY_ {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sendCredentialExpiring(func(c *client) bool {
+		return c.getAuthIdentity() == user
+	})
+}
+
+// RevokeSubject removes the subscriptions of the clients connected with the
+// given user, nkey or JWT public key that could receive messages published
+// on the subject, including wildcard subscriptions overlapping it. Other
+// subscriptions are left untouched and clients are not disconnected. Since
+// the permissions are not changed, clients may subscribe again unless the
+// configuration is updated as well.
+// Returns the number of subscriptions that were removed.
+func (s *Server) RevokeSubject(user, subject string) int {
+	if user == _EMPTY_ || !IsValidSubject(subject) {
+		return 0
+	}
+	s.mu.RLock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.RUnlock()
+
+	var n int
+	for _, c := range clients {
+		c.mu.Lock()
+		if c.getAuthIdentity() != user {
+			c.mu.Unlock()
+			continue
+		}
+		acc := c.acc
+		var removed []*subscription
+		for _, sub := range c.subs {
+			if SubjectsCollide(string(sub.subject), subject) {
+				removed = append(removed, sub)
+			}
+		}
+		c.mu.Unlock()
+		c.removeUnauthorizedSubs(acc, removed)
+		n += len(removed)
+	}
+	return n
+}
+
+// DrainUser makes the clients connected with the given user, nkey or JWT
+// public key read-only before its credentials are revoked: their new
+// publishes and subscriptions are denied, except for replies to the
+// requests they receive, while their existing subscriptions keep receiving
+// messages so that in-flight requests can complete. The clients are closed
+// once the grace period has elapsed. Clients connecting afterwards are not
+// affected, the credentials still have to be removed from the configuration.
+// Returns the number of clients being drained.
+func (s *Server) DrainUser(username string, grace time.Duration) int {
+	if username == _EMPTY_ {
+		return 0
+	}
+	s.mu.RLock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.RUnlock()
+
+	var n int
+	for _, c := range clients {
+		c.mu.Lock()
+		if c.kind != CLIENT || c.isClosed() || c.getAuthIdentity() != username {
+			c.mu.Unlock()
+			continue
+		}
+		c.clearDrainTimer()
+		c.drainDeadline = time.Now().Add(grace)
+		c.drainTmr = time.AfterFunc(grace, c.userDrained)
+		c.applyDrainPermissions()
+		c.mu.Unlock()
+		c.Noticef("Draining user %q, closing in %v", username, grace)
+		n++
+	}
+	return n
+}
+
+// expirePermissionGrants drops the permission grants that have expired at
+// time now and removes the subscriptions that are no longer allowed.
+func (s *Server) expirePermissionGrants(now time.Time) {
+	s.mu.RLock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.RUnlock()
+
+	for _, c := range clients {
+		if c.expirePermissionGrants(now) {
+			c.processSubsOnConfigReload(nil)
+		}
+	}
+}
+
+// resolveGroupSubjects merges the subjects the user of the client may
+// access based on its current group memberships into its permissions.
+// Returns true if they changed, in which case the subscriptions should be
+// checked again.
+func (s *Server) resolveGroupSubjects(c *client, resolver func(user string) []string) bool {
+	c.mu.Lock()
+	user := c.getAuthIdentity()
+	c.mu.Unlock()
+	if user == _EMPTY_ {
+		return false
+	}
+	return c.setGroupSubjects(resolver(user))
+}
+
+// groupSubjectsLoop periodically resolves the group subjects of the
+// clients again, so that membership changes are applied without a reload.
+func (s *Server) groupSubjectsLoop() {
+	defer s.grWG.Done()
+	interval := s.getOpts().GroupSubjectsRefreshInterval
+	if interval <= 0 {
+		interval = DEFAULT_GROUP_SUBJECTS_REFRESH_INTERVAL
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-t.C:
+			resolver := s.getOpts().GroupSubjectsResolver
+			s.mu.RLock()
+			clients := make([]*client, 0, len(s.clients))
+			for _, c := range s.clients {
+				clients = append(clients, c)
+			}
+			s.mu.RUnlock()
+			for _, c := range clients {
+				if s.resolveGroupSubjects(c, resolver) {
+					c.processSubsOnConfigReload(nil)
+				}
+			}
+		}
+	}
+}
+
+// expirePermissionGrantsLoop periodically expires permission grants.
+// It is started once a client is given grants.
+func (s *Server) expirePermissionGrantsLoop() {
+	defer s.grWG.Done()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case now := <-t.C:
+			s.expirePermissionGrants(now)
+		}
+	}
+}
+
+// sendCredentialExpiring sends the credential expiring advisory to the
+// clients selected by the match function, which is invoked with the client
+// lock held. Only clients that accept async INFO updates are notified.
+// Server lock should be held.
+func (s *Server) sendCredentialExpiring(match func(c *client) bool) int {
+	if s.shutdown {
+		return 0
+	}
+	info := s.copyInfo()
+	info.CredentialExpiring = true
+	var n int
+	for _, c := range s.clients {
+		c.mu.Lock()
+		if c.opts.Protocol >= ClientProtoInfo && c.flags.isSet(firstPongSent) && match(c) {
+			c.enqueueProto(c.generateClientInfoJSON(info))
+			n++
+		}
+		c.mu.Unlock()
+	}
+	return n
+}
+
+// AuthConfigExport is a point in time view of the users and nkey users
+// known to the server, as returned by ExportAuthConfig.
+type AuthConfigExport struct {
+	Users []*UserExport     `json:"users,omitempty"`
+	Nkeys []*NkeyUserExport `json:"nkeys,omitempty"`
+}
+
+// UserExport describes a user without its passwords.
+type UserExport struct {
+	Username               string            `json:"user"`
+	Account                string            `json:"account,omitempty"`
+	Permissions            *Permissions      `json:"permissions,omitempty"`
+	TLSPermissions         *Permissions      `json:"tls_permissions,omitempty"`
+	AllowedConnectionTypes []string          `json:"connection_types,omitempty"`
+	Tags                   map[string]string `json:"tags,omitempty"`
+}
+
+// NkeyUserExport describes an nkey user.
+type NkeyUserExport struct {
+	Nkey                   string            `json:"nkey"`
+	Account                string            `json:"account,omitempty"`
+	Permissions            *Permissions      `json:"permissions,omitempty"`
+	AllowedConnectionTypes []string          `json:"connection_types,omitempty"`
+	Tags                   map[string]string `json:"tags,omitempty"`
+}
+
+// ExportAuthConfig returns the JSON encoding of the users and nkey users
+// currently known to the server, with the permissions they are assigned.
+// Secrets such as passwords and tokens are never included. Users are
+// sorted so that the output is stable for a given configuration.
+func (s *Server) ExportAuthConfig() ([]byte, error) {
+	ac := s.authConfigExport()
+	return json.MarshalIndent(ac, _EMPTY_, "  ")
+}
+
+// AuthConfigFingerprint returns a hash of the authorization settings of the
+// server, to detect changes such as on reload. It covers:
+//   - the users and nkey users known to the server, including the remote
+//     ones, with all of their fields and the name of their account,
+//   - the user and password of the single user authorization and the token,
+//   - the revoked nkeys, the absolute deny subjects and the publish ACL.
+//
+// Secrets contribute through their digest keyed with
+// Options.AuthFingerprintKey, the one of an auto-hashed secret being the
+// digest of its plaintext. This way the fingerprint changes with the secrets
+// without exposing them, and servers sharing the key, such as the nodes of a
+// cluster, get the same fingerprint for the same authorization. Without the
+// key, fingerprints can only be compared for a given server.
+// Lists are normalized before hashing so that the fingerprint does not
+// depend on ordering.
+func (s *Server) AuthConfigFingerprint() string {
+	fp := s.authFingerprintState()
+	h := sha256.New()
+	json.NewEncoder(h).Encode(fp)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// authFingerprint is the state hashed by AuthConfigFingerprint. The users
+// are copies without their secrets and account, which are replaced by the
+// digests of the secrets and the name of the account.
+type authFingerprint struct {
+	Users        []*userFingerprint     `json:"users,omitempty"`
+	Nkeys        []*nkeyUserFingerprint `json:"nkeys,omitempty"`
+	Username     string                 `json:"username,omitempty"`
+	Password     string                 `json:"password,omitempty"`
+	Token        string                 `json:"token,omitempty"`
+	RevokedNkeys []string               `json:"revoked_nkeys,omitempty"`
+	AbsoluteDeny []string               `json:"absolute_deny,omitempty"`
+	PublishACL   map[string][]string    `json:"publish_acl,omitempty"`
+}
+
+type userFingerprint struct {
+	*User
+	AccountName string   `json:"account_name,omitempty"`
+	Secrets     []string `json:"secrets,omitempty"`
+}
+
+type nkeyUserFingerprint struct {
+	*NkeyUser
+	AccountName string `json:"account_name,omitempty"`
+}
+
+// authFingerprintState returns the normalized state hashed by
+// AuthConfigFingerprint.
+// Lock should not be held.
+func (s *Server) authFingerprintState() *authFingerprint {
+	accName := func(a *Account) string {
+		if a == nil {
+			return _EMPTY_
+		}
+		return a.Name
+	}
+	sortedCopy := func(l []string) []string {
+		if len(l) == 0 {
+			return nil
+		}
+		c := append([]string(nil), l...)
+		sort.Strings(c)
+		return c
+	}
+	normalize := func(p *Permissions) {
+		if p == nil {
+			return
+		}
+		for _, sp := range []*SubjectPermission{p.Publish, p.Subscribe} {
+			if sp != nil {
+				sort.Strings(sp.Allow)
+				sort.Strings(sp.Deny)
+			}
+		}
+	}
+
+	var fp authFingerprint
+	s.mu.RLock()
+	// The digests of the plaintext of the auto-hashed secrets, by hash.
+	autoHashed := make(map[string]string, len(s.autoHashes))
+	for d, h := range s.autoHashes {
+		autoHashed[h] = d
+	}
+	digest := func(secret string) string {
+		if secret == _EMPTY_ {
+			return _EMPTY_
+		}
+		if d, ok := autoHashed[secret]; ok {
+			return d
+		}
+		return s.secretDigest(secret)
+	}
+	opts := s.getOpts()
+	for _, u := range s.users {
+		uf := &userFingerprint{User: u.clone(), AccountName: accName(u.Account)}
+		if u.Password != _EMPTY_ {
+			uf.Secrets = append(uf.Secrets, "password:"+digest(u.Password))
+		}
+		for _, pwd := range u.Passwords {
+			uf.Secrets = append(uf.Secrets, "passwords:"+digest(pwd))
+		}
+		if u.PSK != _EMPTY_ {
+			uf.Secrets = append(uf.Secrets, "psk:"+digest(u.PSK))
+		}
+		sort.Strings(uf.Secrets)
+		uf.Account, uf.Password, uf.Passwords, uf.PSK = nil, _EMPTY_, nil, _EMPTY_
+		normalize(uf.Permissions)
+		normalize(uf.TLSPermissions)
+		fp.Users = append(fp.Users, uf)
+	}
+	for _, u := range s.nkeys {
+		nf := &nkeyUserFingerprint{NkeyUser: u.clone(), AccountName: accName(u.Account)}
+		nf.Account = nil
+		nf.Namespaces = sortedCopy(nf.Namespaces)
+		normalize(nf.Permissions)
+		fp.Nkeys = append(fp.Nkeys, nf)
+	}
+	fp.Username = opts.Username
+	fp.Password = opts.Password
+	if s.decryptedPassword != _EMPTY_ {
+		fp.Password = s.decryptedPassword
+	}
+	fp.Password = digest(fp.Password)
+	fp.Token = opts.Authorization
+	if s.decryptedToken != _EMPTY_ {
+		fp.Token = s.decryptedToken
+	}
+	fp.Token = digest(fp.Token)
+	fp.RevokedNkeys = sortedCopy(opts.RevokedNkeys)
+	fp.AbsoluteDeny = sortedCopy(opts.AbsoluteDeny)
+	if len(opts.PublishACL) > 0 {
+		fp.PublishACL = make(map[string][]string, len(opts.PublishACL))
+		for subject, ids := range opts.PublishACL {
+			fp.PublishACL[subject] = sortedCopy(ids)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(fp.Users, func(i, j int) bool { return fp.Users[i].Username < fp.Users[j].Username })
+	sort.Slice(fp.Nkeys, func(i, j int) bool { return fp.Nkeys[i].Nkey < fp.Nkeys[j].Nkey })
+	return &fp
+}
+
+// secretDigest returns the hex encoded HMAC-SHA256 of a plaintext secret,
+// keyed with Options.AuthFingerprintKey or, if not set, the random salt of
+// the server. It keys the cache of the auto-hashed secrets and stands for
+// the secrets in AuthConfigFingerprint.
+func (s *Server) secretDigest(secret string) string {
+	mac := hmac.New(sha256.New, s.secretDigestKey)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authConfigExport returns the sorted view of the users and nkey users
+// used by ExportAuthConfig.
+func (s *Server) authConfigExport() *AuthConfigExport {
+	connTypes := func(cts map[string]struct{}) []string {
+		var l []string
+		for ct := range cts {
+			l = append(l, ct)
+		}
+		sort.Strings(l)
+		return l
+	}
+	accName := func(a *Account) string {
+		if a == nil {
+			return _EMPTY_
+		}
+		return a.Name
+	}
+
+	var ac AuthConfigExport
+	s.mu.Lock()
+	for _, u := range s.users {
+		ac.Users = append(ac.Users, &UserExport{
+			Username:               u.Username,
+			Account:                accName(u.Account),
+			Permissions:            u.Permissions.clone(),
+			TLSPermissions:         u.TLSPermissions.clone(),
+			AllowedConnectionTypes: connTypes(u.AllowedConnectionTypes),
+			Tags:                   copyTags(u.Tags),
+		})
+	}
+	for _, u := range s.nkeys {
+		ac.Nkeys = append(ac.Nkeys, &NkeyUserExport{
+			Nkey:                   u.Nkey,
+			Account:                accName(u.Account),
+			Permissions:            u.Permissions.clone(),
+			AllowedConnectionTypes: connTypes(u.AllowedConnectionTypes),
+			Tags:                   copyTags(u.Tags),
+		})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(ac.Users, func(i, j int) bool { return ac.Users[i].Username < ac.Users[j].Username })
+	sort.Slice(ac.Nkeys, func(i, j int) bool { return ac.Nkeys[i].Nkey < ac.Nkeys[j].Nkey })
+	return &ac
+}
+
+// Takes the given slices of NkeyUser and User options and build
+// corresponding maps used by the server. The users are cloned
+// so that server does not reference options.
+// The global account is assigned to users that don't have an
+// existing account.
+// Server lock is held on entry.
+func (s *Server) buildNkeysAndUsersFromOptions(nko []*NkeyUser, uo []*User) (map[string]*NkeyUser, map[string]*User) {
+	var nkeys map[string]*NkeyUser
+	var users map[string]*User
+
+	if nko != nil {
+		nkeys = make(map[string]*NkeyUser, len(nko))
+		for _, u := range nko {
+			copy := u.clone()
+			if u.Account != nil {
+				if v, ok := s.accounts.Load(u.Account.Name); ok {
+					copy.Account = v.(*Account)
+				}
+				copy.Permissions = copy.Account.inheritDefaultPermissions(copy.Permissions)
+			}
+			if copy.Permissions != nil {
+				validateResponsePermissions(copy.Permissions)
+			}
+			nkeys[u.Nkey] = copy
+		}
+	}
+	if uo != nil {
+		users = make(map[string]*User, len(uo))
+		for _, u := range uo {
+			copy := u.clone()
+			if u.Account != nil {
+				if v, ok := s.accounts.Load(u.Account.Name); ok {
+					copy.Account = v.(*Account)
+				}
+				copy.Permissions = copy.Account.inheritDefaultPermissions(copy.Permissions)
+				if copy.TLSPermissions != nil {
+					copy.TLSPermissions = copy.Account.inheritDefaultPermissions(copy.TLSPermissions)
+				}
+			}
+			if copy.Permissions != nil {
+				validateResponsePermissions(copy.Permissions)
+			}
+			if copy.TLSPermissions != nil {
+				validateResponsePermissions(copy.TLSPermissions)
+			}
+			users[u.Username] = copy
+		}
+	}
+	s.assignGlobalAccountToOrphanUsers(nkeys, users)
+	return nkeys, users
+}
+
+// inheritDefaultPermissions returns the given user permissions overlaid on
+// top of the account's default permissions, that is, the user inherits any
+// part of the permissions that it does not define itself.
+func (a *Account) inheritDefaultPermissions(p *Permissions) *Permissions {
+	a.mu.RLock()
+	def := a.defaultPerms
+	a.mu.RUnlock()
+	if def == nil {
+		return p
+	}
+	if p == nil {
+		return def.clone()
+	}
+	def = def.clone()
+	if p.Publish != nil {
+		def.Publish = p.Publish
+	}
+	if p.Subscribe != nil {
+		def.Subscribe = p.Subscribe
+	}
+	if p.Response != nil {
+		def.Response = p.Response
+	}
+	if p.MaxWildcardTokens != 0 {
+		def.MaxWildcardTokens = p.MaxWildcardTokens
+	}
+	if p.QueueRequired != nil {
+		def.QueueRequired = p.QueueRequired
+	}
+	if p.RequestOnly != nil {
+		def.RequestOnly = p.RequestOnly
+	}
+	if p.PublishRates != nil {
+		def.PublishRates = p.PublishRates
+	}
+	if p.AllowOwnInbox {
+		def.AllowOwnInbox = true
+	}
+	if p.DenyMessage != _EMPTY_ {
+		def.DenyMessage = p.DenyMessage
+	}
+	if p.RequiredHeaders != nil {
+		def.RequiredHeaders = p.RequiredHeaders
+	}
+	if p.SubscribeHeaderFilters != nil {
+		def.SubscribeHeaderFilters = p.SubscribeHeaderFilters
+	}
+	if p.Grants != nil {
+		def.Grants = p.Grants
+	}
+	return def
+}
+
+// checkAuthentication will check based on client type and
+// return boolean indicating if client is authorized.
+func (s *Server) checkAuthentication(c *client) bool {
+	switch c.kind {
+	case CLIENT:
+		opts := s.getOpts()
+		if !c.checkCredentialsLen(opts.MaxCredentialLen) {
+			return false
+		}
+		// Clients have to prove some work before any credential work, to
+		// deter connection floods. This only gates new connections.
+		if opts.ConnectPoWDifficulty > 0 {
+			c.mu.Lock()
+			ok := verifyConnectPoW(c.nonce, c.opts.PoW, opts.ConnectPoWDifficulty)
+			c.mu.Unlock()
+			if !ok {
+				c.Debugf("Proof of work missing or below difficulty %d", opts.ConnectPoWDifficulty)
+				return c.authFailure(authFailPoW)
+			}
+		}
+		// The client time is the one of its CONNECT, so this is not checked
+		// again when clients are authorized on reload.
+		if opts.MaxClientClockSkew > 0 && !c.checkClientClock(opts.MaxClientClockSkew) {
+			return c.authFailure(authFailClockSkew)
+		}
+		return s.isClientAuthorized(c)
+	case ROUTER:
+		return s.isRouterAuthorized(c)
+	case GATEWAY:
+		return s.isGatewayAuthorized(c)
+	case LEAF:
+		if !c.checkCredentialsLen(s.getOpts().MaxCredentialLen) {
+			return false
+		}
+		return s.isLeafNodeAuthorized(c)
+	default:
+		return false
+	}
+}
+
+// checkCredentialsLen returns false if any of the credential fields sent in
+// the CONNECT protocol is longer than max. This is done before any expensive
+// work such as base64 decoding, signature verification or bcrypt comparison.
+func (c *client) checkCredentialsLen(max int) bool {
+	if max <= 0 {
+		return true
+	}
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"user", c.opts.Username},
+		{"pass", c.opts.Password},
+		{"auth_token", c.opts.Token},
+		{"nkey", c.opts.Nkey},
+		{"sig", c.opts.Sig},
+	} {
+		if len(f.value) > max {
+			c.Debugf("CONNECT field %q of length %d exceeds the maximum of %d", f.name, len(f.value), max)
+			return c.authFailure(authFailCredentialLen)
+		}
+	}
+	return true
+}
+
+// reauthorizing returns true if the client is authorized again, on reload,
+// after its CONNECT was authorized.
+func (c *client) reauthorizing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flags.isSet(connectAuthorized)
+}
+
+// isClientAuthorized will check the client against the proper authorization method and data.
+// This could be nkey, token, or username/password based.
+func (s *Server) isClientAuthorized(c *client) bool {
+	opts := s.getOpts()
+
+	// Reject clients with a bad reputation before doing any credential work.
+	// The check is done when clients connect, not when they are authorized
+	// again on reload.
+	if opts.IPReputationCheck != nil && !c.reauthorizing() && !c.checkIPReputation(opts.IPReputationCheck) {
+		return c.authFailure(authFailReputation)
+	}
+
+	// Clients have to identify themselves when a name is required.
+	if opts.RequireClientName && c.kind == CLIENT && !c.isMqtt() {
+		c.mu.Lock()
+		named := c.opts.Name != _EMPTY_
+		c.mu.Unlock()
+		if !named {
+			c.Debugf("Client name required")
+			return c.authFailure(authFailNameRequired)
+		}
+	}
+
+	// The local admin is accepted regardless of the authentication
+	// configuration, but only from the loopback interface. Websocket and
+	// MQTT connections are not accepted since they are commonly relayed by
+	// a local proxy. Clients not presenting the local admin credentials go
+	// through the regular authentication.
+	c.mu.Lock()
+	username, password := c.opts.Username, c.opts.Password
+	c.mu.Unlock()
+	if la := opts.LocalAdmin; la != nil && c.kind == CLIENT && username == la.Username && la.checkPassword(password) {
+		if c.isWebsocket() || c.isMqtt() || !c.isLoopback() {
+			c.Warnf("Local admin %q rejected, connection is not from the loopback interface", la.Username)
+			return c.authFailure(authFailNotLoopback)
+		}
+		c.RegisterUser(&User{Username: la.Username, Permissions: allowAllPermissions(), Admin: true})
+		s.accountConnectEvent(c)
+		return true
+	}
+
+	if c.kind == CLIENT && c.opts.AuthScheme != _EMPTY_ {
+		// Clients naming an authentication scheme are only checked by the
+		// custom authenticator registered for it.
+		auth, ok := opts.CustomAuthenticators[c.opts.AuthScheme]
+		if !ok {
+			c.Debugf("Unknown authentication scheme %q", c.opts.AuthScheme)
+			return c.authFailure(authFailUnknownScheme)
+		}
+		if !s.checkCustomAuth(c, auth, opts) {
+			return c.authFailure(authFailCustom)
+		}
+		c.authenticatedWith(authMethodCustom)
+	} else if opts.CustomClientAuthentication != nil {
+		// Check custom auth first, then jwts, then nkeys, then
+		// multiple users with TLS map if enabled, then token,
+		// then single user/pass.
+		if !s.checkCustomAuth(c, opts.CustomClientAuthentication, opts) {
+			return c.authFailure(authFailCustom)
+		}
+		c.authenticatedWith(authMethodCustom)
+	} else if !s.processClientOrLeafAuthentication(c, opts) {
+		return false
+	}
+
+	// The enabled methods are checked against the method that authenticated
+	// the client, not the credentials it presented in the CONNECT.
+	c.mu.Lock()
+	method := c.authedMethod
+	c.mu.Unlock()
+	if len(opts.EnabledAuthMethods) > 0 && !authMethodEnabled(opts.EnabledAuthMethods, method) {
+		c.Debugf("Authentication method %q is disabled", method)
+		return c.authFailure(authFailMethodDisabled)
+	}
+
+	// Under a high connection rate only the stronger methods are accepted.
+	if !s.adaptiveAuthAllows(c, method) {
+		return c.authFailure(authFailStrictMode)
+	}
+
+	if c.kind == CLIENT || c.kind == LEAF {
+		// Generate an event if we have a system account.
+		s.accountConnectEvent(c)
+	}
+
+	return true
+}
+
+// PrivilegedConnect describes the authentication of a privileged user,
+// see Options.PrivilegedConnectCallback.
+type PrivilegedConnect struct {
+	// User is the identity of the user, such as its name or nkey.
+	User string
+	// Account is the name of the account of the user.
+	Account string
+	// Host is the IP address the user connected from.
+	Host string
+	// Admin is true for users flagged as admins and the local admin, and
+	// false for users allowed everything.
+	Admin bool
+}
+
+// localAdminConnect warns that the client authenticated as the local admin.
+// Like privilegedConnect, it is called once the connect succeeded so that the
+// warning is not logged again on reload.
+func (s *Server) localAdminConnect(c *client, opts *Options) {
+	la := opts.LocalAdmin
+	if la == nil {
+		return
+	}
+	c.mu.Lock()
+	admin := c.admin && c.opts.Username == la.Username
+	c.mu.Unlock()
+	if admin {
+		c.Warnf("Local admin %q authenticated", la.Username)
+	}
+}
+
+// privilegedConnect invokes the privileged connect callback if the client
+// authenticated as an admin or as a user allowed everything. It is called
+// once the connect succeeded, not when clients are authorized again on
+// reload.
+func (s *Server) privilegedConnect(c *client, opts *Options) {
+	cb := opts.PrivilegedConnectCallback
+	if cb == nil {
+		return
+	}
+	c.mu.Lock()
+	pc := PrivilegedConnect{
+		User:    c.getAuthIdentity(),
+		Account: accForClient(c),
+		Host:    c.host,
+		Admin:   c.admin,
+	}
+	allowAll := c.perms == nil
+	c.mu.Unlock()
+	// Clients of servers without authentication are not privileged users.
+	if pc.User == _EMPTY_ || (!pc.Admin && !allowAll) {
+		return
+	}
+	cb(pc)
+}
+
+// healthCheckedAuths returns the custom authentications of the options
+// implementing HealthCheckedAuthentication.
+func healthCheckedAuths(opts *Options) []HealthCheckedAuthentication {
+	var hcs []HealthCheckedAuthentication
+	if hc, ok := opts.CustomClientAuthentication.(HealthCheckedAuthentication); ok {
+		hcs = append(hcs, hc)
+	}
+	for _, auth := range opts.CustomAuthenticators {
+		if hc, ok := auth.(HealthCheckedAuthentication); ok {
+			hcs = append(hcs, hc)
+		}
+	}
+	return hcs
+}
+
+// authHealthCheckLoop periodically checks the health of the custom
+// authentications implementing HealthCheckedAuthentication. It is only
+// started when there are some, which can't change on reload.
+func (s *Server) authHealthCheckLoop() {
+	defer s.grWG.Done()
+	interval := s.getOpts().AuthHealthCheckInterval
+	if interval <= 0 {
+		interval = DEFAULT_AUTH_HEALTH_CHECK_INTERVAL
+	}
+	timeout := DEFAULT_AUTH_HEALTH_CHECK_TIMEOUT
+	if interval < timeout {
+		timeout = interval
+	}
+	// Result of the checks still running. A check that does not complete
+	// is waited for again instead of starting new ones, so that a hanging
+	// backend does not accumulate checks.
+	var pending chan error
+	check := func() {
+		if pending == nil {
+			pending = make(chan error, 1)
+			// Not tracked by grWG since a hanging check must not block the
+			// shutdown.
+			go func(hcs []HealthCheckedAuthentication, res chan<- error) {
+				res <- runAuthHealthChecks(hcs)
+			}(healthCheckedAuths(s.getOpts()), pending)
+		}
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case err := <-pending:
+			pending = nil
+			s.setAuthHealth(err)
+		case <-t.C:
+			s.setAuthHealth(fmt.Errorf("health check did not complete within %v", timeout))
+		case <-s.quitCh:
+		}
+	}
+	check()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-t.C:
+			check()
+		}
+	}
+}
+
+// runAuthHealthChecks runs the health checks and returns the first failure.
+func runAuthHealthChecks(hcs []HealthCheckedAuthentication) error {
+	for _, hc := range hcs {
+		if err := hc.HealthCheck(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAuthHealth records the result of the health checks of the custom
+// authentications, logging the changes of health.
+func (s *Server) setAuthHealth(err error) {
+	s.mu.Lock()
+	prev := s.authHealthErr
+	s.authHealthErr = err
+	s.mu.Unlock()
+	if err != nil && prev == nil {
+		s.Warnf("Authentication backend unhealthy: %v", err)
+	} else if err == nil && prev != nil {
+		s.Noticef("Authentication backend healthy again")
+	}
+}
+
+// deferredPerms tracks the permissions of a client being resolved by the
+// PermissionsResolver.
+type deferredPerms struct {
+	resolved bool
+	perms    *Permissions
+}
+
+// deferPermissions denies everything to the client until its permissions
+// are resolved in the background and installed.
+func (s *Server) deferPermissions(c *client, resolver PermissionsResolver) {
+	c.mu.Lock()
+	c.dperms = &deferredPerms{}
+	c.applyDeferredPermissions(s.getOpts())
+	c.mu.Unlock()
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		type result struct {
+			perms *Permissions
+			err   error
+		}
+		// The backend may be slow, do not hold the shutdown waiting for it.
+		resCh := make(chan result, 1)
+		go func() {
+			perms, err := resolver.ResolvePermissions(c)
+			resCh <- result{perms, err}
+		}()
+		var res result
+		select {
+		case res = <-resCh:
+		case <-s.quitCh:
+			return
+		}
+		if res.err != nil {
+			c.Errorf("Unable to resolve permissions: %v", res.err)
+			c.authViolation()
+			return
+		}
+		s.installResolvedPermissions(c, res.perms)
+	})
+}
+
+// installResolvedPermissions replaces the deny all permissions of a client
+// with the resolved ones, and sends them to the client if it supports INFO
+// updates.
+func (s *Server) installResolvedPermissions(c *client, perms *Permissions) {
+	s.mu.Lock()
+	info := s.copyInfo()
+	s.mu.Unlock()
+
+	opts := s.getOpts()
+	c.mu.Lock()
+	if c.isClosed() || c.dperms == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.dperms.resolved, c.dperms.perms = true, perms
+	c.applyDeferredPermissions(opts)
+	c.mu.Unlock()
+	// The resolved permissions do not have the group subjects yet.
+	if r := opts.GroupSubjectsResolver; r != nil && c.kind == CLIENT {
+		s.resolveGroupSubjects(c, r)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Debugf("Resolved permissions installed")
+	if c.opts.Protocol >= ClientProtoInfo {
+		info.Permissions = c.permissionsInfo()
+		c.enqueueProto(c.generateClientInfoJSON(info))
+	}
+}
+
+// applyDeferredPermissions installs the resolved permissions of the client,
+// or denies everything while they are being resolved. This replaces the
+// permissions registered by the authorization, which happens again on reload.
+// Lock should be held.
+func (c *client) applyDeferredPermissions(opts *Options) {
+	if c.dperms == nil {
+		return
+	}
+	if !c.dperms.resolved {
+		c.setPermissions(denyAllPermissions())
+		return
+	}
+	perms := c.userPermissions(c.dperms.perms, c.userTags)
+	if perms == nil {
+		c.perms = nil
+		c.mperms = nil
+	} else {
+		c.setPermissions(perms)
+	}
+	if opts.ProtectSystemSubjects {
+		c.protectSystemSubjects(perms)
+	}
+}
+
+// authRetryInterval is how often transient custom authentication failures
+// are retried during the startup grace period.
+var authRetryInterval = 100 * time.Millisecond
+
+// checkCustomAuth checks the client with the custom authentication. During
+// the AuthStartupGracePeriod, the transient failures reported by a
+// TransientAuthentication are retried instead of rejecting the client, so
+// that clients reconnecting to a restarted server are not all rejected
+// while the authentication backend is not ready. Clients authorized again
+// on reload are checked only once, so that a reload does not wait on the
+// backend for each of them.
+func (s *Server) checkCustomAuth(c *client, auth Authentication, opts *Options) bool {
+	ta, ok := auth.(TransientAuthentication)
+	if !ok || opts.AuthStartupGracePeriod <= 0 || c.reauthorizing() {
+		return auth.Check(c)
+	}
+	s.mu.RLock()
+	deadline := s.start.Add(opts.AuthStartupGracePeriod)
+	s.mu.RUnlock()
+	for {
+		ok, transient := ta.CheckTransient(c)
+		if ok || !transient {
+			return ok
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			c.Debugf("Authentication backend still unavailable after the startup grace period")
+			return false
+		}
+		if wait > authRetryInterval {
+			wait = authRetryInterval
+		}
+		c.Debugf("Authentication backend unavailable, retrying in %v", wait)
+		select {
+		case <-time.After(wait):
+		case <-s.quitCh:
+			return false
+		}
+		c.mu.Lock()
+		closed := c.isClosed()
+		c.mu.Unlock()
+		if closed {
+			return false
+		}
+	}
+}
+
+// authMethodEnabled returns true if the authentication method is part of
+// the enabled ones.
+func authMethodEnabled(enabled []string, method string) bool {
+	for _, m := range enabled {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceSubject returns the subject matching everything within the
+// namespace, or an empty string if there is no namespace.
+func namespaceSubject(ns string) string {
+	if ns == _EMPTY_ {
+		return _EMPTY_
+	}
+	return ns + ".>"
+}
+
+// validateUserLimits checks that the user's max payload and max pending
+// are not negative.
+func validateUserLimits(u *User) error {
+	if u.MaxPayload < 0 {
+		return fmt.Errorf("max payload can not be negative, got %d", u.MaxPayload)
+	}
+	if u.MaxPending < 0 {
+		return fmt.Errorf("max pending can not be negative, got %d", u.MaxPending)
+	}
+	return nil
 }
 
-// clone performs a deep copy of the Permissions struct, returning a new clone
-// with all values copied.
-func (p *Permissions) clone() *Permissions {
-	if p == nil {
+// validateNamespace checks that the namespace is a literal subject and that
+// the allowed subjects of the given permissions are within it.
+func validateNamespace(ns string, perms ...*Permissions) error {
+	if ns == _EMPTY_ {
 		return nil
 	}
-	clone := &Permissions{}
-	if p.Publish != nil {
-		clone.Publish = p.Publish.clone()
+	if !IsValidLiteralSubject(ns) {
+		return fmt.Errorf("namespace %q is not a valid literal subject", ns)
 	}
-	if p.Subscribe != nil {
-		clone.Subscribe = p.Subscribe.clone()
+	nsSubj := namespaceSubject(ns)
+	check := func(action string, sp *SubjectPermission) error {
+		if sp == nil {
+			return nil
+		}
+		for _, allow := range sp.Allow {
+			subj, _, err := splitSubjectQueue(strings.TrimPrefix(allow, exactSubjectPrefix))
+			if err != nil {
+				return err
+			}
+			if !subjectIsSubsetMatch(string(subj), nsSubj) {
+				return fmt.Errorf("%s subject %q is outside of namespace %q", action, allow, ns)
+			}
+		}
+		return nil
 	}
-	if p.Response != nil {
-		clone.Response = &ResponsePermission{
-			MaxMsgs: p.Response.MaxMsgs,
-			Expires: p.Response.Expires,
+	for _, p := range perms {
+		if p == nil {
+			continue
+		}
+		if err := check("publish", p.Publish); err != nil {
+			return err
+		}
+		if err := check("subscribe", p.Subscribe); err != nil {
+			return err
 		}
 	}
-	return clone
+	return nil
 }
 
-// checkAuthforWarnings will look for insecure settings and log concerns.
-// Lock is assumed held.
-func (s *Server) checkAuthforWarnings() {
-	warn := false
-	opts := s.getOpts()
-	if opts.Password != _EMPTY_ && !isBcrypt(opts.Password) {
-		warn = true
+// newPublishRewrites returns the transforms for the given publish rewrites,
+// the more specific sources first so that "foo.bar" is not shadowed by
+// "foo.*", then sorted by source subject so that the first match is
+// deterministic.
+func newPublishRewrites(rewrites map[string]string) ([]*transform, error) {
+	if len(rewrites) == 0 {
+		return nil, nil
 	}
-	for _, u := range s.users {
-		// Skip warn if using TLS certs based auth
-		// unless a password has been left in the config.
-		if u.Password == _EMPTY_ && opts.TLSMap {
-			continue
+	srcs := make([]string, 0, len(rewrites))
+	for src := range rewrites {
+		srcs = append(srcs, src)
+	}
+	sort.Slice(srcs, func(i, j int) bool {
+		return moreSpecificSubject(srcs[i], srcs[j])
+	})
+	trs := make([]*transform, 0, len(srcs))
+	for _, src := range srcs {
+		tr, err := newTransform(src, rewrites[src])
+		if err != nil {
+			return nil, fmt.Errorf("publish rewrite %q -> %q: %v", src, rewrites[src], err)
 		}
-		// Check if this is our internal sys client created on the fly.
-		if s.sysAccOnlyNoAuthUser != _EMPTY_ && u.Username == s.sysAccOnlyNoAuthUser {
-			continue
+		trs = append(trs, tr)
+	}
+	return trs, nil
+}
+
+// moreSpecificSubject returns true if subject a sorts before subject b, that
+// is if, at the first token where they differ in kind, a has a literal where
+// b has a wildcard, or a partial wildcard where b has a full wildcard.
+// Otherwise the subject with fewer tokens comes first, and subjects with
+// tokens of the same kinds are sorted lexicographically.
+func moreSpecificSubject(a, b string) bool {
+	kind := func(token string) int {
+		switch token {
+		case pwcs:
+			return 1
+		case fwcs:
+			return 2
 		}
-		if !isBcrypt(u.Password) {
-			warn = true
-			break
+		return 0
+	}
+	at, bt := strings.Split(a, tsep), strings.Split(b, tsep)
+	for i := 0; i < len(at) && i < len(bt); i++ {
+		if ak, bk := kind(at[i]), kind(bt[i]); ak != bk {
+			return ak < bk
 		}
 	}
-	if warn {
-		// Warning about using plaintext passwords.
-		s.Warnf("Plaintext passwords detected, use nkeys or bcrypt")
+	if len(at) != len(bt) {
+		return len(at) < len(bt)
 	}
+	return a < b
 }
 
-// If Users or Nkeys options have definitions without an account defined,
-// assign them to the default global account.
-// Lock should be held.
-func (s *Server) assignGlobalAccountToOrphanUsers(nkeys map[string]*NkeyUser, users map[string]*User) {
-	for _, u := range users {
-		if u.Account == nil {
-			u.Account = s.gacc
+// validateMaxUsers checks that the number of users does not exceed the
+// maximum, if any.
+func validateMaxUsers(max, n int) error {
+	if max < 0 {
+		return fmt.Errorf("max users can not be negative, got %d", max)
+	}
+	if max > 0 && n > max {
+		return fmt.Errorf("%d users configured, exceeding the maximum of %d", n, max)
+	}
+	return nil
+}
+
+// nkeyRevoked returns true if the nkey is part of the revoked ones.
+func nkeyRevoked(revoked []string, nkey string) bool {
+	for _, k := range revoked {
+		if k == nkey {
+			return true
 		}
 	}
-	for _, u := range nkeys {
-		if u.Account == nil {
-			u.Account = s.gacc
+	return false
+}
+
+// validateRevokedNkeys checks that the revoked nkeys are valid public
+// user nkeys.
+func validateRevokedNkeys(revoked []string) error {
+	for _, k := range revoked {
+		if !nkeys.IsValidPublicUserKey(k) {
+			return fmt.Errorf("revoked nkey %q is not a valid public user nkey", k)
 		}
 	}
+	return nil
 }
 
-// If the given permissions has a ResponsePermission
-// set, ensure that defaults are set (if values are 0)
-// and that a Publish permission is set, and Allow
-// is disabled if not explicitly set.
-func validateResponsePermissions(p *Permissions) {
-	if p == nil || p.Response == nil {
-		return
+// validateEnabledAuthMethods checks that the enabled authentication
+// methods are known ones.
+func validateEnabledAuthMethods(methods []string) error {
+	for _, m := range methods {
+		switch strings.ToLower(m) {
+		case authMethodNone, authMethodCustom, authMethodJWT, authMethodNkey,
+			authMethodToken, authMethodUser, authMethodTLS:
+		default:
+			return fmt.Errorf("unknown authentication method %q", m)
+		}
 	}
-	if p.Publish == nil {
-		p.Publish = &SubjectPermission{}
+	return nil
+}
+
+// checkIPReputation returns false if the reputation check rejects the
+// client's IP address. Connections without an IP address, such as
+// in-process ones, are not checked.
+func (c *client) checkIPReputation(check func(ip net.IP) (bool, string)) bool {
+	c.mu.Lock()
+	ip := net.ParseIP(c.host)
+	c.mu.Unlock()
+	if ip == nil {
+		return true
 	}
-	if p.Publish.Allow == nil {
-		// We turn off the blanket allow statement.
-		p.Publish.Allow = []string{}
+	if allow, reason := check(ip); !allow {
+		c.Warnf("Connection rejected by IP reputation check: %s", reason)
+		return false
 	}
-	// If there is a response permission, ensure
-	// that if value is 0, we set the default value.
-	if p.Response.MaxMsgs == 0 {
-		p.Response.MaxMsgs = DEFAULT_ALLOW_RESPONSE_MAX_MSGS
+	return true
+}
+
+// isLoopback returns true if the client connection comes from the loopback
+// interface.
+func (c *client) isLoopback() bool {
+	c.mu.Lock()
+	ip := net.ParseIP(c.host)
+	c.mu.Unlock()
+	return ip != nil && ip.IsLoopback()
+}
+
+// validateLocalAdmin checks that the local admin has a password and does
+// not shadow a configured user.
+func validateLocalAdmin(o *Options) error {
+	admin := o.LocalAdmin
+	if admin == nil {
+		return nil
 	}
-	if p.Response.Expires == 0 {
-		p.Response.Expires = DEFAULT_ALLOW_RESPONSE_EXPIRATION
+	if admin.Username == _EMPTY_ || (admin.Password == _EMPTY_ && len(admin.Passwords) == 0) {
+		return fmt.Errorf("local admin requires a user and a password")
 	}
+	if o.Username == admin.Username {
+		return fmt.Errorf("local admin %q is also configured as a user", admin.Username)
+	}
+	return checkLocalAdminClash(o, o.Users)
 }
 
-// configureAuthorization will do any setup needed for authorization.
-// Lock is assumed held.
-func (s *Server) configureAuthorization() {
-	opts := s.getOpts()
-	if opts == nil {
-		return
+// checkLocalAdminClash returns an error if one of the users has the name of
+// the local admin. It is used for the configured users as well as the ones
+// fetched from UsersURL or added with Server.AddUser.
+func checkLocalAdminClash(o *Options, users []*User) error {
+	admin := o.LocalAdmin
+	if admin == nil {
+		return nil
 	}
-
-	// Check for multiple users first
-	// This just checks and sets up the user map if we have multiple users.
-	if opts.CustomClientAuthentication != nil {
-		s.info.AuthRequired = true
-	} else if s.trustedKeys != nil {
-		s.info.AuthRequired = true
-	} else if opts.Nkeys != nil || opts.Users != nil {
-		s.nkeys, s.users = s.buildNkeysAndUsersFromOptions(opts.Nkeys, opts.Users)
-		s.info.AuthRequired = true
-	} else if opts.Username != "" || opts.Authorization != "" {
-		s.info.AuthRequired = true
-	} else {
-		s.users = nil
-		s.nkeys = nil
-		s.info.AuthRequired = false
+	for _, u := range users {
+		if u.Username == admin.Username {
+			return fmt.Errorf("local admin %q is also configured as a user", admin.Username)
+		}
 	}
+	return nil
+}
 
-	// Do similar for websocket config
-	s.wsConfigAuth(&opts.Websocket)
-	// And for mqtt config
-	s.mqttConfigAuth(&opts.MQTT)
+// checkClientClock returns false if the time sent by the client in its
+// CONNECT is not valid or differs from the server's time by more than the
+// maximum skew. Clients that do not send their time are accepted.
+func (c *client) checkClientClock(maxSkew time.Duration) bool {
+	c.mu.Lock()
+	ct := c.opts.ClientTime
+	c.mu.Unlock()
+	if ct == _EMPTY_ {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339Nano, ct)
+	if err != nil {
+		c.Warnf("Client time %q not valid: %v", ct, err)
+		return false
+	}
+	skew := time.Since(t)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		c.Warnf("Client clock skewed by %v, more than the maximum of %v, the client clock has to be synchronized",
+			skew.Round(time.Millisecond), maxSkew)
+		return false
+	}
+	return true
 }
 
-// Takes the given slices of NkeyUser and User options and build
-// corresponding maps used by the server. The users are cloned
-// so that server does not reference options.
-// The global account is assigned to users that don't have an
-// existing account.
-// Server lock is held on entry.
-func (s *Server) buildNkeysAndUsersFromOptions(nko []*NkeyUser, uo []*User) (map[string]*NkeyUser, map[string]*User) {
-	var nkeys map[string]*NkeyUser
-	var users map[string]*User
+// checkUserTLS returns the reason of the failure if the user requires a TLS
+// connection, or a minimum TLS version, that the client connection does not
+// satisfy, and an empty string otherwise.
+func (c *client) checkUserTLS(user string, required bool, minVersion uint16) string {
+	if !required && minVersion == 0 {
+		return _EMPTY_
+	}
+	cs := c.GetTLSConnectionState()
+	if cs == nil {
+		c.Debugf("User %q requires a TLS connection", user)
+		return authFailTLS
+	}
+	if cs.Version < minVersion {
+		c.Debugf("User %q requires TLS version %s or higher, connection is using %s",
+			user, tlsVersion(minVersion), tlsVersion(cs.Version))
+		return authFailTLSVersion
+	}
+	return _EMPTY_
+}
 
-	if nko != nil {
-		nkeys = make(map[string]*NkeyUser, len(nko))
-		for _, u := range nko {
-			copy := u.clone()
-			if u.Account != nil {
-				if v, ok := s.accounts.Load(u.Account.Name); ok {
-					copy.Account = v.(*Account)
-				}
-			}
-			if copy.Permissions != nil {
-				validateResponsePermissions(copy.Permissions)
-			}
-			nkeys[u.Nkey] = copy
-		}
+// checkCertNkey returns false if the client certificate is not bound to
+// the nkey the client signed the nonce with.
+func (c *client) checkCertNkey(nkey string) bool {
+	cs := c.GetTLSConnectionState()
+	if cs == nil || len(cs.PeerCertificates) == 0 || cs.PeerCertificates[0] == nil {
+		c.Debugf("Nkey %q requires a client certificate", nkey)
+		return false
 	}
-	if uo != nil {
-		users = make(map[string]*User, len(uo))
-		for _, u := range uo {
-			copy := u.clone()
-			if u.Account != nil {
-				if v, ok := s.accounts.Load(u.Account.Name); ok {
-					copy.Account = v.(*Account)
-				}
-			}
-			if copy.Permissions != nil {
-				validateResponsePermissions(copy.Permissions)
-			}
-			users[u.Username] = copy
+	for _, u := range cs.PeerCertificates[0].URIs {
+		if u.Scheme == certNkeyURIScheme && u.Opaque == nkey {
+			return true
 		}
 	}
-	s.assignGlobalAccountToOrphanUsers(nkeys, users)
-	return nkeys, users
+	c.Debugf("Nkey %q does not match the nkey of the client certificate", nkey)
+	return false
 }
 
-// checkAuthentication will check based on client type and
-// return boolean indicating if client is authorized.
-func (s *Server) checkAuthentication(c *client) bool {
-	switch c.kind {
-	case CLIENT:
-		return s.isClientAuthorized(c)
-	case ROUTER:
-		return s.isRouterAuthorized(c)
-	case GATEWAY:
-		return s.isGatewayAuthorized(c)
-	case LEAF:
-		return s.isLeafNodeAuthorized(c)
-	default:
+// checkUserPinnedCert returns false if the user is pinned to a client
+// certificate and the client did not present that certificate.
+func (c *client) checkUserPinnedCert(user, fingerprint string) bool {
+	if fingerprint == _EMPTY_ {
+		return true
+	}
+	cs := c.GetTLSConnectionState()
+	if cs == nil || len(cs.PeerCertificates) == 0 || cs.PeerCertificates[0] == nil {
+		c.Debugf("User %q requires a pinned client certificate", user)
+		return false
+	}
+	sha := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	if hex.EncodeToString(sha[:]) != normalizeCertFingerprint(fingerprint) {
+		c.Debugf("User %q client certificate does not match the pinned one", user)
 		return false
 	}
+	return true
 }
 
-// isClientAuthorized will check the client against the proper authorization method and data.
-// This could be nkey, token, or username/password based.
-func (s *Server) isClientAuthorized(c *client) bool {
-	opts := s.getOpts()
+// normalizeCertFingerprint returns the lower case fingerprint without the
+// colons that tools such as openssl use to separate bytes.
+func normalizeCertFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", _EMPTY_))
+}
 
-	// Check custom auth first, then jwts, then nkeys, then
-	// multiple users with TLS map if enabled, then token,
-	// then single user/pass.
-	if opts.CustomClientAuthentication != nil && !opts.CustomClientAuthentication.Check(c) {
-		return false
+// validateCertFingerprint checks that the fingerprint looks like a hex
+// encoded SHA-256.
+func validateCertFingerprint(fingerprint string) error {
+	if fingerprint == _EMPTY_ {
+		return nil
 	}
+	if b, err := hex.DecodeString(normalizeCertFingerprint(fingerprint)); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("pinned certificate %q is not a hex-encoded sha256 fingerprint", fingerprint)
+	}
+	return nil
+}
 
-	if opts.CustomClientAuthentication == nil && !s.processClientOrLeafAuthentication(c, opts) {
-		return false
+// authMethod returns the authentication method based on the credentials
+// presented by the client in the CONNECT protocol.
+// Lock should be held.
+func (c *client) authMethod(opts *Options) string {
+	switch {
+	case c.kind == CLIENT && (opts.CustomClientAuthentication != nil || c.opts.AuthScheme != _EMPTY_):
+		return authMethodCustom
+	case c.opts.JWT != _EMPTY_:
+		return authMethodJWT
+	case c.opts.Nkey != _EMPTY_:
+		return authMethodNkey
+	case c.opts.Token != _EMPTY_:
+		return authMethodToken
+	case c.opts.Username != _EMPTY_ || c.opts.Password != _EMPTY_:
+		return authMethodUser
+	case c.nc != nil && (opts.TLSMap || (c.kind == LEAF && opts.LeafNode.TLSMap)):
+		if tc, ok := c.nc.(*tls.Conn); ok && len(tc.ConnectionState().PeerCertificates) > 0 {
+			return authMethodTLS
+		}
 	}
+	return authMethodNone
+}
 
-	if c.kind == CLIENT || c.kind == LEAF {
-		// Generate an event if we have a system account.
-		s.accountConnectEvent(c)
+// activeAuthMethod returns the method that authenticated the client, which
+// is none when the server does not require authentication.
+// Lock should be held.
+func (c *client) activeAuthMethod() string {
+	if c.authedMethod == _EMPTY_ {
+		return authMethodNone
 	}
+	return c.authedMethod
+}
 
+// authenticatedWith records the authentication method of the check that
+// authenticated the client and returns true.
+func (c *client) authenticatedWith(method string) bool {
+	c.mu.Lock()
+	c.authedMethod = method
+	c.mu.Unlock()
 	return true
 }
 
@@ -562,9 +2873,26 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		}
 	}
 	if !authRequired {
-		// TODO(dlc) - If they send us credentials should we fail?
 		s.mu.Unlock()
-		return true
+		// Clients sending credentials to a server that does not require
+		// them are likely misconfigured.
+		if c.kind == CLIENT && opts.RejectCredentialsWhenNoAuth {
+			c.mu.Lock()
+			sent := c.opts.Username != _EMPTY_ || c.opts.Password != _EMPTY_ || c.opts.Token != _EMPTY_ ||
+				c.opts.Nkey != _EMPTY_ || c.opts.JWT != _EMPTY_
+			c.mu.Unlock()
+			if sent {
+				c.Warnf("Rejecting client sending credentials while no authentication is configured")
+				return c.authFailure(authFailNoAuth)
+			}
+		}
+		return c.authenticatedWith(authMethodNone)
+	}
+	// Only nkey users can claim a namespace, see NkeyUser.Namespaces.
+	if c.kind == CLIENT && c.opts.Namespace != _EMPTY_ && (c.opts.JWT != _EMPTY_ || s.nkeys[c.opts.Nkey] == nil) {
+		s.mu.Unlock()
+		c.Debugf("Namespace %q claimed by a client that is not an nkey user", c.opts.Namespace)
+		return c.authFailure(authFailNamespace)
 	}
 	var (
 		username      string
@@ -572,6 +2900,7 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		token         string
 		noAuthUser    string
 		pinnedAcounts map[string]struct{}
+		userMethod    = authMethodUser
 	)
 	tlsMap := opts.TLSMap
 	if c.kind == CLIENT {
@@ -616,7 +2945,13 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		}
 		username = opts.Username
 		password = opts.Password
+		if s.decryptedPassword != _EMPTY_ {
+			password = s.decryptedPassword
+		}
 		token = opts.Authorization
+		if s.decryptedToken != _EMPTY_ {
+			token = s.decryptedToken
+		}
 	}
 
 	// Check if we have trustedKeys defined in the server. If so we require a user jwt.
@@ -624,23 +2959,74 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		if c.opts.JWT == _EMPTY_ {
 			s.mu.Unlock()
 			c.Debugf("Authentication requires a user JWT")
-			return false
+			return c.authFailure(authFailJWT)
 		}
 		// So we have a valid user jwt here.
 		juc, err = jwt.DecodeUserClaims(c.opts.JWT)
 		if err != nil {
-			s.mu.Unlock()
-			c.Debugf("User JWT not valid: %v", err)
-			return false
+			s.mu.Unlock()
+			c.Debugf("User JWT not valid: %v", err)
+			return c.authFailure(authFailJWT)
+		}
+		vr := jwt.CreateValidationResults()
+		juc.Validate(vr)
+		if vr.IsBlocking(true) {
+			s.mu.Unlock()
+			c.Debugf("User JWT no longer valid: %+v", vr)
+			return c.authFailure(authFailJWT)
+		}
+		pinnedAcounts = opts.resolverPinnedAccounts
+	}
+
+	// Check for a signed token, which carries its own permissions. Tokens
+	// that can't be verified go through the regular checks below.
+	if c.kind == CLIENT && s.trustedKeys == nil && opts.TokenSigningKey != _EMPTY_ && c.opts.Token != _EMPTY_ {
+		claims, err := verifySignedToken(opts.TokenSigningKey, c.opts.Token, time.Now())
+		if err == nil {
+			acc := s.gacc
+			if claims.Account != _EMPTY_ {
+				if v, ok := s.accounts.Load(claims.Account); ok {
+					acc = v.(*Account)
+				} else {
+					err = fmt.Errorf("account %q not found", claims.Account)
+				}
+			}
+			if err == nil {
+				s.mu.Unlock()
+				c.RegisterUser(&User{Account: acc, Permissions: claims.Permissions})
+				// The client is disconnected when the token expires.
+				c.mu.Lock()
+				c.clearAuthTimer()
+				c.atmr = time.AfterFunc(time.Until(time.Unix(claims.Expires, 0)), c.authExpired)
+				c.mu.Unlock()
+				return c.authenticatedWith(authMethodToken)
+			}
+		}
+		c.Debugf("Signed token not valid: %v", err)
+	}
+
+	// Tokens are validated by the token validator when there is one, which
+	// is called without the server lock held.
+	if c.kind == CLIENT && s.trustedKeys == nil && opts.TokenValidator != nil && c.opts.Token != _EMPTY_ {
+		tc := s.tokenCache
+		s.mu.Unlock()
+		perms, err := validateToken(opts.TokenValidator, tc, c.opts.Token)
+		if err != nil {
+			c.Debugf("Token validation failed: %v", err)
+			return c.authFailure(authFailToken)
 		}
-		vr := jwt.CreateValidationResults()
-		juc.Validate(vr)
-		if vr.IsBlocking(true) {
+		c.RegisterUser(&User{Permissions: perms})
+		return c.authenticatedWith(authMethodToken)
+	}
+
+	// Check for an account token, which authorizes the client as an
+	// anonymous member of the account.
+	if c.kind == CLIENT && s.trustedKeys == nil && len(s.tokenAccounts) > 0 && c.opts.Token != _EMPTY_ {
+		if acc := s.tokenAccounts[s.tokenDigest(c.opts.Token)]; acc != nil {
 			s.mu.Unlock()
-			c.Debugf("User JWT no longer valid: %+v", vr)
-			return false
+			c.RegisterUser(&User{Account: acc, Permissions: acc.inheritDefaultPermissions(nil)})
+			return c.authenticatedWith(authMethodToken)
 		}
-		pinnedAcounts = opts.resolverPinnedAccounts
 	}
 
 	// Check if we have nkeys or users for client.
@@ -648,9 +3034,13 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 	hasUsers := len(s.users) > 0
 	if hasNkeys && c.opts.Nkey != _EMPTY_ {
 		nkey, ok = s.nkeys[c.opts.Nkey]
-		if !ok || !c.connectionTypeAllowed(nkey.AllowedConnectionTypes) {
+		if !ok {
 			s.mu.Unlock()
-			return false
+			return c.authFailure(authFailUnknownUser)
+		}
+		if !c.connectionTypeAllowed(nkey.AllowedConnectionTypes) {
+			s.mu.Unlock()
+			return c.authFailure(authFailConnectionType)
 		}
 	} else if hasUsers {
 		// Check if we are tls verify and are mapping users from the client_certificate.
@@ -705,7 +3095,7 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 			})
 			if !authorized {
 				s.mu.Unlock()
-				return false
+				return c.authFailure(authFailUnknownUser)
 			}
 			if c.opts.Username != _EMPTY_ {
 				s.Warnf("User %q found in connect proto, but user required from cert", c.opts.Username)
@@ -713,6 +3103,7 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 			// Already checked that the client didn't send a user in connect
 			// but we set it here to be able to identify it in the logs.
 			c.opts.Username = user.Username
+			userMethod = authMethodTLS
 		} else {
 			if (c.kind == CLIENT || c.kind == LEAF) && noAuthUser != _EMPTY_ &&
 				c.opts.Username == _EMPTY_ && c.opts.Password == _EMPTY_ && c.opts.Token == _EMPTY_ {
@@ -721,13 +3112,18 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 					c.opts.Username = u.Username
 					c.opts.Password = u.Password
 					c.mu.Unlock()
+					userMethod = authMethodNone
 				}
 			}
 			if c.opts.Username != _EMPTY_ {
 				user, ok = s.users[c.opts.Username]
-				if !ok || !c.connectionTypeAllowed(user.AllowedConnectionTypes) {
+				if !ok {
 					s.mu.Unlock()
-					return false
+					return c.authFailure(authFailUnknownUser)
+				}
+				if !c.connectionTypeAllowed(user.AllowedConnectionTypes) {
+					s.mu.Unlock()
+					return c.authFailure(authFailConnectionType)
 				}
 			}
 		}
@@ -737,6 +3133,8 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 	// If we have a jwt and a userClaim, make sure we have the Account, etc associated.
 	// We need to look up the account. This will use an account resolver if one is present.
 	if juc != nil {
+		// Reported for any of the failures below.
+		c.authFailReason = authFailJWT
 		allowedConnTypes, err := convertAllowedConnectionTypes(juc.AllowedConnectionTypes)
 		if err != nil {
 			// We got an error, which means some connection types were unknown. As long as
@@ -762,7 +3160,7 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		}
 		if !c.connectionTypeAllowed(allowedConnTypes) {
 			c.Debugf("Connection type not allowed")
-			return false
+			return c.authFailure(authFailConnectionType)
 		}
 		issuer := juc.Issuer
 		if juc.IssuerAccount != _EMPTY_ {
@@ -828,7 +3226,7 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 				c.Debugf("User nkey not valid: %v", err)
 				return false
 			}
-			if err := pub.Verify(c.nonce, sig); err != nil {
+			if !c.checkNonceSignature(func(nonce []byte) bool { return pub.Verify(nonce, sig) == nil }) {
 				c.Debugf("Signature not verified")
 				return false
 			}
@@ -888,66 +3286,528 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 			"signed with %q by Account %q (claim-name: %q, claim-tags: %q) signed with %q has mappings %t accused %p",
 			c.kindString(), juc.Subject, juc.Name, juc.Tags, juc.Issuer, issuer, acc.nameTag, acc.tags, acc.Issuer, acc.hasMappingsLocked(), acc)
 		acc.mu.RUnlock()
-		return true
+		return c.authenticatedWith(authMethodJWT)
 	}
 
 	if nkey != nil {
-		if c.opts.Sig == _EMPTY_ {
-			c.Debugf("Signature missing")
-			return false
+		if reason := c.checkUserTLS(nkey.Nkey, nkey.RequireTLS, nkey.MinTLSVersion); reason != _EMPTY_ {
+			return c.authFailure(reason)
 		}
-		sig, err := base64.RawURLEncoding.DecodeString(c.opts.Sig)
-		if err != nil {
-			// Allow fallback to normal base64.
-			sig, err = base64.StdEncoding.DecodeString(c.opts.Sig)
+		sig, ok := c.connectSignature()
+		if !ok {
+			return c.authFailure(authFailSignature)
+		}
+		if nkey.RawEd25519 {
+			pub, err := decodeRawEd25519Key(c.opts.Nkey)
 			if err != nil {
-				c.Debugf("Signature not valid base64")
-				return false
+				c.Debugf("User Ed25519 key not valid: %v", err)
+				return c.authFailure(authFailSignature)
 			}
+			if !c.checkNonceSignature(func(nonce []byte) bool { return ed25519.Verify(pub, nonce, sig) }) {
+				c.Debugf("Signature not verified")
+				return c.authFailure(authFailSignature)
+			}
+		} else if !c.verifyNonceSignature(c.opts.Nkey, sig) {
+			return c.authFailure(authFailSignature)
 		}
-		pub, err := nkeys.FromPublicKey(c.opts.Nkey)
-		if err != nil {
-			c.Debugf("User nkey not valid: %v", err)
-			return false
+		if nkey.RequireCertNkey && !c.checkCertNkey(c.opts.Nkey) {
+			return c.authFailure(authFailTLS)
 		}
-		if err := pub.Verify(c.nonce, sig); err != nil {
-			c.Debugf("Signature not verified")
-			return false
+		if nkeyRevoked(opts.RevokedNkeys, c.opts.Nkey) {
+			c.Errorf("%v - Nkey %q", ErrRevocation, c.opts.Nkey)
+			return c.authFailure(authFailRevoked)
+		}
+		if !c.namespaceIssued(nkey.Namespaces) {
+			return c.authFailure(authFailNamespace)
 		}
 		if err := c.RegisterNkeyUser(nkey); err != nil {
 			return false
 		}
-		return true
+		return c.authenticatedWith(authMethodNkey)
 	}
 	if user != nil {
-		ok = comparePasswords(user.Password, c.opts.Password)
+		if reason := c.checkUserTLS(user.Username, user.RequireTLS, user.MinTLSVersion); reason != _EMPTY_ {
+			return c.authFailure(reason)
+		}
+		if !c.checkUserPinnedCert(user.Username, user.PinnedCertSHA256) {
+			return c.authFailure(authFailTLS)
+		}
+		method := "password"
+		if user.PSK != _EMPTY_ {
+			ok = c.verifyNonceHMAC(user.PSK)
+			c.authFailReason = authFailSignature
+		} else if user.EitherCredential && c.opts.Sig != _EMPTY_ {
+			// Users migrating to nkeys may sign the nonce instead.
+			method = "nkey"
+			userMethod = authMethodNkey
+			sig, sok := c.connectSignature()
+			ok = sok && c.verifyNonceSignature(user.Nkey, sig)
+			c.authFailReason = authFailSignature
+			if ok && nkeyRevoked(opts.RevokedNkeys, user.Nkey) {
+				c.Errorf("%v - Nkey %q", ErrRevocation, user.Nkey)
+				ok = false
+				c.authFailReason = authFailRevoked
+			}
+		} else if user.EitherCredential && user.Password == _EMPTY_ && len(user.Passwords) == 0 {
+			// Without a password, the signature is the only credential.
+			ok = false
+			c.authFailReason = authFailSignature
+		} else {
+			ok = user.checkPassword(c.opts.Password)
+			c.authFailReason = authFailPassword
+		}
+		// Users may also have to prove they hold their key.
+		if ok && user.RequireSignature {
+			sig, sok := c.connectSignature()
+			ok = sok && c.verifyNonceSignature(user.Nkey, sig)
+			c.authFailReason = authFailSignature
+			if ok && nkeyRevoked(opts.RevokedNkeys, user.Nkey) {
+				c.Errorf("%v - Nkey %q", ErrRevocation, user.Nkey)
+				ok = false
+				c.authFailReason = authFailRevoked
+			}
+		}
+		// Track the progress of the migration to nkeys, once per connection.
+		if ok && user.EitherCredential && !c.reauthorizing() {
+			c.Noticef("User %q authenticated with %s", user.Username, method)
+		}
+		if ok && user.MaxConnectionsPerIP > 0 && !s.trackUserIPConn(c, user.Username, user.MaxConnectionsPerIP) {
+			return c.authFailure(authFailConnsPerIP)
+		}
+		if !ok {
+			return false
+		}
 		// If we are authorized, register the user which will properly setup any permissions
 		// for pub/sub authorizations.
-		if ok {
-			c.RegisterUser(user)
-		}
-		return ok
+		c.RegisterUser(user)
+		return c.authenticatedWith(userMethod)
 	}
 
 	if c.kind == CLIENT {
 		if token != _EMPTY_ {
-			return comparePasswords(token, c.opts.Token)
+			c.authFailReason = authFailToken
+			return comparePasswords(token, c.opts.Token) && c.authenticatedWith(authMethodToken)
 		} else if username != _EMPTY_ {
 			if username != c.opts.Username {
+				return c.authFailure(authFailUnknownUser)
+			}
+			c.authFailReason = authFailPassword
+			if !comparePasswords(password, c.opts.Password) {
 				return false
 			}
-			return comparePasswords(password, c.opts.Password)
+			c.mu.Lock()
+			c.authedID = username
+			c.mu.Unlock()
+			return c.authenticatedWith(authMethodUser)
 		}
 	} else if c.kind == LEAF {
 		// There is no required username/password to connect and
 		// there was no u/p in the CONNECT or none that matches the
 		// know users. Register the leaf connection with global account
 		// or the one specified in config (if provided).
-		return s.registerLeafWithAccount(c, opts.LeafNode.Account)
+		return s.registerLeafWithAccount(c, opts.LeafNode.Account) && c.authenticatedWith(authMethodNone)
+	}
+	return false
+}
+
+// trackUserIPConn counts the connection of the client for the user and its
+// IP address. It returns false if the user already has the maximum number
+// of connections from that address.
+func (s *Server) trackUserIPConn(c *client, user string, max int) bool {
+	c.mu.Lock()
+	host, tracked := c.host, c.userIPConn != _EMPTY_
+	c.mu.Unlock()
+	if tracked {
+		return true
+	}
+	key := user + " " + host
+	s.mu.Lock()
+	n := s.userIPConns[key]
+	if n >= max {
+		s.mu.Unlock()
+		c.Debugf("User %q has the maximum of %d connections from %s", user, max, host)
+		return false
+	}
+	s.userIPConns[key] = n + 1
+	s.mu.Unlock()
+	c.mu.Lock()
+	c.userIPConn = key
+	c.mu.Unlock()
+	return true
+}
+
+// untrackUserIPConn releases the connection counted by trackUserIPConn.
+// Server lock should be held.
+func (s *Server) untrackUserIPConn(key string) {
+	if n := s.userIPConns[key]; n > 1 {
+		s.userIPConns[key] = n - 1
+	} else {
+		delete(s.userIPConns, key)
+	}
+}
+
+// credentialHash returns the salted SHA-256 of the password or token the
+// client presented, or an empty string if it presented none.
+func (s *Server) credentialHash(c *client) string {
+	c.mu.Lock()
+	cred := c.opts.Token
+	if cred == _EMPTY_ {
+		cred = c.opts.Password
+	}
+	c.mu.Unlock()
+	if cred == _EMPTY_ {
+		return _EMPTY_
+	}
+	h := sha256.New()
+	h.Write(s.credHashSalt)
+	h.Write([]byte(cred))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tokenDigest returns the HMAC-SHA256 of an account token keyed with the
+// random salt of the server.
+func (s *Server) tokenDigest(token string) string {
+	mac := hmac.New(sha256.New, s.credHashSalt)
+	mac.Write([]byte(token))
+	return string(mac.Sum(nil))
+}
+
+// authFailure records the reason the client failed to authenticate, which
+// is reported by RecentAuthFailures, and returns false.
+func (c *client) authFailure(reason string) bool {
+	c.authFailReason = reason
+	return false
+}
+
+// recordAuthFailure adds the failed authentication of the client to the
+// recent failures. Only the identity the client presented is recorded.
+func (s *Server) recordAuthFailure(c *client) {
+	if s.authFailures == nil {
+		return
+	}
+	opts := s.getOpts()
+	c.mu.Lock()
+	f := AuthFailure{
+		Time:   time.Now().UTC(),
+		Remote: net.JoinHostPort(c.host, strconv.Itoa(int(c.port))),
+		Kind:   c.kindString(),
+		Method: c.authMethod(opts),
+		Reason: c.authFailReason,
+	}
+	if c.opts.Username != _EMPTY_ {
+		f.User = c.opts.Username
+	} else if c.opts.Nkey != _EMPTY_ {
+		f.User = c.opts.Nkey
+	}
+	authedMethod := c.authedMethod
+	c.mu.Unlock()
+	if f.Reason == _EMPTY_ {
+		f.Reason = authFailDefault
+	}
+	s.authFailures.append(f)
+	s.authCounters.mu.Lock()
+	s.authCounters.failures[AuthFailureStat{Method: f.Method, Reason: f.Reason}]++
+	if f.Reason == authFailStrictMode {
+		s.authCounters.lockouts[authedMethod]++
+	}
+	s.authCounters.mu.Unlock()
+}
+
+// recordAuthSuccess counts the successful authentication of the client by
+// the method that authenticated it, which is also the one its connection is
+// reported with while active.
+func (s *Server) recordAuthSuccess(c *client) {
+	if s.authCounters == nil {
+		return
+	}
+	c.mu.Lock()
+	method := c.activeAuthMethod()
+	c.mu.Unlock()
+	s.authCounters.mu.Lock()
+	s.authCounters.successes[method]++
+	s.authCounters.mu.Unlock()
+}
+
+// AuthStats returns the authentication counters of the server. Failures are
+// sorted by method and reason.
+func (s *Server) AuthStats() *AuthStats {
+	st := &AuthStats{
+		Successes: make(map[string]uint64),
+		Active:    make(map[string]int),
+		Lockouts:  make(map[string]uint64),
+	}
+	if s.authCounters == nil {
+		return st
+	}
+	s.authCounters.mu.Lock()
+	for m, n := range s.authCounters.successes {
+		st.Successes[m] = n
+	}
+	for m, n := range s.authCounters.lockouts {
+		st.Lockouts[m] = n
+	}
+	for f, n := range s.authCounters.failures {
+		f.Count = n
+		st.Failures = append(st.Failures, f)
+	}
+	s.authCounters.mu.Unlock()
+	sort.Slice(st.Failures, func(i, j int) bool {
+		fi, fj := st.Failures[i], st.Failures[j]
+		if fi.Method != fj.Method {
+			return fi.Method < fj.Method
+		}
+		return fi.Reason < fj.Reason
+	})
+
+	s.mu.RLock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.RUnlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		if c.flags.isSet(connectAuthorized) && !c.isClosed() {
+			st.Active[c.activeAuthMethod()]++
+		}
+		c.mu.Unlock()
+	}
+	return st
+}
+
+// RecentAuthFailures returns the most recent authentication failures,
+// oldest first. At most maxRecentAuthFailures of them are kept.
+func (s *Server) RecentAuthFailures() []AuthFailure {
+	if s.authFailures == nil {
+		return nil
+	}
+	return s.authFailures.recent()
+}
+
+// recordLogin records the time the client successfully authenticated for
+// its identity, the user name, nkey or JWT public key. Anonymous and token
+// clients are not tracked.
+func (s *Server) recordLogin(c *client) {
+	c.mu.Lock()
+	id := c.getAuthIdentity()
+	c.mu.Unlock()
+	if id == _EMPTY_ {
+		return
+	}
+	s.lastLogins.Store(id, time.Now().UTC())
+}
+
+// pruneLastLogins forgets the last logins of the identities that are neither
+// configured users or nkeys nor used by one of the connected clients, so
+// that they do not grow with every identity ever authenticated. This is done
+// on reload, once the removed users have been disconnected.
+// Lock should not be held.
+func (s *Server) pruneLastLogins() {
+	keep := make(map[string]struct{})
+	s.mu.RLock()
+	for u := range s.users {
+		keep[u] = struct{}{}
+	}
+	for nk := range s.nkeys {
+		keep[nk] = struct{}{}
+	}
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.RUnlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		if !c.isClosed() {
+			if id := c.getAuthIdentity(); id != _EMPTY_ {
+				keep[id] = struct{}{}
+			}
+		}
+		c.mu.Unlock()
+	}
+	s.lastLogins.Range(func(k, _ interface{}) bool {
+		if _, ok := keep[k.(string)]; !ok {
+			s.lastLogins.Delete(k)
+		}
+		return true
+	})
+}
+
+// UserLastLogin returns when the user, identified by its name or nkey,
+// last successfully authenticated, and false if it never did since the
+// server started, or since it was removed from the configuration. This
+// helps finding dormant credentials.
+func (s *Server) UserLastLogin(username string) (time.Time, bool) {
+	v, ok := s.lastLogins.Load(username)
+	if !ok {
+		return time.Time{}, false
+	}
+	return v.(time.Time), true
+}
+
+// connectSignature returns the decoded nonce signature sent by the client
+// in the CONNECT protocol.
+func (c *client) connectSignature() ([]byte, bool) {
+	if c.opts.Sig == _EMPTY_ {
+		c.Debugf("Signature missing")
+		return nil, false
+	}
+	sig, err := decodeSignature(c.opts.Sig)
+	if err != nil {
+		c.Debugf("Signature not valid base64")
+		return nil, false
+	}
+	return sig, true
+}
+
+// verifyNonceSignature checks that the nonce was signed by the given
+// user nkey.
+func (c *client) verifyNonceSignature(nkey string, sig []byte) bool {
+	pub, err := nkeys.FromPublicKey(nkey)
+	if err != nil {
+		c.Debugf("User nkey not valid: %v", err)
+		return false
+	}
+	if !c.checkNonceSignature(func(nonce []byte) bool { return pub.Verify(nonce, sig) == nil }) {
+		c.Debugf("Signature not verified")
+		return false
+	}
+	return true
+}
+
+// namespaceIssued returns true if the namespace claimed by the client, whose
+// signature has been verified, is one of the issued namespaces. A claim is
+// required when namespaces are issued, and rejected otherwise.
+func (c *client) namespaceIssued(issued []string) bool {
+	ns := c.opts.Namespace
+	if len(issued) == 0 {
+		if ns != _EMPTY_ {
+			c.Debugf("Namespace %q claimed but none was issued", ns)
+			return false
+		}
+		return true
+	}
+	for _, ins := range issued {
+		if ns == ins {
+			return true
+		}
+	}
+	if ns == _EMPTY_ {
+		c.Debugf("No namespace claimed")
+	} else {
+		c.Debugf("Namespace %q was not issued", ns)
 	}
 	return false
 }
 
+// verifyNonceHMAC checks that the client signature is the HMAC-SHA256
+// of the nonce keyed with the given pre-shared key.
+func (c *client) verifyNonceHMAC(psk string) bool {
+	sig, ok := c.connectSignature()
+	if !ok {
+		return false
+	}
+	verify := func(nonce []byte) bool {
+		mac := hmac.New(sha256.New, []byte(psk))
+		mac.Write(nonce)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	if !c.checkNonceSignature(verify) {
+		c.Debugf("Signature not verified")
+		return false
+	}
+	return true
+}
+
+// SignedTokenClaims are the claims embedded in a signed token.
+type SignedTokenClaims struct {
+	// Account the client is bound to, which must exist. Empty means the
+	// global account.
+	Account string `json:"account,omitempty"`
+	// Permissions of the client. Required, use an empty value to allow
+	// everything.
+	Permissions *Permissions `json:"permissions"`
+	// Expires is the unix time at which the token expires. Required.
+	Expires int64 `json:"exp"`
+	// NotBefore is the unix time before which the token is not valid.
+	NotBefore int64 `json:"nbf,omitempty"`
+}
+
+// NewSignedToken returns a token embedding the given claims, signed with
+// the key configured as the server's TokenSigningKey. The token is the
+// base64 encoded JSON of the claims followed by a dot and the base64
+// encoded HMAC-SHA256 of that first part.
+func NewSignedToken(key string, claims *SignedTokenClaims) (string, error) {
+	if key == _EMPTY_ {
+		return _EMPTY_, fmt.Errorf("token signing key is required")
+	}
+	if claims == nil || claims.Permissions == nil {
+		return _EMPTY_, fmt.Errorf("token permissions are required")
+	}
+	if claims.Expires == 0 {
+		return _EMPTY_, fmt.Errorf("token expiration is required")
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifySignedToken checks the signature and validity period of a token
+// created with NewSignedToken and returns the claims it embeds.
+func verifySignedToken(key, token string, now time.Time) (*SignedTokenClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("token is not signed")
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	if expected, err := base64.RawURLEncoding.DecodeString(sig); err != nil || !hmac.Equal(mac.Sum(nil), expected) {
+		return nil, fmt.Errorf("signature not verified")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	var claims SignedTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+	switch {
+	case claims.Expires == 0:
+		return nil, fmt.Errorf("token has no expiration")
+	case now.Unix() >= claims.Expires:
+		return nil, fmt.Errorf("token expired")
+	case claims.NotBefore != 0 && now.Unix() < claims.NotBefore:
+		return nil, fmt.Errorf("token not valid yet")
+	case claims.Permissions == nil:
+		return nil, fmt.Errorf("token has no permissions")
+	}
+	if errs := validatePermissionsSubjects("token", "signed", claims.Permissions); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return &claims, nil
+}
+
+// decodeRawEd25519Key decodes a base64 encoded raw Ed25519 public key.
+func decodeRawEd25519Key(key string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		// Allow fallback to raw URL encoding.
+		if raw, err = base64.RawURLEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("not valid base64")
+		}
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid length %d, expected %d", len(raw), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
 func getTLSAuthDCs(rdns *pkix.RDNSequence) string {
 	dcOID := asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}
 	dcs := []string{}
@@ -1106,11 +3966,15 @@ func (s *Server) isRouterAuthorized(c *client) bool {
 	// Check custom auth first, then TLS map if enabled
 	// then single user/pass.
 	if s.opts.CustomRouterAuthentication != nil {
-		return s.opts.CustomRouterAuthentication.Check(c)
+		if !s.opts.CustomRouterAuthentication.Check(c) {
+			c.Debugf("Route rejected by custom authentication")
+			return false
+		}
+		return true
 	}
 
 	if opts.Cluster.TLSMap || opts.Cluster.TLSCheckKnownURLs {
-		return checkClientTLSCertSubject(c, func(user string, _ *ldap.DN, isDNSAltName bool) (string, bool) {
+		ok := checkClientTLSCertSubject(c, func(user string, _ *ldap.DN, isDNSAltName bool) (string, bool) {
 			if user == "" {
 				return "", false
 			}
@@ -1124,6 +3988,10 @@ func (s *Server) isRouterAuthorized(c *client) bool {
 			}
 			return "", false
 		})
+		if !ok {
+			c.Debugf("Route rejected, no match for the TLS certificate")
+		}
+		return ok
 	}
 
 	if opts.Cluster.Username == "" {
@@ -1131,14 +3999,65 @@ func (s *Server) isRouterAuthorized(c *client) bool {
 	}
 
 	if opts.Cluster.Username != c.opts.Username {
+		c.Debugf("Route rejected, username %q does not match", c.opts.Username)
 		return false
 	}
-	if !comparePasswords(opts.Cluster.Password, c.opts.Password) {
+	if !checkClusterPassword(&opts.Cluster, c.opts.Password) {
+		c.Debugf("Route rejected, password does not match for username %q", c.opts.Username)
 		return false
 	}
 	return true
 }
 
+// checkClusterPassword returns true if the route password matches the
+// cluster password or any of the additional ones used for rotation.
+func checkClusterPassword(co *ClusterOpts, routePassword string) bool {
+	if comparePasswords(co.Password, routePassword) {
+		return true
+	}
+	for _, pwd := range co.Passwords {
+		if comparePasswords(pwd, routePassword) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetClusterPasswords replaces the passwords of the cluster without a
+// configuration reload. All are accepted from routes, so that the cluster
+// secret can be rotated one server at a time. The first password is the one
+// this server connects with to the routes it discovers, while configured
+// routes connect with the credentials of their URL. Routes already connected
+// are not affected. The passwords are kept across configuration reloads
+// until the configured ones change, in which case those are used again.
+// Returns an error if the cluster does not use a password.
+func (s *Server) SetClusterPasswords(passwords ...string) error {
+	if len(passwords) == 0 {
+		return fmt.Errorf("at least one cluster password is required")
+	}
+	for _, pwd := range passwords {
+		if pwd == _EMPTY_ {
+			return fmt.Errorf("cluster password can not be empty")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	opts := s.getOpts()
+	if opts.Cluster.Username == _EMPTY_ || opts.Cluster.TLSMap || opts.CustomRouterAuthentication != nil {
+		return fmt.Errorf("cluster is not configured for password authentication")
+	}
+	nopts := opts.Clone()
+	setClusterPasswords(&nopts.Cluster, passwords)
+	s.setOpts(nopts)
+	if s.runtimeClusterPasswords == nil {
+		s.configuredClusterPasswords = clusterPasswords(&opts.Cluster)
+	}
+	s.runtimeClusterPasswords = copyStrings(passwords)
+	return nil
+}
+
 // isGatewayAuthorized checks optional gateway authorization which can be nil or username/password.
 func (s *Server) isGatewayAuthorized(c *client) bool {
 	// Snapshot server options.
@@ -1286,21 +4205,195 @@ func comparePasswords(serverPassword, clientPassword string) bool {
 	return true
 }
 
+// validateAuth returns the first problem found in the authorization
+// options, if any.
 func validateAuth(o *Options) error {
-	if err := validatePinnedCerts(o.TLSPinnedCerts); err != nil {
-		return err
+	if errs := validateAuthorization(o); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validateAuthorization returns all the problems found in the authorization
+// options, each of which prevents the server from starting.
+func validateAuthorization(o *Options) []error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
+	add(validatePinnedCerts(o.TLSPinnedCerts))
+	add(validateNonceRawLen(o.NonceRawLen))
+	add(validateEnabledAuthMethods(o.EnabledAuthMethods))
+	add(validateAdaptiveAuth(o.AdaptiveAuth))
+	add(validateRevokedNkeys(o.RevokedNkeys))
+	add(validateLocalAdmin(o))
+	add(validatePublishACL(o.PublishACL))
+	add(validateAbsoluteDeny(o.AbsoluteDeny))
+	add(validateEncryptedSecrets(o))
+	add(validateMaxUsers(o.MaxUsers, len(o.Users)+len(o.Nkeys)))
+	users := make(map[string]struct{}, len(o.Users))
 	for _, u := range o.Users {
+		if _, ok := users[u.Username]; ok {
+			errs = append(errs, fmt.Errorf("duplicate user %q detected", u.Username))
+		}
+		users[u.Username] = struct{}{}
 		if err := validateAllowedConnectionTypes(u.AllowedConnectionTypes); err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("user %q: %v", u.Username, err))
+		}
+		if (u.RequireSignature || u.EitherCredential) && !nkeys.IsValidPublicUserKey(u.Nkey) {
+			errs = append(errs, fmt.Errorf("user %q: nkey %q is not a valid public user nkey", u.Username, u.Nkey))
+		}
+		if _, err := newPublishRewrites(u.PublishRewrites); err != nil {
+			errs = append(errs, fmt.Errorf("user %q: %v", u.Username, err))
 		}
+		if err := validateCertFingerprint(u.PinnedCertSHA256); err != nil {
+			errs = append(errs, fmt.Errorf("user %q: %v", u.Username, err))
+		}
+		if err := validateNamespace(u.Namespace, u.Permissions, u.TLSPermissions); err != nil {
+			errs = append(errs, fmt.Errorf("user %q: %v", u.Username, err))
+		}
+		if err := validateUserLimits(u); err != nil {
+			errs = append(errs, fmt.Errorf("user %q: %v", u.Username, err))
+		}
+		errs = append(errs, validatePermissionsSubjects("user", u.Username, u.Permissions)...)
 	}
+	keys := make(map[string]struct{}, len(o.Nkeys))
 	for _, u := range o.Nkeys {
+		if _, ok := keys[u.Nkey]; ok {
+			errs = append(errs, fmt.Errorf("duplicate nkey %q detected", u.Nkey))
+		}
+		keys[u.Nkey] = struct{}{}
 		if err := validateAllowedConnectionTypes(u.AllowedConnectionTypes); err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("nkey %q: %v", u.Nkey, err))
+		}
+		for _, ns := range u.Namespaces {
+			if err := validateNamespace(ns); err != nil {
+				errs = append(errs, fmt.Errorf("nkey %q: %v", u.Nkey, err))
+			}
+		}
+		errs = append(errs, validatePermissionsSubjects("nkey", u.Nkey, u.Permissions)...)
+	}
+	if o.ConnectPoWDifficulty < 0 || o.ConnectPoWDifficulty > maxConnectPoWDifficulty {
+		errs = append(errs, fmt.Errorf("connect proof of work difficulty must be between 0 and %d, got %d",
+			maxConnectPoWDifficulty, o.ConnectPoWDifficulty))
+	}
+	add(validateNoAuthUser(o, o.NoAuthUser))
+	return errs
+}
+
+// validateEmptyPasswords returns an error for each user that has no
+// password while nothing else authenticates it, in which case anyone
+// knowing the user name can connect as that user. This can be explicitly
+// allowed with the user's PasswordOptional.
+func validateEmptyPasswords(o *Options) []error {
+	// Users are then authenticated by other means.
+	if o.CustomClientAuthentication != nil || o.TLSMap || o.Websocket.TLSMap || o.MQTT.TLSMap || o.LeafNode.TLSMap {
+		return nil
+	}
+	var errs []error
+	for _, u := range o.Users {
+		if u.Password != _EMPTY_ || len(u.Passwords) > 0 || u.PSK != _EMPTY_ ||
+			u.PasswordOptional || u.RequireTLS || u.RequireSignature || u.PinnedCertSHA256 != _EMPTY_ {
+			continue
+		}
+		// Connecting without credentials as this user is explicitly allowed.
+		if u.Username == o.NoAuthUser || u.Username == o.Websocket.NoAuthUser || u.Username == o.MQTT.NoAuthUser {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("user %q has no password, set password_optional to allow it", u.Username))
+	}
+	return errs
+}
+
+// ValidateAuthorization checks the authorization related options without
+// starting a server. Unlike the validation done on startup, it does not stop
+// at the first problem but returns all of them, including the insecure
+// settings that the server only warns about.
+func ValidateAuthorization(opts *Options) []error {
+	errs := validateAuthorization(opts)
+	errs = append(errs, validateNkeyUsersKeys(opts)...)
+	errs = append(errs, validateEmptyPasswords(opts)...)
+	return append(errs, validateStrictModePlaintext(opts)...)
+}
+
+// validateNkeyUsersKeys returns an error for each nkey user with a key that
+// is not valid. These are otherwise only checked when parsing the
+// configuration.
+func validateNkeyUsersKeys(o *Options) []error {
+	var errs []error
+	for _, u := range o.Nkeys {
+		if u.RawEd25519 {
+			if _, err := decodeRawEd25519Key(u.Nkey); err != nil {
+				errs = append(errs, fmt.Errorf("ed25519 key %q: %v", u.Nkey, err))
+			}
+		} else if !nkeys.IsValidPublicUserKey(u.Nkey) {
+			errs = append(errs, fmt.Errorf("nkey %q is not a valid public user nkey", u.Nkey))
+		}
+	}
+	return errs
+}
+
+// validateStrictModePlaintext returns an error for the plaintext token and
+// for each user with a plaintext password when the adaptive authentication
+// accepts them in strict mode, which is meant to only accept the stronger
+// credentials.
+func validateStrictModePlaintext(o *Options) []error {
+	if o.AdaptiveAuth == nil {
+		return nil
+	}
+	methods := o.AdaptiveAuth.Methods
+	if len(methods) == 0 {
+		methods = defaultAdaptiveAuthMethods
+	}
+	var errs []error
+	for _, m := range methods {
+		switch m {
+		case authMethodToken:
+			if o.Authorization != _EMPTY_ && !isBcrypt(o.Authorization) {
+				errs = append(errs, fmt.Errorf("plaintext token is accepted in strict mode, use bcrypt"))
+			}
+		case authMethodUser:
+			for _, u := range o.Users {
+				plain := u.Password != _EMPTY_ && !isBcrypt(u.Password)
+				for _, pwd := range u.Passwords {
+					plain = plain || !isBcrypt(pwd)
+				}
+				if plain {
+					errs = append(errs, fmt.Errorf("user %q has a plaintext password accepted in strict mode, use bcrypt", u.Username))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// validatePermissionsSubjects returns an error for each permission subject
+// that is not valid.
+func validatePermissionsSubjects(kind, name string, p *Permissions) []error {
+	if p == nil {
+		return nil
+	}
+	var errs []error
+	check := func(action string, sp *SubjectPermission) {
+		if sp == nil {
+			return
+		}
+		for _, sa := range [][]string{sp.Allow, sp.Deny} {
+			for _, subj := range sa {
+				if err := checkPermSubjectArray([]string{subj}); err != nil {
+					errs = append(errs, fmt.Errorf("%s %q %s permissions: %v", kind, name, action, err))
+				}
+			}
+		}
+		if err := checkNoExactSubjects(sp.Deny); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q %s permissions: %v", kind, name, action, err))
 		}
 	}
-	return validateNoAuthUser(o, o.NoAuthUser)
+	check("publish", p.Publish)
+	check("subscribe", p.Subscribe)
+	return errs
 }
 
 func validateAllowedConnectionTypes(m map[string]struct{}) error {
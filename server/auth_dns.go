@@ -0,0 +1,118 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// DEFAULT_DNS_AUTH_TIMEOUT is the default amount of time the DNS lookups of
+// a DNSAuthentication have to complete before the client is rejected.
+const DEFAULT_DNS_AUTH_TIMEOUT = 2 * time.Second
+
+// DNSResolver does the DNS lookups of a DNSAuthentication.
+// It is implemented by *net.Resolver.
+type DNSResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSAuthentication is an Authentication implementation identifying clients
+// by the DNS name of their IP address, for instance devices of a fleet that
+// have no credentials of their own.
+//
+// The reverse lookup of the client's IP address must return a host name
+// under one of the allowed domains, and the forward lookup of that name must
+// return the client's IP address, otherwise the PTR record is not trusted.
+// Lookups that fail or do not complete within the timeout reject the client.
+// Authorized clients are registered with the host name as their username.
+type DNSAuthentication struct {
+	// Domains are the domains the host names must be under, such as
+	// "devices.example.com".
+	Domains []string
+	// Resolver does the lookups. Defaults to net.DefaultResolver.
+	Resolver DNSResolver
+	// Timeout is the maximum time all lookups of a client may take.
+	// Defaults to DEFAULT_DNS_AUTH_TIMEOUT.
+	Timeout time.Duration
+	// Permissions are assigned to clients that are authorized. Since the
+	// clients have no credentials, they are denied everything when not set.
+	Permissions *Permissions
+}
+
+// Check implements the Authentication interface.
+func (d *DNSAuthentication) Check(c ClientAuthentication) bool {
+	addr, ok := c.RemoteAddress().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_DNS_AUTH_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	names, err := resolver.LookupAddr(ctx, addr.IP.String())
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		host := strings.ToLower(strings.TrimSuffix(name, "."))
+		if !d.domainAllowed(host) {
+			continue
+		}
+		// Only trust the PTR record if the name resolves back to the client.
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.IP.Equal(addr.IP) {
+				perms := d.Permissions.clone()
+				if perms == nil {
+					perms = denyAllPermissions()
+				}
+				c.RegisterUser(&User{
+					Username:    host,
+					Permissions: perms,
+				})
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// domainAllowed returns true if the host is one of the allowed domains or
+// a subdomain of one.
+func (d *DNSAuthentication) domainAllowed(host string) bool {
+	for _, domain := range d.Domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain == _EMPTY_ {
+			continue
+		}
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DEFAULT_EXEC_AUTH_TIMEOUT is the default amount of time an external
+// authentication command has to complete before the client is rejected.
+const DEFAULT_EXEC_AUTH_TIMEOUT = 2 * time.Second
+
+// ExecAuthentication is an Authentication implementation that delegates
+// the verification of a client's credentials to an external command.
+//
+// The command is started for each client connection with the username,
+// password and token presented in the CONNECT protocol written to its
+// standard input, one per line and in that order. Credentials are never
+// passed as arguments so that they do not show up in the process list.
+// A zero exit status authorizes the client, anything else, including the
+// command not completing within the timeout, rejects it.
+type ExecAuthentication struct {
+	// Command is the path of the executable to run.
+	Command string
+	// Args are optional static arguments passed to the command.
+	Args []string
+	// Timeout is the maximum time the command is allowed to run.
+	// Defaults to DEFAULT_EXEC_AUTH_TIMEOUT.
+	Timeout time.Duration
+	// Permissions are assigned to clients that are authorized. As for
+	// DNSAuthentication, they are denied everything when not set.
+	Permissions *Permissions
+}
+
+// Check implements the Authentication interface.
+func (e *ExecAuthentication) Check(c ClientAuthentication) bool {
+	if e.Command == _EMPTY_ {
+		return false
+	}
+	opts := c.GetOpts()
+	creds := []string{opts.Username, opts.Password, opts.Token}
+	for _, cred := range creds {
+		// A line break would allow a client to shift the other fields.
+		if strings.ContainsAny(cred, "\r\n") {
+			return false
+		}
+	}
+
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_EXEC_AUTH_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	cmd.Stdin = strings.NewReader(strings.Join(creds, "\n") + "\n")
+	if err := cmd.Run(); err != nil {
+		return false
+	}
+
+	perms := e.Permissions.clone()
+	if perms == nil {
+		perms = denyAllPermissions()
+	}
+	c.RegisterUser(&User{
+		Username:    opts.Username,
+		Permissions: perms,
+	})
+	return true
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A policy module is consulted for each publish and subscribe of client and
+// leafnode connections, in addition to their permissions. The module is
+// loaded by the PolicyRuntime of the options. The WASM runtime lives in the
+// separate github.com/nats-io/nats-server/v2/wasmpolicy module, so that it
+// is not a dependency of the server.
+//
+// The decisions are cached per connection, so the result of the module must
+// only depend on the request. The module is called without holding the
+// connection's lock, except when checking the interest sent to leafnodes.
+
+// Denials caused by errors of the policy module are only cached for this
+// long, so that a failing module does not delay every message while a module
+// that recovers is consulted again.
+const policyErrorCacheTTL = time.Second
+
+var errPolicyNoRuntime = errors.New("policy modules require a policy runtime, such as the one of the wasmpolicy module")
+
+// PolicyOp is the operation passed to a policy module.
+type PolicyOp uint32
+
+const (
+	PolicyPublish PolicyOp = iota + 1
+	PolicySubscribe
+)
+
+// String returns the name of the operation.
+func (op PolicyOp) String() string {
+	switch op {
+	case PolicyPublish:
+		return "publish"
+	case PolicySubscribe:
+		return "subscribe"
+	}
+	return "unknown"
+}
+
+// PolicyRuntime loads policy modules.
+type PolicyRuntime interface {
+	// Load compiles the policy module, it is called once when the server
+	// is created.
+	Load(module []byte) (Policy, error)
+}
+
+// Policy is a loaded policy module, shared by all the connections.
+type Policy interface {
+	// Allowed returns true if the module allows the operation on the
+	// subject. The identity is the user name, nkey or JWT public key
+	// verified when the client authenticated, empty for anonymous and
+	// token clients. Calls must be bounded in time, errors deny the
+	// operation.
+	Allowed(op PolicyOp, subject, identity, account string) (bool, error)
+	// Close releases the module when the server shuts down.
+	Close()
+}
+
+// policyCacheKey is the key of a cached policy decision.
+type policyCacheKey struct {
+	op      PolicyOp
+	subject string
+}
+
+// policyDecision is a cached policy decision. Decisions caused by errors
+// expire, expires is zero for the others.
+type policyDecision struct {
+	allowed bool
+	expires int64
+}
+
+// policyCache holds the policy decisions of a client.
+type policyCache struct {
+	// Have these first for memory alignment due to the use of atomic.
+	size      int32
+	prun      int32
+	errLogged int32
+	m         sync.Map
+}
+
+// policyAllows returns true if the policy module allows the operation.
+// The module is called without the lock, with the identity and account
+// copied under it.
+// Lock should not be held.
+func (c *client) policyAllows(op PolicyOp, subject string) bool {
+	if allowed, ok := c.cachedPolicyDecision(op, subject); ok {
+		return allowed
+	}
+	c.mu.Lock()
+	identity, account := c.getAuthIdentity(), c.policyAccount()
+	c.mu.Unlock()
+	return c.callPolicy(op, subject, identity, account)
+}
+
+// policyAllowsLocked is like policyAllows for the paths that check the
+// interest sent to leafnodes, which can't release the lock.
+// Lock should be held.
+func (c *client) policyAllowsLocked(op PolicyOp, subject string) bool {
+	if allowed, ok := c.cachedPolicyDecision(op, subject); ok {
+		return allowed
+	}
+	return c.callPolicy(op, subject, c.getAuthIdentity(), c.policyAccount())
+}
+
+// policyAccount returns the name of the account passed to the policy module.
+// Lock should be held.
+func (c *client) policyAccount() string {
+	if c.acc != nil {
+		return c.acc.Name
+	}
+	return _EMPTY_
+}
+
+// cachedPolicyDecision returns the cached decision for the operation, if any.
+func (c *client) cachedPolicyDecision(op PolicyOp, subject string) (allowed bool, ok bool) {
+	key := policyCacheKey{op, subject}
+	v, ok := c.pdc.m.Load(key)
+	if !ok {
+		return false, false
+	}
+	d := v.(policyDecision)
+	if d.expires != 0 && time.Now().UnixNano() > d.expires {
+		if _, loaded := c.pdc.m.LoadAndDelete(key); loaded {
+			atomic.AddInt32(&c.pdc.size, -1)
+		}
+		return false, false
+	}
+	return d.allowed, true
+}
+
+// callPolicy calls the policy module and caches its decision. Errors deny
+// the operation so that the policy fails closed. Only the first error is
+// logged for a client so that a failing module does not flood the log, the
+// following ones are logged at the debug level.
+func (c *client) callPolicy(op PolicyOp, subject, identity, account string) bool {
+	d := policyDecision{}
+	allowed, err := c.policy.Allowed(op, subject, identity, account)
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&c.pdc.errLogged, 0, 1) {
+			c.Errorf("Policy module error for %s on %q, further errors are logged at the debug level: %v", op, subject, err)
+		} else {
+			c.Debugf("Policy module error for %s on %q: %v", op, subject, err)
+		}
+		d.expires = time.Now().Add(policyErrorCacheTTL).UnixNano()
+	} else {
+		d.allowed = allowed
+	}
+	key := policyCacheKey{op, subject}
+	if _, loaded := c.pdc.m.LoadOrStore(key, d); loaded {
+		c.pdc.m.Store(key, d)
+	} else if n := atomic.AddInt32(&c.pdc.size, 1); n > maxPermCacheSize {
+		c.prunePolicyCache()
+	}
+	return d.allowed
+}
+
+// prunePolicyCache randomly deletes cached policy decisions, like
+// prunePubPermsCache.
+func (c *client) prunePolicyCache() {
+	if !atomic.CompareAndSwapInt32(&c.pdc.prun, 0, 1) {
+		return
+	}
+	r := 0
+	c.pdc.m.Range(func(k, _ interface{}) bool {
+		c.pdc.m.Delete(k)
+		if r++; r > pruneSize && atomic.LoadInt32(&c.pdc.size)-int32(r) < int32(maxPermCacheSize) {
+			return false
+		}
+		return true
+	})
+	atomic.AddInt32(&c.pdc.size, -int32(r))
+	atomic.StoreInt32(&c.pdc.prun, 0)
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// testPolicy is a policy module implemented in Go, which is its own runtime.
+type testPolicy struct {
+	allowed func(op PolicyOp, subject, identity, account string) (bool, error)
+	loadErr error
+	calls   int32
+	closed  int32
+}
+
+func (p *testPolicy) Load(module []byte) (Policy, error) {
+	if p.loadErr != nil {
+		return nil, p.loadErr
+	}
+	return p, nil
+}
+
+func (p *testPolicy) Allowed(op PolicyOp, subject, identity, account string) (bool, error) {
+	atomic.AddInt32(&p.calls, 1)
+	return p.allowed(op, subject, identity, account)
+}
+
+func (p *testPolicy) Close() {
+	atomic.StoreInt32(&p.closed, 1)
+}
+
+func TestAuthPolicyModule(t *testing.T) {
+	module := []byte("module")
+	subjectPolicy := &testPolicy{allowed: func(_ PolicyOp, subject, _, _ string) (bool, error) {
+		return subject == "allow.me", nil
+	}}
+	denyPolicy := &testPolicy{allowed: func(_ PolicyOp, subject, _, _ string) (bool, error) {
+		return subject != "allow.me", nil
+	}}
+	identityPolicy := &testPolicy{allowed: func(_ PolicyOp, _, identity, _ string) (bool, error) {
+		return len(identity) == 4, nil
+	}}
+	errPolicy := &testPolicy{allowed: func(_ PolicyOp, _, _, _ string) (bool, error) {
+		return true, errors.New("module failure")
+	}}
+
+	// A policy module requires a runtime to load it.
+	opts := DefaultOptions()
+	opts.PolicyModule = module
+	_, err := NewServer(opts)
+	require_Error(t, err, errPolicyNoRuntime)
+	opts.PolicyRuntime = &testPolicy{loadErr: errors.New("invalid module")}
+	_, err = NewServer(opts)
+	require_Error(t, err)
+	require_Contains(t, err.Error(), "Error loading policy module: invalid module")
+
+	errCh := make(chan error, 10)
+	errHandler := nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	})
+	expectErr := func(prefix string) {
+		t.Helper()
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), prefix) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected error %q", prefix)
+		}
+	}
+
+	opts = DefaultOptions()
+	opts.PolicyModule, opts.PolicyRuntime = module, subjectPolicy
+	s := RunServer(opts)
+	nc := natsConnect(t, s.ClientURL(), errHandler)
+	defer nc.Close()
+
+	sub := natsSubSync(t, nc, "allow.me")
+	natsFlush(t, nc)
+	natsSubSync(t, nc, "allow.me.not")
+	natsFlush(t, nc)
+	expectErr(`Permissions Violation for Subscription to "allow.me.not"`)
+
+	natsPub(t, nc, "denied", []byte("denied"))
+	natsFlush(t, nc)
+	expectErr(`Permissions Violation for Publish to "denied"`)
+
+	natsPub(t, nc, "allow.me", []byte("allowed"))
+	msg := natsNexMsg(t, sub, time.Second)
+	require_Equal(t, string(msg.Data), "allowed")
+
+	// The module is closed when the server shuts down.
+	nc.Close()
+	s.Shutdown()
+	require_Equal(t, atomic.LoadInt32(&subjectPolicy.closed), int32(1))
+
+	// Leafnode connections are subject to the module too.
+	lo := DefaultOptions()
+	lo.LeafNode.Host, lo.LeafNode.Port = "127.0.0.1", -1
+	lo.PolicyModule, lo.PolicyRuntime = module, denyPolicy
+	hub := RunServer(lo)
+	defer hub.Shutdown()
+	u, err := url.Parse(fmt.Sprintf("nats://127.0.0.1:%d", hub.getOpts().LeafNode.Port))
+	require_NoError(t, err)
+	so := DefaultOptions()
+	so.Cluster.Name = "spoke"
+	so.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}}}
+	spoke := RunServer(so)
+	defer spoke.Shutdown()
+	checkLeafNodeConnected(t, hub)
+	ncl := natsConnect(t, spoke.ClientURL())
+	defer ncl.Close()
+	lsub := natsSubSync(t, ncl, ">")
+	natsFlush(t, ncl)
+	checkSubInterest(t, hub, globalAccountName, "foo", time.Second)
+	// Publish internally since clients are subject to the module as well.
+	require_NoError(t, hub.sendInternalAccountMsg(hub.globalAccount(), "allow.me", []byte("denied")))
+	require_NoError(t, hub.sendInternalAccountMsg(hub.globalAccount(), "foo", []byte("allowed")))
+	msg = natsNexMsg(t, lsub, time.Second)
+	require_Equal(t, msg.Subject, "foo")
+
+	// The module is passed the verified identity, not the user a token
+	// client put in its CONNECT.
+	opts = DefaultOptions()
+	opts.Users = []*User{{Username: "user", Password: "pwd"}, {Username: "bob", Password: "pwd"}}
+	opts.PolicyModule, opts.PolicyRuntime = module, identityPolicy
+	s2 := RunServer(opts)
+	defer s2.Shutdown()
+	nc2 := natsConnect(t, s2.ClientURL(), nats.UserInfo("user", "pwd"), errHandler)
+	defer nc2.Close()
+	natsSubSync(t, nc2, "foo")
+	natsFlush(t, nc2)
+	nc3 := natsConnect(t, s2.ClientURL(), nats.UserInfo("bob", "pwd"), errHandler)
+	defer nc3.Close()
+	natsSubSync(t, nc3, "foo")
+	natsFlush(t, nc3)
+	expectErr(`Permissions Violation for Subscription to "foo"`)
+
+	opts = DefaultOptions()
+	opts.Authorization = "tok"
+	opts.PolicyModule, opts.PolicyRuntime = module, identityPolicy
+	s3 := RunServer(opts)
+	defer s3.Shutdown()
+	c, cr, _ := newClientForServer(s3)
+	defer c.close()
+	c.parseAsync("CONNECT {\"auth_token\":\"tok\",\"user\":\"user\",\"verbose\":false}\r\nSUB foo 1\r\nPING\r\n")
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR 'Permissions Violation for Subscription to \"foo\"") {
+		t.Fatalf("Expected a permissions violation, got %q", l)
+	}
+
+	// Module errors deny the operation.
+	opts = DefaultOptions()
+	opts.PolicyModule, opts.PolicyRuntime = module, errPolicy
+	s4 := RunServer(opts)
+	defer s4.Shutdown()
+	l := &captureErrorLogger{errCh: make(chan string, 10)}
+	s4.SetLogger(l, false, false)
+	nc4 := natsConnect(t, s4.ClientURL(), errHandler)
+	defer nc4.Close()
+	natsSubSync(t, nc4, "allow.me")
+	natsFlush(t, nc4)
+	expectErr(`Permissions Violation for Subscription to "allow.me"`)
+	// Only the first module error of a client is logged as an error.
+	natsPub(t, nc4, "allow.me", []byte("denied"))
+	natsFlush(t, nc4)
+	expectErr(`Permissions Violation for Publish to "allow.me"`)
+	var logged []string
+	for done := false; !done; {
+		select {
+		case e := <-l.errCh:
+			if strings.Contains(e, "Policy module error") {
+				logged = append(logged, e)
+			}
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	if len(logged) != 1 {
+		t.Fatalf("Expected one module error to be logged, got %q", logged)
+	}
+	// Denials caused by errors are cached for a short time, so that a
+	// failing module does not delay every message.
+	calls := atomic.LoadInt32(&errPolicy.calls)
+	natsPub(t, nc4, "allow.me", []byte("denied"))
+	natsFlush(t, nc4)
+	expectErr(`Permissions Violation for Publish to "allow.me"`)
+	require_Equal(t, atomic.LoadInt32(&errPolicy.calls), calls)
+	var c4 *client
+	s4.mu.Lock()
+	for _, cli := range s4.clients {
+		c4 = cli
+	}
+	s4.mu.Unlock()
+	c4.pdc.m.Store(policyCacheKey{PolicyPublish, "allow.me"}, policyDecision{expires: time.Now().Add(-time.Millisecond).UnixNano()})
+	_, ok := c4.cachedPolicyDecision(PolicyPublish, "allow.me")
+	require_False(t, ok)
+
+	// The module is called without holding the client's lock, which the
+	// monitoring endpoints need.
+	started, release := make(chan struct{}), make(chan struct{})
+	blockPolicy := &testPolicy{allowed: func(_ PolicyOp, _, _, _ string) (bool, error) {
+		close(started)
+		<-release
+		return false, nil
+	}}
+	opts = DefaultOptions()
+	opts.PolicyModule, opts.PolicyRuntime = module, blockPolicy
+	s5 := RunServer(opts)
+	defer s5.Shutdown()
+	nc5 := natsConnect(t, s5.ClientURL(), errHandler)
+	defer nc5.Close()
+	natsSubSync(t, nc5, "foo")
+	<-started
+	connzDone := make(chan error, 1)
+	go func() {
+		_, err := s5.Connz(nil)
+		connzDone <- err
+	}()
+	select {
+	case err := <-connzDone:
+		require_NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected Connz not to wait for the module")
+	}
+	close(release)
+	natsFlush(t, nc5)
+	expectErr(`Permissions Violation for Subscription to "foo"`)
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ProxyHeaderAuthentication is an Authentication implementation for websocket
+// clients connecting through an authenticating HTTP proxy. After doing its own
+// authentication, the proxy sets the X-Forwarded-User header, and optionally
+// X-Forwarded-Groups, on the websocket upgrade request.
+//
+// Those headers are only trusted when the connection comes from one of the
+// trusted proxies, any other client is rejected. The permissions assigned to
+// the user are the ones of the first group that has permissions configured,
+// or the default permissions if no group matches.
+type ProxyHeaderAuthentication struct {
+	trusted      []*net.IPNet
+	groups       map[string]*Permissions
+	defaultPerms *Permissions
+}
+
+// NewProxyHeaderAuthentication creates a ProxyHeaderAuthentication trusting
+// the given proxies, which can be IP addresses or CIDR networks.
+func NewProxyHeaderAuthentication(trustedProxies []string, groups map[string]*Permissions, defaultPermissions *Permissions) (*ProxyHeaderAuthentication, error) {
+	p := &ProxyHeaderAuthentication{groups: groups, defaultPerms: defaultPermissions}
+	for _, tp := range trustedProxies {
+		if !strings.Contains(tp, "/") {
+			ip := net.ParseIP(tp)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", tp)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			p.trusted = append(p.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(tp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network %q: %v", tp, err)
+		}
+		p.trusted = append(p.trusted, ipNet)
+	}
+	if len(p.trusted) == 0 {
+		return nil, fmt.Errorf("at least one trusted proxy is required")
+	}
+	return p, nil
+}
+
+// Check implements the Authentication interface.
+func (p *ProxyHeaderAuthentication) Check(ca ClientAuthentication) bool {
+	c, ok := ca.(*client)
+	if !ok || !p.isTrustedProxy(c.RemoteAddress()) {
+		return false
+	}
+	c.mu.Lock()
+	if c.ws == nil || c.ws.proxyUser == _EMPTY_ {
+		c.mu.Unlock()
+		return false
+	}
+	user, groups := c.ws.proxyUser, c.ws.proxyGroups
+	c.mu.Unlock()
+
+	perms := p.defaultPerms
+	for _, g := range groups {
+		if gp, ok := p.groups[g]; ok {
+			perms = gp
+			break
+		}
+	}
+	c.RegisterUser(&User{Username: user, Permissions: perms.clone()})
+	return true
+}
+
+// isTrustedProxy returns true if the address is one of a trusted proxy.
+func (p *ProxyHeaderAuthentication) isTrustedProxy(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
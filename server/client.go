@@ -26,6 +26,7 @@ import (
 	"net/url"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -83,6 +84,20 @@ const (
 	okProto   = "+OK" + _CRLF_
 )
 
+// Prefixes of the errors sent to clients denied by the security checks, so
+// that authentication failures can be told apart from operations denied to
+// authenticated clients.
+const (
+	// AuthenticationViolationErr is sent when the client fails to
+	// authenticate on connect, after which the connection is closed.
+	// Its text predates the distinction and is kept for existing clients.
+	AuthenticationViolationErr = "Authorization Violation"
+	// PermissionsViolationErr prefixes the errors sent when an authenticated
+	// client is not authorized to publish or subscribe. The connection is
+	// kept open.
+	PermissionsViolationErr = "Permissions Violation"
+)
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -136,6 +151,7 @@ const (
 	skipFlushOnClose                              // Marks that flushOutbound() should not be called on connection close.
 	expectConnect                                 // Marks if this connection is expected to send a CONNECT
 	connectProcessFinished                        // Marks if this connection has finished the connect process.
+	connectAuthorized                             // Marks that the CONNECT has been authorized.
 )
 
 // set the flag (would be equivalent to set the boolean to true)
@@ -204,6 +220,7 @@ const (
 	DuplicateServerName
 	MinimumVersionRequired
 	ClusterNamesIdentical
+	IdleTimeout
 )
 
 // Some flags passed to processMsgResults
@@ -228,6 +245,7 @@ type client struct {
 	opts       ClientOpts
 	rrTracking *rrTracking
 	mpay       int32
+	umpay      int32 // User max payload, zero if not set.
 	msubs      int32
 	mcl        int32
 	mu         sync.Mutex
@@ -245,6 +263,9 @@ type client struct {
 	replies    map[string]*resp
 	mperms     *msgDeny
 	darray     []string
+	policy     Policy
+	pdc        *policyCache
+	idle       *idleTimer
 	pcd        map[*client]struct{}
 	atmr       *time.Timer
 	ping       pinfo
@@ -271,8 +292,46 @@ type client struct {
 	echo  bool
 	noIcb bool
 
-	tags    jwt.TagList
-	nameTag string
+	tags     jwt.TagList
+	nameTag  string
+	userTags map[string]string
+	// Rewrites applied to the subjects published by the user.
+	pubRewrites []*transform
+	// Subject the user's publish and subscribe subjects have to be within.
+	namespace string
+	// Why authentication failed, only set while authenticating.
+	authFailReason string
+	// Authentication method of the check that authenticated the client,
+	// regardless of the other credentials it presented.
+	authedMethod string
+	// User name, nkey or JWT public key verified when the client was
+	// authenticated, empty for token and anonymous clients.
+	authedID string
+	// User and IP address the connection is counted for, when the user
+	// limits its connections per IP address.
+	userIPConn string
+	// Log the reason of the user's denied operations.
+	traceDenials bool
+	// The user is flagged as an admin.
+	admin bool
+	// Permissions being resolved by the PermissionsResolver, applied again
+	// after the client is authorized on reload.
+	dperms *deferredPerms
+	// Everything is denied because the client was authorized without
+	// permissions and NilPermissionsMeanDeny is set.
+	nilDenied bool
+	// Closes the client of a user drained by DrainUser at drainDeadline.
+	drainTmr      *time.Timer
+	drainDeadline time.Time
+	// Distinct subjects published to, when the user limits their number.
+	maxPubSubjs int
+	pubSubjs    map[string]struct{}
+	// Publish rate limit of the user, for all subjects. Only accessed
+	// from the readLoop once registered.
+	pubRate *pubRateLimiter
+	// Nonces tracked when the previous nonce is allowed.
+	issuedNonce *issuedNonce
+	prevNonce   *issuedNonce
 
 	tlsTo *time.Timer
 }
@@ -358,6 +417,36 @@ func nbPoolPut(b []byte) {
 type perm struct {
 	allow *Sublist
 	deny  *Sublist
+	// Literal subjects of the "exact:" allow rules, which are not in the
+	// allow sublist so that they never match wildcard subjects.
+	exact map[string]struct{}
+	// Shared sublists of the subjects loaded from prefix tree files.
+	// They must not be modified.
+	allowTrie *Sublist
+	denyTrie  *Sublist
+}
+
+// matchPsubs returns the plain subscriptions of the sublist that match the
+// subject, such as the subjects loaded from a prefix tree file, if any.
+func matchPsubs(sl *Sublist, subject string) []*subscription {
+	if sl == nil {
+		return nil
+	}
+	return sl.Match(subject).psubs
+}
+
+// allowsExact returns true if the subject is allowed by an exact rule.
+func (p *perm) allowsExact(subject string) bool {
+	_, ok := p.exact[subject]
+	return ok
+}
+
+// addExact adds the literal subject of an exact allow rule.
+func (p *perm) addExact(subject string) {
+	if p.exact == nil {
+		p.exact = make(map[string]struct{})
+	}
+	p.exact[subject] = struct{}{}
 }
 
 type permissions struct {
@@ -368,6 +457,142 @@ type permissions struct {
 	pub    perm
 	resp   *ResponsePermission
 	pcache sync.Map
+	// Maximum number of wildcard tokens in a subscription subject.
+	maxWildcards int
+	// Subjects that can only be subscribed to with a queue group.
+	queueRequired []string
+	// Publish rate limits. Only accessed from the client's readLoop.
+	pubRates []*pubRateLimiter
+	// Appended to permissions violation errors.
+	denyMsg string
+	// Headers required to publish on some subjects.
+	reqHeaders []*RequiredHeader
+	// Header values required for messages to be delivered on some subjects.
+	subHdrFilters []*HeaderFilter
+	// Subjects that only accept messages with a reply subject.
+	requestOnly []string
+	// Allowed subjects that expire.
+	grants []*permGrant
+	// Allowed subjects resolved from the user's group memberships, and
+	// the subjects they were resolved to.
+	groups     []*permGrant
+	groupSubjs []string
+}
+
+// permGrant is an allowed subject inserted in a permission sublist
+// that is removed once it expires.
+type permGrant struct {
+	sl      *Sublist
+	sub     *subscription
+	expires time.Time
+}
+
+// pubRateLimiter is a token bucket enforcing a PublishRate.
+type pubRateLimiter struct {
+	PublishRate
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated until time now and returns true if a
+// message can be published, without taking a token.
+func (rl *pubRateLimiter) refill(now time.Time) bool {
+	rate := float64(rl.Rate)
+	rl.tokens += now.Sub(rl.last).Seconds() * rate
+	if rl.tokens > rate {
+		rl.tokens = rate
+	}
+	rl.last = now
+	return rl.tokens >= 1
+}
+
+// take takes a token, once refill returned true.
+func (rl *pubRateLimiter) take() {
+	rl.tokens--
+}
+
+// pubRateExceeded returns the first publish rate limit that the subject
+// exceeds, or nil if the message can be published. A token is only taken
+// from the limits of the subject if none of them is exceeded, so that a
+// rejected message does not count against overlapping limits.
+func (p *permissions) pubRateExceeded(subject string) *pubRateLimiter {
+	now := time.Now()
+	for _, rl := range p.pubRates {
+		if matchLiteral(subject, rl.Subject) && !rl.refill(now) {
+			return rl
+		}
+	}
+	for _, rl := range p.pubRates {
+		if matchLiteral(subject, rl.Subject) {
+			rl.take()
+		}
+	}
+	return nil
+}
+
+// headersFiltered returns true if a message on the subject has to be dropped
+// because it does not have an allowed value of a filtered header.
+func (p *permissions) headersFiltered(subject string, hdr []byte) bool {
+	for _, hf := range p.subHdrFilters {
+		if !matchLiteral(subject, hf.Subject) {
+			continue
+		}
+		v := getHeader(hf.Header, hdr)
+		if v == nil {
+			return true
+		}
+		allowed := false
+		for _, av := range hf.Values {
+			if string(v) == av {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// missingRequiredHeader returns the first header required to publish on
+// the subject that is not present in the message headers, if any.
+func (p *permissions) missingRequiredHeader(subject string, hdr []byte) string {
+	for _, rh := range p.reqHeaders {
+		if matchLiteral(subject, rh.Subject) && len(getHeader(rh.Header, hdr)) == 0 {
+			return rh.Header
+		}
+	}
+	return _EMPTY_
+}
+
+// replyRequired returns true if messages published on the subject must
+// have a reply subject.
+func (p *permissions) replyRequired(subject string) bool {
+	for _, ro := range p.requestOnly {
+		if matchLiteral(subject, ro) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackPublishSubject records the subject as published to and returns
+// false if it is a new subject and the maximum number of distinct subjects
+// has been reached. Subjects are tracked for the connection's lifetime.
+// Lock is held on entry.
+func (c *client) trackPublishSubject(subject []byte) bool {
+	if _, ok := c.pubSubjs[string(subject)]; ok {
+		return true
+	}
+	if len(c.pubSubjs) >= c.maxPubSubjs {
+		return false
+	}
+	if c.pubSubjs == nil {
+		c.pubSubjs = make(map[string]struct{})
+	}
+	c.pubSubjs[string(subject)] = struct{}{}
+	return true
 }
 
 // This is used to dynamically track responses and reply subjects
@@ -608,6 +833,14 @@ type ClientOpts struct {
 	AccountNew   bool   `json:"new_account,omitempty"`
 	Headers      bool   `json:"headers,omitempty"`
 	NoResponders bool   `json:"no_responders,omitempty"`
+	AuthScheme   string `json:"auth_scheme,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	// ClientTime is the time of the client, in RFC 3339 format, checked
+	// against Options.MaxClientClockSkew.
+	ClientTime string `json:"client_time,omitempty"`
+	// PoW is the proof of work solving the nonce for
+	// Options.ConnectPoWDifficulty, see SolveConnectPoW.
+	PoW string `json:"pow,omitempty"`
 
 	// Routes and Leafnodes only
 	Import *SubjectPermission `json:"import,omitempty"`
@@ -643,6 +876,12 @@ func (c *client) initClient() {
 	if c.mcl == 0 {
 		c.mcl = MAX_CONTROL_LINE_SIZE
 	}
+	if c.kind == CLIENT || c.kind == LEAF {
+		c.policy = s.policy
+		if c.policy != nil {
+			c.pdc = &policyCache{}
+		}
+	}
 
 	c.subs = make(map[string]*subscription)
 	c.echo = true
@@ -754,6 +993,10 @@ func (c *client) registerWithAccount(acc *Account) error {
 	if acc == nil || acc.sl == nil {
 		return ErrBadAccount
 	}
+	// A connection registering again with its account, for instance when
+	// authorization is reloaded, is already accounted for and must not be
+	// closed because the account limits were lowered.
+	reregister := c.acc == acc
 	// If we were previously registered, usually to $G, do accounting here to remove.
 	if c.acc != nil {
 		if prev := c.acc.removeClient(c); prev == 1 && c.srv != nil {
@@ -769,10 +1012,12 @@ func (c *client) registerWithAccount(acc *Account) error {
 	c.mu.Unlock()
 
 	// Check if we have a max connections violation
-	if kind == CLIENT && acc.MaxTotalConnectionsReached() {
-		return ErrTooManyAccountConnections
-	} else if kind == LEAF && acc.MaxTotalLeafNodesReached() {
-		return ErrTooManyAccountConnections
+	if !reregister {
+		if kind == CLIENT && acc.MaxTotalConnectionsReached() {
+			return ErrTooManyAccountConnections
+		} else if kind == LEAF && acc.MaxTotalLeafNodesReached() {
+			return ErrTooManyAccountConnections
+		}
 	}
 
 	// Add in new one.
@@ -845,6 +1090,9 @@ func (c *client) applyAccountLimits() {
 	if minLimit(&c.mpay, mPay) && !wasUnlimited {
 		c.Errorf("Max Payload set to %d from server overrides account or user config", opts.MaxPayload)
 	}
+	if c.umpay > 0 {
+		minLimit(&c.mpay, c.umpay)
+	}
 	wasUnlimited = c.msubs == jwt.NoLimit
 	if minLimit(&c.msubs, mSubs) && !wasUnlimited {
 		c.Errorf("Max Subscriptions set to %d from server overrides account or user config", opts.MaxSubs)
@@ -870,15 +1118,28 @@ func (c *client) RegisterUser(user *User) {
 		}
 	}
 
+	// Clients that presented a verified certificate may get other permissions.
+	userPerms := user.Permissions
+	if user.TLSPermissions != nil {
+		if state := c.GetTLSConnectionState(); state != nil && len(state.VerifiedChains) > 0 {
+			userPerms = user.TLSPermissions
+		}
+	}
+
 	c.mu.Lock()
 
 	// Assign permissions.
-	if user.Permissions == nil {
+	perms := c.userPermissions(userPerms, user.Tags)
+	if perms == nil {
 		// Reset perms to nil in case client previously had them.
 		c.perms = nil
 		c.mperms = nil
 	} else {
-		c.setPermissions(user.Permissions)
+		c.setPermissions(perms)
+		c.allowOwnInbox(perms, user.Username)
+	}
+	if c.kind == CLIENT && c.srv != nil && c.srv.getOpts().ProtectSystemSubjects {
+		c.protectSystemSubjects(perms)
 	}
 
 	// allows custom authenticators to set a username to be reported in
@@ -886,10 +1147,75 @@ func (c *client) RegisterUser(user *User) {
 	if user.Username != _EMPTY_ {
 		c.opts.Username = user.Username
 	}
+	c.authedID = user.Username
+
+	c.userTags = user.Tags
+	c.admin = user.Admin
+	c.setIdleTimeout(user.IdleTimeout)
+
+	rewrites, err := newPublishRewrites(user.PublishRewrites)
+	if err != nil {
+		c.Errorf("Invalid publish rewrites: %v", err)
+	}
+	c.pubRewrites = rewrites
+	c.namespace = namespaceSubject(user.Namespace)
+	c.setUserLimits(user.MaxPayload, user.MaxPending)
+	c.traceDenials = user.TraceDenials
+	c.maxPubSubjs = user.MaxPublishSubjects
+	if c.maxPubSubjs == 0 {
+		c.pubSubjs = nil
+	}
+	c.pubRate = nil
+	if user.MaxPublishRate > 0 {
+		c.pubRate = &pubRateLimiter{
+			PublishRate: PublishRate{Subject: fwcs, Rate: user.MaxPublishRate},
+			tokens:      float64(user.MaxPublishRate),
+			last:        time.Now(),
+		}
+	}
+	c.applyUserOptions(user.Options)
 
 	c.mu.Unlock()
 }
 
+// setUserLimits applies the user's max payload, which can only lower the
+// current one, and max pending. Zero restores the server defaults.
+// Lock is held on entry.
+func (c *client) setUserLimits(maxPayload int32, maxPending int64) {
+	if maxPayload != c.umpay {
+		c.umpay = maxPayload
+		c.applyAccountLimits()
+	}
+	if c.srv == nil || c.kind != CLIENT {
+		return
+	}
+	if maxPending > 0 {
+		c.out.mp = maxPending
+	} else {
+		c.out.mp = c.srv.getOpts().MaxPending
+	}
+}
+
+// applyUserOptions forces off the protocol features forbidden by the user
+// options, whatever the client requested in its CONNECT.
+// Lock should be held.
+func (c *client) applyUserOptions(uo *UserOptions) {
+	if uo == nil || c.kind != CLIENT {
+		return
+	}
+	if uo.NoEcho {
+		c.echo = false
+	}
+	if uo.NoVerbose {
+		c.opts.Verbose = false
+	}
+	if uo.NoHeaders {
+		c.headers = false
+		// No responders notifications are sent as header-only messages.
+		c.opts.NoResponders = false
+	}
+}
+
 // RegisterNkeyUser allows auth to call back into a new nkey
 // client with the authenticated user. This is used to map
 // any permissions into the client and setup accounts.
@@ -904,18 +1230,123 @@ func (c *client) RegisterNkeyUser(user *NkeyUser) error {
 
 	c.mu.Lock()
 	c.user = user
+	c.authedID = user.Nkey
+	c.userTags = user.Tags
+	c.admin = user.Admin
+	c.setIdleTimeout(user.IdleTimeout)
+	// The claimed namespace has been checked against the issued ones.
+	c.namespace = namespaceSubject(c.opts.Namespace)
 	// Assign permissions.
-	if user.Permissions == nil {
+	perms := c.userPermissions(user.Permissions, user.Tags)
+	if perms == nil {
 		// Reset perms to nil in case client previously had them.
 		c.perms = nil
 		c.mperms = nil
 	} else {
-		c.setPermissions(user.Permissions)
+		c.setPermissions(perms)
+		c.allowOwnInbox(perms, user.Nkey)
+	}
+	if c.kind == CLIENT && c.srv != nil && c.srv.getOpts().ProtectSystemSubjects {
+		c.protectSystemSubjects(perms)
 	}
 	c.mu.Unlock()
 	return nil
 }
 
+// userPermissions returns the permissions to assign to the client for
+// the given user permissions, with tag templates expanded using the
+// user's tags. A user without permissions is denied everything if the
+// server is configured so.
+func (c *client) userPermissions(perms *Permissions, tags map[string]string) *Permissions {
+	if perms == nil && c.kind == CLIENT && c.srv != nil && c.srv.getOpts().NilPermissionsMeanDeny {
+		return denyAllPermissions()
+	}
+	if perms == nil || !perms.hasTagTemplates() {
+		return perms
+	}
+	perms, err := perms.expandTagTemplates(tags)
+	if err != nil {
+		c.Warnf("Denying all permissions, unable to expand permissions template: %v", err)
+	}
+	return perms
+}
+
+// applyNilPermissionsMeanDeny denies everything to a client that was
+// authorized without permissions, such as with a token or when no
+// authentication is configured, if the server is configured so. Clients
+// registered with a user are handled by userPermissions. The denial is
+// lifted if the option is turned off by a reload.
+// Lock should be held.
+func (c *client) applyNilPermissionsMeanDeny(opts *Options) {
+	if c.kind != CLIENT {
+		return
+	}
+	if c.perms == nil && opts.NilPermissionsMeanDeny {
+		c.setPermissions(denyAllPermissions())
+		c.nilDenied = true
+	} else if c.nilDenied && !opts.NilPermissionsMeanDeny {
+		c.perms, c.mperms = nil, nil
+		c.nilDenied = false
+	}
+}
+
+// permissionsInfo returns the allow and deny subjects of the client
+// permissions, including the ones merged after registration and the "exact:"
+// allow rules, or nil if the client has no permissions.
+// Lock should be held.
+func (c *client) permissionsInfo() *Permissions {
+	if c.perms == nil {
+		return nil
+	}
+	subjects := func(sl *Sublist) []string {
+		if sl == nil {
+			return nil
+		}
+		var subs []*subscription
+		sl.All(&subs)
+		subjects := make([]string, 0, len(subs))
+		for _, sub := range subs {
+			subject := string(sub.subject)
+			if len(sub.queue) > 0 {
+				subject += " " + string(sub.queue)
+			}
+			subjects = append(subjects, subject)
+		}
+		sort.Strings(subjects)
+		return subjects
+	}
+	subjectPermission := func(p perm) *SubjectPermission {
+		if p.allow == nil && p.deny == nil {
+			return nil
+		}
+		allow, deny := subjects(p.allow), subjects(p.deny)
+		if len(p.exact) > 0 || p.allowTrie != nil {
+			for subject := range p.exact {
+				allow = append(allow, exactSubjectPrefix+subject)
+			}
+			allow = append(allow, subjects(p.allowTrie)...)
+			sort.Strings(allow)
+		}
+		if p.denyTrie != nil {
+			deny = append(deny, subjects(p.denyTrie)...)
+			sort.Strings(deny)
+		}
+		return &SubjectPermission{Allow: allow, Deny: deny}
+	}
+	return &Permissions{
+		Publish:   subjectPermission(c.perms.pub),
+		Subscribe: subjectPermission(c.perms.sub),
+	}
+}
+
+// UserTags returns the metadata tags of the user this client was
+// registered with, if any.
+func (c *client) UserTags() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyTags(c.userTags)
+}
+
 func splitSubjectQueue(sq string) ([]byte, []byte, error) {
 	vals := strings.Fields(strings.TrimSpace(sq))
 	s := []byte(vals[0])
@@ -934,7 +1365,24 @@ func (c *client) setPermissions(perms *Permissions) {
 	if perms == nil {
 		return
 	}
-	c.perms = &permissions{}
+	c.perms = &permissions{
+		maxWildcards:  perms.MaxWildcardTokens,
+		queueRequired: perms.QueueRequired,
+		reqHeaders:    perms.RequiredHeaders,
+		subHdrFilters: perms.SubscribeHeaderFilters,
+		requestOnly:   perms.RequestOnly,
+		// Make sure the message does not span multiple lines.
+		denyMsg: strings.Join(strings.Fields(perms.DenyMessage), " "),
+	}
+
+	// Setup the publish rate limiters, starting with a full bucket.
+	now := time.Now()
+	for _, pr := range perms.PublishRates {
+		if pr.Rate <= 0 {
+			continue
+		}
+		c.perms.pubRates = append(c.perms.pubRates, &pubRateLimiter{PublishRate: *pr, tokens: float64(pr.Rate), last: now})
+	}
 
 	// Loop over publish permissions
 	if perms.Publish != nil {
@@ -942,10 +1390,15 @@ func (c *client) setPermissions(perms *Permissions) {
 			c.perms.pub.allow = NewSublistWithCache()
 		}
 		for _, pubSubject := range perms.Publish.Allow {
+			if strings.HasPrefix(pubSubject, exactSubjectPrefix) {
+				c.perms.pub.addExact(strings.TrimPrefix(pubSubject, exactSubjectPrefix))
+				continue
+			}
 			sub := &subscription{subject: []byte(pubSubject)}
 			c.perms.pub.allow.Insert(sub)
 		}
-		if len(perms.Publish.Deny) > 0 {
+		c.perms.pub.allowTrie, c.perms.pub.denyTrie = perms.Publish.allowTrie, perms.Publish.denyTrie
+		if len(perms.Publish.Deny) > 0 || perms.Publish.denyTrie != nil {
 			c.perms.pub.deny = NewSublistWithCache()
 		}
 		for _, pubSubject := range perms.Publish.Deny {
@@ -964,10 +1417,14 @@ func (c *client) setPermissions(perms *Permissions) {
 	// Loop over subscribe permissions
 	if perms.Subscribe != nil {
 		var err error
-		if len(perms.Subscribe.Allow) > 0 {
+		if len(perms.Subscribe.Allow) > 0 || perms.Subscribe.allowTrie != nil {
 			c.perms.sub.allow = NewSublistWithCache()
 		}
 		for _, subSubject := range perms.Subscribe.Allow {
+			if strings.HasPrefix(subSubject, exactSubjectPrefix) {
+				c.perms.sub.addExact(strings.TrimPrefix(subSubject, exactSubjectPrefix))
+				continue
+			}
 			sub := &subscription{}
 			sub.subject, sub.queue, err = splitSubjectQueue(subSubject)
 			if err != nil {
@@ -976,7 +1433,8 @@ func (c *client) setPermissions(perms *Permissions) {
 			}
 			c.perms.sub.allow.Insert(sub)
 		}
-		if len(perms.Subscribe.Deny) > 0 {
+		c.perms.sub.allowTrie, c.perms.sub.denyTrie = perms.Subscribe.allowTrie, perms.Subscribe.denyTrie
+		if len(perms.Subscribe.Deny) > 0 || perms.Subscribe.denyTrie != nil {
 			c.perms.sub.deny = NewSublistWithCache()
 			// Also hold onto this array for later.
 			c.darray = perms.Subscribe.Deny
@@ -992,6 +1450,39 @@ func (c *client) setPermissions(perms *Permissions) {
 		}
 	}
 
+	// Add the grants that are not yet expired to the allow lists.
+	for _, g := range perms.Grants {
+		if !now.Before(g.Expires) {
+			continue
+		}
+		if c.perms.pub.allow != nil {
+			for _, pubSubject := range g.Publish {
+				sub := &subscription{subject: []byte(pubSubject)}
+				c.perms.pub.allow.Insert(sub)
+				c.perms.grants = append(c.perms.grants, &permGrant{c.perms.pub.allow, sub, g.Expires})
+			}
+		}
+		if c.perms.sub.allow != nil {
+			for _, subSubject := range g.Subscribe {
+				sub := &subscription{}
+				var err error
+				sub.subject, sub.queue, err = splitSubjectQueue(subSubject)
+				if err != nil {
+					c.Errorf("%s", err.Error())
+					continue
+				}
+				c.perms.sub.allow.Insert(sub)
+				c.perms.grants = append(c.perms.grants, &permGrant{c.perms.sub.allow, sub, g.Expires})
+			}
+		}
+	}
+	// Start expiring the grants the first time a client is given some.
+	if s := c.srv; len(c.perms.grants) > 0 && s != nil && atomic.CompareAndSwapInt32(&s.permGrants, 0, 1) {
+		if !s.startGoRoutine(s.expirePermissionGrantsLoop) {
+			atomic.StoreInt32(&s.permGrants, 0)
+		}
+	}
+
 	// If we are a leafnode and we are the hub copy the extracted perms
 	// to resend back to soliciting server. These are reversed from the
 	// way routes interpret them since this is how the soliciting server
@@ -1053,6 +1544,99 @@ func (c *client) mergeDenyPermissions(what denyType, denyPubs []string) {
 	}
 }
 
+// ownInboxPrefix returns the inbox prefix of the given user, which is
+// empty if the user name can not be used as a subject token.
+func ownInboxPrefix(user string) string {
+	if user == _EMPTY_ || strings.ContainsAny(user, " \t\r\n.*>") {
+		return _EMPTY_
+	}
+	return "_INBOX." + user + "."
+}
+
+// allowOwnInbox adds the inbox prefix of the user to the allowed subscribe
+// subjects if requested by the permissions. Without a subscribe allow list,
+// the inbox becomes the only subject the client can subscribe to.
+// Lock is held on entry.
+func (c *client) allowOwnInbox(perms *Permissions, user string) {
+	if !perms.AllowOwnInbox {
+		return
+	}
+	if c.perms.sub.allow == nil {
+		c.perms.sub.allow = NewSublistWithCache()
+	}
+	if prefix := ownInboxPrefix(user); prefix != _EMPTY_ {
+		c.perms.sub.allow.Insert(&subscription{subject: []byte(prefix + ">")})
+	}
+}
+
+// Subjects denied to clients when ProtectSystemSubjects is set, unless
+// explicitly allowed by their permissions.
+var protectedSystemSubjects = []string{"$SYS.>", "$JS.>"}
+
+// protectSystemSubjects adds deny permissions for the protected system
+// namespaces that the given permissions expose without explicitly allowing
+// them. A namespace is exposed when there is no allow list, or when an allow
+// clause such as ">" is broader than the namespace. Only an allow of the
+// whole namespace, such as "$SYS.>", lifts the protection: clauses within
+// it do not, since the deny would otherwise be lifted for all the subjects
+// the broader clause exposes. Without a broader clause, clauses within the
+// namespace are not affected.
+// Lock is held on entry.
+func (c *client) protectSystemSubjects(perms *Permissions) {
+	var pubAllow, subAllow, subDeny []string
+	var pubTrie, subTrie *Sublist
+	if perms != nil {
+		if perms.Publish != nil {
+			pubAllow, pubTrie = perms.Publish.Allow, perms.Publish.allowTrie
+		}
+		if perms.Subscribe != nil {
+			subAllow, subDeny, subTrie = perms.Subscribe.Allow, perms.Subscribe.Deny, perms.Subscribe.allowTrie
+		}
+	}
+	exposed := func(allow []string, trie *Sublist, protected string) bool {
+		if allow == nil && trie == nil {
+			return true
+		}
+		var broader bool
+		// The clauses of a prefix tree matching the protected subject are
+		// either the same or broader.
+		for _, sub := range matchPsubs(trie, protected) {
+			if string(sub.subject) == protected {
+				return false
+			}
+			broader = true
+		}
+		for _, subj := range allow {
+			bsubj, _, err := splitSubjectQueue(subj)
+			if err != nil {
+				continue
+			}
+			subj := string(bsubj)
+			if subj == protected {
+				return false
+			}
+			if !subjectIsSubsetMatch(subj, protected) && SubjectsCollide(subj, protected) {
+				broader = true
+			}
+		}
+		return broader
+	}
+	for _, protected := range protectedSystemSubjects {
+		if exposed(pubAllow, pubTrie, protected) {
+			c.mergeDenyPermissions(pub, []string{protected})
+		}
+		if exposed(subAllow, subTrie, protected) {
+			c.mergeDenyPermissions(sub, []string{protected})
+			subDeny = append(subDeny[:len(subDeny):len(subDeny)], protected)
+		}
+	}
+	// Needed to filter messages delivered to wildcard subscriptions.
+	if len(subDeny) > 0 {
+		c.darray = subDeny
+		c.mperms = nil
+	}
+}
+
 // Merge client.perms structure with additional pub deny permissions
 // Client lock must not be held on entry
 func (c *client) mergeDenyPermissionsLocked(what denyType, denyPubs []string) {
@@ -1088,6 +1672,9 @@ func (c *client) setExpiration(claims *jwt.ClaimsData, validFor time.Duration) {
 func (c *client) loadMsgDenyFilter() {
 	c.mperms = &msgDeny{NewSublistWithCache(), make(map[string]bool)}
 	for _, sub := range c.darray {
+		if c.perms != nil {
+			sub = c.perms.sub.deliveryDeny(sub)
+		}
 		c.mperms.deny.Insert(&subscription{subject: []byte(sub)})
 	}
 }
@@ -1332,6 +1919,7 @@ func (c *client) readLoop(pre []byte) {
 		if c.in.msgs > 0 || c.in.subs > 0 {
 			c.last = last
 			c.lastIn = last
+			c.updateIdle(last)
 		}
 
 		if n >= cap(b) {
@@ -1818,6 +2406,10 @@ func (c *client) processConnect(arg []byte) error {
 	// Indicate that the CONNECT protocol has been received, and that the
 	// server now knows which protocol this client supports.
 	c.flags.set(connectReceived)
+	// The nonce can no longer be used by the next connection.
+	if c.issuedNonce != nil {
+		c.issuedNonce.claim()
+	}
 	// Capture these under lock
 	c.echo = c.opts.Echo
 	proto := c.opts.Protocol
@@ -1850,6 +2442,12 @@ func (c *client) processConnect(arg []byte) error {
 		}
 	}
 
+	// If websocket client and no credentials in the CONNECT, use the token
+	// from the URL query, if any. It is never logged.
+	if ws := c.ws; ws != nil && c.kind == CLIENT && ws.queryToken != _EMPTY_ && c.opts.Token == _EMPTY_ && c.opts.Username == _EMPTY_ &&
+		c.opts.Password == _EMPTY_ && c.opts.Nkey == _EMPTY_ && c.opts.JWT == _EMPTY_ {
+		c.opts.Token = ws.queryToken
+	}
 	// If websocket client and JWT not in the CONNECT, use the cookie JWT (possibly empty).
 	if ws := c.ws; ws != nil && c.opts.JWT == "" {
 		c.opts.JWT = ws.cookieJwt
@@ -1876,8 +2474,40 @@ func (c *client) processConnect(arg []byte) error {
 			srv.mu.Unlock()
 		}
 
+		// Capture the authentication method before auth may alter the options.
+		var method string
+		if kind == CLIENT || kind == LEAF {
+			c.mu.Lock()
+			method = c.authMethod(srv.getOpts())
+			c.mu.Unlock()
+		}
+
 		// Check for Auth
-		if ok := srv.checkAuthentication(c); !ok {
+		ok := srv.checkAuthentication(c)
+		if kind == CLIENT || kind == LEAF {
+			srv.sendAuthEvent(c, method, ok)
+			if ok {
+				c.mu.Lock()
+				c.flags.set(connectAuthorized)
+				c.mu.Unlock()
+			}
+		}
+		if ok && kind == CLIENT {
+			srv.recordLogin(c)
+			srv.recordAuthSuccess(c)
+			c.mu.Lock()
+			c.applyNilPermissionsMeanDeny(srv.getOpts())
+			c.mu.Unlock()
+			srv.localAdminConnect(c, srv.getOpts())
+			srv.privilegedConnect(c, srv.getOpts())
+			if r := srv.getOpts().PermissionsResolver; r != nil {
+				srv.deferPermissions(c, r)
+			}
+			if r := srv.getOpts().GroupSubjectsResolver; r != nil {
+				srv.resolveGroupSubjects(c, r)
+			}
+		}
+		if !ok {
 			// We may fail here because we reached max limits on an account.
 			if ujwt != _EMPTY_ {
 				c.mu.Lock()
@@ -1920,6 +2550,8 @@ func (c *client) processConnect(arg []byte) error {
 		// they have header support on as well.
 		c.mu.Lock()
 		misMatch := c.opts.NoResponders && !c.headers
+		// The user options may have disabled verbose.
+		verbose = c.opts.Verbose
 		c.mu.Unlock()
 		if misMatch {
 			c.sendErr(ErrNoRespondersRequiresHeaders.Error())
@@ -1929,6 +2561,15 @@ func (c *client) processConnect(arg []byte) error {
 		if verbose {
 			c.sendOK()
 		}
+		if proto >= ClientProtoInfo && srv.getOpts().SendPermissionsToClient {
+			srv.mu.Lock()
+			info := srv.copyInfo()
+			srv.mu.Unlock()
+			c.mu.Lock()
+			info.Permissions = c.permissionsInfo()
+			c.enqueueProto(c.generateClientInfoJSON(info))
+			c.mu.Unlock()
+		}
 	case ROUTER:
 		// Delegate the rest of processing to the route
 		return c.processRouteConnect(srv, arg, lang)
@@ -1962,6 +2603,39 @@ func (c *client) authExpired() {
 	c.closeConnection(AuthenticationExpired)
 }
 
+// clearDrainTimer stops the timer closing a drained client.
+// Lock should be held
+func (c *client) clearDrainTimer() {
+	if c.drainTmr == nil {
+		return
+	}
+	c.drainTmr.Stop()
+	c.drainTmr = nil
+}
+
+// applyDrainPermissions makes a client drained by DrainUser read-only again,
+// replacing the permissions registered by the authorization, which happens
+// again on reload.
+// Lock should be held
+func (c *client) applyDrainPermissions() {
+	if c.drainTmr == nil {
+		return
+	}
+	perms := denyAllPermissions()
+	if grace := time.Until(c.drainDeadline); grace > 0 {
+		perms.Response = &ResponsePermission{MaxMsgs: 1, Expires: grace}
+	}
+	c.setPermissions(perms)
+	c.mperms = nil
+}
+
+// userDrained closes the connection at the end of the grace period given
+// to Server.DrainUser.
+func (c *client) userDrained() {
+	c.sendErrAndDebug("User Authentication Revoked")
+	c.closeConnection(Revocation)
+}
+
 func (c *client) accountAuthExpired() {
 	c.sendErrAndDebug("Account Authentication Expired")
 	c.closeConnection(AuthenticationExpired)
@@ -1977,7 +2651,7 @@ func (c *client) authViolation() {
 		hasUsers = s.users != nil
 		s.mu.Unlock()
 		defer s.sendAuthErrorEvent(c)
-
+		s.recordAuthFailure(c)
 	}
 	if hasTrustedNkeys {
 		c.Errorf("%v", ErrAuthentication)
@@ -1994,10 +2668,31 @@ func (c *client) authViolation() {
 			c.Errorf(ErrAuthentication.Error())
 		}
 	}
+	if s != nil && s.getOpts().LogFailedCredentialHashes {
+		if h := s.credentialHash(c); h != _EMPTY_ {
+			c.Errorf("Rejected credential hash %s", h)
+		}
+	}
 	if c.isMqtt() {
 		c.mqttEnqueueConnAck(mqttConnAckRCNotAuthorized, false)
 	} else {
-		c.sendErr("Authorization Violation")
+		errTxt := AuthenticationViolationErr
+		// Tell the client how to fix its connection.
+		switch c.authFailReason {
+		case authFailNameRequired:
+			errTxt += " - Client Name Required"
+		case authFailClockSkew:
+			errTxt += " - Client Clock Skewed, Synchronize The Client Clock"
+		case authFailConnsPerIP:
+			errTxt += " - Too Many Connections From IP"
+		case authFailPoW:
+			errTxt += " - Proof Of Work Required"
+		case authFailCredentialLen:
+			errTxt += " - Credentials Too Long"
+		case authFailTLSVersion:
+			errTxt += " - TLS Version Too Old"
+		}
+		c.sendErr(errTxt)
 	}
 	c.closeConnection(AuthenticationViolation)
 }
@@ -2228,6 +2923,7 @@ func (c *client) processPing() {
 	// Record this to suppress us sending one if this
 	// is within a given time interval for activity.
 	c.lastIn = time.Now()
+	c.updateIdle(c.lastIn)
 
 	// If not a CLIENT, we are done. Also the CONNECT should
 	// have been received, but make sure it is so before proceeding
@@ -2475,6 +3171,12 @@ func (c *client) processSubEx(subject, queue, bsid []byte, cb msgHandler, noForw
 	// Create the subscription
 	sub := &subscription{client: c, subject: subject, queue: queue, sid: bsid, icb: cb, si: si, rsi: rsi}
 
+	// The policy module is consulted without holding the lock.
+	if c.kind == CLIENT && c.policy != nil && !c.policyAllows(PolicySubscribe, string(subject)) {
+		c.subPermissionViolation(sub)
+		return nil, ErrSubscribePermissionViolation
+	}
+
 	c.mu.Lock()
 
 	// Indicate activity.
@@ -2752,12 +3454,40 @@ func (c *client) addShadowSub(sub *subscription, ime *ime) (*subscription, error
 }
 
 // canSubscribe determines if the client is authorized to subscribe to the
-// given subject. Assumes caller is holding lock.
+// given subject. The policy module, if any, is consulted last for leafnodes.
+// Clients consult it in processSubEx, before taking the lock.
+// Assumes caller is holding lock.
 func (c *client) canSubscribe(subject string, optQueue ...string) bool {
+	if !c.canSubscribePerms(subject, optQueue...) {
+		return false
+	}
+	if c.policy != nil && c.kind == LEAF {
+		return c.policyAllowsLocked(PolicySubscribe, subject)
+	}
+	return true
+}
+
+// canSubscribePerms determines if the client permissions allow it to
+// subscribe to the given subject.
+// Assumes caller is holding lock.
+func (c *client) canSubscribePerms(subject string, optQueue ...string) bool {
+	// Absolutely denied subjects override any permission, messages on them
+	// are also filtered out for overlapping wildcard subscriptions.
+	if c.absolutelyDenied(subject) {
+		return false
+	}
+	if c.namespace != _EMPTY_ && !subjectIsSubsetMatch(subject, c.namespace) {
+		return false
+	}
 	if c.perms == nil {
 		return true
 	}
 
+	// Reject subscriptions that would fan-out too broadly.
+	if c.perms.maxWildcards > 0 && tooManyWildcards(subject, c.perms.maxWildcards) {
+		return false
+	}
+
 	allowed := true
 
 	// Optional queue group.
@@ -2766,6 +3496,15 @@ func (c *client) canSubscribe(subject string, optQueue ...string) bool {
 		queue = optQueue[0]
 	}
 
+	// Plain subscriptions must not receive messages from queue only subjects.
+	if queue == _EMPTY_ {
+		for _, qr := range c.perms.queueRequired {
+			if SubjectsCollide(subject, qr) {
+				return false
+			}
+		}
+	}
+
 	// Check allow list. If no allow list that means all are allowed. Deny can overrule.
 	if c.perms.sub.allow != nil {
 		r := c.perms.sub.allow.Match(subject)
@@ -2774,17 +3513,23 @@ func (c *client) canSubscribe(subject string, optQueue ...string) bool {
 			// If the queue appears in the allow list, then DO allow.
 			allowed = queueMatches(queue, r.qsubs)
 		}
+		if !allowed {
+			allowed = c.perms.sub.allowsExact(subject) || len(matchPsubs(c.perms.sub.allowTrie, subject)) != 0
+		}
 		// Leafnodes operate slightly differently in that they allow broader scoped subjects.
 		// They will prune based on publish perms before sending to a leafnode client.
 		if !allowed && c.kind == LEAF && subjectHasWildcard(subject) {
 			r := c.perms.sub.allow.ReverseMatch(subject)
 			allowed = len(r.psubs) != 0
+			if !allowed && c.perms.sub.allowTrie != nil {
+				allowed = len(c.perms.sub.allowTrie.ReverseMatch(subject).psubs) != 0
+			}
 		}
 	}
 	// If we have a deny list and we think we are allowed, check that as well.
 	if allowed && c.perms.sub.deny != nil {
 		r := c.perms.sub.deny.Match(subject)
-		allowed = len(r.psubs) == 0
+		allowed = !c.perms.sub.denies(subject, r.psubs) && !c.perms.sub.denies(subject, matchPsubs(c.perms.sub.denyTrie, subject))
 
 		if queue != _EMPTY_ && len(r.qsubs) > 0 {
 			// If the queue appears in the deny list, then DO NOT allow.
@@ -2792,22 +3537,92 @@ func (c *client) canSubscribe(subject string, optQueue ...string) bool {
 		}
 
 		// We use the actual subscription to signal us to spin up the deny mperms
-		// and cache. We check if the subject is a wildcard that contains any of
-		// the deny clauses.
+		// and cache. We check if the subject is a wildcard that overlaps any of the deny clauses.
 		// FIXME(dlc) - We could be smarter and track when these go away and remove.
 		if allowed && c.mperms == nil && subjectHasWildcard(subject) {
 			// Whip through the deny array and check if this wildcard subject is within scope.
 			for _, sub := range c.darray {
-				if subjectIsSubsetMatch(sub, subject) {
+				if SubjectsCollide(c.perms.sub.deliveryDeny(sub), subject) {
 					c.loadMsgDenyFilter()
 					break
 				}
 			}
+			// Same with the subjects denied by a prefix tree.
+			if c.mperms == nil && c.perms.sub.denyTrie != nil {
+				if len(c.perms.sub.denyTrie.ReverseMatch(subject).psubs) != 0 || len(matchPsubs(c.perms.sub.denyTrie, subject)) != 0 {
+					c.loadMsgDenyFilter()
+				}
+			}
 		}
 	}
 	return allowed
 }
 
+// denies returns true if one of the deny clauses matched by the subject
+// applies to it.
+func (p *perm) denies(subject string, matched []*subscription) bool {
+	for _, sub := range matched {
+		if deny := string(sub.subject); !p.deniesOnlyDeeper(deny) || beyondDepth(subject, deny) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniesOnlyDeeper returns true if the deny clause is a full wildcard, such
+// as "foo.>", and the partial wildcard at the same depth, "foo.*", is
+// explicitly allowed. Such a deny only protects the deeper subjects and the
+// full wildcard subscriptions, so "foo.*" and "foo.bar" remain allowed.
+func (p *perm) deniesOnlyDeeper(deny string) bool {
+	if (p.allow == nil && p.allowTrie == nil) || !endsWithToken(deny, fwcs) {
+		return false
+	}
+	partial := deny[:len(deny)-len(fwcs)] + pwcs
+	for _, sl := range []*Sublist{p.allow, p.allowTrie} {
+		for _, sub := range matchPsubs(sl, partial) {
+			if string(sub.subject) == partial {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deliveryDeny returns the subjects the deny clause filters out of the
+// messages delivered to wildcard subscriptions. This is "foo.*.>" for a
+// "foo.>" deny that only protects the deeper subjects.
+func (p *perm) deliveryDeny(deny string) string {
+	if p.deniesOnlyDeeper(deny) {
+		return deny[:len(deny)-len(fwcs)] + pwcs + tsep + fwcs
+	}
+	return deny
+}
+
+// beyondDepth returns true if the subscription subject is a full wildcard or
+// is deeper than the full wildcard deny clause it matched.
+func beyondDepth(subject, deny string) bool {
+	return endsWithToken(subject, fwcs) || numTokens(subject) > numTokens(deny)
+}
+
+// endsWithToken returns true if the last token of the subject is the given one.
+func endsWithToken(subject, token string) bool {
+	return subject == token || strings.HasSuffix(subject, tsep+token)
+}
+
+// tooManyWildcards returns true if the subject has more than max wildcard
+// tokens, or if it is made only of wildcard tokens.
+func tooManyWildcards(subject string, max int) bool {
+	var wildcards, literals int
+	for _, t := range strings.Split(subject, tsep) {
+		if len(t) == 1 && (t[0] == pwc || t[0] == fwc) {
+			wildcards++
+		} else {
+			literals++
+		}
+	}
+	return wildcards > max || literals == 0
+}
+
 func queueMatches(queue string, qsubs [][]*subscription) bool {
 	if len(qsubs) == 0 {
 		return true
@@ -2958,7 +3773,7 @@ func (c *client) processUnsub(arg []byte) error {
 func (c *client) checkDenySub(subject string) bool {
 	if denied, ok := c.mperms.dcache[subject]; ok {
 		return denied
-	} else if r := c.mperms.deny.Match(subject); len(r.psubs) != 0 {
+	} else if r := c.mperms.deny.Match(subject); len(r.psubs) != 0 || c.trieDeniesDelivery(subject) {
 		c.mperms.dcache[subject] = true
 		return true
 	} else {
@@ -2970,6 +3785,16 @@ func (c *client) checkDenySub(subject string) bool {
 	return false
 }
 
+// trieDeniesDelivery returns true if the subject is denied by the subjects
+// loaded from a subscribe deny prefix tree.
+// Lock should be held.
+func (c *client) trieDeniesDelivery(subject string) bool {
+	if c.perms == nil || c.perms.sub.denyTrie == nil {
+		return false
+	}
+	return c.perms.sub.denies(subject, matchPsubs(c.perms.sub.denyTrie, subject))
+}
+
 // Create a message header for routes or leafnodes. Header and origin cluster aware.
 func (c *client) msgHeaderForRouteOrLeaf(subj, reply []byte, rt *routeTarget, acc *Account) []byte {
 	hasHeader := c.pa.hdr > 0
@@ -3134,6 +3959,13 @@ func (c *client) deliverMsg(prodIsMQTT bool, sub *subscription, acc *Account, su
 	}
 
 	client := sub.client
+
+	// The policy module of leafnodes is consulted without holding the lock.
+	if client.kind == LEAF && client.policy != nil && !client.policyAllows(PolicyPublish, string(subject)) {
+		client.Debugf("Not permitted to deliver to %q", subject)
+		return false
+	}
+
 	client.mu.Lock()
 
 	// Check if we have a subscribe deny clause. This will trigger us to check the subject
@@ -3142,6 +3974,10 @@ func (c *client) deliverMsg(prodIsMQTT bool, sub *subscription, acc *Account, su
 		client.mu.Unlock()
 		return false
 	}
+	if sl := client.absoluteDenyList(); sl != nil && len(sl.Match(string(subject)).psubs) > 0 {
+		client.mu.Unlock()
+		return false
+	}
 
 	// New race detector forces this now.
 	if sub.isClosed() {
@@ -3158,6 +3994,18 @@ func (c *client) deliverMsg(prodIsMQTT bool, sub *subscription, acc *Account, su
 		}
 	}
 
+	// Check that the message has the header values the client is allowed to receive.
+	if client.perms != nil && len(client.perms.subHdrFilters) > 0 {
+		var hdr []byte
+		if c.pa.hdr > 0 {
+			hdr = msg[:c.pa.hdr]
+		}
+		if client.perms.headersFiltered(string(subject), hdr) {
+			client.mu.Unlock()
+			return false
+		}
+	}
+
 	srv := client.srv
 
 	sub.nm++
@@ -3432,6 +4280,95 @@ func (c *client) pruneDenyCache() {
 	}
 }
 
+// expirePermissionGrants removes the grants that have expired at time now
+// from the permissions. Returns true if any was removed, in which case the
+// subscriptions should be checked again.
+func (c *client) expirePermissionGrants(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perms == nil || len(c.perms.grants) == 0 {
+		return false
+	}
+	var expired bool
+	grants := c.perms.grants[:0]
+	for _, g := range c.perms.grants {
+		if now.Before(g.expires) {
+			grants = append(grants, g)
+			continue
+		}
+		g.sl.Remove(g.sub)
+		expired = true
+	}
+	c.perms.grants = grants
+	if expired {
+		// Previously allowed publish subjects may be cached.
+		c.clearPubPermsCache()
+	}
+	return expired
+}
+
+// setGroupSubjects replaces the allowed subjects resolved from the user's
+// group memberships with the given ones. Like grants, they are only added
+// to the allow lists the permissions have. Returns true if they changed,
+// in which case the subscriptions should be checked again.
+func (c *client) setGroupSubjects(subjects []string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perms == nil || (c.perms.pub.allow == nil && c.perms.sub.allow == nil) {
+		return false
+	}
+	if len(subjects) == len(c.perms.groupSubjs) {
+		same := true
+		for i, subj := range subjects {
+			if subj != c.perms.groupSubjs[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return false
+		}
+	}
+	for _, g := range c.perms.groups {
+		g.sl.Remove(g.sub)
+	}
+	c.perms.groups = nil
+	for _, subject := range subjects {
+		if c.perms.pub.allow != nil {
+			sub := &subscription{subject: []byte(subject)}
+			c.perms.pub.allow.Insert(sub)
+			c.perms.groups = append(c.perms.groups, &permGrant{sl: c.perms.pub.allow, sub: sub})
+		}
+		if c.perms.sub.allow != nil {
+			sub := &subscription{}
+			var err error
+			sub.subject, sub.queue, err = splitSubjectQueue(subject)
+			if err != nil {
+				c.Errorf("%s", err.Error())
+				continue
+			}
+			c.perms.sub.allow.Insert(sub)
+			c.perms.groups = append(c.perms.groups, &permGrant{sl: c.perms.sub.allow, sub: sub})
+		}
+	}
+	c.perms.groupSubjs = append([]string(nil), subjects...)
+	// Previously allowed publish subjects may be cached.
+	c.clearPubPermsCache()
+	return true
+}
+
+// clearPubPermsCache empties the publish permissions cache.
+// Lock should be held.
+func (c *client) clearPubPermsCache() {
+	r := 0
+	c.perms.pcache.Range(func(k, _ interface{}) bool {
+		c.perms.pcache.Delete(k)
+		r++
+		return true
+	})
+	atomic.AddInt32(&c.perms.pcsz, -int32(r))
+}
+
 // prunePubPermsCache will prune the cache via randomly
 // deleting items. Doing so pruneSize items at a time.
 func (c *client) prunePubPermsCache() {
@@ -3476,12 +4413,12 @@ func (c *client) pubAllowedFullCheck(subject string, fullCheck, hasLock bool) bo
 	// Cache miss, check allow then deny as needed.
 	if c.perms.pub.allow != nil {
 		r := c.perms.pub.allow.Match(subject)
-		allowed = len(r.psubs) != 0
+		allowed = len(r.psubs) != 0 || c.perms.pub.allowsExact(subject) || len(matchPsubs(c.perms.pub.allowTrie, subject)) != 0
 	}
 	// If we have a deny list and are currently allowed, check that as well.
 	if allowed && c.perms.pub.deny != nil {
 		r := c.perms.pub.deny.Match(subject)
-		allowed = len(r.psubs) == 0
+		allowed = len(r.psubs) == 0 && len(matchPsubs(c.perms.pub.denyTrie, subject)) == 0
 	}
 
 	// If we are currently not allowed but we are tracking reply subjects
@@ -3551,6 +4488,39 @@ func (c *client) processInboundMsg(msg []byte) {
 	}
 }
 
+// rewritePublishSubject returns the subject resulting from the first
+// publish rewrite matching the given subject, if any.
+// Lock should be held.
+func (c *client) rewritePublishSubject(subject string) (string, bool) {
+	for _, tr := range c.pubRewrites {
+		if subj, err := tr.Match(subject); err == nil {
+			return subj, true
+		}
+	}
+	return _EMPTY_, false
+}
+
+// pubPolicyAllows returns true if the policy module allows publishing the
+// current message, checking the subject it is rewritten to as well. The
+// denied subject is returned otherwise.
+// Lock should not be held.
+func (c *client) pubPolicyAllows() ([]byte, bool) {
+	if !c.policyAllows(PolicyPublish, string(c.pa.subject)) {
+		return c.pa.subject, false
+	}
+	var subj string
+	var rewritten bool
+	c.mu.Lock()
+	if len(c.pubRewrites) > 0 {
+		subj, rewritten = c.rewritePublishSubject(string(c.pa.subject))
+	}
+	c.mu.Unlock()
+	if rewritten && !c.policyAllows(PolicyPublish, subj) {
+		return []byte(subj), false
+	}
+	return nil, true
+}
+
 // selectMappedSubject will chose the mapped subject based on the client's inbound subject.
 func (c *client) selectMappedSubject() bool {
 	nsubj, changed := c.acc.selectMappedSubject(string(c.pa.subject))
@@ -3576,6 +4546,14 @@ func (c *client) processInboundClientMsg(msg []byte) (bool, bool) {
 		return false, true
 	}
 
+	// The policy module is consulted without holding the lock.
+	if c.policy != nil {
+		if subj, ok := c.pubPolicyAllows(); !ok {
+			c.pubPermissionViolation(subj)
+			return false, true
+		}
+	}
+
 	// Mostly under testing scenarios.
 	c.mu.Lock()
 	if c.srv == nil || c.acc == nil {
@@ -3586,18 +4564,100 @@ func (c *client) processInboundClientMsg(msg []byte) (bool, bool) {
 	genidAddr := &acc.sl.genid
 
 	// Check pub permissions
-	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) && !c.pubAllowedFullCheck(string(c.pa.subject), true, true) {
+	if !c.pubAllowedFullCheck(string(c.pa.subject), true, true) {
 		c.mu.Unlock()
 		c.pubPermissionViolation(c.pa.subject)
 		return false, true
 	}
-	c.mu.Unlock()
-
+	// Check that the subject is within the user's namespace
+	if c.namespace != _EMPTY_ && !subjectIsSubsetMatch(string(c.pa.subject), c.namespace) {
+		c.mu.Unlock()
+		c.pubPermissionViolation(c.pa.subject)
+		return false, true
+	}
+	// Check the server's publish ACL
+	var pacl *publishACL
+	if c.kind == CLIENT {
+		pacl = c.srv.publishACL()
+	}
+	if pacl != nil && !pacl.allowed(string(c.pa.subject), c.getAuthIdentity()) {
+		c.mu.Unlock()
+		c.pubPermissionViolation(c.pa.subject)
+		return false, true
+	}
+	// Absolutely denied subjects override any permission.
+	if sl := c.absoluteDenyList(); sl != nil && len(sl.Match(string(c.pa.subject)).psubs) > 0 {
+		c.mu.Unlock()
+		c.pubPermissionViolation(c.pa.subject)
+		return false, true
+	}
+	// Rewrite the subject if needed. The rewritten subject has to be allowed
+	// as well so that rewrites can't be used to bypass deny rules.
+	if len(c.pubRewrites) > 0 {
+		if subj, ok := c.rewritePublishSubject(string(c.pa.subject)); ok {
+			if !c.pubAllowedFullCheck(subj, true, true) ||
+				(c.namespace != _EMPTY_ && !subjectIsSubsetMatch(subj, c.namespace)) ||
+				(pacl != nil && !pacl.allowed(subj, c.getAuthIdentity())) ||
+				c.absolutelyDenied(subj) {
+				c.mu.Unlock()
+				c.pubPermissionViolation([]byte(subj))
+				return false, true
+			}
+			c.pa.subject = []byte(subj)
+		}
+	}
+	// Check required headers
+	if c.perms != nil && len(c.perms.reqHeaders) > 0 {
+		var hdr []byte
+		if c.pa.hdr > 0 {
+			hdr = msg[:c.pa.hdr]
+		}
+		if h := c.perms.missingRequiredHeader(string(c.pa.subject), hdr); h != _EMPTY_ {
+			c.mu.Unlock()
+			c.pubMissingHeader(c.pa.subject, h)
+			return false, true
+		}
+	}
+	// Check request only subjects
+	if c.perms != nil && len(c.perms.requestOnly) > 0 && len(c.pa.reply) == 0 &&
+		c.perms.replyRequired(string(c.pa.subject)) {
+		c.mu.Unlock()
+		c.pubReplyRequired(c.pa.subject)
+		return false, true
+	}
+	// Check the number of distinct subjects published to
+	if c.maxPubSubjs > 0 && !c.trackPublishSubject(c.pa.subject) {
+		c.mu.Unlock()
+		c.pubSubjectsExceeded(c.pa.subject)
+		return false, true
+	}
 	// Now check for reserved replies. These are used for service imports.
 	if c.kind == CLIENT && len(c.pa.reply) > 0 && isReservedReply(c.pa.reply) {
+		c.mu.Unlock()
 		c.replySubjectViolation(c.pa.reply)
 		return false, true
 	}
+	// Rates are checked last so that a message rejected for any other
+	// reason does not consume a token.
+	// Check the user's publish rate, its token is only taken once the
+	// message passed the publish rates of its subject as well.
+	if c.pubRate != nil && !c.pubRate.refill(time.Now()) {
+		c.mu.Unlock()
+		c.pubRateExceeded(c.pa.subject, false)
+		return false, true
+	}
+	// Check publish rates
+	if c.perms != nil && len(c.perms.pubRates) > 0 {
+		if rl := c.perms.pubRateExceeded(string(c.pa.subject)); rl != nil {
+			c.mu.Unlock()
+			c.pubRateExceeded(c.pa.subject, rl.Drop)
+			return false, true
+		}
+	}
+	if c.pubRate != nil {
+		c.pubRate.take()
+	}
+	c.mu.Unlock()
 
 	if c.opts.Verbose {
 		c.sendOK()
@@ -4547,33 +5607,133 @@ func (c *client) checkLeafClientInfoHeader(msg []byte) (dmsg []byte, setHdr bool
 	return dmsg, setHdr
 }
 
+// permViolationHint returns the deny message of the client's permissions
+// formatted to be appended to a permissions violation error, if any.
+// Lock should not be held.
+func (c *client) permViolationHint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perms == nil || c.perms.denyMsg == _EMPTY_ {
+		return _EMPTY_
+	}
+	return " - " + c.perms.denyMsg
+}
+
 func (c *client) pubPermissionViolation(subject []byte) {
-	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q", subject))
+	c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Publish to %q%s", subject, c.permViolationHint()))
 	c.Errorf("Publish Violation - %s, Subject %q", c.getAuthUser(), subject)
+	c.traceDenial(PolicyPublish, string(subject))
+}
+
+func (c *client) pubRateExceeded(subject []byte, drop bool) {
+	if !drop {
+		c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Publish to %q, Rate Exceeded", subject))
+	}
+	c.Debugf("Publish Rate Exceeded - %s, Subject %q", c.getAuthUser(), subject)
+}
+
+func (c *client) pubMissingHeader(subject []byte, header string) {
+	c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Publish to %q, Missing Header %q%s", subject, header, c.permViolationHint()))
+	c.Errorf("Publish Violation - %s, Subject %q, Missing Header %q", c.getAuthUser(), subject, header)
+}
+
+func (c *client) pubReplyRequired(subject []byte) {
+	c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Publish to %q, Reply Subject Required%s", subject, c.permViolationHint()))
+	c.Errorf("Publish Violation - %s, Subject %q, Reply Subject Required", c.getAuthUser(), subject)
+}
+
+func (c *client) pubSubjectsExceeded(subject []byte) {
+	c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Publish to %q, Maximum Publish Subjects Exceeded", subject))
+	c.Errorf("Publish Violation - %s, Subject %q, Maximum Publish Subjects %d Exceeded", c.getAuthUser(), subject, c.maxPubSubjs)
 }
 
 func (c *client) subPermissionViolation(sub *subscription) {
-	errTxt := fmt.Sprintf("Permissions Violation for Subscription to %q", sub.subject)
+	errTxt := fmt.Sprintf(PermissionsViolationErr+" for Subscription to %q", sub.subject)
 	logTxt := fmt.Sprintf("Subscription Violation - %s, Subject %q, SID %s",
 		c.getAuthUser(), sub.subject, sub.sid)
 
 	if sub.queue != nil {
-		errTxt = fmt.Sprintf("Permissions Violation for Subscription to %q using queue %q", sub.subject, sub.queue)
+		errTxt = fmt.Sprintf(PermissionsViolationErr+" for Subscription to %q using queue %q", sub.subject, sub.queue)
 		logTxt = fmt.Sprintf("Subscription Violation - %s, Subject %q, Queue: %q, SID %s",
 			c.getAuthUser(), sub.subject, sub.queue, sub.sid)
 	}
 
-	c.sendErr(errTxt)
+	c.sendErr(errTxt + c.permViolationHint())
 	c.Errorf(logTxt)
+	c.traceDenial(PolicySubscribe, string(sub.subject))
 }
 
 func (c *client) replySubjectViolation(reply []byte) {
-	c.sendErr(fmt.Sprintf("Permissions Violation for Publish with Reply of %q", reply))
+	c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Publish with Reply of %q%s", reply, c.permViolationHint()))
 	c.Errorf("Publish Violation - %s, Reply %q", c.getAuthUser(), reply)
+	c.traceDenial(PolicyPublish, string(reply))
+}
+
+// traceDenial logs why an operation of a user with TraceDenials set was
+// denied, at a level that does not require debug or trace logging.
+// Lock should not be held.
+func (c *client) traceDenial(op PolicyOp, subject string) {
+	c.mu.Lock()
+	if !c.traceDenials {
+		c.mu.Unlock()
+		return
+	}
+	reason := c.denialReason(op, subject)
+	user, acc := c.getAuthUser(), accForClient(c)
+	c.mu.Unlock()
+	c.Warnf("Denial Trace - %s, Account %q, %s on %q: %s", user, acc, op, subject, reason)
+}
+
+// denialReason returns which restriction denies the operation, checking
+// them in the order they are applied.
+// Lock should be held.
+func (c *client) denialReason(op PolicyOp, subject string) string {
+	var p *perm
+	if c.perms != nil {
+		if op == PolicyPublish {
+			p = &c.perms.pub
+		} else {
+			p = &c.perms.sub
+		}
+	}
+	if c.absolutelyDenied(subject) {
+		return "absolutely denied by the server"
+	}
+	if p != nil && p.deny != nil {
+		if r := p.deny.Match(subject); len(r.psubs)+len(r.qsubs) > 0 {
+			var rules []string
+			for _, sub := range r.psubs {
+				rules = append(rules, string(sub.subject))
+			}
+			for _, qsubs := range r.qsubs {
+				for _, sub := range qsubs {
+					rules = append(rules, string(sub.subject)+" "+string(sub.queue))
+				}
+			}
+			return fmt.Sprintf("matches deny rules %q", rules)
+		}
+	}
+	if p != nil && p.allow != nil {
+		if r := p.allow.Match(subject); len(r.psubs)+len(r.qsubs) == 0 {
+			return "no allow rule matches"
+		}
+	}
+	if c.namespace != _EMPTY_ && !subjectIsSubsetMatch(subject, c.namespace) {
+		return fmt.Sprintf("outside of namespace %q", strings.TrimSuffix(c.namespace, ".>"))
+	}
+	if op == PolicyPublish && c.kind == CLIENT && c.srv != nil {
+		if pacl := c.srv.publishACL(); pacl != nil && !pacl.allowed(subject, c.getAuthIdentity()) {
+			return "not an allowed publisher in the publish ACL"
+		}
+	}
+	if c.policy != nil {
+		return "denied by the policy module or other restrictions"
+	}
+	return "denied by other restrictions"
 }
 
 func (c *client) maxTokensViolation(sub *subscription) {
-	errTxt := fmt.Sprintf("Permissions Violation for Subscription to %q, too many tokens", sub.subject)
+	errTxt := fmt.Sprintf(PermissionsViolationErr+" for Subscription to %q, too many tokens", sub.subject)
 	logTxt := fmt.Sprintf("Subscription Violation Too Many Tokens - %s, Subject %q, SID %s",
 		c.getAuthUser(), sub.subject, sub.sid)
 	c.sendErr(errTxt)
@@ -4669,6 +5829,66 @@ func (c *client) clearTlsToTimer() {
 	c.tlsTo = nil
 }
 
+// idleTimer closes clients that have been idle for too long.
+type idleTimer struct {
+	timeout time.Duration
+	last    time.Time
+	tmr     *time.Timer
+}
+
+// setIdleTimeout starts enforcing the given idle timeout, replacing any
+// previous one. A zero timeout disables it. The last activity of a replaced
+// timeout is kept, so that authorizing the client again on reload does not
+// postpone its expiration.
+// Lock should be held
+func (c *client) setIdleTimeout(d time.Duration) {
+	last := time.Now()
+	if c.idle != nil {
+		last = c.idle.last
+	}
+	c.clearIdleTimer()
+	if d <= 0 {
+		return
+	}
+	c.idle = &idleTimer{timeout: d, last: last}
+	c.idle.tmr = time.AfterFunc(time.Until(last.Add(d)), c.checkIdle)
+}
+
+// Lock should be held
+func (c *client) clearIdleTimer() {
+	if c.idle == nil {
+		return
+	}
+	c.idle.tmr.Stop()
+	c.idle = nil
+}
+
+// updateIdle records activity from the client.
+// Lock should be held
+func (c *client) updateIdle(now time.Time) {
+	if c.idle != nil {
+		c.idle.last = now
+	}
+}
+
+// checkIdle closes the connection if there was no activity for the idle
+// timeout, otherwise it is checked again when it could expire.
+func (c *client) checkIdle() {
+	c.mu.Lock()
+	if c.idle == nil || c.isClosed() {
+		c.mu.Unlock()
+		return
+	}
+	if remaining := c.idle.timeout - time.Since(c.idle.last); remaining > 0 {
+		c.idle.tmr.Reset(remaining)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	c.sendErrAndDebug("Idle Timeout")
+	c.closeConnection(IdleTimeout)
+}
+
 // Lock should be held
 func (c *client) setAuthTimer(d time.Duration) {
 	c.atmr = time.AfterFunc(d, c.authTimeout)
@@ -4790,7 +6010,6 @@ func (c *client) processSubsOnConfigReload(awcsti map[string]struct{}) {
 		subs     = _subs[:0]
 		_removed [32]*subscription
 		removed  = _removed[:0]
-		srv      = c.srv
 	)
 	if checkAcc {
 		// We actually only want to check if stream imports have changed.
@@ -4801,6 +6020,8 @@ func (c *client) processSubsOnConfigReload(awcsti map[string]struct{}) {
 	// We will clear any mperms we have here. It will rebuild on the fly with canSubscribe,
 	// so we do that here as we collect them. We will check result down below.
 	c.mperms = nil
+	// The existing subscriptions of a drained client are kept until it is closed.
+	drained := c.drainTmr != nil
 	// Collect client's subs under the lock
 	for _, sub := range c.subs {
 		// Just checking to rebuild mperms under the lock, will collect removed though here.
@@ -4809,6 +6030,9 @@ func (c *client) processSubsOnConfigReload(awcsti map[string]struct{}) {
 		canQSub := sub.queue != nil && c.canSubscribe(string(sub.subject), string(sub.queue))
 
 		if !canSub && !canQSub {
+			if drained {
+				continue
+			}
 			removed = append(removed, sub)
 		} else if checkAcc {
 			subs = append(subs, sub)
@@ -4829,10 +6053,24 @@ func (c *client) processSubsOnConfigReload(awcsti map[string]struct{}) {
 	}
 
 	// Unsubscribe all that need to be removed and report back to client and logs.
+	c.removeUnauthorizedSubs(acc, removed)
+}
+
+// removeUnauthorizedSubs unsubscribes the given subscriptions, which are no
+// longer authorized, and reports it back to the client and logs.
+// Lock should not be held.
+func (c *client) removeUnauthorizedSubs(acc *Account, removed []*subscription) {
+	if len(removed) == 0 {
+		return
+	}
+	srv := c.srv
+	silent := srv.getOpts().SilentPermissionViolations
 	for _, sub := range removed {
 		c.unsubscribe(acc, sub, true, true)
-		c.sendErr(fmt.Sprintf("Permissions Violation for Subscription to %q (sid %q)",
-			sub.subject, sub.sid))
+		if !silent {
+			c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Subscription to %q (sid %q)%s",
+				sub.subject, sub.sid, c.permViolationHint()))
+		}
 		srv.Noticef("Removed sub %q (sid %q) for %s - not authorized",
 			sub.subject, sub.sid, c.getAuthUser())
 	}
@@ -4854,9 +6092,16 @@ func (c *client) closeConnection(reason ClosedState) {
 	// so don't set this to 1, instead bump the count.
 	c.rref++
 	c.flags.set(closeConnection)
+	// The next connection from the same host may use the nonce if no
+	// CONNECT was received.
+	if c.issuedNonce != nil {
+		c.issuedNonce.abandon()
+	}
 	c.clearAuthTimer()
 	c.clearPingTimer()
 	c.clearTlsToTimer()
+	c.clearIdleTimer()
+	c.clearDrainTimer()
 	c.markConnAsClosed(reason)
 
 	// Unblock anyone who is potentially stalled waiting on us.
@@ -5373,6 +6618,25 @@ func (c *client) getRawAuthUser() string {
 	}
 }
 
+// getAuthIdentity returns the identity the client authenticated with,
+// which unlike getRawAuthUser is never read from the unverified CONNECT
+// and never returns a token.
+// Lock should be held.
+func (c *client) getAuthIdentity() string {
+	return c.authedID
+}
+
+// getPresentedIdentity returns the identity the client presented in the
+// CONNECT, which is not verified, to report failed authentications. Like
+// getAuthIdentity it never returns a token.
+// Lock should be held.
+func (c *client) getPresentedIdentity() string {
+	if c.opts.Token != _EMPTY_ && c.opts.Nkey == _EMPTY_ && c.opts.Username == _EMPTY_ && c.opts.JWT == _EMPTY_ {
+		return _EMPTY_
+	}
+	return c.getRawAuthUser()
+}
+
 // getAuthUser returns the auth user for the client.
 // Lock should be held.
 func (c *client) getAuthUser() string {
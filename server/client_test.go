@@ -1039,6 +1039,176 @@ func TestQueueSubscribePermissions(t *testing.T) {
 	}
 }
 
+func TestSubscribeMaxWildcardTokens(t *testing.T) {
+	cases := []struct {
+		name    string
+		max     int
+		subject string
+		want    string
+	}{
+		{"no limit allows full wildcard", 0, ">", "+OK\r\n"},
+		{"full wildcard", 1, ">", "-ERR 'Permissions Violation for Subscription to \">\"'\r\n"},
+		{"only partial wildcards", 2, "*.*.*", "-ERR 'Permissions Violation for Subscription to \"*.*.*\"'\r\n"},
+		{"too many wildcards", 1, "foo.*.>", "-ERR 'Permissions Violation for Subscription to \"foo.*.>\"'\r\n"},
+		{"full wildcard with prefix", 1, "foo.>", "+OK\r\n"},
+		{"partial wildcards with prefix", 2, "foo.*.*", "+OK\r\n"},
+		{"literal subject", 1, "foo.bar", "+OK\r\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, client, r := setupClient()
+			defer client.close()
+
+			client.RegisterUser(&User{
+				Permissions: &Permissions{MaxWildcardTokens: c.max},
+			})
+			connect := []byte("CONNECT {\"verbose\":true}\r\n")
+			sub := []byte(fmt.Sprintf("SUB %s 1\r\n", c.subject))
+
+			go client.parseAndClose(append(connect, sub...))
+
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, r); err != nil {
+				t.Fatal(err)
+			}
+
+			// Extra OK is from the successful CONNECT.
+			want := "+OK\r\n" + c.want
+			if got := buf.String(); got != want {
+				t.Fatalf("Expected to receive %q, but instead received %q", want, got)
+			}
+		})
+	}
+}
+
+func TestSubscribeQueueRequiredPermissions(t *testing.T) {
+	cases := []struct {
+		name    string
+		subject string
+		queue   string
+		want    string
+	}{
+		{"queue subscribe on queue only subject", "jobs.new", "workers", "+OK\r\n"},
+		{"plain subscribe on queue only subject", "jobs.new", _EMPTY_, "-ERR 'Permissions Violation for Subscription to \"jobs.new\"'\r\n"},
+		{"plain wildcard subscribe overlapping queue only subject", "jobs.*", _EMPTY_, "-ERR 'Permissions Violation for Subscription to \"jobs.*\"'\r\n"},
+		{"plain subscribe on other subject", "events.new", _EMPTY_, "+OK\r\n"},
+		{"queue subscribe on other subject", "events.new", "workers", "+OK\r\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, client, r := setupClient()
+			defer client.close()
+
+			client.RegisterUser(&User{
+				Permissions: &Permissions{QueueRequired: []string{"jobs.>"}},
+			})
+			connect := []byte("CONNECT {\"verbose\":true}\r\n")
+			qsub := []byte(fmt.Sprintf("SUB %s %s 1\r\n", c.subject, c.queue))
+
+			go client.parseAndClose(append(connect, qsub...))
+
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, r); err != nil {
+				t.Fatal(err)
+			}
+
+			// Extra OK is from the successful CONNECT.
+			want := "+OK\r\n" + c.want
+			if got := buf.String(); got != want {
+				t.Fatalf("Expected to receive %q, but instead received %q", want, got)
+			}
+		})
+	}
+}
+
+func TestClientPublishRatePermissions(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		t.Run(fmt.Sprintf("drop=%v", drop), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Users = []*User{{
+				Username: "user",
+				Password: "pwd",
+				Permissions: &Permissions{
+					PublishRates: []*PublishRate{{Subject: "metrics.>", Rate: 10, Drop: drop}},
+					RequestOnly:  []string{"metrics.req"},
+				},
+			}}
+			s := RunServer(opts)
+			defer s.Shutdown()
+
+			url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+			errCh := make(chan error, 100)
+			nc := natsConnect(t, url, nats.UserInfo("user", "pwd"),
+				nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+					errCh <- err
+				}))
+			defer nc.Close()
+
+			sub := natsSubSync(t, nc, ">")
+			natsFlush(t, nc)
+
+			checkReceived := func(expected int) {
+				t.Helper()
+				for i := 0; i < expected; i++ {
+					natsNexMsg(t, sub, time.Second)
+				}
+				if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+					t.Fatalf("Unexpected message on %q", msg.Subject)
+				}
+			}
+
+			// A burst above the rate is throttled.
+			for i := 0; i < 15; i++ {
+				natsPub(t, nc, "metrics.cpu", []byte("hello"))
+			}
+			// Other subjects are not limited.
+			for i := 0; i < 15; i++ {
+				natsPub(t, nc, "events", []byte("hello"))
+			}
+			natsFlush(t, nc)
+			checkReceived(25)
+			if drop {
+				require_True(t, len(errCh) == 0)
+			} else {
+				require_True(t, len(errCh) == 5)
+				for i := 0; i < 5; i++ {
+					if err := <-errCh; !strings.Contains(err.Error(), "Rate Exceeded") {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+				}
+			}
+
+			// Let the bucket refill, then sustained traffic under the rate
+			// is not throttled, even when exceeding the burst size.
+			time.Sleep(time.Second)
+			for i := 0; i < 15; i++ {
+				natsPub(t, nc, "metrics.cpu", []byte("hello"))
+				natsFlush(t, nc)
+				time.Sleep(125 * time.Millisecond)
+			}
+			checkReceived(15)
+			require_True(t, len(errCh) == 0)
+
+			// Messages rejected for other reasons do not consume the rate.
+			time.Sleep(time.Second)
+			for i := 0; i < 10; i++ {
+				natsPub(t, nc, "metrics.req", []byte("hello"))
+			}
+			for i := 0; i < 10; i++ {
+				natsPub(t, nc, "metrics.cpu", []byte("hello"))
+			}
+			natsFlush(t, nc)
+			checkReceived(10)
+			for i := 0; i < 10; i++ {
+				if err := <-errCh; !strings.Contains(err.Error(), "Reply Subject Required") {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			require_True(t, len(errCh) == 0)
+		})
+	}
+}
+
 func TestClientPubWithQueueSubNoEcho(t *testing.T) {
 	opts := DefaultOptions()
 	s := RunServer(opts)
@@ -2516,3 +2686,1045 @@ func TestClientAuthRequiredNoAuthUser(t *testing.T) {
 		t.Fatalf("Expected AuthRequired to be false due to 'no_auth_user'")
 	}
 }
+
+func TestClientNilPermissionsMeanDeny(t *testing.T) {
+	for _, test := range []struct {
+		auth  string
+		deny  bool
+		setup func(o *Options)
+		creds nats.Option
+	}{
+		{"user", false, func(o *Options) { o.Users = []*User{{Username: "user", Password: "pwd"}} }, nats.UserInfo("user", "pwd")},
+		{"user", true, func(o *Options) { o.Users = []*User{{Username: "user", Password: "pwd"}} }, nats.UserInfo("user", "pwd")},
+		{"token", false, func(o *Options) { o.Authorization = "tok" }, nats.Token("tok")},
+		{"token", true, func(o *Options) { o.Authorization = "tok" }, nats.Token("tok")},
+		{"no auth", true, func(o *Options) {}, nats.Name("anonymous")},
+	} {
+		deny := test.deny
+		t.Run(fmt.Sprintf("%s deny=%v", test.auth, deny), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.NilPermissionsMeanDeny = deny
+			test.setup(opts)
+			s := RunServer(opts)
+			defer s.Shutdown()
+
+			errCh := make(chan error, 10)
+			nc := natsConnect(t, s.ClientURL(), test.creds,
+				nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+					errCh <- err
+				}))
+			defer nc.Close()
+
+			sub := natsSubSync(t, nc, "foo")
+			natsPub(t, nc, "foo", []byte("hello"))
+			natsFlush(t, nc)
+
+			if !deny {
+				natsNexMsg(t, sub, time.Second)
+				select {
+				case err := <-errCh:
+					t.Fatalf("Unexpected error: %v", err)
+				default:
+				}
+				return
+			}
+			for _, expected := range []string{"Subscription", "Publish"} {
+				select {
+				case err := <-errCh:
+					if !strings.Contains(err.Error(), "Permissions Violation for "+expected) {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Expected permissions violation for %s", expected)
+				}
+			}
+			if _, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+				t.Fatal("Expected no message")
+			}
+			if test.auth != "token" {
+				return
+			}
+			// Turning the option off on reload lifts the denial.
+			opts = opts.Clone()
+			opts.NilPermissionsMeanDeny = false
+			require_NoError(t, s.ReloadOptions(opts))
+			sub = natsSubSync(t, nc, "bar")
+			natsPub(t, nc, "bar", []byte("hello"))
+			natsNexMsg(t, sub, time.Second)
+		})
+	}
+}
+
+func TestClientProtectSystemSubjects(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ProtectSystemSubjects = true
+	opts.Users = []*User{
+		{
+			Username: "broad",
+			Password: "pwd",
+			Permissions: &Permissions{
+				Publish:   &SubjectPermission{Allow: []string{">"}},
+				Subscribe: &SubjectPermission{Allow: []string{">"}},
+			},
+		},
+		{
+			Username: "admin",
+			Password: "pwd",
+			Permissions: &Permissions{
+				Publish:   &SubjectPermission{Allow: []string{">", "$SYS.>"}},
+				Subscribe: &SubjectPermission{Allow: []string{">", "$SYS.>"}},
+			},
+		},
+		{
+			Username: "narrow",
+			Password: "pwd",
+			Permissions: &Permissions{
+				Publish:   &SubjectPermission{Allow: []string{">", "$SYS.REQ.USER.INFO"}},
+				Subscribe: &SubjectPermission{Allow: []string{">", "$SYS.REQ.USER.INFO"}},
+			},
+		},
+		{
+			Username: "info",
+			Password: "pwd",
+			Permissions: &Permissions{
+				Publish:   &SubjectPermission{Allow: []string{"app.>", "$SYS.REQ.USER.INFO"}},
+				Subscribe: &SubjectPermission{Allow: []string{"app.>", "$SYS.REQ.USER.INFO"}},
+			},
+		},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	errCh := make(chan error, 10)
+	broad := natsConnect(t, url, nats.UserInfo("broad", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer broad.Close()
+	admin := natsConnect(t, url, nats.UserInfo("admin", "pwd"))
+	defer admin.Close()
+
+	// The broad user is not allowed to subscribe to system subjects.
+	for _, subj := range []string{"$SYS.>", "$JS.API.INFO"} {
+		natsSubSync(t, broad, subj)
+		natsFlush(t, broad)
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "Permissions Violation for Subscription") {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected permissions violation for subscription to %q", subj)
+		}
+	}
+
+	// Nor publish on them.
+	natsPub(t, broad, "$SYS.foo", []byte("hello"))
+	natsFlush(t, broad)
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation for Publish") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected permissions violation for publish")
+	}
+
+	// The full wildcard subscription does not get system messages.
+	broadSub := natsSubSync(t, broad, ">")
+	natsFlush(t, broad)
+	adminSub := natsSubSync(t, admin, "$SYS.foo")
+	natsFlush(t, admin)
+	natsPub(t, admin, "$SYS.foo", []byte("sys"))
+	natsPub(t, admin, "foo", []byte("app"))
+	natsFlush(t, admin)
+
+	msg := natsNexMsg(t, broadSub, time.Second)
+	require_Equal(t, msg.Subject, "foo")
+	msg = natsNexMsg(t, adminSub, time.Second)
+	require_Equal(t, string(msg.Data), "sys")
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+
+	// A narrow grant alongside ">" does not lift the protection.
+	nc := natsConnect(t, url, nats.UserInfo("narrow", "pwd"))
+	defer nc.Close()
+	nc2 := natsConnect(t, url, nats.UserInfo("info", "pwd"))
+	defer nc2.Close()
+	var narrow, info *client
+	s.mu.RLock()
+	for _, c := range s.clients {
+		switch c.getRawAuthUserLock() {
+		case "narrow":
+			narrow = c
+		case "info":
+			info = c
+		}
+	}
+	s.mu.RUnlock()
+	require_True(t, narrow != nil && info != nil)
+	canSubscribe := func(c *client, subj string) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.canSubscribe(subj)
+	}
+	for _, subj := range []string{"$SYS.ACCOUNT.foo.CONNECT", "$SYS.REQ.USER.INFO", "$JS.API.INFO"} {
+		require_False(t, canSubscribe(narrow, subj))
+		require_False(t, narrow.pubAllowed(subj))
+	}
+	require_True(t, canSubscribe(narrow, "foo"))
+
+	// Without a broader clause, grants within the namespace apply.
+	require_True(t, canSubscribe(info, "$SYS.REQ.USER.INFO"))
+	require_True(t, info.pubAllowed("$SYS.REQ.USER.INFO"))
+	require_False(t, canSubscribe(info, "$SYS.ACCOUNT.foo.CONNECT"))
+}
+
+func TestClientPermissionsAllowOwnInbox(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{
+		{
+			Username: "rr",
+			Password: "pwd",
+			Permissions: &Permissions{
+				Publish:       &SubjectPermission{Allow: []string{"svc.>"}},
+				AllowOwnInbox: true,
+			},
+		},
+		{Username: "svc", Password: "pwd"},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	svc := natsConnect(t, url, nats.UserInfo("svc", "pwd"))
+	defer svc.Close()
+	natsSub(t, svc, "svc.echo", func(m *nats.Msg) { m.Respond(m.Data) })
+	natsFlush(t, svc)
+
+	errCh := make(chan error, 10)
+	nc := natsConnect(t, url, nats.UserInfo("rr", "pwd"), nats.CustomInboxPrefix("_INBOX.rr"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+
+	resp, err := nc.Request("svc.echo", []byte("hello"), time.Second)
+	require_NoError(t, err)
+	require_Equal(t, string(resp.Data), "hello")
+
+	for _, subj := range []string{"foo", "_INBOX.other.foo", "_INBOX.>"} {
+		natsSubSync(t, nc, subj)
+		natsFlush(t, nc)
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "Permissions Violation for Subscription") {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected permissions violation for subscription to %q", subj)
+		}
+	}
+}
+
+func TestClientPermissionsDenyMessage(t *testing.T) {
+	cases := []struct {
+		name string
+		op   string
+		want string
+	}{
+		{"publish", "PUB foo 2\r\nok\r\n", "-ERR 'Permissions Violation for Publish to \"foo\" - contact #platform to request access'\r\n"},
+		{"subscribe", "SUB foo 1\r\n", "-ERR 'Permissions Violation for Subscription to \"foo\" - contact #platform to request access'\r\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, client, r := setupClient()
+			defer client.close()
+
+			client.RegisterUser(&User{
+				Permissions: &Permissions{
+					Publish:   &SubjectPermission{Deny: []string{"foo"}},
+					Subscribe: &SubjectPermission{Deny: []string{"foo"}},
+					// Line breaks must not end up in the protocol.
+					DenyMessage: "contact #platform\r\nto request access\n",
+				},
+			})
+			connect := []byte("CONNECT {\"verbose\":false}\r\n")
+
+			go client.parseAndClose(append(connect, c.op...))
+
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, r); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != c.want {
+				t.Fatalf("Expected to receive %q, but instead received %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestClientPermissionsDenyMessageConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: alice, password: pwd, deny_message: "contact #platform", permissions: {publish: {deny: "foo"}}}
+				{user: bob, password: pwd, deny_message: "contact #platform", permissions: {
+					publish: {deny: "foo"}, deny_message: "contact #billing"
+				}}
+			]
+		}
+	`))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	for user, hint := range map[string]string{"alice": "contact #platform", "bob": "contact #billing"} {
+		t.Run(user, func(t *testing.T) {
+			errCh := make(chan error, 1)
+			nc := natsConnect(t, s.ClientURL(), nats.UserInfo(user, "pwd"),
+				nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+					errCh <- err
+				}))
+			defer nc.Close()
+			natsPub(t, nc, "foo", []byte("denied"))
+			natsFlush(t, nc)
+			select {
+			case err := <-errCh:
+				require_Contains(t, err.Error(), `Permissions Violation for Publish to "foo" - `+hint)
+			case <-time.After(time.Second):
+				t.Fatal("Expected permissions violation")
+			}
+		})
+	}
+}
+
+func TestClientPublishRequiredHeaders(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: pub, password: pwd, permissions: {
+					required_headers: [{subject: "orders.>", header: "X-Tenant"}]
+				}}
+				{user: sub, password: pwd}
+			]
+		}
+	`))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sub := natsConnect(t, s.ClientURL(), nats.UserInfo("sub", "pwd"))
+	defer sub.Close()
+	ss := natsSubSync(t, sub, ">")
+	natsFlush(t, sub)
+
+	errCh := make(chan error, 10)
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+
+	// Without the header.
+	natsPub(t, nc, "orders.new", []byte("no header"))
+	natsFlush(t, nc)
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), `Permissions Violation for Publish to "orders.new", Missing Header "X-Tenant"`) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected permissions violation")
+	}
+
+	// With the header.
+	msg := nats.NewMsg("orders.new")
+	msg.Header.Set("X-Tenant", "acme")
+	msg.Data = []byte("with header")
+	require_NoError(t, nc.PublishMsg(msg))
+	// Other subjects do not require it.
+	natsPub(t, nc, "other", []byte("other"))
+	natsFlush(t, nc)
+
+	m := natsNexMsg(t, ss, time.Second)
+	require_Equal(t, string(m.Data), "with header")
+	require_Equal(t, m.Header.Get("X-Tenant"), "acme")
+	m = natsNexMsg(t, ss, time.Second)
+	require_Equal(t, string(m.Data), "other")
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestClientSubscribeHeaderFilters(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: pub, password: pwd}
+				{user: sub, password: pwd, permissions: {
+					subscribe_header_filters: [{subject: "orders.>", header: "X-Tenant", values: ["acme", "globex"]}]
+				}}
+			]
+		}
+	`))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sub := natsConnect(t, s.ClientURL(), nats.UserInfo("sub", "pwd"))
+	defer sub.Close()
+	ss := natsSubSync(t, sub, ">")
+	natsFlush(t, sub)
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"))
+	defer nc.Close()
+
+	publish := func(subject, tenant, data string) {
+		t.Helper()
+		msg := nats.NewMsg(subject)
+		if tenant != _EMPTY_ {
+			msg.Header.Set("X-Tenant", tenant)
+		}
+		msg.Data = []byte(data)
+		require_NoError(t, nc.PublishMsg(msg))
+	}
+	publish("orders.new", "acme", "1")
+	publish("orders.new", "initech", "2")
+	publish("orders.new", _EMPTY_, "3")
+	publish("orders.new", "globex", "4")
+	// Other subjects are not filtered.
+	publish("other", _EMPTY_, "5")
+	natsFlush(t, nc)
+
+	for _, want := range []string{"1", "4", "5"} {
+		m := natsNexMsg(t, ss, time.Second)
+		require_Equal(t, string(m.Data), want)
+	}
+	if m, err := ss.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected message %q", m.Data)
+	}
+}
+
+func TestClientPublishRequestOnly(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: pub, password: pwd, permissions: {request_only: ["svc.>"]}}
+				{user: sub, password: pwd}
+			]
+		}
+	`))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sub := natsConnect(t, s.ClientURL(), nats.UserInfo("sub", "pwd"))
+	defer sub.Close()
+	ss := natsSubSync(t, sub, ">")
+	natsFlush(t, sub)
+
+	errCh := make(chan error, 10)
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+
+	// Fire and forget.
+	natsPub(t, nc, "svc.echo", []byte("no reply"))
+	natsFlush(t, nc)
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), `Permissions Violation for Publish to "svc.echo", Reply Subject Required`) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected permissions violation")
+	}
+
+	// A request.
+	require_NoError(t, nc.PublishRequest("svc.echo", "reply", []byte("request")))
+	// Other subjects do not require a reply.
+	natsPub(t, nc, "other", []byte("other"))
+	natsFlush(t, nc)
+
+	m := natsNexMsg(t, ss, time.Second)
+	require_Equal(t, string(m.Data), "request")
+	require_Equal(t, m.Reply, "reply")
+	m = natsNexMsg(t, ss, time.Second)
+	require_Equal(t, string(m.Data), "other")
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestClientMaxPublishSubjects(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: pub, password: pwd, max_publish_subjects: 2}
+				{user: sub, password: pwd}
+			]
+		}
+	`))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sub := natsConnect(t, s.ClientURL(), nats.UserInfo("sub", "pwd"))
+	defer sub.Close()
+	ss := natsSubSync(t, sub, ">")
+	natsFlush(t, sub)
+
+	errCh := make(chan error, 10)
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+
+	natsPub(t, nc, "foo", []byte("1"))
+	natsPub(t, nc, "bar", []byte("2"))
+	// A third subject hits the cap.
+	natsPub(t, nc, "baz", []byte("3"))
+	natsFlush(t, nc)
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), `Permissions Violation for Publish to "baz", Maximum Publish Subjects Exceeded`) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected permissions violation")
+	}
+	// Subjects already published to still work.
+	natsPub(t, nc, "foo", []byte("4"))
+	natsPub(t, nc, "bar", []byte("5"))
+	natsFlush(t, nc)
+
+	for _, want := range []string{"1", "2", "4", "5"} {
+		m := natsNexMsg(t, ss, time.Second)
+		require_Equal(t, string(m.Data), want)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+
+	// The cap applies per connection.
+	nc2 := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"))
+	defer nc2.Close()
+	natsPub(t, nc2, "baz", []byte("6"))
+	natsFlush(t, nc2)
+	m := natsNexMsg(t, ss, time.Second)
+	require_Equal(t, string(m.Data), "6")
+}
+
+func TestClientPublishRatesOverlapping(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{{
+		Username: "user",
+		Password: "pwd",
+		Permissions: &Permissions{
+			PublishRates: []*PublishRate{
+				{Subject: "metrics.>", Rate: 10, Drop: true},
+				{Subject: "metrics.cpu", Rate: 2, Drop: true},
+			},
+		},
+	}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("user", "pwd"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, ">")
+	natsFlush(t, nc)
+
+	// Messages rejected by the narrower rate do not consume the tokens
+	// of the wider one.
+	for i := 0; i < 10; i++ {
+		natsPub(t, nc, "metrics.cpu", []byte("hello"))
+	}
+	for i := 0; i < 10; i++ {
+		natsPub(t, nc, "metrics.mem", []byte("hello"))
+	}
+	natsFlush(t, nc)
+	counts := map[string]int{}
+	for {
+		msg, err := sub.NextMsg(100 * time.Millisecond)
+		if err != nil {
+			break
+		}
+		counts[msg.Subject]++
+	}
+	require_Equal(t, counts["metrics.cpu"], 2)
+	require_Equal(t, counts["metrics.mem"], 8)
+}
+
+func TestClientUserMaxPublishRate(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: pub, password: pwd, max_publish_rate: 10}
+				{user: sub, password: pwd}
+			]
+		}
+	`))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sub := natsConnect(t, s.ClientURL(), nats.UserInfo("sub", "pwd"))
+	defer sub.Close()
+	ss := natsSubSync(t, sub, ">")
+	natsFlush(t, sub)
+
+	errCh := make(chan error, 100)
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+
+	checkReceived := func(expected int) {
+		t.Helper()
+		for i := 0; i < expected; i++ {
+			natsNexMsg(t, ss, time.Second)
+		}
+		if msg, err := ss.NextMsg(100 * time.Millisecond); err == nil {
+			t.Fatalf("Unexpected message on %q", msg.Subject)
+		}
+	}
+
+	// A burst above the rate is throttled, whatever the subjects.
+	for i := 0; i < 15; i++ {
+		natsPub(t, nc, fmt.Sprintf("foo.%d", i), []byte("hello"))
+	}
+	natsFlush(t, nc)
+	checkReceived(10)
+	require_True(t, len(errCh) == 5)
+	for i := 0; i < 5; i++ {
+		if err := <-errCh; !strings.Contains(err.Error(), "Rate Exceeded") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Sustained traffic under the rate is not throttled.
+	time.Sleep(time.Second)
+	for i := 0; i < 15; i++ {
+		natsPub(t, nc, fmt.Sprintf("bar.%d", i), []byte("hello"))
+		natsFlush(t, nc)
+		time.Sleep(125 * time.Millisecond)
+	}
+	checkReceived(15)
+	require_True(t, len(errCh) == 0)
+}
+
+func TestClientUserMaxPublishRateWithPublishRates(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: pub, password: pwd, max_publish_rate: 10,
+					permissions: {publish_rates: [{subject: "metrics.cpu", rate: 2, drop: true}]}}
+				{user: sub, password: pwd}
+			]
+		}
+	`))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sub := natsConnect(t, s.ClientURL(), nats.UserInfo("sub", "pwd"))
+	defer sub.Close()
+	ss := natsSubSync(t, sub, ">")
+	natsFlush(t, sub)
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, _ error) {}))
+	defer nc.Close()
+
+	// Messages rejected by the rate of their subject do not count against
+	// the user's rate.
+	for i := 0; i < 10; i++ {
+		natsPub(t, nc, "metrics.cpu", []byte("hello"))
+	}
+	for i := 0; i < 10; i++ {
+		natsPub(t, nc, "events", []byte("hello"))
+	}
+	natsFlush(t, nc)
+	counts := map[string]int{}
+	for {
+		msg, err := ss.NextMsg(100 * time.Millisecond)
+		if err != nil {
+			break
+		}
+		counts[msg.Subject]++
+	}
+	require_Equal(t, counts["metrics.cpu"], 2)
+	require_Equal(t, counts["events"], 8)
+}
+
+func TestClientErrorCategories(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{{
+		Username:    "alice",
+		Password:    "pwd",
+		Permissions: &Permissions{Subscribe: &SubjectPermission{Allow: []string{"foo"}}},
+	}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	expectLine := func(cr *bufio.Reader, prefix string) {
+		t.Helper()
+		l, err := cr.ReadString('\n')
+		require_NoError(t, err)
+		if !strings.HasPrefix(l, prefix) {
+			t.Fatalf("Expected %q, got %q", prefix, l)
+		}
+	}
+
+	// Failing to authenticate closes the connection.
+	c, cr, _ := newClientForServer(s)
+	defer c.close()
+	c.parseAsync("CONNECT {\"verbose\":false,\"user\":\"alice\",\"pass\":\"wrong\"}\r\nPING\r\n")
+	expectLine(cr, "-ERR '"+AuthenticationViolationErr+"'")
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		c.mu.Lock()
+		closed := c.isClosed()
+		c.mu.Unlock()
+		if !closed {
+			return fmt.Errorf("connection not closed")
+		}
+		return nil
+	})
+
+	// Being denied an operation keeps it open.
+	c, cr, _ = newClientForServer(s)
+	defer c.close()
+	c.parseAsync("CONNECT {\"verbose\":false,\"user\":\"alice\",\"pass\":\"pwd\"}\r\nSUB bar 1\r\nPING\r\n")
+	expectLine(cr, "-ERR '"+PermissionsViolationErr+" for Subscription to \"bar\"'")
+	expectLine(cr, "PONG")
+
+	// Including when removing subscriptions that are no longer authorized.
+	c.parseAsync("SUB foo 2\r\nPING\r\n")
+	expectLine(cr, "PONG")
+	require_Equal(t, s.RevokeSubject("alice", "foo"), 1)
+	expectLine(cr, "-ERR '"+PermissionsViolationErr+" for Subscription to \"foo\" (sid \"2\")'")
+	c.parseAsync("PING\r\n")
+	expectLine(cr, "PONG")
+}
+
+func TestClientPermissionsTagTemplates(t *testing.T) {
+	perms := &Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"*.{{tag:team}}.>"}},
+		Subscribe: &SubjectPermission{Allow: []string{"*.{{ tag:team }}.>", "public"}},
+	}
+	cases := []struct {
+		name string
+		tags map[string]string
+		op   string
+		want string
+	}{
+		{"publish on own subject", map[string]string{"team": "blue"}, "PUB orders.blue.new 2\r\nok\r\n", "+OK\r\n"},
+		{"publish on other subject", map[string]string{"team": "blue"}, "PUB orders.red.new 2\r\nok\r\n", "-ERR 'Permissions Violation for Publish to \"orders.red.new\"'\r\n"},
+		{"subscribe on own subject", map[string]string{"team": "blue"}, "SUB orders.blue.> 1\r\n", "+OK\r\n"},
+		{"subscribe on other subject", map[string]string{"team": "blue"}, "SUB orders.red.> 1\r\n", "-ERR 'Permissions Violation for Subscription to \"orders.red.>\"'\r\n"},
+		{"missing tag publish", nil, "PUB orders.blue.new 2\r\nok\r\n", "-ERR 'Permissions Violation for Publish to \"orders.blue.new\"'\r\n"},
+		{"missing tag subscribe", map[string]string{"other": "blue"}, "SUB public 1\r\n", "-ERR 'Permissions Violation for Subscription to \"public\"'\r\n"},
+		{"invalid tag value", map[string]string{"team": "*"}, "PUB orders.red.new 2\r\nok\r\n", "-ERR 'Permissions Violation for Publish to \"orders.red.new\"'\r\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, client, r := setupClient()
+			defer client.close()
+
+			client.RegisterUser(&User{Permissions: perms, Tags: c.tags})
+			connect := []byte("CONNECT {\"verbose\":true}\r\n")
+
+			go client.parseAndClose(append(connect, c.op...))
+
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, r); err != nil {
+				t.Fatal(err)
+			}
+			// Extra OK is from the successful CONNECT.
+			want := "+OK\r\n" + c.want
+			if got := buf.String(); got != want {
+				t.Fatalf("Expected to receive %q, but instead received %q", want, got)
+			}
+		})
+	}
+	// The user permissions are not modified.
+	require_Equal(t, perms.Publish.Allow[0], "*.{{tag:team}}.>")
+}
+
+func TestClientUserIdleTimeout(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{
+		{Username: "idle", Password: "pwd", IdleTimeout: 250 * time.Millisecond},
+		{Username: "nolimit", Password: "pwd"},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 1)
+	idle := natsConnect(t, s.ClientURL(), nats.UserInfo("idle", "pwd"), nats.NoReconnect(),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			errCh <- nc.LastError()
+		}))
+	defer idle.Close()
+	active := natsConnect(t, s.ClientURL(), nats.UserInfo("idle", "pwd"), nats.NoReconnect())
+	defer active.Close()
+	other := natsConnect(t, s.ClientURL(), nats.UserInfo("nolimit", "pwd"), nats.NoReconnect())
+	defer other.Close()
+
+	// Keep one connection active with publishes and pings.
+	deadline := time.Now().Add(750 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		natsPub(t, active, "foo", []byte("hello"))
+		time.Sleep(50 * time.Millisecond)
+		natsFlush(t, active)
+	}
+
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "Idle Timeout") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected idle connection to be closed")
+	}
+	require_False(t, active.IsClosed())
+	require_False(t, other.IsClosed())
+
+	conns, err := s.Connz(&ConnzOptions{State: ConnClosed})
+	require_NoError(t, err)
+	require_Len(t, len(conns.Conns), 1)
+	require_Equal(t, conns.Conns[0].Reason, IdleTimeout.String())
+}
+
+func TestClientUserIdleTimeoutReload(t *testing.T) {
+	template := `
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: idle, password: pwd, idle_timeout: "500ms"}
+				{user: other, password: %q}
+			]
+		}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, "pwd0")))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 1)
+	idle := natsConnect(t, s.ClientURL(), nats.UserInfo("idle", "pwd"), nats.NoReconnect(),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			errCh <- nc.LastError()
+		}))
+	defer idle.Close()
+
+	// Reloads authorize the client again, which is not an activity.
+	for i := 1; i <= 10; i++ {
+		changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(template, fmt.Sprintf("pwd%d", i))))
+		require_NoError(t, s.Reload())
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case err := <-errCh:
+			if err == nil || !strings.Contains(err.Error(), "Idle Timeout") {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			return
+		default:
+		}
+	}
+	t.Fatal("Expected idle connection to be closed")
+}
+
+func TestClientSubscribeDenyFullWildcardDepth(t *testing.T) {
+	c := &client{kind: CLIENT}
+	c.setPermissions(&Permissions{
+		Subscribe: &SubjectPermission{
+			Allow: []string{"foo.*", "foo.>", "bar.>"},
+			Deny:  []string{"foo.>", "bar.baz.>"},
+		},
+	})
+	for _, test := range []struct {
+		subject string
+		allowed bool
+	}{
+		{"foo.*", true},
+		{"foo.>", false},
+		{"foo.bar", true},
+		{"foo.bar.*", false},
+		{"foo.bar.baz", false},
+		{"foo.*.*", false},
+		{"bar.*", true},
+		{"bar.baz.*", false},
+		{"bar.*.*", true},
+	} {
+		t.Run(test.subject, func(t *testing.T) {
+			if allowed := c.canSubscribe(test.subject); allowed != test.allowed {
+				t.Fatalf("Expected allowed to be %v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+
+	// Without an explicit allow at that depth the deny still applies.
+	c = &client{kind: CLIENT}
+	c.setPermissions(&Permissions{
+		Subscribe: &SubjectPermission{Allow: []string{">"}, Deny: []string{"secret.>"}},
+	})
+	if c.canSubscribe("secret.*") {
+		t.Fatal("Expected subscription to be denied")
+	}
+}
+
+func TestClientSubscribeDenyFullWildcardDepthDelivery(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{
+		{Username: "sub", Password: "pwd", Permissions: &Permissions{
+			Subscribe: &SubjectPermission{Allow: []string{"foo.*", "bar.>"}, Deny: []string{"foo.>", "bar.baz.>"}},
+		}},
+		{Username: "pub", Password: "pwd"},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("sub", "pwd"))
+	defer nc.Close()
+	fooSub := natsSubSync(t, nc, "foo.*")
+	barSub := natsSubSync(t, nc, "bar.*.*")
+	natsFlush(t, nc)
+
+	pc := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"))
+	defer pc.Close()
+	natsPub(t, pc, "foo.bar", []byte("allowed"))
+	natsPub(t, pc, "bar.baz.qux", []byte("denied"))
+	natsPub(t, pc, "bar.qux.baz", []byte("allowed"))
+	natsFlush(t, pc)
+
+	// The "foo.>" deny only protects the deeper subjects, so the partial
+	// wildcard subscription at the allowed depth receives its messages.
+	msg := natsNexMsg(t, fooSub, time.Second)
+	require_Equal(t, msg.Subject, "foo.bar")
+	// The "bar.baz.>" deny still filters the messages of the wildcard subscription.
+	msg = natsNexMsg(t, barSub, time.Second)
+	require_Equal(t, msg.Subject, "bar.qux.baz")
+	if msg, err := barSub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no message, got %q", msg.Subject)
+	}
+
+	// A wildcard subscription crossing the depth does not receive the deeper subjects.
+	c := &client{kind: CLIENT}
+	c.setPermissions(&Permissions{
+		Subscribe: &SubjectPermission{Allow: []string{"foo.*", ">"}, Deny: []string{"foo.>"}},
+	})
+	if !c.canSubscribe("*.>") {
+		t.Fatal("Expected subscription to be allowed")
+	}
+	if c.mperms == nil {
+		t.Fatal("Expected the message deny filter to be loaded")
+	}
+	if c.checkDenySub("foo.bar") {
+		t.Fatal("Expected message at the allowed depth to be delivered")
+	}
+	if !c.checkDenySub("foo.bar.baz") {
+		t.Fatal("Expected deeper message to be filtered")
+	}
+}
+
+func TestClientExactSubjectPermissions(t *testing.T) {
+	c := &client{kind: CLIENT}
+	c.setPermissions(&Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"exact:foo.bar", "baz.*"}},
+		Subscribe: &SubjectPermission{Allow: []string{"exact:foo.bar", "baz.>"}},
+	})
+	for _, test := range []struct {
+		subject string
+		allowed bool
+	}{
+		{"foo.bar", true},
+		{"foo.baz", false},
+		{"foo.bar.x", false},
+		{"baz.x", true},
+	} {
+		t.Run("pub "+test.subject, func(t *testing.T) {
+			if allowed := c.pubAllowed(test.subject); allowed != test.allowed {
+				t.Fatalf("Expected allowed to be %v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+	for _, test := range []struct {
+		subject string
+		allowed bool
+	}{
+		{"foo.bar", true},
+		{"foo.baz", false},
+		{"foo.bar.x", false},
+		{"foo.*", false},
+		{"foo.>", false},
+		{"*.bar", false},
+		{"baz.x.y", true},
+	} {
+		t.Run("sub "+test.subject, func(t *testing.T) {
+			if allowed := c.canSubscribe(test.subject); allowed != test.allowed {
+				t.Fatalf("Expected allowed to be %v, got %v", test.allowed, allowed)
+			}
+		})
+	}
+	require_True(t, c.canSubscribe("foo.bar", "workers"))
+
+	// Exact subjects have to be literal, and are only for allow lists.
+	for _, test := range []struct {
+		name  string
+		perms string
+		err   string
+	}{
+		{"wildcard", `publish: {allow: "exact:foo.*"}`, `exact subject "foo.*" is not a valid literal subject`},
+		{"deny", `subscribe: {deny: "exact:foo.bar"}`, `deny subject "exact:foo.bar" can't be qualified`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				authorization {
+					users: [{user: alice, password: pwd, permissions: {%s}}]
+				}
+			`, test.perms)))
+			_, err := ProcessConfigFile(conf)
+			require_Error(t, err)
+			require_Contains(t, err.Error(), test.err)
+		})
+	}
+}
+
+func BenchmarkClientPubAllowed(b *testing.B) {
+	c := &client{}
+	c.setPermissions(&Permissions{
+		Publish: &SubjectPermission{
+			Allow: []string{"orders.*.created", "orders.*.updated", "metrics.>"},
+			Deny:  []string{"orders.internal.*", "metrics.debug.>"},
+		},
+	})
+	const subject = "orders.eu.created"
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.pubAllowed(subject)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.perms.pcache.Delete(subject)
+			atomic.AddInt32(&c.perms.pcsz, -1)
+			c.pubAllowed(subject)
+		}
+	})
+}
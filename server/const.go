@@ -64,6 +64,10 @@ const (
 	// 4k should be plenty since payloads sans connect/info string are separate.
 	MAX_CONTROL_LINE_SIZE = 4096
 
+	// MAX_CREDENTIAL_LEN is the default maximum length of any credential field
+	// (user, pass, auth_token, nkey or sig) sent in the CONNECT protocol.
+	MAX_CREDENTIAL_LEN = 4096
+
 	// MAX_PAYLOAD_SIZE is the maximum allowed payload size. Should be using
 	// something different if > 1MB payloads are needed.
 	MAX_PAYLOAD_SIZE = (1024 * 1024)
@@ -208,4 +212,22 @@ const (
 
 	// DEFAULT_FETCH_TIMEOUT is the default time that the system will wait for an account fetch to return.
 	DEFAULT_ACCOUNT_FETCH_TIMEOUT = 1900 * time.Millisecond
+
+	// DEFAULT_USERS_URL_TIMEOUT is the default timeout when fetching users from the users URL.
+	DEFAULT_USERS_URL_TIMEOUT = 5 * time.Second
+
+	// DEFAULT_TOKEN_VALIDATOR_CACHE_TTL is the default time the results of the token validator are cached.
+	DEFAULT_TOKEN_VALIDATOR_CACHE_TTL = time.Minute
+
+	// DEFAULT_ADAPTIVE_AUTH_COOLDOWN is the default time the connection rate has to be normal to leave the strict authentication mode.
+	DEFAULT_ADAPTIVE_AUTH_COOLDOWN = 30 * time.Second
+
+	// DEFAULT_AUTH_HEALTH_CHECK_INTERVAL is the default interval between the health checks of the custom authentication backends.
+	DEFAULT_AUTH_HEALTH_CHECK_INTERVAL = 10 * time.Second
+
+	// DEFAULT_AUTH_HEALTH_CHECK_TIMEOUT is the time after which a health check of the custom authentication backends that has not completed is a failure, unless the interval is shorter.
+	DEFAULT_AUTH_HEALTH_CHECK_TIMEOUT = 5 * time.Second
+
+	// DEFAULT_GROUP_SUBJECTS_REFRESH_INTERVAL is the default interval at which the group subjects of the users are resolved again.
+	DEFAULT_GROUP_SUBJECTS_REFRESH_INTERVAL = 30 * time.Second
 )
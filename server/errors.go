@@ -60,6 +60,10 @@ var (
 	// connections.
 	ErrTooManyAccountConnections = errors.New("maximum account active connections exceeded")
 
+	// ErrTooManyUsers signals that adding a user would exceed the maximum
+	// number of users.
+	ErrTooManyUsers = errors.New("maximum users exceeded")
+
 	// ErrTooManySubs signals a client that the maximum number of subscriptions per connection
 	// has been reached.
 	ErrTooManySubs = errors.New("maximum subscriptions exceeded")
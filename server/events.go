@@ -59,6 +59,7 @@ const (
 	lameDuckEventSubj        = "$SYS.SERVER.%s.LAMEDUCK"
 	shutdownEventSubj        = "$SYS.SERVER.%s.SHUTDOWN"
 	authErrorEventSubj       = "$SYS.SERVER.%s.CLIENT.AUTH.ERR"
+	authEventSubj            = "$SYS.ACCOUNT.AUTH"
 	serverStatsSubj          = "$SYS.SERVER.%s.STATSZ"
 	serverDirectReqSubj      = "$SYS.REQ.SERVER.%s.%s"
 	serverPingReqSubj        = "$SYS.REQ.SERVER.PING.%s"
@@ -158,6 +159,20 @@ type DisconnectEventMsg struct {
 // DisconnectEventMsgType is the schema type for DisconnectEventMsg
 const DisconnectEventMsgType = "io.nats.server.advisory.v1.client_disconnect"
 
+// AuthEvent is sent when a client or leafnode connection has been
+// authenticated or rejected. It never includes any credential.
+type AuthEvent struct {
+	TypedEvent
+	Server     ServerInfo        `json:"server"`
+	Client     ClientInfo        `json:"client"`
+	Method     string            `json:"method"`
+	Authorized bool              `json:"authorized"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// AuthEventMsgType is the schema type for AuthEvent
+const AuthEventMsgType = "io.nats.server.advisory.v1.client_auth"
+
 // OCSPPeerRejectEventMsg is sent when a peer TLS handshake is ultimately rejected due to OCSP invalidation.
 // A "peer" can be an inbound client connection or a leaf connection to a remote server. Peer in event payload
 // is always the peer's (TLS) leaf cert, which may or may be the invalid cert (See also OCSPPeerChainlinkInvalidEventMsg)
@@ -2084,6 +2099,53 @@ func (s *Server) sendAuthErrorEvent(c *client) {
 	s.mu.Unlock()
 }
 
+// sendAuthEvent will send the result of the authentication of the
+// given client on the auth events subject when PublishAuthEvents is set.
+// Lock should not be held.
+func (s *Server) sendAuthEvent(c *client, method string, authorized bool) {
+	if !s.getOpts().PublishAuthEvents {
+		return
+	}
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	eid := s.nextEventID()
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	user := c.getAuthIdentity()
+	if !authorized {
+		user = c.getPresentedIdentity()
+	}
+	m := AuthEvent{
+		TypedEvent: TypedEvent{
+			Type: AuthEventMsgType,
+			ID:   eid,
+			Time: time.Now().UTC(),
+		},
+		Client: ClientInfo{
+			Start:      &c.start,
+			Host:       c.host,
+			ID:         c.cid,
+			Account:    accForClient(c),
+			User:       user,
+			Name:       c.opts.Name,
+			Lang:       c.opts.Lang,
+			Version:    c.opts.Version,
+			Kind:       c.kindString(),
+			ClientType: c.clientTypeString(),
+		},
+		Method:     method,
+		Authorized: authorized,
+		Tags:       copyTags(c.userTags),
+	}
+	c.mu.Unlock()
+
+	s.sendInternalMsgLocked(authEventSubj, _EMPTY_, &m.Server, &m)
+}
+
 // Internal message callback.
 // If the msg is needed past the callback it is required to be copied.
 // rmsg contains header and the message. use client.msgParts(rmsg) to split them apart
@@ -958,7 +958,7 @@ func (s *Server) createLeafNode(conn net.Conn, rURL *url.URL, remote *leafNodeCf
 	}
 	c.mu.Unlock()
 
-	var nonce [nonceLen]byte
+	var nonce []byte
 	var info *Info
 
 	// Grab this before the client lock below.
@@ -966,7 +966,7 @@ func (s *Server) createLeafNode(conn net.Conn, rURL *url.URL, remote *leafNodeCf
 		// Grab server variables
 		s.mu.Lock()
 		info = s.copyLeafNodeInfo()
-		s.generateNonce(nonce[:])
+		nonce = s.generateNonce()
 		s.mu.Unlock()
 	}
 
@@ -1001,8 +1001,7 @@ func (s *Server) createLeafNode(conn net.Conn, rURL *url.URL, remote *leafNodeCf
 	} else {
 		// Send our info to the other side.
 		// Remember the nonce we sent here for signatures, etc.
-		c.nonce = make([]byte, nonceLen)
-		copy(c.nonce, nonce[:])
+		c.nonce = nonce
 		info.Nonce = string(c.nonce)
 		info.CID = c.cid
 		b, _ := json.Marshal(info)
@@ -1450,9 +1449,13 @@ func (s *Server) removeLeafNodeConnection(c *client) {
 		c.leaf.tsubt.Stop()
 		c.leaf.tsubt = nil
 	}
+	userIPConn := c.userIPConn
 	c.mu.Unlock()
 	s.mu.Lock()
 	delete(s.leafs, cid)
+	if userIPConn != _EMPTY_ {
+		s.untrackUserIPConn(userIPConn)
+	}
 	s.mu.Unlock()
 	s.removeFromTempClients(cid)
 }
@@ -2027,6 +2030,25 @@ func (c *client) processLeafSub(argo []byte) (err error) {
 	}
 	sub.subject = args[0]
 
+	// Check permissions if applicable. (but exclude the $LDS, $GR and _GR_)
+	ldsPrefix := bytes.HasPrefix(sub.subject, []byte(leafNodeLoopDetectionSubjectPrefix))
+	checkPerms := true
+	if sub.subject[0] == '$' || sub.subject[0] == '_' {
+		if ldsPrefix ||
+			bytes.HasPrefix(sub.subject, []byte(oldGWReplyPrefix)) ||
+			bytes.HasPrefix(sub.subject, []byte(gwReplyPrefix)) {
+			checkPerms = false
+		}
+	}
+	literal := subjectIsLiteral(string(sub.subject))
+
+	// The policy module is consulted without holding the lock.
+	if checkPerms && literal && c.policy != nil && !c.policyAllows(PolicyPublish, string(sub.subject)) {
+		c.leafSubPermViolation(sub.subject)
+		c.Debugf(fmt.Sprintf(PermissionsViolationErr+" for Subscription to %q", sub.subject))
+		return nil
+	}
+
 	c.mu.Lock()
 	if c.isClosed() {
 		c.mu.Unlock()
@@ -2035,28 +2057,18 @@ func (c *client) processLeafSub(argo []byte) (err error) {
 
 	acc := c.acc
 	// Check if we have a loop.
-	ldsPrefix := bytes.HasPrefix(sub.subject, []byte(leafNodeLoopDetectionSubjectPrefix))
 	if ldsPrefix && string(sub.subject) == acc.getLDSubject() {
 		c.mu.Unlock()
 		c.handleLeafNodeLoop(true)
 		return nil
 	}
 
-	// Check permissions if applicable. (but exclude the $LDS, $GR and _GR_)
-	checkPerms := true
-	if sub.subject[0] == '$' || sub.subject[0] == '_' {
-		if ldsPrefix ||
-			bytes.HasPrefix(sub.subject, []byte(oldGWReplyPrefix)) ||
-			bytes.HasPrefix(sub.subject, []byte(gwReplyPrefix)) {
-			checkPerms = false
-		}
-	}
-
 	// If we are a hub check that we can publish to this subject.
-	if checkPerms && subjectIsLiteral(string(sub.subject)) && !c.pubAllowedFullCheck(string(sub.subject), true, true) {
+	if checkPerms && (c.absolutelyDenied(string(sub.subject)) ||
+		literal && !c.pubAllowedFullCheck(string(sub.subject), true, true)) {
 		c.mu.Unlock()
 		c.leafSubPermViolation(sub.subject)
-		c.Debugf(fmt.Sprintf("Permissions Violation for Subscription to %q", sub.subject))
+		c.Debugf(fmt.Sprintf(PermissionsViolationErr+" for Subscription to %q", sub.subject))
 		return nil
 	}
 
@@ -2351,6 +2363,12 @@ func (c *client) processInboundLeafMsg(msg []byte) {
 		return
 	}
 
+	// Absolutely denied subjects override any permission.
+	if c.absolutelyDenied(subject) {
+		c.Debugf("Dropping leafnode message on absolutely denied subject: %q", subject)
+		return
+	}
+
 	// Match the subscriptions. We will use our own L1 map if
 	// it's still valid, avoiding contention on the shared sublist.
 	var r *SublistResult
@@ -2430,10 +2448,10 @@ func (c *client) leafPermViolation(pub bool, subj []byte) {
 	c.setLeafConnectDelayIfSoliciting(leafNodeReconnectAfterPermViolation)
 	var action string
 	if pub {
-		c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q", subj))
+		c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Publish to %q", subj))
 		action = "Publish"
 	} else {
-		c.sendErr(fmt.Sprintf("Permissions Violation for Subscription to %q", subj))
+		c.sendErr(fmt.Sprintf(PermissionsViolationErr+" for Subscription to %q", subj))
 		action = "Subscription"
 	}
 	c.Errorf("%s Violation on %q - Check other side configuration", action, subj)
@@ -104,39 +104,40 @@ const (
 
 // ConnInfo has detailed information on a per connection basis.
 type ConnInfo struct {
-	Cid            uint64         `json:"cid"`
-	Kind           string         `json:"kind,omitempty"`
-	Type           string         `json:"type,omitempty"`
-	IP             string         `json:"ip"`
-	Port           int            `json:"port"`
-	Start          time.Time      `json:"start"`
-	LastActivity   time.Time      `json:"last_activity"`
-	Stop           *time.Time     `json:"stop,omitempty"`
-	Reason         string         `json:"reason,omitempty"`
-	RTT            string         `json:"rtt,omitempty"`
-	Uptime         string         `json:"uptime"`
-	Idle           string         `json:"idle"`
-	Pending        int            `json:"pending_bytes"`
-	InMsgs         int64          `json:"in_msgs"`
-	OutMsgs        int64          `json:"out_msgs"`
-	InBytes        int64          `json:"in_bytes"`
-	OutBytes       int64          `json:"out_bytes"`
-	NumSubs        uint32         `json:"subscriptions"`
-	Name           string         `json:"name,omitempty"`
-	Lang           string         `json:"lang,omitempty"`
-	Version        string         `json:"version,omitempty"`
-	TLSVersion     string         `json:"tls_version,omitempty"`
-	TLSCipher      string         `json:"tls_cipher_suite,omitempty"`
-	TLSPeerCerts   []*TLSPeerCert `json:"tls_peer_certs,omitempty"`
-	AuthorizedUser string         `json:"authorized_user,omitempty"`
-	Account        string         `json:"account,omitempty"`
-	Subs           []string       `json:"subscriptions_list,omitempty"`
-	SubsDetail     []SubDetail    `json:"subscriptions_list_detail,omitempty"`
-	JWT            string         `json:"jwt,omitempty"`
-	IssuerKey      string         `json:"issuer_key,omitempty"`
-	NameTag        string         `json:"name_tag,omitempty"`
-	Tags           jwt.TagList    `json:"tags,omitempty"`
-	MQTTClient     string         `json:"mqtt_client,omitempty"` // This is the MQTT client id
+	Cid            uint64            `json:"cid"`
+	Kind           string            `json:"kind,omitempty"`
+	Type           string            `json:"type,omitempty"`
+	IP             string            `json:"ip"`
+	Port           int               `json:"port"`
+	Start          time.Time         `json:"start"`
+	LastActivity   time.Time         `json:"last_activity"`
+	Stop           *time.Time        `json:"stop,omitempty"`
+	Reason         string            `json:"reason,omitempty"`
+	RTT            string            `json:"rtt,omitempty"`
+	Uptime         string            `json:"uptime"`
+	Idle           string            `json:"idle"`
+	Pending        int               `json:"pending_bytes"`
+	InMsgs         int64             `json:"in_msgs"`
+	OutMsgs        int64             `json:"out_msgs"`
+	InBytes        int64             `json:"in_bytes"`
+	OutBytes       int64             `json:"out_bytes"`
+	NumSubs        uint32            `json:"subscriptions"`
+	Name           string            `json:"name,omitempty"`
+	Lang           string            `json:"lang,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	TLSVersion     string            `json:"tls_version,omitempty"`
+	TLSCipher      string            `json:"tls_cipher_suite,omitempty"`
+	TLSPeerCerts   []*TLSPeerCert    `json:"tls_peer_certs,omitempty"`
+	AuthorizedUser string            `json:"authorized_user,omitempty"`
+	Account        string            `json:"account,omitempty"`
+	Subs           []string          `json:"subscriptions_list,omitempty"`
+	SubsDetail     []SubDetail       `json:"subscriptions_list_detail,omitempty"`
+	JWT            string            `json:"jwt,omitempty"`
+	IssuerKey      string            `json:"issuer_key,omitempty"`
+	NameTag        string            `json:"name_tag,omitempty"`
+	Tags           jwt.TagList       `json:"tags,omitempty"`
+	UserTags       map[string]string `json:"user_tags,omitempty"`
+	MQTTClient     string            `json:"mqtt_client,omitempty"` // This is the MQTT client id
 
 	// Internal
 	rtt int64 // For fast sorting
@@ -416,6 +417,7 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 			ci.JWT = client.opts.JWT
 			ci.IssuerKey = issuerForClient(client)
 			ci.Tags = client.tags
+			ci.UserTags = copyTags(client.userTags)
 			ci.NameTag = client.nameTag
 		}
 		client.mu.Unlock()
@@ -783,6 +785,10 @@ type RouteInfo struct {
 	NumSubs      uint32             `json:"subscriptions"`
 	Subs         []string           `json:"subscriptions_list,omitempty"`
 	SubsDetail   []SubDetail        `json:"subscriptions_list_detail,omitempty"`
+
+	// ThrottledMsgs is the number of messages dropped for exceeding an
+	// import rate of the cluster permissions.
+	ThrottledMsgs int64 `json:"throttled_msgs,omitempty"`
 }
 
 // Routez returns a Routez struct containing information about routes.
@@ -829,6 +835,7 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 			Uptime:       myUptime(rs.Now.Sub(r.start)),
 			Idle:         myUptime(rs.Now.Sub(r.last)),
 		}
+		ri.ThrottledMsgs = atomic.LoadInt64(&r.route.throttledMsgs)
 
 		if len(r.subs) > 0 {
 			if routezOpts.SubscriptionsDetail {
@@ -1141,6 +1148,63 @@ func (s *Server) HandleIPQueuesz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// HandleAuthMetrics renders the authentication counters of AuthStats in the
+// Prometheus text exposition format. Successes, active connections and
+// lockouts are labelled with the method that authenticated the clients,
+// failures with the method of the credentials they presented.
+func (s *Server) HandleAuthMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[AuthMetricsPath]++
+	s.mu.Unlock()
+
+	st := s.AuthStats()
+	var b strings.Builder
+
+	b.WriteString("# HELP nats_server_auth_successes_total Successful client authentications.\n")
+	b.WriteString("# TYPE nats_server_auth_successes_total counter\n")
+	for _, m := range sortedKeys(st.Successes) {
+		fmt.Fprintf(&b, "nats_server_auth_successes_total{method=%s} %d\n", promLabel(m), st.Successes[m])
+	}
+
+	b.WriteString("# HELP nats_server_auth_failures_total Failed client authentications.\n")
+	b.WriteString("# TYPE nats_server_auth_failures_total counter\n")
+	for _, f := range st.Failures {
+		fmt.Fprintf(&b, "nats_server_auth_failures_total{method=%s,reason=%s} %d\n", promLabel(f.Method), promLabel(f.Reason), f.Count)
+	}
+
+	b.WriteString("# HELP nats_server_auth_active_connections Connected clients by authentication method.\n")
+	b.WriteString("# TYPE nats_server_auth_active_connections gauge\n")
+	for _, m := range sortedKeys(st.Active) {
+		fmt.Fprintf(&b, "nats_server_auth_active_connections{method=%s} %d\n", promLabel(m), st.Active[m])
+	}
+
+	b.WriteString("# HELP nats_server_auth_lockouts_total Clients rejected while the adaptive authentication is in strict mode.\n")
+	b.WriteString("# TYPE nats_server_auth_lockouts_total counter\n")
+	for _, m := range sortedKeys(st.Lockouts) {
+		fmt.Fprintf(&b, "nats_server_auth_lockouts_total{method=%s} %d\n", promLabel(m), st.Lockouts[m])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// promLabel returns the quoted Prometheus label value.
+func promLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+// sortedKeys returns the keys of the map in order.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // Varz will output server information on the monitoring port at /varz.
 type Varz struct {
 	ID                    string                `json:"server_id"`
@@ -2395,6 +2459,8 @@ func (reason ClosedState) String() string {
 		return "Minimum Version Required"
 	case ClusterNamesIdentical:
 		return "Cluster Names Identical"
+	case IdleTimeout:
+		return "Idle Timeout"
 	}
 
 	return "Unknown State"
@@ -3112,6 +3178,15 @@ func (s *Server) healthz(opts *HealthzOptions) *HealthStatus {
 		return health
 	}
 
+	s.mu.RLock()
+	authErr := s.authHealthErr
+	s.mu.RUnlock()
+	if authErr != nil {
+		health.Status = "unavailable"
+		health.Error = fmt.Sprintf("authentication backend unhealthy: %v", authErr)
+		return health
+	}
+
 	sopts := s.getOpts()
 
 	// If JS is not enabled in the config, we stop.
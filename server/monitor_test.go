@@ -4891,3 +4891,51 @@ func TestHealthzStatusUnavailable(t *testing.T) {
 
 	checkHealthzEndpoint(t, s.MonitorAddr().String(), http.StatusServiceUnavailable, "unavailable")
 }
+
+func TestMonitorAuthMetrics(t *testing.T) {
+	s := runMonitorServerWithAccounts()
+	defer s.Shutdown()
+
+	curl := fmt.Sprintf("nats://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+	nc := natsConnect(t, curl, nats.UserInfo("a", "a"))
+	defer nc.Close()
+	if nc, err := nats.Connect(curl, nats.UserInfo("b", "wrong")); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to fail")
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, AuthMetricsPath)
+	body := string(readBodyEx(t, url, http.StatusOK, "text/plain; version=0.0.4; charset=utf-8"))
+	for _, want := range []string{
+		"# TYPE nats_server_auth_successes_total counter\n",
+		"nats_server_auth_successes_total{method=\"user\"} 1\n",
+		"# TYPE nats_server_auth_failures_total counter\n",
+		"nats_server_auth_failures_total{method=\"user\",reason=\"invalid password\"} 1\n",
+		"# TYPE nats_server_auth_active_connections gauge\n",
+		"nats_server_auth_active_connections{method=\"user\"} 1\n",
+		"# TYPE nats_server_auth_lockouts_total counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("Expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+
+	nc.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.AuthStats().Active["user"]; n != 0 {
+			return fmt.Errorf("expected no active connection, got %d", n)
+		}
+		return nil
+	})
+
+	// Clients are counted by the method that authenticated them, not by
+	// the credentials they presented.
+	s2 := RunServer(DefaultOptions())
+	defer s2.Shutdown()
+	nc2 := natsConnect(t, s2.ClientURL(), nats.UserInfo("a", "a"))
+	defer nc2.Close()
+	st := s2.AuthStats()
+	require_Equal(t, st.Successes[authMethodNone], 1)
+	require_Equal(t, st.Active[authMethodNone], 1)
+	require_Len(t, len(st.Successes), 1)
+}
@@ -2732,6 +2732,14 @@ func (s *Server) mqttProcessConnect(c *client, cp *mqttConnectProto, trace bool)
 		c.authViolation()
 		return ErrAuthentication
 	}
+	s.recordLogin(c)
+	s.recordAuthSuccess(c)
+	c.mu.Lock()
+	c.flags.set(connectAuthorized)
+	c.applyNilPermissionsMeanDeny(s.getOpts())
+	c.mu.Unlock()
+	s.localAdminConnect(c, s.getOpts())
+	s.privilegedConnect(c, s.getOpts())
 	// Now that we are are authenticated, we have the client bound to the account.
 	// Get the account's level MQTT sessions manager. If it does not exists yet,
 	// this will create it along with the streams where sessions and messages
@@ -3183,8 +3191,9 @@ func generatePubPerms(perms *Permissions) *perm {
 			sub := &subscription{subject: []byte(pubSubject)}
 			p.allow.Insert(sub)
 		}
+		p.allowTrie = perms.Publish.allowTrie
 	}
-	if len(perms.Publish.Deny) > 0 {
+	if len(perms.Publish.Deny) > 0 || perms.Publish.denyTrie != nil {
 		if p == nil {
 			p = &perm{}
 		}
@@ -3193,6 +3202,7 @@ func generatePubPerms(perms *Permissions) *perm {
 			sub := &subscription{subject: []byte(pubSubject)}
 			p.deny.Insert(sub)
 		}
+		p.denyTrie = perms.Publish.denyTrie
 	}
 	return p
 }
@@ -3202,12 +3212,12 @@ func pubAllowed(perms *perm, subject string) bool {
 	allowed := true
 	if perms.allow != nil {
 		r := perms.allow.Match(subject)
-		allowed = len(r.psubs) != 0
+		allowed = len(r.psubs) != 0 || len(matchPsubs(perms.allowTrie, subject)) != 0
 	}
 	// If we have a deny list and are currently allowed, check that as well.
 	if allowed && perms.deny != nil {
 		r := perms.deny.Match(subject)
-		allowed = len(r.psubs) == 0
+		allowed = len(r.psubs) == 0 && len(matchPsubs(perms.denyTrie, subject)) == 0
 	}
 	return allowed
 }
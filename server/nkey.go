@@ -14,16 +14,130 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
+	"math/bits"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
 )
 
 // Raw length of the nonce challenge
 const (
 	nonceRawLen = 11
 	nonceLen    = 15 // base64.RawURLEncoding.EncodedLen(nonceRawLen)
+
+	// Maximum raw length of the nonce challenge that can be configured.
+	maxNonceRawLen = 1024
+)
+
+// How long after being issued a nonce can still be signed by the client of
+// the next connection from the same host, when AllowPreviousNonce is set.
+var previousNonceWindow = 2 * time.Second
+
+// issuedNonce is a nonce presented to a client, tracked when previous nonces
+// are allowed. Another connection may only use it once, and only if its own
+// connection closed before sending CONNECT.
+type issuedNonce struct {
+	nonce  []byte
+	issued time.Time
+	state  int32
+}
+
+// States of an issued nonce.
+const (
+	nonceIssued    int32 = iota // Its connection has not sent CONNECT yet.
+	nonceClaimed                // Its connection sent CONNECT.
+	nonceAbandoned              // Its connection closed before sending CONNECT.
+	nonceUsed                   // The next connection used it.
 )
 
+// claim marks the nonce as belonging to its connection, which sent CONNECT.
+func (n *issuedNonce) claim() {
+	atomic.CompareAndSwapInt32(&n.state, nonceIssued, nonceClaimed)
+}
+
+// abandon marks the nonce as usable by the next connection, unless its
+// connection sent CONNECT.
+func (n *issuedNonce) abandon() {
+	atomic.CompareAndSwapInt32(&n.state, nonceIssued, nonceAbandoned)
+}
+
+// use marks the nonce as used and returns false if it was not abandoned.
+func (n *issuedNonce) use() bool {
+	return atomic.CompareAndSwapInt32(&n.state, nonceAbandoned, nonceUsed)
+}
+
+// trackNonce records the nonce just presented to the client, which becomes
+// the previous nonce of the next client connecting from the same host, so
+// that a signature captured on a connection can't be replayed from another
+// host.
+// Server lock should be held.
+func (s *Server) trackNonce(c *client) {
+	var host string
+	if addr := c.nc.RemoteAddr(); addr != nil {
+		host, _, _ = net.SplitHostPort(addr.String())
+	}
+	now := time.Now()
+	n := &issuedNonce{nonce: c.nonce, issued: now}
+	if s.prevNonces == nil {
+		s.prevNonces = make(map[string]*issuedNonce)
+	}
+	c.prevNonce, c.issuedNonce = s.prevNonces[host], n
+	s.prevNonces[host] = n
+	// Drop the nonces of the hosts that did not reconnect in time.
+	if now.Sub(s.prevNoncesSwept) > previousNonceWindow {
+		for h, pn := range s.prevNonces {
+			if now.Sub(pn.issued) > previousNonceWindow {
+				delete(s.prevNonces, h)
+			}
+		}
+		s.prevNoncesSwept = now
+	}
+}
+
+// checkNonceSignature returns true if verify accepts the client's signature
+// over its nonce or, if allowed, over the nonce issued just before it for a
+// connection from the same host that closed before sending CONNECT, within
+// previousNonceWindow. This covers clients reconnecting quickly with a
+// cached INFO, while clients sharing a host can't use the nonces of the
+// others. Clients authorized again on reload are checked against the nonce
+// they already used.
+func (c *client) checkNonceSignature(verify func(nonce []byte) bool) bool {
+	if c.reauthorizing() {
+		return verify(c.signedNonce(c.nonce)) || (c.prevNonce != nil && verify(c.signedNonce(c.prevNonce.nonce)))
+	}
+	if verify(c.signedNonce(c.nonce)) {
+		return true
+	}
+	prev := c.prevNonce
+	if prev == nil || time.Since(prev.issued) > previousNonceWindow || !verify(c.signedNonce(prev.nonce)) || !prev.use() {
+		return false
+	}
+	c.Debugf("Signature verified with the previous nonce")
+	return true
+}
+
+// signedNonce returns what the client signs for the nonce, which is
+// "<nonce>|<namespace>" when it claims a namespace so that the claim can't
+// be altered.
+func (c *client) signedNonce(nonce []byte) []byte {
+	if c.opts.Namespace == _EMPTY_ {
+		return nonce
+	}
+	b := make([]byte, 0, len(nonce)+1+len(c.opts.Namespace))
+	b = append(b, nonce...)
+	b = append(b, '|')
+	return append(b, c.opts.Namespace...)
+}
+
 // NonceRequired tells us if we should send a nonce.
 func (s *Server) NonceRequired() bool {
 	s.mu.Lock()
@@ -34,14 +148,196 @@ func (s *Server) NonceRequired() bool {
 // nonceRequired tells us if we should send a nonce.
 // Lock should be held on entry.
 func (s *Server) nonceRequired() bool {
-	return s.getOpts().AlwaysEnableNonce || len(s.nkeys) > 0 || s.trustedKeys != nil
+	return s.getOpts().AlwaysEnableNonce || len(s.nkeys) > 0 || s.trustedKeys != nil || s.usersRequireSig ||
+		s.signingKey != nil || s.getOpts().ConnectPoWDifficulty > 0
+}
+
+// signNonce returns the signature of the nonce with the server signing key,
+// or an empty string if there is none.
+func (s *Server) signNonce(nonce string) string {
+	if s.signingKey == nil {
+		return _EMPTY_
+	}
+	sig, err := s.signingKey.Sign([]byte(nonce))
+	if err != nil {
+		s.Errorf("Error signing nonce: %v", err)
+		return _EMPTY_
+	}
+	return base64.RawURLEncoding.EncodeToString(sig)
 }
 
 // Generate a nonce for INFO challenge.
+// The random bytes are read directly from crypto/rand for each nonce, so
+// there is no generator state or seed kept by the server that could need
+// to be rotated.
 // Assumes server lock is held
-func (s *Server) generateNonce(n []byte) {
-	var raw [nonceRawLen]byte
-	data := raw[:]
+func (s *Server) generateNonce() []byte {
+	rawLen := nonceRawLen
+	if n := s.getOpts().NonceRawLen; n > 0 {
+		rawLen = n
+	}
+	data := make([]byte, rawLen)
 	rand.Read(data)
+	n := make([]byte, base64.RawURLEncoding.EncodedLen(rawLen))
 	base64.RawURLEncoding.Encode(n, data)
+	return n
+}
+
+// validateNonceRawLen checks that the configured nonce length is not
+// weaker than the default and stays within reasonable bounds.
+func validateNonceRawLen(n int) error {
+	if n != 0 && (n < nonceRawLen || n > maxNonceRawLen) {
+		return fmt.Errorf("nonce raw length must be between %d and %d, got %d", nonceRawLen, maxNonceRawLen, n)
+	}
+	return nil
+}
+
+// GenerateNkeyUser creates a new user nkey and returns its seed and public
+// key. The public key is what is configured for the user in the server,
+// while the seed is kept by the client to sign the nonce.
+func GenerateNkeyUser() (seed, public string, err error) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	defer kp.Wipe()
+	s, err := kp.Seed()
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	public, err = kp.PublicKey()
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	return string(s), public, nil
+}
+
+// SignNonce signs the nonce from the server's INFO with the user seed and
+// returns the signature encoded as expected in the "sig" field of CONNECT.
+func SignNonce(seed string, nonce []byte) (string, error) {
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return _EMPTY_, err
+	}
+	defer kp.Wipe()
+	sig, err := kp.Sign(nonce)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	return base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyNonceSignature returns true if sigB64, a signature encoded as in
+// the "sig" field of CONNECT, is the signature of the nonce by the user
+// nkey pubKey. It does the same verification as the server does for nkey
+// users, for custom authentications that also verify signed nonces.
+func VerifyNonceSignature(pubKey string, nonce []byte, sigB64 string) bool {
+	sig, err := decodeSignature(sigB64)
+	if err != nil {
+		return false
+	}
+	pub, err := nkeys.FromPublicKey(pubKey)
+	if err != nil {
+		return false
+	}
+	return pub.Verify(nonce, sig) == nil
+}
+
+// decodeSignature decodes a signature sent in CONNECT. Clients encode it
+// with the raw URL base64 encoding, but the standard one is also accepted.
+func decodeSignature(sig string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		// Allow fallback to normal base64.
+		b, err = base64.StdEncoding.DecodeString(sig)
+	}
+	return b, err
+}
+
+// maxConnectPoWDifficulty is the maximum number of leading zero bits a
+// proof of work can be required to have. Solving it takes about 2^32 hashes,
+// beyond that clients could not connect in a practical time.
+const maxConnectPoWDifficulty = 32
+
+// SolveConnectPoW returns a proof of work for the nonce from the server's
+// INFO, to be sent in the "pow" field of CONNECT when the server requires
+// one with the given difficulty. The SHA-256 of the nonce followed by the
+// proof of work has at least difficulty leading zero bits. An error is
+// returned if the difficulty is not supported or the context is done
+// before a solution is found.
+func SolveConnectPoW(ctx context.Context, nonce []byte, difficulty int) (string, error) {
+	if difficulty < 0 || difficulty > maxConnectPoWDifficulty {
+		return _EMPTY_, fmt.Errorf("proof of work difficulty must be between 0 and %d, got %d",
+			maxConnectPoWDifficulty, difficulty)
+	}
+	if len(nonce) == 0 {
+		return _EMPTY_, fmt.Errorf("proof of work requires a nonce")
+	}
+	for i := uint64(0); ; i++ {
+		// Check the context from time to time, not on every hash.
+		if i&0xfff == 0 {
+			if err := ctx.Err(); err != nil {
+				return _EMPTY_, err
+			}
+		}
+		pow := strconv.FormatUint(i, 36)
+		if verifyConnectPoW(nonce, pow, difficulty) {
+			return pow, nil
+		}
+	}
+}
+
+// verifyConnectPoW returns true if the proof of work solves the nonce
+// with at least difficulty leading zero bits.
+func verifyConnectPoW(nonce []byte, pow string, difficulty int) bool {
+	if pow == _EMPTY_ || len(nonce) == 0 {
+		return false
+	}
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write([]byte(pow))
+	sum := h.Sum(nil)
+	zeros := 0
+	for _, b := range sum {
+		if b == 0 {
+			zeros += 8
+			continue
+		}
+		zeros += bits.LeadingZeros8(b)
+		break
+	}
+	return zeros >= difficulty
+}
+
+// ParseCreds parses the contents of a .creds file, as generated by the NATS
+// tooling, and returns the user JWT and seed it contains. The seed must be
+// the one of the JWT's user. A client authenticates by sending the JWT in
+// the "jwt" field of CONNECT and the nonce signed with SignNonce and the
+// seed in the "sig" field.
+func ParseCreds(contents []byte) (ujwt, seed string, err error) {
+	ujwt, err = jwt.ParseDecoratedJWT(contents)
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	uc, err := jwt.DecodeUserClaims(ujwt)
+	if err != nil {
+		return _EMPTY_, _EMPTY_, fmt.Errorf("invalid user JWT: %v", err)
+	}
+	kp, err := jwt.ParseDecoratedUserNKey(contents)
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	defer kp.Wipe()
+	public, err := kp.PublicKey()
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	if public != uc.Subject {
+		return _EMPTY_, _EMPTY_, fmt.Errorf("seed of %q does not match the user JWT subject %q", public, uc.Subject)
+	}
+	s, err := kp.Seed()
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	return ujwt, string(s), nil
 }
@@ -15,15 +15,22 @@ package server
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	crand "crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	mrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nkeys"
 )
 
@@ -187,6 +194,122 @@ func TestNkeyClientConnect(t *testing.T) {
 	}
 }
 
+func TestNkeyClientConnectNonceRawLen(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pubKey, _ := kp.PublicKey()
+
+	opts := defaultServerOptions
+	opts.Nkeys = []*NkeyUser{{Nkey: pubKey}}
+	opts.NonceRawLen = 32
+	s, c, cr, l := rawSetup(opts)
+	defer s.Shutdown()
+	// The client must be closed first since the server is not running and
+	// would otherwise wait for its write loop.
+	defer c.close()
+
+	var info nonceInfo
+	if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+		t.Fatalf("Could not parse INFO json: %v\n", err)
+	}
+	if expected := base64.RawURLEncoding.EncodedLen(32); len(info.Nonce) != expected {
+		t.Fatalf("Expected nonce of length %d, got %q", expected, info.Nonce)
+	}
+	sigraw, err := kp.Sign([]byte(info.Nonce))
+	if err != nil {
+		t.Fatalf("Failed signing nonce: %v", err)
+	}
+	sig := base64.RawURLEncoding.EncodeToString(sigraw)
+
+	cs := fmt.Sprintf("CONNECT {\"nkey\":%q,\"sig\":\"%s\",\"verbose\":true,\"pedantic\":true}\r\nPING\r\n", pubKey, sig)
+	c.parseAsync(cs)
+	l, _ = cr.ReadString('\n')
+	if !strings.HasPrefix(l, "+OK") {
+		t.Fatalf("Expected an OK, got: %v", l)
+	}
+
+	// A nonce shorter than the default is not allowed.
+	opts.NonceRawLen = nonceRawLen - 1
+	if _, err := NewServer(&opts); err == nil || !strings.Contains(err.Error(), "nonce raw length") {
+		t.Fatalf("Expected error about the nonce length, got %v", err)
+	}
+}
+
+func TestNkeyClientConnectRawEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(crand.Reader)
+	require_NoError(t, err)
+	pubKey := base64.StdEncoding.EncodeToString(pub)
+
+	opts := defaultServerOptions
+	opts.Nkeys = []*NkeyUser{{Nkey: pubKey, RawEd25519: true}}
+	s, c, cr, l := rawSetup(opts)
+	defer c.close()
+
+	connect := func(t *testing.T, c *testAsyncClient, cr *bufio.Reader, info string, key ed25519.PrivateKey) string {
+		t.Helper()
+		var ni nonceInfo
+		if err := json.Unmarshal([]byte(info[5:]), &ni); err != nil {
+			t.Fatalf("Could not parse INFO json: %v\n", err)
+		}
+		if ni.Nonce == _EMPTY_ {
+			t.Fatalf("Expected a non-empty nonce")
+		}
+		sig := base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(ni.Nonce)))
+		cs := fmt.Sprintf("CONNECT {\"nkey\":%q,\"sig\":\"%s\",\"verbose\":true,\"pedantic\":true}\r\nPING\r\n", pubKey, sig)
+		c.parseAsync(cs)
+		l, _ := cr.ReadString('\n')
+		return l
+	}
+
+	if l := connect(t, c, cr, l, priv); !strings.HasPrefix(l, "+OK") {
+		t.Fatalf("Expected an OK, got: %v", l)
+	}
+
+	// Signing with another key must fail.
+	_, other, err := ed25519.GenerateKey(crand.Reader)
+	require_NoError(t, err)
+	c, cr, l = newClientForServer(s)
+	defer c.close()
+	if l := connect(t, c, cr, l, other); !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error, got: %v", l)
+	}
+
+	// Raw keys must have the proper size.
+	opts.Nkeys = []*NkeyUser{{Nkey: base64.StdEncoding.EncodeToString(pub[:16]), RawEd25519: true}}
+	if errs := ValidateAuthorization(&opts); len(errs) != 1 {
+		t.Fatalf("Expected an error for the invalid key, got %v", errs)
+	}
+}
+
+func TestNonceGenerationUnique(t *testing.T) {
+	s := New(&defaultServerOptions)
+
+	const workers, count = 8, 1000
+	nonces := make(chan string, workers*count)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				s.mu.Lock()
+				n := s.generateNonce()
+				s.mu.Unlock()
+				nonces <- string(n)
+			}
+		}()
+	}
+	wg.Wait()
+	close(nonces)
+
+	seen := make(map[string]struct{}, workers*count)
+	for n := range nonces {
+		if _, ok := seen[n]; ok {
+			t.Fatalf("Duplicate nonce %q", n)
+		}
+		seen[n] = struct{}{}
+	}
+}
+
 func TestMixedClientConnect(t *testing.T) {
 	s, c, cr, _ := mixedSetup()
 	defer c.close()
@@ -301,3 +424,502 @@ func BenchmarkPublicVerify(b *testing.B) {
 		}
 	}
 }
+
+func TestNkeySeedStore(t *testing.T) {
+	kp, err := nkeys.CreateServer()
+	require_NoError(t, err)
+	seed, err := kp.Seed()
+	require_NoError(t, err)
+	pub, err := kp.PublicKey()
+	require_NoError(t, err)
+
+	s := New(&defaultServerOptions)
+	checkRoundTrip := func(t *testing.T, ss SeedStore) {
+		t.Helper()
+		skp, err := ss.KeyPair()
+		require_NoError(t, err)
+		spub, err := skp.PublicKey()
+		require_NoError(t, err)
+		require_Equal(t, spub, pub)
+
+		nonce := s.generateNonce()
+		sig, err := skp.Sign(nonce)
+		require_NoError(t, err)
+		// Verify with the public key only, as a client would.
+		vkp, err := nkeys.FromPublicKey(pub)
+		require_NoError(t, err)
+		require_NoError(t, vkp.Verify(nonce, sig))
+	}
+
+	t.Run("file", func(t *testing.T) {
+		fn := filepath.Join(t.TempDir(), "server.nk")
+		require_NoError(t, os.WriteFile(fn, append(seed, '\n'), 0600))
+		checkRoundTrip(t, &FileSeedStore{Path: fn})
+
+		if runtime.GOOS != "windows" {
+			require_NoError(t, os.Chmod(fn, 0644))
+			if _, err := (&FileSeedStore{Path: fn}).KeyPair(); err == nil {
+				t.Fatal("Expected error for seed file readable by others")
+			}
+		}
+		if _, err := (&FileSeedStore{Path: fn + ".missing"}).KeyPair(); err == nil {
+			t.Fatal("Expected error for missing seed file")
+		}
+	})
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("NATS_TEST_SEED", string(seed))
+		checkRoundTrip(t, &EnvSeedStore{Name: "NATS_TEST_SEED"})
+
+		t.Setenv("NATS_TEST_SEED", "bad")
+		if _, err := (&EnvSeedStore{Name: "NATS_TEST_SEED"}).KeyPair(); err == nil {
+			t.Fatal("Expected error for invalid seed")
+		}
+		if _, err := (&EnvSeedStore{Name: "NATS_TEST_SEED_MISSING"}).KeyPair(); err == nil {
+			t.Fatal("Expected error for missing environment variable")
+		}
+	})
+}
+
+func TestServerSigningKeyNonceSignature(t *testing.T) {
+	kp, err := nkeys.CreateServer()
+	require_NoError(t, err)
+	seed, err := kp.Seed()
+	require_NoError(t, err)
+	pub, err := kp.PublicKey()
+	require_NoError(t, err)
+
+	fn := filepath.Join(t.TempDir(), "server.nk")
+	require_NoError(t, os.WriteFile(fn, seed, 0600))
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		server_signing_key: {file: %q}
+	`, fn)))
+	opts := LoadConfig(conf)
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, _, l := newClientForServer(s)
+	defer c.close()
+	if !strings.HasPrefix(l, "INFO ") {
+		t.Fatalf("INFO response incorrect: %s\n", l)
+	}
+	var info Info
+	require_NoError(t, json.Unmarshal([]byte(l[5:]), &info))
+	if info.Nonce == _EMPTY_ || info.NonceSig == _EMPTY_ {
+		t.Fatalf("Expected a signed nonce, got %+v", info)
+	}
+
+	// Verify with the pinned public key, as a client would.
+	sig, err := base64.RawURLEncoding.DecodeString(info.NonceSig)
+	require_NoError(t, err)
+	vkp, err := nkeys.FromPublicKey(pub)
+	require_NoError(t, err)
+	require_NoError(t, vkp.Verify([]byte(info.Nonce), sig))
+
+	// Another key does not verify the signature.
+	other, err := nkeys.CreateServer()
+	require_NoError(t, err)
+	if err := other.Verify([]byte(info.Nonce), sig); err == nil {
+		t.Fatal("Expected signature verification to fail with another key")
+	}
+
+	// The server does not start with an invalid seed.
+	opts = DefaultOptions()
+	opts.ServerSigningKey = &FileSeedStore{Path: fn + ".missing"}
+	if _, err := NewServer(opts); err == nil {
+		t.Fatal("Expected error for missing server signing key")
+	}
+}
+
+func TestNkeyClientConnectPreviousNonce(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pubKey, _ := kp.PublicKey()
+
+	opts := defaultServerOptions
+	opts.Nkeys = []*NkeyUser{{Nkey: pubKey}}
+	opts.AllowPreviousNonce = true
+	s, c, _, _ := rawSetup(opts)
+	c.close()
+
+	newClient := func() (*testAsyncClient, *bufio.Reader, string) {
+		t.Helper()
+		c, cr, l := newClientForServer(s)
+		var info nonceInfo
+		if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+			t.Fatalf("Could not parse INFO json: %v\n", err)
+		}
+		return c, cr, info.Nonce
+	}
+	connect := func(c *testAsyncClient, cr *bufio.Reader, nonce string) string {
+		t.Helper()
+		sigraw, err := kp.Sign([]byte(nonce))
+		require_NoError(t, err)
+		sig := base64.RawURLEncoding.EncodeToString(sigraw)
+		c.parseAsync(fmt.Sprintf("CONNECT {\"nkey\":%q,\"sig\":%q}\r\nPING\r\n", pubKey, sig))
+		l, _ := cr.ReadString('\n')
+		return l
+	}
+
+	// The client of the first connection reconnects before using its nonce.
+	c1, _, n1 := newClient()
+	c1.close()
+	c2, cr2, _ := newClient()
+	defer c2.close()
+	require_True(t, strings.HasPrefix(connect(c2, cr2, n1), "PONG"))
+
+	// The previous nonce is not accepted while its connection is open, nor
+	// once it sent CONNECT.
+	c3, cr3, n3 := newClient()
+	defer c3.close()
+	c4, cr4, _ := newClient()
+	require_True(t, strings.HasPrefix(connect(c4, cr4, n3), "-ERR"))
+	require_True(t, strings.HasPrefix(connect(c3, cr3, n3), "PONG"))
+	c5, cr5, _ := newClient()
+	defer c5.close()
+	require_True(t, strings.HasPrefix(connect(c5, cr5, n3), "-ERR"))
+
+	// Only the nonce issued just before is accepted.
+	c6, _, n6 := newClient()
+	c6.close()
+	c7, _, _ := newClient()
+	c7.close()
+	c8, cr8, _ := newClient()
+	defer c8.close()
+	require_True(t, strings.HasPrefix(connect(c8, cr8, n6), "-ERR"))
+
+	// And only for a short time.
+	old := previousNonceWindow
+	previousNonceWindow = 50 * time.Millisecond
+	defer func() { previousNonceWindow = old }()
+	c9, _, n9 := newClient()
+	c9.close()
+	c10, cr10, _ := newClient()
+	defer c10.close()
+	time.Sleep(100 * time.Millisecond)
+	require_True(t, strings.HasPrefix(connect(c10, cr10, n9), "-ERR"))
+
+	// The previous nonce is not accepted unless allowed.
+	opts.AllowPreviousNonce = false
+	s, c, _, _ = rawSetup(opts)
+	c.close()
+	c11, _, n11 := newClient()
+	c11.close()
+	c12, cr12, _ := newClient()
+	defer c12.close()
+	require_True(t, strings.HasPrefix(connect(c12, cr12, n11), "-ERR"))
+}
+
+func TestNkeyClientConnectPreviousNonceOtherHost(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pubKey, _ := kp.PublicKey()
+
+	confTmpl := `
+		listen: "127.0.0.1:-1"
+		allow_previous_nonce: %v
+		authorization { users: [{nkey: %q}] }
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(confTmpl, true, pubKey)))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	dial := func(localIP string) (net.Conn, *bufio.Reader, string) {
+		t.Helper()
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+		conn, err := d.Dial("tcp", s.Addr().String())
+		require_NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		cr := bufio.NewReader(conn)
+		l, err := cr.ReadString('\n')
+		require_NoError(t, err)
+		var info nonceInfo
+		require_NoError(t, json.Unmarshal([]byte(l[5:]), &info))
+		return conn, cr, info.Nonce
+	}
+	connect := func(conn net.Conn, cr *bufio.Reader, nonce string) string {
+		t.Helper()
+		sigraw, err := kp.Sign([]byte(nonce))
+		require_NoError(t, err)
+		sig := base64.RawURLEncoding.EncodeToString(sigraw)
+		_, err = conn.Write([]byte(fmt.Sprintf("CONNECT {\"nkey\":%q,\"sig\":%q,\"verbose\":false}\r\nPING\r\n", pubKey, sig)))
+		require_NoError(t, err)
+		l, _ := cr.ReadString('\n')
+		return l
+	}
+
+	// The connection is closed before sending CONNECT, which the server
+	// needs to notice before the nonce can be used.
+	abandon := func(conn net.Conn) {
+		t.Helper()
+		n := s.NumClients()
+		conn.Close()
+		checkFor(t, time.Second, 10*time.Millisecond, func() error {
+			if nc := s.NumClients(); nc >= n {
+				return fmt.Errorf("Expected the connection to be closed, got %v clients", nc)
+			}
+			return nil
+		})
+	}
+
+	// The previous nonce issued to another host is not accepted.
+	c1, _, n1 := dial("127.0.0.1")
+	c2, cr2, _ := dial("127.0.0.2")
+	abandon(c1)
+	require_True(t, strings.HasPrefix(connect(c2, cr2, n1), "-ERR"))
+
+	// But it is from the same host.
+	c1, _, n1 = dial("127.0.0.1")
+	c3, cr3, _ := dial("127.0.0.1")
+	abandon(c1)
+	require_True(t, strings.HasPrefix(connect(c3, cr3, n1), "PONG"))
+	c4, cr4, n4 := dial("127.0.0.1")
+	require_True(t, strings.HasPrefix(connect(c4, cr4, n4), "PONG"))
+	c5, cr5, n5 := dial("127.0.0.1")
+	require_True(t, strings.HasPrefix(connect(c5, cr5, n5), "PONG"))
+
+	// Clients are not disconnected by a reload, whichever nonce they used.
+	require_NoError(t, os.WriteFile(conf, []byte(fmt.Sprintf(confTmpl, true, pubKey)+"debug: true\n"), 0666))
+	require_NoError(t, s.Reload())
+	for _, c := range []struct {
+		conn net.Conn
+		cr   *bufio.Reader
+	}{{c3, cr3}, {c4, cr4}, {c5, cr5}} {
+		_, err := c.conn.Write([]byte("PING\r\n"))
+		require_NoError(t, err)
+		l, err := c.cr.ReadString('\n')
+		require_NoError(t, err)
+		require_True(t, strings.HasPrefix(l, "PONG"))
+	}
+
+	// The setting can be disabled with a reload.
+	require_NoError(t, os.WriteFile(conf, []byte(fmt.Sprintf(confTmpl, false, pubKey)), 0666))
+	require_NoError(t, s.Reload())
+	c6, _, n6 := dial("127.0.0.1")
+	c7, cr7, _ := dial("127.0.0.1")
+	abandon(c6)
+	require_True(t, strings.HasPrefix(connect(c7, cr7, n6), "-ERR"))
+}
+
+func TestNkeyClientConnectPreviousNonceSameHost(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pubKey, _ := kp.PublicKey()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		allow_previous_nonce: true
+		authorization { users: [{nkey: %q}] }
+	`, pubKey)))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	dial := func() (net.Conn, *bufio.Reader, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require_NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		cr := bufio.NewReader(conn)
+		l, err := cr.ReadString('\n')
+		require_NoError(t, err)
+		var info nonceInfo
+		require_NoError(t, json.Unmarshal([]byte(l[5:]), &info))
+		return conn, cr, info.Nonce
+	}
+	connect := func(conn net.Conn, cr *bufio.Reader, nonce string) string {
+		t.Helper()
+		sigraw, err := kp.Sign([]byte(nonce))
+		require_NoError(t, err)
+		sig := base64.RawURLEncoding.EncodeToString(sigraw)
+		_, err = conn.Write([]byte(fmt.Sprintf("CONNECT {\"nkey\":%q,\"sig\":%q,\"verbose\":false}\r\nPING\r\n", pubKey, sig)))
+		require_NoError(t, err)
+		l, _ := cr.ReadString('\n')
+		return l
+	}
+
+	// Two clients of the same host connect. The second one can't use the
+	// nonce of the first while the first is still connecting.
+	_, _, n1 := dial()
+	c2, cr2, _ := dial()
+	require_True(t, strings.HasPrefix(connect(c2, cr2, n1), "-ERR"))
+
+	// Nor once the first one sent CONNECT.
+	c3, cr3, n3 := dial()
+	c4, cr4, _ := dial()
+	require_True(t, strings.HasPrefix(connect(c3, cr3, n3), "PONG"))
+	require_True(t, strings.HasPrefix(connect(c4, cr4, n3), "-ERR"))
+
+	// The first one can still use its own nonce.
+	c5, cr5, n5 := dial()
+	c6, cr6, _ := dial()
+	require_True(t, strings.HasPrefix(connect(c6, cr6, n5), "-ERR"))
+	require_True(t, strings.HasPrefix(connect(c5, cr5, n5), "PONG"))
+}
+
+func TestNkeyClientConnectNamespaceClaim(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pubKey, _ := kp.PublicKey()
+	okp, _ := nkeys.CreateUser()
+	otherKey, _ := okp.PublicKey()
+
+	opts := defaultServerOptions
+	opts.Nkeys = []*NkeyUser{
+		{Nkey: pubKey, Namespaces: []string{"team-a", "team-b"}},
+		{Nkey: otherKey},
+	}
+	s, c, _, _ := rawSetup(opts)
+	c.close()
+
+	connect := func(kp nkeys.KeyPair, ns, signed string) (*testAsyncClient, *bufio.Reader, string) {
+		t.Helper()
+		c, cr, l := newClientForServer(s)
+		var info nonceInfo
+		require_NoError(t, json.Unmarshal([]byte(l[5:]), &info))
+		pub, _ := kp.PublicKey()
+		sigraw, err := kp.Sign([]byte(info.Nonce + signed))
+		require_NoError(t, err)
+		sig := base64.RawURLEncoding.EncodeToString(sigraw)
+		c.parseAsync(fmt.Sprintf("CONNECT {\"verbose\":false,\"nkey\":%q,\"sig\":%q,\"namespace\":%q}\r\nPING\r\n", pub, sig, ns))
+		l, _ = cr.ReadString('\n')
+		return c, cr, l
+	}
+
+	// A claimed namespace that was issued confines the client to it.
+	c, cr, l := connect(kp, "team-a", "|team-a")
+	defer c.close()
+	require_True(t, strings.HasPrefix(l, "PONG"))
+	c.parseAsync("PUB team-a.foo 2\r\nok\r\nPING\r\n")
+	l, _ = cr.ReadString('\n')
+	require_True(t, strings.HasPrefix(l, "PONG"))
+	c.parseAsync("PUB team-b.foo 2\r\nok\r\nPING\r\n")
+	l, _ = cr.ReadString('\n')
+	require_Contains(t, l, "-ERR 'Permissions Violation for Publish to \"team-b.foo\"")
+
+	for _, test := range []struct {
+		name   string
+		kp     nkeys.KeyPair
+		ns     string
+		signed string
+	}{
+		{"namespace not issued", kp, "team-c", "|team-c"},
+		{"namespace not signed", kp, "team-b", ""},
+		{"namespace signed for another claim", kp, "team-b", "|team-a"},
+		{"no namespace claimed", kp, "", ""},
+		{"no namespace issued", okp, "team-a", "|team-a"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, l := connect(test.kp, test.ns, test.signed)
+			defer c.close()
+			require_True(t, strings.HasPrefix(l, "-ERR"))
+		})
+	}
+
+	// Users without issued namespaces connect as before.
+	c, _, l = connect(okp, "", "")
+	defer c.close()
+	require_True(t, strings.HasPrefix(l, "PONG"))
+}
+
+func TestNkeyGenerateUserAndSignNonce(t *testing.T) {
+	seed, public, err := GenerateNkeyUser()
+	require_NoError(t, err)
+	require_True(t, nkeys.IsValidPublicUserKey(public))
+	kp, err := nkeys.FromSeed([]byte(seed))
+	require_NoError(t, err)
+	pub, _ := kp.PublicKey()
+	require_Equal(t, pub, public)
+
+	// The signature verifies against the public key.
+	nonce := []byte("abcdefghijk")
+	sig, err := SignNonce(seed, nonce)
+	require_NoError(t, err)
+	raw, err := base64.RawURLEncoding.DecodeString(sig)
+	require_NoError(t, err)
+	pkp, err := nkeys.FromPublicKey(public)
+	require_NoError(t, err)
+	require_NoError(t, pkp.Verify(nonce, raw))
+	require_Error(t, pkp.Verify([]byte("other nonce"), raw))
+
+	_, err = SignNonce("not a seed", nonce)
+	require_Error(t, err)
+
+	// And is accepted by the server.
+	opts := defaultServerOptions
+	opts.Nkeys = []*NkeyUser{{Nkey: public}}
+	s, c, _, _ := rawSetup(opts)
+	c.close()
+	c, cr, l := newClientForServer(s)
+	defer c.close()
+	var info nonceInfo
+	require_NoError(t, json.Unmarshal([]byte(l[5:]), &info))
+	sig, err = SignNonce(seed, []byte(info.Nonce))
+	require_NoError(t, err)
+	c.parseAsync(fmt.Sprintf("CONNECT {\"verbose\":false,\"nkey\":%q,\"sig\":%q}\r\nPING\r\n", public, sig))
+	l, _ = cr.ReadString('\n')
+	require_True(t, strings.HasPrefix(l, "PONG"))
+}
+
+func TestNkeyParseCredsAndAuthenticate(t *testing.T) {
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ajwt, err := jwt.NewAccountClaims(apub).Encode(oKp)
+	require_NoError(t, err)
+
+	seed, public, err := GenerateNkeyUser()
+	require_NoError(t, err)
+	ujwt, err := jwt.NewUserClaims(public).Encode(akp)
+	require_NoError(t, err)
+	creds, err := jwt.FormatUserConfig(ujwt, []byte(seed))
+	require_NoError(t, err)
+
+	pjwt, pseed, err := ParseCreds(creds)
+	require_NoError(t, err)
+	require_Equal(t, pjwt, ujwt)
+	require_Equal(t, pseed, seed)
+
+	// The seed has to be the one of the JWT's user.
+	otherSeed, _, err := GenerateNkeyUser()
+	require_NoError(t, err)
+	bad, err := jwt.FormatUserConfig(ujwt, []byte(otherSeed))
+	require_NoError(t, err)
+	_, _, err = ParseCreds(bad)
+	require_Error(t, err)
+	_, _, err = ParseCreds([]byte("not a creds file"))
+	require_Error(t, err)
+
+	// The parsed credentials complete the nonce signing flow.
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+	addAccountToMemResolver(s, apub, ajwt)
+	c, cr, l := newClientForServer(s)
+	defer c.close()
+	var info nonceInfo
+	require_NoError(t, json.Unmarshal([]byte(l[5:]), &info))
+	sig, err := SignNonce(pseed, []byte(info.Nonce))
+	require_NoError(t, err)
+	c.parseAsync(fmt.Sprintf("CONNECT {\"verbose\":false,\"jwt\":%q,\"sig\":%q}\r\nPING\r\n", pjwt, sig))
+	l, _ = cr.ReadString('\n')
+	require_True(t, strings.HasPrefix(l, "PONG"))
+}
+
+func TestNkeyVerifyNonceSignature(t *testing.T) {
+	seed, public, err := GenerateNkeyUser()
+	require_NoError(t, err)
+	_, other, err := GenerateNkeyUser()
+	require_NoError(t, err)
+
+	nonce := []byte("abcdefghijk")
+	sig, err := SignNonce(seed, nonce)
+	require_NoError(t, err)
+	require_True(t, VerifyNonceSignature(public, nonce, sig))
+
+	// The standard base64 encoding is accepted as well.
+	raw, err := base64.RawURLEncoding.DecodeString(sig)
+	require_NoError(t, err)
+	require_True(t, VerifyNonceSignature(public, nonce, base64.StdEncoding.EncodeToString(raw)))
+
+	require_False(t, VerifyNonceSignature(public, []byte("other nonce"), sig))
+	require_False(t, VerifyNonceSignature(other, nonce, sig))
+	require_False(t, VerifyNonceSignature("not a key", nonce, sig))
+	require_False(t, VerifyNonceSignature(public, nonce, "not base64!"))
+	require_False(t, VerifyNonceSignature(public, nonce, _EMPTY_))
+}
@@ -78,6 +78,14 @@ type ClusterOpts struct {
 	NoAdvertise       bool              `json:"-"`
 	ConnectRetries    int               `json:"-"`
 
+	// Passwords are accepted from routes in addition to Password, which is
+	// the one this server connects with to the routes it discovers. This
+	// allows rotating the cluster secret without restarting all servers at
+	// once: the new secret is added to Passwords, then swapped with
+	// Password, then removed. Configured routes connect with the credentials
+	// of their URL, which is not changed by the rotation.
+	Passwords []string `json:"-"`
+
 	// Not exported (used in tests)
 	resolver netResolver
 	// Snapshot of configured TLS options.
@@ -245,6 +253,7 @@ type Options struct {
 	MaxControlLine        int32         `json:"max_control_line"`
 	MaxPayload            int32         `json:"max_payload"`
 	MaxPending            int64         `json:"max_pending"`
+	MaxCredentialLen      int           `json:"max_credential_len"`
 	Cluster               ClusterOpts   `json:"cluster,omitempty"`
 	Gateway               GatewayOpts   `json:"gateway,omitempty"`
 	LeafNode              LeafNodeOpts  `json:"leaf,omitempty"`
@@ -301,9 +310,241 @@ type Options struct {
 	// the server and so not presented as a configuration option
 	AlwaysEnableNonce bool
 
+	// NonceRawLen is the number of random bytes used to generate the
+	// nonce presented to new connections. Defaults to 11 bytes.
+	NonceRawLen int `json:"-"`
+
+	// AllowPreviousNonce accepts signatures over the nonce presented to
+	// the previous connection from the same host, for a short time, for
+	// clients that reconnect quickly using a cached INFO. The nonce is only
+	// accepted once, and only if its connection closed before sending
+	// CONNECT, so that clients sharing an address, such as behind a NAT or
+	// a proxy, can't use the nonces of the others.
+	AllowPreviousNonce bool `json:"allow_previous_nonce,omitempty"`
+
+	// UsersURL is an HTTP endpoint the users are fetched from when the
+	// server is created, in addition to the configured ones which take
+	// precedence. The document has the same schema as the authorization
+	// block. The users are not fetched again on reload, which keeps the
+	// ones fetched at startup.
+	UsersURL string `json:"-"`
+	// UsersURLTimeout is the timeout of the request to UsersURL.
+	UsersURLTimeout time.Duration `json:"-"`
+	// UsersURLToken is sent as a bearer token to UsersURL if set.
+	UsersURLToken string `json:"-"`
+	// UsersURLCache is a file where the users fetched from UsersURL are
+	// stored, and used instead if the endpoint can't be reached.
+	UsersURLCache string `json:"-"`
+
+	// MaxUsers is the maximum number of users and nkey users, including
+	// the ones fetched from UsersURL or added with Server.AddUser, to
+	// guard against provisioning bugs. Zero means no limit.
+	MaxUsers int `json:"-"`
+
+	// AuthFingerprintKey keys the digests of the secrets covered by
+	// Server.AuthConfigFingerprint. Servers sharing it, such as the nodes
+	// of a cluster, get the same fingerprint for the same authorization,
+	// so it must be the same on all of them and kept secret. When not set,
+	// the digests are keyed with a random salt of the server and the
+	// fingerprints can only be compared on that server. It can't be changed
+	// with a reload.
+	AuthFingerprintKey string `json:"-"`
+
+	// ServerSigningKey holds the seed of the nkey the server uses to sign
+	// the nonce presented to clients. The signature is sent in the INFO so
+	// that clients can verify the server identity against its public key
+	// before sending credentials.
+	ServerSigningKey SeedStore `json:"-"`
+
 	CustomClientAuthentication Authentication `json:"-"`
 	CustomRouterAuthentication Authentication `json:"-"`
 
+	// AuthStartupGracePeriod is the time after the server start during
+	// which the transient failures of a custom authentication implementing
+	// TransientAuthentication are retried instead of rejecting the client.
+	AuthStartupGracePeriod time.Duration `json:"auth_startup_grace_period,omitempty"`
+
+	// AuthHealthCheckInterval is the interval at which the custom
+	// authentications implementing HealthCheckedAuthentication are checked.
+	// Defaults to DEFAULT_AUTH_HEALTH_CHECK_INTERVAL. A check is a failure if
+	// it does not complete within DEFAULT_AUTH_HEALTH_CHECK_TIMEOUT, or the
+	// interval if shorter.
+	AuthHealthCheckInterval time.Duration `json:"-"`
+
+	// RejectCredentialsWhenNoAuth rejects clients sending credentials in
+	// their CONNECT while no authentication is configured, since this is
+	// likely a misconfiguration. By default such clients are accepted.
+	RejectCredentialsWhenNoAuth bool `json:"reject_credentials_when_no_auth,omitempty"`
+
+	// RequireClientName rejects clients that do not identify themselves
+	// with the name field of their CONNECT, so that all connections can
+	// be attributed, for instance in the connz monitoring endpoint.
+	RequireClientName bool `json:"require_client_name,omitempty"`
+
+	// MaxClientClockSkew, when set, rejects clients whose time, sent with
+	// the client_time field of their CONNECT, differs from the server's
+	// by more than this duration. Clients that do not send their time are
+	// accepted.
+	MaxClientClockSkew time.Duration `json:"max_client_clock_skew,omitempty"`
+
+	// ConnectPoWDifficulty, when set, requires clients to send with their
+	// CONNECT a proof of work for the nonce of the server's INFO, whose
+	// SHA-256 with the nonce has this number of leading zero bits, before
+	// they are authenticated. This deters connection floods, and only
+	// applies to new connections, not to connected clients on reload. It
+	// can't exceed 32, and each additional bit doubles the work of clients.
+	ConnectPoWDifficulty int `json:"connect_pow_difficulty,omitempty"`
+
+	// LocalAdmin is a break-glass credential accepted regardless of the
+	// authentication configuration, but only for client connections coming
+	// from the loopback interface. It is granted all permissions, even with
+	// NilPermissionsMeanDeny set. Websocket and MQTT connections are not
+	// accepted. Note that a proxy running on the same host, such as a TLS
+	// terminator forwarding to the listener, makes its remote clients appear
+	// local, so it must not be used along with it.
+	LocalAdmin *User `json:"-"`
+
+	// CustomAuthenticators are selected by clients through the auth_scheme
+	// field of their CONNECT. Clients naming an unknown scheme are rejected
+	// while the others go through the regular authentication. They do not
+	// make authentication required on their own, so clients that do not
+	// name a scheme are accepted when nothing else is configured.
+	CustomAuthenticators map[string]Authentication `json:"-"`
+
+	// AutoHashTokens will replace plaintext authorization tokens and user
+	// passwords with a bcrypt hash when authorization is configured, so
+	// that plaintext secrets are not kept in memory beyond startup. The
+	// server hashes a copy of the options, the given ones are not modified.
+	AutoHashTokens bool `json:"-"`
+
+	// PublishAuthEvents will publish the outcome of each client
+	// authentication on the $SYS.ACCOUNT.AUTH subject.
+	PublishAuthEvents bool `json:"-"`
+
+	// IPReputationCheck, if set, is invoked with the IP address of a client
+	// before any credential is verified. Returning false rejects the client
+	// and the reason is logged. It is called from the client's connection
+	// path, so implementations should cache their answers instead of doing
+	// a blocking lookup for each connection. Connected clients are not
+	// checked again on reload.
+	IPReputationCheck func(ip net.IP) (allow bool, reason string) `json:"-"`
+
+	// SilentPermissionViolations, when set, prevents an error from being
+	// sent to clients whose subscriptions are removed because they are no
+	// longer authorized after a configuration reload. The removal is
+	// still logged.
+	SilentPermissionViolations bool `json:"silent_permission_violations,omitempty"`
+
+	// LogFailedCredentialHashes, when set, logs a salted SHA-256 of the
+	// password or token of clients that fail to authenticate, so that
+	// repeated attempts with the same credential can be correlated without
+	// logging it. The salt is random for each server run.
+	LogFailedCredentialHashes bool `json:"log_failed_credential_hashes,omitempty"`
+
+	// SendPermissionsToClient, when set, sends an INFO with the allow and
+	// deny subjects of the client permissions after a successful CONNECT,
+	// to clients that support async INFO, so that they can avoid attempting
+	// operations that would be denied.
+	SendPermissionsToClient bool `json:"send_permissions_to_client,omitempty"`
+
+	// ProtectSystemSubjects, when set, denies clients publishing and
+	// subscribing on "$SYS.>" and "$JS.>" when their permissions allow
+	// them through a broader subject, such as ">", unless they explicitly
+	// allow the whole namespace. This prevents users granted ">" from
+	// inadvertently receiving system traffic.
+	ProtectSystemSubjects bool `json:"protect_system_subjects,omitempty"`
+
+	// NilPermissionsMeanDeny, when set, denies clients that have no
+	// permissions publishing and subscribing on any subject, instead of
+	// allowing everything. This includes the clients authorized with a
+	// token, a JWT without permissions or when no authentication is
+	// configured.
+	NilPermissionsMeanDeny bool `json:"nil_permissions_mean_deny,omitempty"`
+
+	// EnabledAuthMethods restricts the authentication methods clients can
+	// use, among "none", "custom", "jwt", "nkey", "token", "user" and "tls".
+	// Clients using a disabled method are rejected even if they present
+	// valid credentials. Empty means that all methods are enabled.
+	EnabledAuthMethods []string `json:"enabled_auth_methods,omitempty"`
+
+	// AdaptiveAuth, if set, restricts the authentication methods clients
+	// can use while the rate of new client connections is above a
+	// threshold, see AdaptiveAuthOpts.
+	AdaptiveAuth *AdaptiveAuthOpts `json:"adaptive_auth,omitempty"`
+
+	// TokenSigningKey is the secret used to verify signed tokens. Such a
+	// token embeds the account, permissions and expiration of the client,
+	// see NewSignedToken.
+	TokenSigningKey string `json:"-"`
+
+	// TokenValidator, if set, validates the tokens of clients against an
+	// external backend and provides their permissions, see TokenValidator.
+	TokenValidator TokenValidator `json:"-"`
+
+	// SecretDecryptor, if set, decrypts the authorization token, password
+	// and user passwords and pre-shared keys that are stored encrypted in
+	// the configuration, which are the ones prefixed with "enc:". The prefix
+	// is removed before the value is passed to the decryptor. Other secrets,
+	// and all of them when no decryptor is set, are used as they are.
+	SecretDecryptor func(ciphertext string) (string, error) `json:"-"`
+
+	// TokenValidatorCacheTTL is how long the results of the TokenValidator
+	// are cached. Defaults to DEFAULT_TOKEN_VALIDATOR_CACHE_TTL, a negative
+	// value disables the cache.
+	TokenValidatorCacheTTL time.Duration `json:"-"`
+
+	// RevokedNkeys lists user nkeys that are rejected even when the client
+	// proves it holds the private key. It can be updated with a reload.
+	RevokedNkeys []string `json:"revoked_nkeys,omitempty"`
+
+	// PolicyModule, if set, is the bytecode of a policy module consulted for
+	// each publish and subscribe of client and leafnode connections in
+	// addition to their permissions. The module is loaded by PolicyRuntime
+	// when the server is created, NewServer returns an error if there is no
+	// runtime. Neither can be changed with a reload. See auth_policy.go.
+	PolicyModule []byte `json:"-"`
+
+	// PolicyRuntime loads PolicyModule. The WASM runtime is provided by the
+	// github.com/nats-io/nats-server/v2/wasmpolicy module.
+	PolicyRuntime PolicyRuntime `json:"-"`
+
+	// PermissionsResolver, if set, resolves the permissions of client
+	// connections after they are authorized, without blocking the CONNECT.
+	// See PermissionsResolver.
+	PermissionsResolver PermissionsResolver `json:"-"`
+
+	// GroupSubjectsResolver, if set, returns the subjects a user may access
+	// based on its current group memberships, which are added to the allow
+	// lists of its permissions. It is called when the user connects and
+	// then every GroupSubjectsRefreshInterval, the subscriptions no longer
+	// allowed being removed, so that membership changes do not require a
+	// reload. Users without allow lists are not affected.
+	GroupSubjectsResolver func(user string) []string `json:"-"`
+
+	// GroupSubjectsRefreshInterval is the interval at which the group
+	// subjects of the connected users are resolved again. Defaults to
+	// DEFAULT_GROUP_SUBJECTS_REFRESH_INTERVAL.
+	GroupSubjectsRefreshInterval time.Duration `json:"-"`
+
+	// PrivilegedConnectCallback, if set, is invoked when a user flagged as
+	// an admin, the local admin, or a user allowed everything authenticates,
+	// so that privileged logins can be alerted on. It is invoked only once
+	// authentication succeeded, and should not block.
+	PrivilegedConnectCallback func(pc PrivilegedConnect) `json:"-"`
+
+	// PublishACL maps subject patterns to the identities of the only
+	// publishers allowed to publish on them, such as user names or nkeys,
+	// in addition to the publishers' own permissions. A publisher has to be
+	// listed for every pattern matching the subject.
+	PublishACL map[string][]string `json:"-"`
+
+	// AbsoluteDeny lists subjects no client can publish or subscribe to,
+	// whatever its permissions, including users without any restriction.
+	// Wildcard subscriptions overlapping them are allowed but never receive
+	// messages on the denied subjects. Messages and interest on the denied
+	// subjects are not accepted from nor sent to leafnodes and routes either.
+	AbsoluteDeny []string `json:"absolute_deny,omitempty"`
+
 	// CheckConfig configuration file syntax test was successful and exit.
 	CheckConfig bool `json:"-"`
 
@@ -365,6 +606,12 @@ type WebsocketOpts struct {
 	// "jwt" specified in the CONNECT options is missing or empty.
 	JWTCookie string
 
+	// Name of the query parameter of the WebSocket URL, which if present,
+	// will be treated as the authorization token during CONNECT phase for
+	// browser clients that can't set headers. It is ignored if the CONNECT
+	// contains any credentials.
+	TokenQueryParam string
+
 	// Authentication section. If anything is configured in this section,
 	// it will override the authorization configuration of regular clients.
 	Username string
@@ -530,6 +777,9 @@ func (o *Options) Clone() *Options {
 	if o.Cluster.TLSConfig != nil {
 		clone.Cluster.TLSConfig = o.Cluster.TLSConfig.Clone()
 	}
+	if o.Cluster.Passwords != nil {
+		clone.Cluster.Passwords = copyStrings(o.Cluster.Passwords)
+	}
 	if o.Gateway.TLSConfig != nil {
 		clone.Gateway.TLSConfig = o.Gateway.TLSConfig.Clone()
 	}
@@ -559,10 +809,11 @@ func deepCopyURLs(urls []*url.URL) []*url.URL {
 // Configuration file authorization section.
 type authorization struct {
 	// Singles
-	user  string
-	pass  string
-	token string
-	acc   string
+	user   string
+	pass   string
+	passes []string
+	token  string
+	acc    string
 	// Multiple Nkeys/Users
 	nkeys              []*NkeyUser
 	users              []*User
@@ -834,6 +1085,11 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.Password = auth.pass
 		o.Authorization = auth.token
 		o.AuthTimeout = auth.timeout
+		if auth.passes != nil {
+			err := &configErr{tk, "Authorization passwords are only supported for clusters, use a users array"}
+			*errors = append(*errors, err)
+			return
+		}
 		if (auth.user != _EMPTY_ || auth.pass != _EMPTY_) && auth.token != _EMPTY_ {
 			err := &configErr{tk, "Cannot have a user/pass and token"}
 			*errors = append(*errors, err)
@@ -968,6 +1224,8 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			return
 		}
 		o.MaxPayload = int32(v.(int64))
+	case "max_credential_len":
+		o.MaxCredentialLen = int(v.(int64))
 	case "max_pending":
 		o.MaxPending = v.(int64)
 	case "max_connections", "max_conn":
@@ -1330,6 +1588,92 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		}
 	case "no_auth_user":
 		o.NoAuthUser = v.(string)
+	case "silent_permission_violations":
+		o.SilentPermissionViolations = v.(bool)
+	case "log_failed_credential_hashes":
+		o.LogFailedCredentialHashes = v.(bool)
+	case "auth_startup_grace_period":
+		o.AuthStartupGracePeriod = parseDuration("auth_startup_grace_period", tk, v, errors, warnings)
+	case "reject_credentials_when_no_auth":
+		o.RejectCredentialsWhenNoAuth = v.(bool)
+	case "require_client_name":
+		o.RequireClientName = v.(bool)
+	case "max_client_clock_skew":
+		o.MaxClientClockSkew = parseDuration("max_client_clock_skew", tk, v, errors, warnings)
+	case "connect_pow_difficulty":
+		o.ConnectPoWDifficulty = int(v.(int64))
+	case "local_admin":
+		admin, err := parseLocalAdmin(tk, &lt, v)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.LocalAdmin = admin
+	case "publish_acl":
+		acl, err := parsePublishACL(tk, &lt, v, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.PublishACL = acl
+	case "absolute_deny":
+		subjects, err := parseStringArray("absolute deny", tk, &lt, v, errors, warnings)
+		if err != nil {
+			return
+		}
+		if err := validateAbsoluteDeny(subjects); err != nil {
+			*errors = append(*errors, &configErr{tk, err.Error()})
+			return
+		}
+		o.AbsoluteDeny = subjects
+	case "allow_previous_nonce":
+		o.AllowPreviousNonce = v.(bool)
+	case "max_users":
+		o.MaxUsers = int(v.(int64))
+	case "auth_fingerprint_key":
+		o.AuthFingerprintKey = v.(string)
+	case "users_url":
+		o.UsersURL = v.(string)
+	case "users_url_timeout":
+		o.UsersURLTimeout = parseDuration("users_url_timeout", tk, v, errors, warnings)
+	case "users_url_token":
+		o.UsersURLToken = v.(string)
+	case "users_url_cache":
+		o.UsersURLCache = v.(string)
+	case "server_signing_key":
+		ss, err := parseSeedStore(tk, &lt, v)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.ServerSigningKey = ss
+	case "send_permissions_to_client":
+		o.SendPermissionsToClient = v.(bool)
+	case "protect_system_subjects":
+		o.ProtectSystemSubjects = v.(bool)
+	case "nil_permissions_mean_deny":
+		o.NilPermissionsMeanDeny = v.(bool)
+	case "enabled_auth_methods":
+		methods, err := parseStringArray("enabled auth methods", tk, &lt, v, errors, warnings)
+		if err != nil {
+			return
+		}
+		o.EnabledAuthMethods = methods
+	case "adaptive_auth":
+		aa, err := parseAdaptiveAuth(tk, &lt, v, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.AdaptiveAuth = aa
+	case "token_signing_key":
+		o.TokenSigningKey = v.(string)
+	case "revoked_nkeys":
+		keys, err := parseStringArray("revoked nkeys", tk, &lt, v, errors, warnings)
+		if err != nil {
+			return
+		}
+		o.RevokedNkeys = keys
 	case "system_account", "system":
 		// Already processed at the beginning so we just skip them
 		// to not treat them as unknown values.
@@ -1584,6 +1928,7 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			}
 			opts.Cluster.Username = auth.user
 			opts.Cluster.Password = auth.pass
+			opts.Cluster.Passwords = auth.passes
 			opts.Cluster.AuthTimeout = auth.timeout
 
 			if auth.defaultPermissions != nil {
@@ -1629,6 +1974,25 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 		case "connect_retries":
 			opts.Cluster.ConnectRetries = int(mv.(int64))
 		case "permissions":
+			// Import rates only apply to routes, so they are parsed here
+			// and not as part of the user permissions.
+			var importRates []*PublishRate
+			if pm, ok := mv.(map[string]interface{}); ok {
+				upm := make(map[string]interface{}, len(pm))
+				for k, v := range pm {
+					if strings.ToLower(k) != "import_rates" {
+						upm[k] = v
+						continue
+					}
+					rates, err := parsePublishRates(v, errors)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					importRates = rates
+				}
+				mv = upm
+			}
 			perms, err := parseUserPermissions(mv, errors, warnings)
 			if err != nil {
 				*errors = append(*errors, err)
@@ -1640,6 +2004,13 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 				*errors = append(*errors, err)
 				continue
 			}
+			if perms.PublishRates != nil {
+				err := &configErr{tk, "Cluster permissions do not support publish rates, use import_rates"}
+				*errors = append(*errors, err)
+				continue
+			}
+			// Import is Publish, see setClusterPermissions.
+			perms.PublishRates = importRates
 			// This will possibly override permissions that were define in auth block
 			setClusterPermissions(&opts.Cluster, perms)
 		default:
@@ -1745,6 +2116,11 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 				*errors = append(*errors, err)
 				continue
 			}
+			if auth.passes != nil {
+				err := &configErr{tk, "Gateway authorization does not support passwords"}
+				*errors = append(*errors, err)
+				continue
+			}
 			o.Gateway.Username = auth.user
 			o.Gateway.Password = auth.pass
 			o.Gateway.AuthTimeout = auth.timeout
@@ -2476,8 +2852,9 @@ func setClusterPermissions(opts *ClusterOpts, perms *Permissions) {
 	// The parsing sets Import into Publish and Export into Subscribe, convert
 	// accordingly.
 	opts.Permissions = &RoutePermissions{
-		Import: perms.Publish,
-		Export: perms.Subscribe,
+		Import:      perms.Publish,
+		Export:      perms.Subscribe,
+		ImportRates: perms.PublishRates,
 	}
 }
 
@@ -2793,6 +3170,14 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						continue
 					}
 					acc.defaultPerms = permissions
+				case "token":
+					token := mv.(string)
+					if isBcrypt(token) {
+						err := &configErr{tk, fmt.Sprintf("Token of account %q can't be a bcrypt hash", aname)}
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.authToken = token
 				case "mappings", "maps":
 					err := parseAccountMappings(tk, acc, errors, warnings)
 					if err != nil {
@@ -3508,6 +3893,12 @@ func parseAuthorization(v interface{}, opts *Options, errors *[]error, warnings
 			auth.user = mv.(string)
 		case "pass", "password":
 			auth.pass = mv.(string)
+		case "passwords":
+			passes, err := parseStringArray("passwords", tk, &lt, mv, errors, warnings)
+			if err != nil {
+				continue
+			}
+			auth.passes = passes
 		case "token":
 			auth.token = mv.(string)
 		case "timeout":
@@ -3580,10 +3971,11 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 		}
 
 		var (
-			user  = &User{}
-			nkey  = &NkeyUser{}
-			perms *Permissions
-			err   error
+			user    = &User{}
+			nkey    = &NkeyUser{}
+			perms   *Permissions
+			denyMsg string
+			err     error
 		)
 		for k, v := range um {
 			// Also needs to unwrap first
@@ -3592,20 +3984,136 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 			switch strings.ToLower(k) {
 			case "nkey":
 				nkey.Nkey = v.(string)
+			case "ed25519_key":
+				nkey.Nkey = v.(string)
+				nkey.RawEd25519 = true
 			case "user", "username":
 				user.Username = v.(string)
 			case "pass", "password":
 				user.Password = v.(string)
+			case "passwords":
+				user.Passwords, err = parseStringArray("passwords", tk, &lt, v, errors, warnings)
+				if err != nil {
+					continue
+				}
 			case "permission", "permissions", "authorization":
 				perms, err = parseUserPermissions(tk, errors, warnings)
 				if err != nil {
 					*errors = append(*errors, err)
 					continue
 				}
+			case "tls_permissions":
+				user.TLSPermissions, err = parseUserPermissions(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+			case "deny_message":
+				denyMsg = v.(string)
 			case "allowed_connection_types", "connection_types", "clients":
 				cts := parseAllowedConnectionTypes(tk, &lt, v, errors, warnings)
 				nkey.AllowedConnectionTypes = cts
 				user.AllowedConnectionTypes = cts
+			case "require_tls":
+				nkey.RequireTLS = v.(bool)
+				user.RequireTLS = v.(bool)
+			case "require_cert_nkey":
+				nkey.RequireCertNkey = v.(bool)
+			case "require_signature":
+				user.RequireSignature = v.(bool)
+			case "either_credential":
+				user.EitherCredential = v.(bool)
+			case "password_optional":
+				user.PasswordOptional = v.(bool)
+			case "psk":
+				user.PSK = v.(string)
+			case "idle_timeout":
+				d := parseDuration("idle_timeout", tk, v, errors, warnings)
+				nkey.IdleTimeout = d
+				user.IdleTimeout = d
+			case "min_tls_version":
+				// Accept both "1.3" and 1.3
+				sv, ok := v.(string)
+				if !ok {
+					sv = fmt.Sprintf("%.1f", v)
+				}
+				version, err := tlsVersionFromString(sv)
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				nkey.MinTLSVersion = version
+				user.MinTLSVersion = version
+			case "namespace":
+				user.Namespace = v.(string)
+			case "namespaces":
+				nkey.Namespaces, err = parseStringArray("namespaces", tk, &lt, v, errors, warnings)
+				if err != nil {
+					continue
+				}
+			case "trace_denials":
+				user.TraceDenials = v.(bool)
+			case "admin":
+				nkey.Admin = v.(bool)
+				user.Admin = v.(bool)
+			case "options":
+				uo, err := parseUserOptions(tk, &lt, v)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				user.Options = uo
+			case "max_payload", "max_pay":
+				mp := v.(int64)
+				if mp < 0 || mp > 1<<31-1 {
+					err := &configErr{tk, fmt.Sprintf("Invalid user max payload %d", mp)}
+					*errors = append(*errors, err)
+					continue
+				}
+				user.MaxPayload = int32(mp)
+			case "max_pending":
+				user.MaxPending = v.(int64)
+			case "max_publish_subjects":
+				mps := v.(int64)
+				if mps < 0 {
+					err := &configErr{tk, fmt.Sprintf("Invalid user max publish subjects %d", mps)}
+					*errors = append(*errors, err)
+					continue
+				}
+				user.MaxPublishSubjects = int(mps)
+			case "max_publish_rate":
+				mpr := v.(int64)
+				if mpr < 0 {
+					err := &configErr{tk, fmt.Sprintf("Invalid user max publish rate %d", mpr)}
+					*errors = append(*errors, err)
+					continue
+				}
+				user.MaxPublishRate = int(mpr)
+			case "max_connections_per_ip":
+				mc := v.(int64)
+				if mc < 0 {
+					err := &configErr{tk, fmt.Sprintf("Invalid user max connections per IP %d", mc)}
+					*errors = append(*errors, err)
+					continue
+				}
+				user.MaxConnectionsPerIP = int(mc)
+			case "pinned_cert_sha256":
+				user.PinnedCertSHA256 = v.(string)
+			case "publish_rewrites":
+				rewrites, err := parsePublishRewrites(tk, &lt, v)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				user.PublishRewrites = rewrites
+			case "tags":
+				tags, err := parseUserTags(tk, &lt, v)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				nkey.Tags = tags
+				user.Tags = tags
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -3619,6 +4127,32 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 				}
 			}
 		}
+		// Users signing the nonce in addition to, or instead of, the
+		// password hold the nkey.
+		if user.RequireSignature || user.EitherCredential {
+			if user.RequireSignature && user.EitherCredential {
+				return nil, nil, &configErr{tk, "User can not both require a signature and accept either credential"}
+			}
+			if !nkeys.IsValidPublicUserKey(nkey.Nkey) {
+				msg := "User requiring a signature needs a valid public nkey"
+				if user.EitherCredential {
+					msg = "User accepting either credential needs a valid public nkey"
+				}
+				return nil, nil, &configErr{tk, msg}
+			}
+			user.Nkey, nkey.Nkey = nkey.Nkey, _EMPTY_
+		}
+
+		// The deny message of the user applies to its permissions that
+		// do not have their own.
+		if denyMsg != _EMPTY_ {
+			for _, p := range []*Permissions{perms, user.TLSPermissions} {
+				if p != nil && p.DenyMessage == _EMPTY_ {
+					p.DenyMessage = denyMsg
+				}
+			}
+		}
+
 		// Place perms if we have them.
 		if perms != nil {
 			// nkey takes precedent.
@@ -3634,13 +4168,20 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 			return nil, nil, &configErr{tk, "User entry requires a user"}
 		} else if nkey.Nkey != "" {
 			// Make sure the nkey a proper public nkey for a user..
-			if !nkeys.IsValidPublicUserKey(nkey.Nkey) {
+			if nkey.RawEd25519 {
+				if _, err := decodeRawEd25519Key(nkey.Nkey); err != nil {
+					return nil, nil, &configErr{tk, fmt.Sprintf("Not a valid Ed25519 public key: %v", err)}
+				}
+			} else if !nkeys.IsValidPublicUserKey(nkey.Nkey) {
 				return nil, nil, &configErr{tk, "Not a valid public nkey for a user"}
 			}
 			// If we have user or password defined here that is an error.
-			if user.Username != "" || user.Password != "" {
+			if user.Username != "" || user.Password != "" || len(user.Passwords) > 0 {
 				return nil, nil, &configErr{tk, "Nkey users do not take usernames or passwords"}
 			}
+			if user.TLSPermissions != nil {
+				return nil, nil, &configErr{tk, "Nkey users do not take TLS permissions"}
+			}
 			keys = append(keys, nkey)
 		} else {
 			users = append(users, user)
@@ -3649,6 +4190,183 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 	return keys, users, nil
 }
 
+// Helper function to parse the key/value metadata tags of a user.
+func parseUserTags(tk token, lt *token, mv interface{}) (map[string]string, error) {
+	tm, ok := mv.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected tags to be a map/struct, got %v", mv)}
+	}
+	tags := make(map[string]string, len(tm))
+	for k, v := range tm {
+		vtk, v := unwrapValue(v, lt)
+		tv, ok := v.(string)
+		if !ok {
+			return nil, &configErr{vtk, fmt.Sprintf("Expected tag %q value to be a string, got %T", k, v)}
+		}
+		tags[k] = tv
+	}
+	return tags, nil
+}
+
+// parseLocalAdmin parses the user and password of the local admin.
+func parseLocalAdmin(tk token, lt *token, mv interface{}) (*User, error) {
+	am, ok := mv.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected local admin to be a map/struct, got %v", mv)}
+	}
+	admin := &User{}
+	for k, v := range am {
+		vtk, v := unwrapValue(v, lt)
+		sv, ok := v.(string)
+		if !ok {
+			return nil, &configErr{vtk, fmt.Sprintf("Expected local admin %q to be a string, got %T", k, v)}
+		}
+		switch strings.ToLower(k) {
+		case "user", "username":
+			admin.Username = sv
+		case "pass", "password":
+			admin.Password = sv
+		default:
+			return nil, &configErr{vtk, fmt.Sprintf("Unknown field %q in local admin", k)}
+		}
+	}
+	return admin, nil
+}
+
+// parseUserOptions parses the protocol features forced off for a user.
+func parseUserOptions(tk token, lt *token, mv interface{}) (*UserOptions, error) {
+	om, ok := mv.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected user options to be a map/struct, got %v", mv)}
+	}
+	uo := &UserOptions{}
+	for k, v := range om {
+		vtk, v := unwrapValue(v, lt)
+		bv, ok := v.(bool)
+		if !ok {
+			return nil, &configErr{vtk, fmt.Sprintf("Expected user option %q to be a boolean, got %T", k, v)}
+		}
+		switch strings.ToLower(k) {
+		case "no_echo":
+			uo.NoEcho = bv
+		case "no_verbose":
+			uo.NoVerbose = bv
+		case "no_headers":
+			uo.NoHeaders = bv
+		default:
+			return nil, &configErr{vtk, fmt.Sprintf("Unknown field %q in user options", k)}
+		}
+	}
+	return uo, nil
+}
+
+// parseAdaptiveAuth parses the adaptive authentication options.
+func parseAdaptiveAuth(tk token, lt *token, mv interface{}, errors, warnings *[]error) (*AdaptiveAuthOpts, error) {
+	am, ok := mv.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected adaptive auth to be a map/struct, got %v", mv)}
+	}
+	aa := &AdaptiveAuthOpts{}
+	for k, v := range am {
+		vtk, v := unwrapValue(v, lt)
+		switch strings.ToLower(k) {
+		case "connect_rate":
+			rate, ok := v.(int64)
+			if !ok {
+				return nil, &configErr{vtk, fmt.Sprintf("Expected adaptive auth %q to be a number, got %T", k, v)}
+			}
+			aa.ConnectRate = int(rate)
+		case "methods":
+			methods, err := parseStringArray("adaptive auth methods", vtk, lt, v, errors, warnings)
+			if err != nil {
+				return nil, err
+			}
+			aa.Methods = methods
+		case "cooldown":
+			aa.Cooldown = parseDuration("cooldown", vtk, v, errors, warnings)
+		default:
+			return nil, &configErr{vtk, fmt.Sprintf("Unknown field %q in adaptive auth", k)}
+		}
+	}
+	if err := validateAdaptiveAuth(aa); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return aa, nil
+}
+
+// parsePublishACL parses the map of subject patterns to the publishers
+// allowed to publish on them.
+func parsePublishACL(tk token, lt *token, mv interface{}, errors, warnings *[]error) (map[string][]string, error) {
+	am, ok := mv.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected publish ACL to be a map/struct, got %v", mv)}
+	}
+	acl := make(map[string][]string, len(am))
+	for subject, v := range am {
+		vtk, v := unwrapValue(v, lt)
+		ids, err := parseStringArray("publish ACL publishers", vtk, lt, v, errors, warnings)
+		if err != nil {
+			return nil, err
+		}
+		acl[subject] = ids
+	}
+	if err := validatePublishACL(acl); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return acl, nil
+}
+
+// parseSeedStore parses the location of a seed, either a file path or a
+// map with a "file" or "env" field.
+func parseSeedStore(tk token, lt *token, mv interface{}) (SeedStore, error) {
+	switch v := mv.(type) {
+	case string:
+		return &FileSeedStore{Path: v}, nil
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return nil, &configErr{tk, "Expected seed location to have a single \"file\" or \"env\" field"}
+		}
+		for k, v := range v {
+			vtk, v := unwrapValue(v, lt)
+			sv, ok := v.(string)
+			if !ok || sv == _EMPTY_ {
+				return nil, &configErr{vtk, fmt.Sprintf("Expected seed %q to be a non empty string, got %v", k, v)}
+			}
+			switch strings.ToLower(k) {
+			case "file":
+				return &FileSeedStore{Path: sv}, nil
+			case "env":
+				return &EnvSeedStore{Name: sv}, nil
+			default:
+				return nil, &configErr{vtk, fmt.Sprintf("Unknown field %q in seed location", k)}
+			}
+		}
+	}
+	return nil, &configErr{tk, fmt.Sprintf("Expected seed location to be a file path or a map/struct, got %v", mv)}
+}
+
+// parsePublishRewrites parses the map of published subjects to the subjects
+// they are rewritten to.
+func parsePublishRewrites(tk token, lt *token, mv interface{}) (map[string]string, error) {
+	rm, ok := mv.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected publish rewrites to be a map/struct, got %v", mv)}
+	}
+	rewrites := make(map[string]string, len(rm))
+	for k, v := range rm {
+		vtk, v := unwrapValue(v, lt)
+		dest, ok := v.(string)
+		if !ok {
+			return nil, &configErr{vtk, fmt.Sprintf("Expected publish rewrite %q destination to be a string, got %T", k, v)}
+		}
+		rewrites[k] = dest
+	}
+	if _, err := newPublishRewrites(rewrites); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return rewrites, nil
+}
+
 func parseAllowedConnectionTypes(tk token, lt *token, mv interface{}, errors *[]error, warnings *[]error) map[string]struct{} {
 	cts, err := parseStringArray("allowed connection types", tk, lt, mv, errors, warnings)
 	// If error, it has already been added to the `errors` array, simply return
@@ -3720,6 +4438,60 @@ func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissio
 					p.Publish.Allow = []string{}
 				}
 			}
+		case "publish_rates":
+			rates, err := parsePublishRates(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.PublishRates = rates
+		case "required_headers":
+			headers, err := parseRequiredHeaders(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.RequiredHeaders = headers
+		case "subscribe_header_filters":
+			filters, err := parseHeaderFilters(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.SubscribeHeaderFilters = filters
+		case "grants":
+			grants, err := parsePermissionGrants(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.Grants = grants
+		case "queue_required":
+			subjects, err := parsePermSubjects(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.QueueRequired = subjects
+		case "request_only":
+			subjects, err := parsePermSubjects(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.RequestOnly = subjects
+		case "max_wildcard_tokens":
+			max, ok := mv.(int64)
+			if !ok || max < 0 {
+				err := &configErr{tk, fmt.Sprintf("Expected max_wildcard_tokens to be a positive integer, got %v", mv)}
+				*errors = append(*errors, err)
+				continue
+			}
+			p.MaxWildcardTokens = int(max)
+		case "allow_own_inbox":
+			p.AllowOwnInbox = mv.(bool)
+		case "deny_message":
+			p.DenyMessage = mv.(string)
 		default:
 			if !tk.IsUsedVariable() {
 				err := &configErr{tk, fmt.Sprintf("Unknown field %q parsing permissions", k)}
@@ -3730,6 +4502,201 @@ func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissio
 	return p, nil
 }
 
+// Helper function to parse publish rate limits, e.g.
+// publish_rates: [{subject: "metrics.>", rate: 100, drop: true}]
+func parsePublishRates(v interface{}, errors *[]error) ([]*PublishRate, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected publish rates to be an array, got %T", v)}
+	}
+	var rates []*PublishRate
+	for _, e := range arr {
+		tk, e := unwrapValue(e, &lt)
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected publish rate to be a map/struct, got %T", e)}
+		}
+		pr := &PublishRate{}
+		for k, v := range m {
+			tk, v := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "subject":
+				pr.Subject = v.(string)
+			case "rate":
+				pr.Rate = int(v.(int64))
+			case "drop":
+				pr.Drop = v.(bool)
+			default:
+				return nil, &configErr{tk, fmt.Sprintf("Unknown field %q parsing publish rate", k)}
+			}
+		}
+		if !IsValidSubject(pr.Subject) {
+			return nil, &configErr{tk, fmt.Sprintf("Invalid publish rate subject %q", pr.Subject)}
+		}
+		if pr.Rate <= 0 {
+			return nil, &configErr{tk, fmt.Sprintf("Publish rate for %q must be positive", pr.Subject)}
+		}
+		rates = append(rates, pr)
+	}
+	return rates, nil
+}
+
+// parseHeaderFilters parses the list of header values required for messages
+// to be delivered on given subjects.
+func parseHeaderFilters(v interface{}, errors *[]error) ([]*HeaderFilter, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected header filters to be an array, got %T", v)}
+	}
+	var filters []*HeaderFilter
+	for _, e := range arr {
+		tk, e := unwrapValue(e, &lt)
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected header filter to be a map/struct, got %T", e)}
+		}
+		hf := &HeaderFilter{}
+		for k, v := range m {
+			tk, v := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "subject":
+				hf.Subject = v.(string)
+			case "header":
+				hf.Header = v.(string)
+			case "values":
+				switch vv := v.(type) {
+				case string:
+					hf.Values = []string{vv}
+				case []interface{}:
+					for _, i := range vv {
+						tk, i := unwrapValue(i, &lt)
+						s, ok := i.(string)
+						if !ok {
+							return nil, &configErr{tk, fmt.Sprintf("Expected header filter value to be a string, got %T", i)}
+						}
+						hf.Values = append(hf.Values, s)
+					}
+				default:
+					return nil, &configErr{tk, fmt.Sprintf("Expected header filter values to be a string or array, got %T", v)}
+				}
+			default:
+				return nil, &configErr{tk, fmt.Sprintf("Unknown field %q parsing header filter", k)}
+			}
+		}
+		if !IsValidSubject(hf.Subject) {
+			return nil, &configErr{tk, fmt.Sprintf("Invalid header filter subject %q", hf.Subject)}
+		}
+		if hf.Header == _EMPTY_ {
+			return nil, &configErr{tk, fmt.Sprintf("Header filter for %q must have a header name", hf.Subject)}
+		}
+		filters = append(filters, hf)
+	}
+	return filters, nil
+}
+
+// parseRequiredHeaders parses the list of headers required to publish on
+// some subjects, each entry being a map with a subject and a header.
+func parseRequiredHeaders(v interface{}, errors *[]error) ([]*RequiredHeader, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected required headers to be an array, got %T", v)}
+	}
+	var headers []*RequiredHeader
+	for _, e := range arr {
+		tk, e := unwrapValue(e, &lt)
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected required header to be a map/struct, got %T", e)}
+		}
+		rh := &RequiredHeader{}
+		for k, v := range m {
+			tk, v := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "subject":
+				rh.Subject = v.(string)
+			case "header":
+				rh.Header = v.(string)
+			default:
+				return nil, &configErr{tk, fmt.Sprintf("Unknown field %q parsing required header", k)}
+			}
+		}
+		if !IsValidSubject(rh.Subject) {
+			return nil, &configErr{tk, fmt.Sprintf("Invalid required header subject %q", rh.Subject)}
+		}
+		if rh.Header == _EMPTY_ {
+			return nil, &configErr{tk, fmt.Sprintf("Required header for %q must have a header name", rh.Subject)}
+		}
+		headers = append(headers, rh)
+	}
+	return headers, nil
+}
+
+// parsePermissionGrants parses an array of grants, each with publish and/or
+// subscribe subjects and an expiration date.
+func parsePermissionGrants(v interface{}, errors, warnings *[]error) ([]*PermissionGrant, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected grants to be an array, got %T", v)}
+	}
+	var grants []*PermissionGrant
+	for _, e := range arr {
+		tk, e := unwrapValue(e, &lt)
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected grant to be a map/struct, got %T", e)}
+		}
+		g := &PermissionGrant{}
+		for k, v := range m {
+			tk, v := unwrapValue(v, &lt)
+			var err error
+			switch strings.ToLower(k) {
+			case "pub", "publish":
+				g.Publish, err = parsePermSubjects(tk, errors, warnings)
+			case "sub", "subscribe":
+				g.Subscribe, err = parsePermSubjects(tk, errors, warnings)
+			case "expires":
+				switch vv := v.(type) {
+				case time.Time:
+					g.Expires = vv
+				case string:
+					g.Expires, err = time.Parse(time.RFC3339, vv)
+				default:
+					err = fmt.Errorf("unexpected type %T", v)
+				}
+				if err != nil {
+					err = &configErr{tk, fmt.Sprintf("Invalid grant expiration: %v", err)}
+				}
+			default:
+				err = &configErr{tk, fmt.Sprintf("Unknown field %q parsing grant", k)}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if g.Expires.IsZero() {
+			return nil, &configErr{tk, "Grant must have an expiration"}
+		}
+		grants = append(grants, g)
+	}
+	return grants, nil
+}
+
 // Top level parser for authorization configurations.
 func parseVariablePermissions(v interface{}, errors, warnings *[]error) (*SubjectPermission, error) {
 	switch vv := v.(type) {
@@ -3851,6 +4818,8 @@ func parseSubjectPermission(v interface{}, errors, warnings *[]error) (*SubjectP
 		return nil, nil
 	}
 	p := &SubjectPermission{}
+	// Subjects loaded from files are merged after the inline ones.
+	var allowFromFile, denyFromFile []string
 	for k, v := range m {
 		tk, _ := unwrapValue(v, &lt)
 		switch strings.ToLower(k) {
@@ -3867,20 +4836,252 @@ func parseSubjectPermission(v interface{}, errors, warnings *[]error) (*SubjectP
 				*errors = append(*errors, err)
 				continue
 			}
+			if err := checkNoExactSubjects(subjects); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
 			p.Deny = subjects
+		case "allow_file":
+			subjects, err := parsePermSubjectsFile(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			allowFromFile = subjects
+		case "deny_file":
+			subjects, err := parsePermSubjectsFile(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if err := checkNoExactSubjects(subjects); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			denyFromFile = subjects
+		case "allow_trie_file":
+			sl, err := parsePermSubjectsTrieFile(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.allowTrie, p.AllowTrieDigest = sl, sublistDigest(sl)
+		case "deny_trie_file":
+			sl, err := parsePermSubjectsTrieFile(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.denyTrie, p.DenyTrieDigest = sl, sublistDigest(sl)
 		default:
 			if !tk.IsUsedVariable() {
-				err := &configErr{tk, fmt.Sprintf("Unknown field name %q parsing subject permissions, only 'allow' or 'deny' are permitted", k)}
+				err := &configErr{tk, fmt.Sprintf("Unknown field name %q parsing subject permissions, only 'allow', 'deny', 'allow_file', 'deny_file', 'allow_trie_file' or 'deny_trie_file' are permitted", k)}
 				*errors = append(*errors, err)
 			}
 		}
 	}
+	p.Allow = append(p.Allow, allowFromFile...)
+	p.Deny = append(p.Deny, denyFromFile...)
+	// Subjects loaded from a prefix tree are only in its sublist, but the
+	// allow list must not be nil for the allow to be enforced.
+	if p.allowTrie != nil && p.Allow == nil {
+		p.Allow = []string{}
+	}
 	return p, nil
 }
 
+// permSubjectsFilePath returns the path of the subjects file the token
+// refers to. Relative paths are resolved against the directory of the
+// configuration file holding the token, as for includes.
+func permSubjectsFilePath(tk token) (string, error) {
+	path, ok := tk.Value().(string)
+	if !ok {
+		return _EMPTY_, &configErr{tk, fmt.Sprintf("Expected subjects file to be a path, got %T", tk.Value())}
+	}
+	if !filepath.IsAbs(path) && tk.SourceFile() != _EMPTY_ {
+		path = filepath.Join(filepath.Dir(tk.SourceFile()), path)
+	}
+	return path, nil
+}
+
+// parsePermSubjectsFile loads the subjects listed in the file the token
+// refers to, one per line. As in the allow and deny arrays, a subject can be
+// followed by a queue group name, such as "foo bar". Blank lines and lines
+// starting with '#' or '//' are ignored.
+func parsePermSubjectsFile(tk token) ([]string, error) {
+	path, err := permSubjectsFilePath(tk)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &configErr{tk, fmt.Sprintf("error reading subjects file: %v", err)}
+	}
+	var subjects []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == _EMPTY_ || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if checkPermSubjectArray([]string{line}) != nil {
+			return nil, &configErr{tk, fmt.Sprintf("subject %q on line %d of %q is not a valid subject", line, i+1, path)}
+		}
+		subjects = append(subjects, line)
+	}
+	return subjects, nil
+}
+
+// parsePermSubjectsTrieFile loads the subjects stored as a prefix tree in
+// the file the token refers to. See parseSubjectTrie for the format.
+func parsePermSubjectsTrieFile(tk token) (*Sublist, error) {
+	path, err := permSubjectsFilePath(tk)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &configErr{tk, fmt.Sprintf("error reading subjects file: %v", err)}
+	}
+	sl, err := parseSubjectTrie(data)
+	if err != nil {
+		return nil, &configErr{tk, fmt.Sprintf("%v of %q", err, path)}
+	}
+	return sl, nil
+}
+
+// subjectTrieNode is a node of the prefix tree being read by parseSubjectTrie.
+type subjectTrieNode struct {
+	indent   int
+	subject  []byte
+	children bool
+	// The node of the subject in the sublist being built.
+	node *node
+}
+
+// followsFullWildcard returns true if the last token of the subject of the
+// node is a full wildcard, which can't be followed by other tokens.
+func (n *subjectTrieNode) followsFullWildcard() bool {
+	l := len(n.subject)
+	return n.subject[l-1] == fwc && (l == 1 || n.subject[l-2] == btsep)
+}
+
+// parseSubjectTrie returns a sublist of the subjects of a prefix tree. Each line holds
+// one or more tokens and is indented under the line that is its prefix.
+// A line without children is a subject, and a "." child makes its parent a
+// subject too:
+//
+//	orders
+//	  .
+//	  us.*
+//	  eu
+//	    >
+//
+// holds "orders", "orders.us.*" and "orders.eu.>". Lines are indented with
+// either spaces or tabs, not both. Only the tokens of each line are
+// validated and added to the sublist below the node of their prefix, so
+// prefixes shared by many subjects are parsed and walked once. The
+// sublist is built once per configuration and shared by all the clients
+// using the permissions, instead of being compiled for each of them.
+// Queue groups are not supported, subjects that need one must be listed in
+// the allow or deny arrays or files instead.
+// Blank lines and lines starting with '#' or '//' are ignored.
+func parseSubjectTrie(data []byte) (*Sublist, error) {
+	sl := NewSublistWithCache()
+	// The subject of the nodes is not modified once set, so it is shared
+	// with their subscription.
+	add := func(n *subjectTrieNode) {
+		sl.insertAt(n.node, &subscription{subject: n.subject})
+	}
+	var stack []subjectTrieNode
+	// The character used for indentation, set by the first indented line.
+	var indentChar byte
+	// Close the nodes that are not prefixes of a line with that indent.
+	closeNodes := func(indent int) {
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			if n := &stack[len(stack)-1]; !n.children {
+				add(n)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	text := string(data)
+	for i := 0; text != _EMPTY_; i++ {
+		line := text
+		if eol := strings.IndexByte(text, '\n'); eol >= 0 {
+			line, text = text[:eol], text[eol+1:]
+		} else {
+			text = _EMPTY_
+		}
+		tokens := strings.TrimSpace(line)
+		if tokens == _EMPTY_ || strings.HasPrefix(tokens, "#") || strings.HasPrefix(tokens, "//") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		for j := 0; j < indent; j++ {
+			if indentChar == 0 {
+				indentChar = line[j]
+			} else if line[j] != indentChar {
+				return nil, fmt.Errorf("indentation of line %d mixes tabs and spaces", i+1)
+			}
+		}
+		closeNodes(indent)
+		// Only used before the stack is appended to.
+		var parent *subjectTrieNode
+		if len(stack) > 0 {
+			parent = &stack[len(stack)-1]
+		}
+		if tokens == "." {
+			if parent == nil {
+				return nil, fmt.Errorf("\".\" on line %d has no prefix", i+1)
+			}
+			parent.children = true
+			add(parent)
+			continue
+		}
+		if strings.ContainsAny(tokens, " \t") {
+			return nil, fmt.Errorf("tokens %q on line %d have a queue group, which is not supported", tokens, i+1)
+		}
+		if !IsValidSubject(tokens) {
+			return nil, fmt.Errorf("tokens %q on line %d are not valid", tokens, i+1)
+		}
+		var subject []byte
+		level := sl.root
+		if parent != nil {
+			if parent.followsFullWildcard() {
+				return nil, fmt.Errorf("tokens %q on line %d follow a full wildcard", tokens, i+1)
+			}
+			parent.children = true
+			subject = make([]byte, 0, len(parent.subject)+1+len(tokens))
+			subject = append(append(subject, parent.subject...), btsep)
+			level = parent.node.next
+		}
+		subject = append(subject, tokens...)
+		stack = append(stack, subjectTrieNode{indent: indent, subject: subject, node: level.addTokens(tokens)})
+	}
+	closeNodes(-1)
+	return sl, nil
+}
+
+// checkNoExactSubjects returns an error if a deny list uses the "exact:"
+// qualifier, which is only meaningful for allow lists.
+func checkNoExactSubjects(deny []string) error {
+	for _, s := range deny {
+		if strings.HasPrefix(s, exactSubjectPrefix) {
+			return fmt.Errorf("deny subject %q can't be qualified with %q", s, exactSubjectPrefix)
+		}
+	}
+	return nil
+}
+
 // Helper function to validate permissions subjects.
 func checkPermSubjectArray(sa []string) error {
 	for _, s := range sa {
+		if strings.HasPrefix(s, exactSubjectPrefix) {
+			if exact := strings.TrimPrefix(s, exactSubjectPrefix); !IsValidLiteralSubject(exact) {
+				return fmt.Errorf("exact subject %q is not a valid literal subject", exact)
+			}
+			continue
+		}
 		if !IsValidSubject(s) {
 			// Check here if this is a queue group qualified subject.
 			elements := strings.Fields(s)
@@ -4277,6 +5478,8 @@ func parseWebsocket(v interface{}, o *Options, errors *[]error, warnings *[]erro
 			o.Websocket.AuthTimeout = auth.timeout
 		case "jwt_cookie":
 			o.Websocket.JWTCookie = mv.(string)
+		case "token_query_param":
+			o.Websocket.TokenQueryParam = mv.(string)
 		case "no_auth_user":
 			o.Websocket.NoAuthUser = mv.(string)
 		default:
@@ -4710,6 +5913,9 @@ func setBaselineOptions(opts *Options) {
 	if opts.MaxPending == 0 {
 		opts.MaxPending = MAX_PENDING_SIZE
 	}
+	if opts.MaxCredentialLen == 0 {
+		opts.MaxCredentialLen = MAX_CREDENTIAL_LEN
+	}
 	if opts.WriteDeadline == time.Duration(0) {
 		opts.WriteDeadline = DEFAULT_FLUSH_DEADLINE
 	}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
@@ -60,6 +61,7 @@ func TestDefaultOptions(t *testing.T) {
 		MaxControlLine:      MAX_CONTROL_LINE_SIZE,
 		MaxPayload:          MAX_PAYLOAD_SIZE,
 		MaxPending:          MAX_PENDING_SIZE,
+		MaxCredentialLen:    MAX_CREDENTIAL_LEN,
 		WriteDeadline:       DEFAULT_FLUSH_DEADLINE,
 		MaxClosedClients:    DEFAULT_MAX_CLOSED_CLIENTS,
 		LameDuckDuration:    DEFAULT_LAME_DUCK_DURATION,
@@ -1124,6 +1126,7 @@ func TestNkeyUsersWithPermsConfig(t *testing.T) {
 
 func TestBadNkeyConfig(t *testing.T) {
 	confFileName := "nkeys_bad.conf"
+	defer removeFile(t, confFileName)
 	content := `
     authorization {
       users = [ {nkey: "Ufoo"}]
@@ -1138,6 +1141,7 @@ func TestBadNkeyConfig(t *testing.T) {
 
 func TestNkeyWithPassConfig(t *testing.T) {
 	confFileName := "nkeys_pass.conf"
+	defer removeFile(t, confFileName)
 	content := `
     authorization {
       users = [
@@ -1154,6 +1158,7 @@ func TestNkeyWithPassConfig(t *testing.T) {
 
 func TestTokenWithUserPass(t *testing.T) {
 	confFileName := "test.conf"
+	defer removeFile(t, confFileName)
 	content := `
 	authorization={
 		user: user
@@ -1174,6 +1179,7 @@ func TestTokenWithUserPass(t *testing.T) {
 
 func TestTokenWithUsers(t *testing.T) {
 	confFileName := "test.conf"
+	defer removeFile(t, confFileName)
 	content := `
 	authorization={
 		token: $2a$11$whatever
@@ -1753,6 +1759,59 @@ func TestClusterPermissionsConfig(t *testing.T) {
 	}
 }
 
+func TestClusterImportRatesConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		cluster {
+			port: -1
+			permissions {
+				import: "foo.>"
+				import_rates: [{subject: "foo.>", rate: 10, drop: true}]
+			}
+		}
+	`))
+	opts, err := ProcessConfigFile(conf)
+	require_NoError(t, err)
+	require_True(t, opts.Cluster.Permissions != nil)
+	rates := opts.Cluster.Permissions.ImportRates
+	require_True(t, len(rates) == 1)
+	require_Equal(t, rates[0].Subject, "foo.>")
+	require_True(t, rates[0].Rate == 10 && rates[0].Drop)
+
+	// Import rates are only accepted in the cluster permissions, and
+	// publish rates are not accepted there.
+	for _, test := range []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{"user", `
+			authorization {
+				users = [{user: a, password: pwd, permissions: {
+					import_rates: [{subject: "foo.>", rate: 10}]
+				}}]
+			}`, `Unknown field "import_rates" parsing permissions`},
+		{"default permissions", `
+			authorization {
+				default_permissions: {import_rates: [{subject: "foo.>", rate: 10}]}
+			}`, `Unknown field "import_rates" parsing permissions`},
+		{"cluster publish rates", `
+			cluster {
+				port: -1
+				permissions {
+					publish_rates: [{subject: "foo.>", rate: 10}]
+				}
+			}`, "Cluster permissions do not support publish rates"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.conf))
+			_, err := ProcessConfigFile(conf)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
 func TestParseServiceLatency(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -3291,3 +3350,289 @@ func TestAuthorizationAndAccountsMisconfigurations(t *testing.T) {
 		})
 	}
 }
+
+func TestPermissionsSubjectsFile(t *testing.T) {
+	dir := t.TempDir()
+	allowFile := filepath.Join(dir, "allow.txt")
+	writeSubjects := func(content string) {
+		t.Helper()
+		require_NoError(t, os.WriteFile(allowFile, []byte(content), 0644))
+	}
+	writeSubjects(`
+		# Orders service
+		orders.*
+
+		// Billing
+		billing.>
+	`)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: alice, password: pwd, permissions: {publish: {allow: "inline", allow_file: %q, deny: "billing.secret"}}}
+			]
+		}
+	`, allowFile)))
+	opts, err := ProcessConfigFile(conf)
+	require_NoError(t, err)
+	p := opts.Users[0].Permissions.Publish
+	require_Equal(t, strings.Join(p.Allow, ","), "inline,orders.*,billing.>")
+	require_Equal(t, strings.Join(p.Deny, ","), "billing.secret")
+
+	// The file is loaded again on reload.
+	s := RunServer(opts)
+	defer s.Shutdown()
+	writeSubjects("shipping.>\n")
+	require_NoError(t, s.Reload())
+	s.mu.RLock()
+	p = s.users["alice"].Permissions.Publish
+	s.mu.RUnlock()
+	require_Equal(t, strings.Join(p.Allow, ","), "inline,shipping.>")
+
+	// Invalid subjects and missing files are errors.
+	writeSubjects("orders.*\nbad..subject\n")
+	_, err = ProcessConfigFile(conf)
+	require_Error(t, err)
+	require_Contains(t, err.Error(), `subject "bad..subject" on line 2`)
+	require_NoError(t, os.Remove(allowFile))
+	_, err = ProcessConfigFile(conf)
+	require_Error(t, err)
+	require_Contains(t, err.Error(), "error reading subjects file")
+
+	// Relative paths are resolved against the directory of the configuration
+	// file, and subjects can have a queue group.
+	writeSubjects("orders.*\nbilling.> workers\n")
+	conf = filepath.Join(dir, "nats.conf")
+	require_NoError(t, os.WriteFile(conf, []byte(`
+		authorization {
+			users: [
+				{user: alice, password: pwd, permissions: {subscribe: {allow_file: "allow.txt"}}}
+			]
+		}
+	`), 0644))
+	opts, err = ProcessConfigFile(conf)
+	require_NoError(t, err)
+	p = opts.Users[0].Permissions.Subscribe
+	require_Equal(t, strings.Join(p.Allow, ","), "orders.*,billing.> workers")
+	c := &client{kind: CLIENT}
+	c.setPermissions(opts.Users[0].Permissions)
+	require_True(t, c.canSubscribe("billing.invoices", "workers"))
+	require_False(t, c.canSubscribe("billing.invoices"))
+}
+
+func TestPermissionsSubjectsTrieFile(t *testing.T) {
+	dir := t.TempDir()
+	flatFile := filepath.Join(dir, "allow.txt")
+	trieFile := filepath.Join(dir, "allow.trie")
+	require_NoError(t, os.WriteFile(flatFile, []byte(`
+		orders
+		orders.us.east
+		orders.us.west
+		orders.eu.*
+		billing.>
+		$SYS.REQ.SERVER.PING
+	`), 0644))
+	require_NoError(t, os.WriteFile(trieFile, []byte(`
+# Orders service
+orders
+  .
+  us
+    east
+    west
+  eu.*
+
+// Billing
+billing
+  >
+$SYS.REQ.SERVER
+  PING
+`), 0644))
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: alice, password: pwd, permissions: {publish: {allow_file: %q}}}
+				{user: bob, password: pwd, permissions: {publish: {allow: "inline", allow_trie_file: %q, deny_trie_file: %q}}}
+				{user: carol, password: pwd, permissions: {publish: {allow_trie_file: %q}, subscribe: {allow: ">", deny_trie_file: %q}}}
+			]
+		}
+	`, flatFile, trieFile, trieFile, trieFile, trieFile)))
+	opts, err := ProcessConfigFile(conf)
+	require_NoError(t, err)
+	users := map[string]*Permissions{}
+	for _, u := range opts.Users {
+		users[u.Username] = u.Permissions
+	}
+	bob := users["bob"].Publish
+	require_Equal(t, strings.Join(bob.Allow, ","), "inline")
+	require_True(t, len(bob.Deny) == 0)
+	require_True(t, bob.allowTrie != nil && bob.denyTrie != nil)
+
+	// Matchers built from the flat list and from the tree must agree.
+	flatSl := NewSublistWithCache()
+	for _, subj := range users["alice"].Publish.Allow {
+		require_NoError(t, flatSl.Insert(&subscription{subject: []byte(subj)}))
+	}
+	for _, subj := range []string{
+		"orders", "orders.us", "orders.us.east", "orders.us.west", "orders.us.north",
+		"orders.eu.fr", "orders.eu.fr.paris", "billing", "billing.invoices",
+		"billing.invoices.2024", "$SYS.REQ.SERVER.PING", "$SYS.REQ.SERVER", "shipping",
+	} {
+		want, got := len(flatSl.Match(subj).psubs) > 0, len(bob.allowTrie.Match(subj).psubs) > 0
+		if want != got {
+			t.Fatalf("Expected match of %q to be %v, got %v", subj, want, got)
+		}
+	}
+
+	// The clients share the sublists built from the tree.
+	carol := users["carol"]
+	c1, c2 := &client{kind: CLIENT}, &client{kind: CLIENT}
+	c1.setPermissions(carol)
+	c2.setPermissions(carol)
+	require_True(t, c1.perms.pub.allowTrie == carol.Publish.allowTrie)
+	require_True(t, c2.perms.pub.allowTrie == carol.Publish.allowTrie)
+	require_True(t, c2.perms.sub.denyTrie == carol.Subscribe.denyTrie)
+	require_True(t, c1.pubAllowed("orders.us.east"))
+	require_False(t, c1.pubAllowed("orders.us.north"))
+	require_False(t, c1.pubAllowed("shipping"))
+	require_True(t, c1.canSubscribe("shipping"))
+	require_False(t, c1.canSubscribe("billing.invoices"))
+	require_False(t, c1.canSubscribe("billing.*"))
+	// Wildcard subscriptions overlapping the tree do not receive denied messages.
+	require_True(t, c1.canSubscribe(">"))
+	require_True(t, c1.mperms != nil)
+	require_True(t, c1.checkDenySub("billing.invoices"))
+	require_False(t, c1.checkDenySub("shipping"))
+
+	// The subjects of the tree are reflected by the exported configuration
+	// and its fingerprint.
+	require_Equal(t, bob.AllowTrieDigest, users["carol"].Publish.AllowTrieDigest)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	export, err := s.ExportAuthConfig()
+	require_NoError(t, err)
+	require_Contains(t, string(export), `"allow_trie_digest": "`+bob.AllowTrieDigest+`"`)
+	fp := s.AuthConfigFingerprint()
+	require_NoError(t, os.WriteFile(trieFile, []byte("orders\n  us\n"), 0644))
+	require_NoError(t, s.Reload())
+	if s.AuthConfigFingerprint() == fp {
+		t.Fatal("Expected fingerprint to change with the prefix tree file")
+	}
+
+	// Relative paths are resolved against the directory of the configuration
+	// file.
+	relConf := filepath.Join(dir, "nats.conf")
+	require_NoError(t, os.WriteFile(relConf, []byte(`
+		authorization {
+			users: [{user: alice, password: pwd, permissions: {publish: {allow_trie_file: "allow.trie"}}}]
+		}
+	`), 0644))
+	relOpts, err := ProcessConfigFile(relConf)
+	require_NoError(t, err)
+	require_True(t, len(relOpts.Users[0].Permissions.Publish.allowTrie.Match("orders.us").psubs) == 1)
+
+	// Invalid trees are errors.
+	for _, test := range []struct {
+		tree string
+		err  string
+	}{
+		{"orders\n  bad..tokens\n", `tokens "bad..tokens" on line 2 are not valid`},
+		{".\norders\n", `"." on line 1 has no prefix`},
+		{"billing.>\n  invoices\n", `tokens "invoices" on line 2 follow a full wildcard`},
+		{"orders\n  us\n\teu\n", `indentation of line 3 mixes tabs and spaces`},
+		{"orders\n \tus\n", `indentation of line 2 mixes tabs and spaces`},
+		{"orders\n  us workers\n", `tokens "us workers" on line 2 have a queue group, which is not supported`},
+	} {
+		require_NoError(t, os.WriteFile(trieFile, []byte(test.tree), 0644))
+		_, err = ProcessConfigFile(conf)
+		require_Error(t, err)
+		require_Contains(t, err.Error(), test.err)
+	}
+}
+
+func BenchmarkPermissionsSubjectsTrieFile(b *testing.B) {
+	// 100,000 subjects of the form "acme.region-N.svc-N.op-N".
+	var flat, trie strings.Builder
+	trie.WriteString("acme\n")
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&trie, "  region-%d\n", i)
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&trie, "    svc-%d\n", j)
+			for k := 0; k < 100; k++ {
+				fmt.Fprintf(&trie, "      op-%d\n", k)
+				fmt.Fprintf(&flat, "acme.region-%d.svc-%d.op-%d\n", i, j, k)
+			}
+		}
+	}
+	dir := b.TempDir()
+	for _, test := range []struct {
+		name    string
+		field   string
+		content string
+	}{
+		{"flat", "allow_file", flat.String()},
+		{"trie", "allow_trie_file", trie.String()},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			file := filepath.Join(dir, test.name)
+			require_NoError(b, os.WriteFile(file, []byte(test.content), 0644))
+			conf := createConfFile(b, []byte(fmt.Sprintf(`
+				authorization {
+					users: [{user: alice, password: pwd, permissions: {publish: {%s: %q}}}]
+				}
+			`, test.field, file)))
+			opts, err := ProcessConfigFile(conf)
+			require_NoError(b, err)
+			perms := opts.Users[0].Permissions
+			// Permissions are set up for each connecting client.
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c := &client{kind: CLIENT}
+				c.setPermissions(perms)
+			}
+		})
+	}
+}
+
+func BenchmarkParseSubjectTrie(b *testing.B) {
+	// The same 100,000 subjects as BenchmarkPermissionsSubjectsTrieFile.
+	var flat, trie strings.Builder
+	trie.WriteString("acme\n")
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&trie, "  region-%d\n", i)
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&trie, "    svc-%d\n", j)
+			for k := 0; k < 100; k++ {
+				fmt.Fprintf(&trie, "      op-%d\n", k)
+				fmt.Fprintf(&flat, "acme.region-%d.svc-%d.op-%d\n", i, j, k)
+			}
+		}
+	}
+	// Validating and inserting each subject of a flat list walks the
+	// sublist from its root for every subject.
+	b.Run("flat", func(b *testing.B) {
+		data := []byte(flat.String())
+		for i := 0; i < b.N; i++ {
+			sl := NewSublistWithCache()
+			for _, subject := range strings.Split(string(data), "\n") {
+				if subject = strings.TrimSpace(subject); subject == _EMPTY_ {
+					continue
+				}
+				if !IsValidSubject(subject) {
+					b.Fatalf("Invalid subject %q", subject)
+				}
+				if err := sl.Insert(&subscription{subject: []byte(subject)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("trie", func(b *testing.B) {
+		data := []byte(trie.String())
+		for i := 0; i < b.N; i++ {
+			if _, err := parseSubjectTrie(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
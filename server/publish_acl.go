@@ -0,0 +1,82 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "fmt"
+
+// publishACL restricts which publishers can publish on subjects, in
+// addition to the publishers' own permissions.
+type publishACL struct {
+	sl *Sublist
+	// Allowed identities for each subject pattern.
+	publishers map[string]map[string]struct{}
+}
+
+// newPublishACL builds the publish ACL from the subject patterns mapped to
+// the allowed publisher identities. Returns nil if there are none.
+func newPublishACL(acl map[string][]string) *publishACL {
+	if len(acl) == 0 {
+		return nil
+	}
+	pa := &publishACL{
+		sl:         NewSublistWithCache(),
+		publishers: make(map[string]map[string]struct{}, len(acl)),
+	}
+	for subject, ids := range acl {
+		pa.sl.Insert(&subscription{subject: []byte(subject)})
+		set := make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			set[id] = struct{}{}
+		}
+		pa.publishers[subject] = set
+	}
+	return pa
+}
+
+// allowed returns true if the identity is listed by every pattern matching
+// the subject. Subjects not covered by the ACL are allowed.
+func (pa *publishACL) allowed(subject, identity string) bool {
+	r := pa.sl.Match(subject)
+	for _, sub := range r.psubs {
+		if _, ok := pa.publishers[string(sub.subject)][identity]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// validatePublishACL checks that the publish ACL subjects are valid and
+// that each of them lists publishers.
+func validatePublishACL(acl map[string][]string) error {
+	for subject, ids := range acl {
+		if !IsValidSubject(subject) {
+			return fmt.Errorf("invalid publish ACL subject %q", subject)
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("publish ACL subject %q has no publishers", subject)
+		}
+		for _, id := range ids {
+			if id == _EMPTY_ {
+				return fmt.Errorf("publish ACL subject %q has an empty publisher", subject)
+			}
+		}
+	}
+	return nil
+}
+
+// publishACL returns the server's publish ACL, or nil if there is none.
+func (s *Server) publishACL() *publishACL {
+	pa, _ := s.pubACL.Load().(*publishACL)
+	return pa
+}
@@ -311,6 +311,263 @@ func (a *authTimeoutOption) Apply(server *Server) {
 	server.Noticef("Reloaded: authorization timeout = %v", a.newValue)
 }
 
+// maxCredentialLenOption implements the option interface for the
+// `max_credential_len` setting.
+type maxCredentialLenOption struct {
+	noopOption // Not authOption because this is a no-op; will be reloaded with options.
+	newValue   int
+}
+
+// Apply is a no-op because the limit will be reloaded after options are
+// applied.
+func (m *maxCredentialLenOption) Apply(server *Server) {
+	server.Noticef("Reloaded: max_credential_len = %d", m.newValue)
+}
+
+// silentPermissionViolationsOption implements the option interface for the
+// `silent_permission_violations` setting.
+type silentPermissionViolationsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting will be reloaded after options are
+// applied.
+func (s *silentPermissionViolationsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: silent_permission_violations = %v", s.newValue)
+}
+
+// logFailedCredentialHashesOption implements the option interface for the
+// `log_failed_credential_hashes` setting.
+type logFailedCredentialHashesOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting will be reloaded after options are
+// applied.
+func (l *logFailedCredentialHashesOption) Apply(server *Server) {
+	server.Noticef("Reloaded: log_failed_credential_hashes = %v", l.newValue)
+}
+
+// sendPermissionsToClientOption implements the option interface for the
+// `send_permissions_to_client` setting.
+type sendPermissionsToClientOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting will be reloaded after options are
+// applied.
+func (s *sendPermissionsToClientOption) Apply(server *Server) {
+	server.Noticef("Reloaded: send_permissions_to_client = %v", s.newValue)
+}
+
+// protectSystemSubjectsOption implements the option interface for the
+// `protect_system_subjects` setting.
+type protectSystemSubjectsOption struct {
+	authOption
+	newValue bool
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (p *protectSystemSubjectsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: protect_system_subjects = %v", p.newValue)
+}
+
+// nilPermissionsMeanDenyOption implements the option interface for the
+// `nil_permissions_mean_deny` setting.
+type nilPermissionsMeanDenyOption struct {
+	authOption
+	newValue bool
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (n *nilPermissionsMeanDenyOption) Apply(server *Server) {
+	server.Noticef("Reloaded: nil_permissions_mean_deny = %v", n.newValue)
+}
+
+// maxUsersOption implements the option interface for the `max_users`
+// setting.
+type maxUsersOption struct {
+	authOption
+	newValue int
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (m *maxUsersOption) Apply(server *Server) {
+	server.Noticef("Reloaded: max_users = %d", m.newValue)
+}
+
+// enabledAuthMethodsOption implements the option interface for the
+// `enabled_auth_methods` setting.
+type enabledAuthMethodsOption struct {
+	authOption
+	newValue []string
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (e *enabledAuthMethodsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: enabled_auth_methods = %v", e.newValue)
+}
+
+// adaptiveAuthOption implements the option interface for the
+// `adaptive_auth` setting.
+type adaptiveAuthOption struct {
+	authOption
+	newValue *AdaptiveAuthOpts
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (a *adaptiveAuthOption) Apply(server *Server) {
+	server.Noticef("Reloaded: adaptive_auth = %+v", a.newValue)
+}
+
+// revokedNkeysOption implements the option interface for the
+// `revoked_nkeys` setting.
+type revokedNkeysOption struct {
+	authOption
+	newValue []string
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (r *revokedNkeysOption) Apply(server *Server) {
+	server.Noticef("Reloaded: revoked_nkeys = %v", r.newValue)
+}
+
+// publishACLOption implements the option interface for the `publish_acl`
+// setting.
+type publishACLOption struct {
+	authOption
+	newValue map[string][]string
+}
+
+// Apply is a no-op because the publish ACL is rebuilt when authorization
+// is reloaded after options are applied.
+func (p *publishACLOption) Apply(server *Server) {
+	server.Noticef("Reloaded: publish_acl")
+}
+
+// absoluteDenyOption implements the option interface for the
+// `absolute_deny` setting.
+type absoluteDenyOption struct {
+	authOption
+	newValue []string
+}
+
+// Apply is a no-op because the absolute deny list is rebuilt when
+// authorization is reloaded after options are applied.
+func (a *absoluteDenyOption) Apply(server *Server) {
+	server.Noticef("Reloaded: absolute_deny = %v", a.newValue)
+}
+
+// allowPreviousNonceOption implements the option interface for the
+// `allow_previous_nonce` setting.
+type allowPreviousNonceOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the option is read when clients are created.
+func (a *allowPreviousNonceOption) Apply(server *Server) {
+	server.Noticef("Reloaded: allow_previous_nonce = %v", a.newValue)
+}
+
+// authStartupGracePeriodOption implements the option interface for the
+// `auth_startup_grace_period` setting.
+type authStartupGracePeriodOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the grace period is read from the options when
+// clients authenticate.
+func (a *authStartupGracePeriodOption) Apply(server *Server) {
+	server.Noticef("Reloaded: auth_startup_grace_period = %v", a.newValue)
+}
+
+// requireClientNameOption implements the option interface for the
+// `require_client_name` setting.
+type requireClientNameOption struct {
+	authOption
+	newValue bool
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (r *requireClientNameOption) Apply(server *Server) {
+	server.Noticef("Reloaded: require_client_name = %v", r.newValue)
+}
+
+// maxClientClockSkewOption implements the option interface for the
+// `max_client_clock_skew` setting.
+type maxClientClockSkewOption struct {
+	authOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (m *maxClientClockSkewOption) Apply(server *Server) {
+	server.Noticef("Reloaded: max_client_clock_skew = %v", m.newValue)
+}
+
+// connectPoWDifficultyOption implements the option interface for the
+// `connect_pow_difficulty` setting.
+type connectPoWDifficultyOption struct {
+	authOption
+	newValue int
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (c *connectPoWDifficultyOption) Apply(server *Server) {
+	server.Noticef("Reloaded: connect_pow_difficulty = %v", c.newValue)
+}
+
+// rejectCredentialsWhenNoAuthOption implements the option interface for
+// the `reject_credentials_when_no_auth` setting.
+type rejectCredentialsWhenNoAuthOption struct {
+	authOption
+	newValue bool
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (r *rejectCredentialsWhenNoAuthOption) Apply(server *Server) {
+	server.Noticef("Reloaded: reject_credentials_when_no_auth = %v", r.newValue)
+}
+
+// localAdminOption implements the option interface for the `local_admin`
+// setting.
+type localAdminOption struct {
+	authOption
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (l *localAdminOption) Apply(server *Server) {
+	server.Noticef("Reloaded: local_admin")
+}
+
+// tokenSigningKeyOption implements the option interface for the
+// `token_signing_key` setting.
+type tokenSigningKeyOption struct {
+	authOption
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (t *tokenSigningKeyOption) Apply(server *Server) {
+	server.Noticef("Reloaded: token_signing_key")
+}
+
 // tagsOption implements the option interface for the `tags` setting.
 type tagsOption struct {
 	noopOption // Not authOption because this is a no-op; will be reloaded with options.
@@ -902,6 +1159,23 @@ func (s *Server) reloadOptions(curOpts, newOpts *Options) error {
 	// applications starting NATS Server programmatically).
 	newOpts.CustomClientAuthentication = curOpts.CustomClientAuthentication
 	newOpts.CustomRouterAuthentication = curOpts.CustomRouterAuthentication
+	newOpts.CustomAuthenticators = curOpts.CustomAuthenticators
+	newOpts.IPReputationCheck = curOpts.IPReputationCheck
+	newOpts.PolicyModule = curOpts.PolicyModule
+	newOpts.PolicyRuntime = curOpts.PolicyRuntime
+	newOpts.PermissionsResolver = curOpts.PermissionsResolver
+	newOpts.GroupSubjectsResolver = curOpts.GroupSubjectsResolver
+	newOpts.GroupSubjectsRefreshInterval = curOpts.GroupSubjectsRefreshInterval
+	newOpts.PrivilegedConnectCallback = curOpts.PrivilegedConnectCallback
+	newOpts.TokenValidator = curOpts.TokenValidator
+	newOpts.TokenValidatorCacheTTL = curOpts.TokenValidatorCacheTTL
+	newOpts.SecretDecryptor = curOpts.SecretDecryptor
+	newOpts.AuthHealthCheckInterval = curOpts.AuthHealthCheckInterval
+	newOpts.AutoHashTokens = curOpts.AutoHashTokens
+	// Hash the plaintext secrets before comparing the options, unchanged
+	// secrets get the hash they already have.
+	newOpts, _ = s.autoHashOptions(newOpts)
+	s.keepRuntimeSecrets(newOpts)
 
 	changed, err := s.diffOptions(newOpts)
 	if err != nil {
@@ -912,6 +1186,15 @@ func (s *Server) reloadOptions(curOpts, newOpts *Options) error {
 		if err := validateOptions(newOpts); err != nil {
 			return err
 		}
+		if err := s.validateMaxUsersWithRemote(newOpts); err != nil {
+			return err
+		}
+		s.mu.RLock()
+		remoteUsers := s.remoteUsers
+		s.mu.RUnlock()
+		if err := checkLocalAdminClash(newOpts, remoteUsers); err != nil {
+			return err
+		}
 	}
 
 	// Create a context that is used to pass special info that we may need
@@ -959,8 +1242,8 @@ func imposeOrder(value interface{}) error {
 	case WebsocketOpts:
 		sort.Strings(value.AllowedOrigins)
 	case string, bool, uint8, int, int32, int64, time.Duration, float64, nil, LeafNodeOpts, ClusterOpts, *tls.Config, PinnedCertSet,
-		*URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication, MQTTOpts, jwt.TagList,
-		*OCSPConfig, map[string]string, JSLimitOpts, StoreCipher, *OCSPResponseCacheConfig:
+		*URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication, []byte, PermissionsResolver, TokenValidator, MQTTOpts, jwt.TagList,
+		*OCSPConfig, map[string]string, map[string][]string, map[string]Authentication, *User, *AdaptiveAuthOpts, SeedStore, JSLimitOpts, StoreCipher, *OCSPResponseCacheConfig:
 		// explicitly skipped types
 	default:
 		// this will fail during unit tests
@@ -994,6 +1277,11 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		if field.PkgPath != _EMPTY_ {
 			continue
 		}
+		// Callbacks can't be compared and can only be set programmatically,
+		// in which case they are carried over from the current options.
+		if field.Type.Kind() == reflect.Func {
+			continue
+		}
 		var (
 			oldValue = oldConfig.Field(i).Interface()
 			newValue = newConfig.Field(i).Interface()
@@ -1078,6 +1366,46 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &maxControlLineOption{newValue: newValue.(int32)})
 		case "maxpayload":
 			diffOpts = append(diffOpts, &maxPayloadOption{newValue: newValue.(int32)})
+		case "silentpermissionviolations":
+			diffOpts = append(diffOpts, &silentPermissionViolationsOption{newValue: newValue.(bool)})
+		case "logfailedcredentialhashes":
+			diffOpts = append(diffOpts, &logFailedCredentialHashesOption{newValue: newValue.(bool)})
+		case "sendpermissionstoclient":
+			diffOpts = append(diffOpts, &sendPermissionsToClientOption{newValue: newValue.(bool)})
+		case "protectsystemsubjects":
+			diffOpts = append(diffOpts, &protectSystemSubjectsOption{newValue: newValue.(bool)})
+		case "nilpermissionsmeandeny":
+			diffOpts = append(diffOpts, &nilPermissionsMeanDenyOption{newValue: newValue.(bool)})
+		case "maxusers":
+			diffOpts = append(diffOpts, &maxUsersOption{newValue: newValue.(int)})
+		case "adaptiveauth":
+			diffOpts = append(diffOpts, &adaptiveAuthOption{newValue: newValue.(*AdaptiveAuthOpts)})
+		case "enabledauthmethods":
+			diffOpts = append(diffOpts, &enabledAuthMethodsOption{newValue: newValue.([]string)})
+		case "allowpreviousnonce":
+			diffOpts = append(diffOpts, &allowPreviousNonceOption{newValue: newValue.(bool)})
+		case "authstartupgraceperiod":
+			diffOpts = append(diffOpts, &authStartupGracePeriodOption{newValue: newValue.(time.Duration)})
+		case "rejectcredentialswhennoauth":
+			diffOpts = append(diffOpts, &rejectCredentialsWhenNoAuthOption{newValue: newValue.(bool)})
+		case "requireclientname":
+			diffOpts = append(diffOpts, &requireClientNameOption{newValue: newValue.(bool)})
+		case "maxclientclockskew":
+			diffOpts = append(diffOpts, &maxClientClockSkewOption{newValue: newValue.(time.Duration)})
+		case "connectpowdifficulty":
+			diffOpts = append(diffOpts, &connectPoWDifficultyOption{newValue: newValue.(int)})
+		case "localadmin":
+			diffOpts = append(diffOpts, &localAdminOption{})
+		case "tokensigningkey":
+			diffOpts = append(diffOpts, &tokenSigningKeyOption{})
+		case "publishacl":
+			diffOpts = append(diffOpts, &publishACLOption{newValue: newValue.(map[string][]string)})
+		case "absolutedeny":
+			diffOpts = append(diffOpts, &absoluteDenyOption{newValue: newValue.([]string)})
+		case "revokednkeys":
+			diffOpts = append(diffOpts, &revokedNkeysOption{newValue: newValue.([]string)})
+		case "maxcredentiallen":
+			diffOpts = append(diffOpts, &maxCredentialLenOption{newValue: newValue.(int)})
 		case "pinginterval":
 			diffOpts = append(diffOpts, &pingIntervalOption{newValue: newValue.(time.Duration)})
 		case "maxpingsout":
@@ -1354,6 +1682,9 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
 					field.Name, oldValue, newValue)
 			}
+		case "authfingerprintkey":
+			// The key is not printed.
+			return nil, fmt.Errorf("config reload not supported for %s", field.Name)
 		case "systemaccount":
 			if oldValue != DEFAULT_SYSTEM_ACCOUNT || newValue != _EMPTY_ {
 				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
@@ -1734,9 +2065,20 @@ func (s *Server) reloadAuthorization() {
 		}
 		// Check to make sure account is correct.
 		c.swapAccountAfterReload()
+		// The reloaded permissions replaced the deferred and drain ones.
+		c.mu.Lock()
+		c.applyNilPermissionsMeanDeny(opts)
+		c.applyDeferredPermissions(opts)
+		c.applyDrainPermissions()
+		c.mu.Unlock()
+		// The reloaded permissions do not have the group subjects yet.
+		if r := opts.GroupSubjectsResolver; r != nil && c.kind == CLIENT {
+			s.resolveGroupSubjects(c, r)
+		}
 		// Remove any unauthorized subscriptions and check for account imports.
 		c.processSubsOnConfigReload(awcsti)
 	}
+	s.pruneLastLogins()
 
 	for _, route := range routes {
 		// Disconnect any unauthorized routes.
@@ -1775,6 +2117,10 @@ func (s *Server) clientHasMovedToDifferentAccount(c *client) bool {
 			nu = s.nkeys[c.opts.Nkey]
 		}
 	} else if c.opts.Username != "" {
+		// The local admin is not a configured user and keeps its account.
+		if la := s.getOpts().LocalAdmin; la != nil && c.opts.Username == la.Username {
+			return false
+		}
 		if s.users != nil {
 			u = s.users[c.opts.Username]
 		}
@@ -13,6 +13,8 @@
 
 package server
 
+import "sync"
+
 // We wrap to hold onto optional items for /connz.
 type closedClient struct {
 	ConnInfo
@@ -75,3 +77,42 @@ func (rb *closedRingBuffer) closedClients() []*closedClient {
 	}
 	return dup
 }
+
+// Maximum number of authentication failures kept by the server.
+const maxRecentAuthFailures = 128
+
+// authFailureRingBuffer is a fixed sized ring buffer of the most recent
+// authentication failures. It has its own lock since failures are added
+// from the clients' connection paths.
+type authFailureRingBuffer struct {
+	mu       sync.Mutex
+	total    uint64
+	failures []AuthFailure
+}
+
+// Create a new ring buffer with at most max failures.
+func newAuthFailureRingBuffer(max int) *authFailureRingBuffer {
+	return &authFailureRingBuffer{failures: make([]AuthFailure, max)}
+}
+
+// Adds a failure, replacing the oldest one if there is no more room.
+func (rb *authFailureRingBuffer) append(f AuthFailure) {
+	rb.mu.Lock()
+	rb.failures[rb.total%uint64(len(rb.failures))] = f
+	rb.total++
+	rb.mu.Unlock()
+}
+
+// Returns a copy of the failures, oldest first.
+func (rb *authFailureRingBuffer) recent() []AuthFailure {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	size := uint64(len(rb.failures))
+	if rb.total <= size {
+		return append([]AuthFailure(nil), rb.failures[:rb.total]...)
+	}
+	head := rb.total % size
+	dup := make([]AuthFailure, 0, size)
+	dup = append(dup, rb.failures[head:]...)
+	return append(dup, rb.failures[:head]...)
+}
@@ -66,6 +66,10 @@ func setRouteProtoForTest(wantedProto int) int {
 }
 
 type route struct {
+	// Number of messages dropped for exceeding an import rate. First for
+	// the alignment of atomic operations.
+	throttledMsgs int64
+
 	remoteID     string
 	remoteName   string
 	didSolicit   bool
@@ -437,6 +441,23 @@ func (c *client) processInboundRoutedMsg(msg []byte) {
 		return
 	}
 
+	// Absolutely denied subjects override any permission.
+	if sl := c.absoluteDenyList(); sl != nil && len(sl.Match(string(c.pa.subject)).psubs) > 0 {
+		c.Debugf("Dropping routed message on absolutely denied subject: %q", c.pa.subject)
+		return
+	}
+
+	// Throttle the route if it exceeds an import rate. The dropped messages
+	// are counted and reported in Routez.
+	if c.perms != nil && len(c.perms.pubRates) > 0 {
+		if rl := c.perms.pubRateExceeded(string(c.pa.subject)); rl != nil {
+			atomic.AddInt64(&c.route.throttledMsgs, 1)
+			c.RateLimitWarnf("Dropping routed messages exceeding the import rate of %d msgs/sec on %q", rl.Rate, rl.Subject)
+			c.Debugf("Import rate of %d msgs/sec exceeded for routed message on subject: %q", rl.Rate, c.pa.subject)
+			return
+		}
+	}
+
 	// Check for no interest, short circuit if so.
 	// This is the fanout scale.
 	if len(r.psubs)+len(r.qsubs) > 0 {
@@ -832,7 +853,7 @@ func (s *Server) forwardNewRouteInfoToKnownServers(info *Info) {
 func (c *client) canImport(subject string) bool {
 	// Use pubAllowed() since this checks Publish permissions which
 	// is what Import maps to.
-	return c.pubAllowedFullCheck(subject, false, true)
+	return !c.absolutelyDenied(subject) && c.pubAllowedFullCheck(subject, false, true)
 }
 
 // canExport is whether or not we will accept a SUB from the remote for a given subject.
@@ -858,9 +879,11 @@ func (c *client) setRoutePermissions(perms *RoutePermissions) {
 	// The Import permission is mapped to Publish
 	// and Export permission is mapped to Subscribe.
 	// For meaning of Import/Export, see canImport and canExport.
+	// Import rates are enforced as publish rates.
 	p := &Permissions{
-		Publish:   perms.Import,
-		Subscribe: perms.Export,
+		Publish:      perms.Import,
+		Subscribe:    perms.Export,
+		PublishRates: perms.ImportRates,
 	}
 	c.setPermissions(p)
 }
@@ -1294,10 +1317,7 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	// Grab server variables
 	s.mu.Lock()
 	// New proto wants a nonce (although not used in routes, that is, not signed in CONNECT)
-	var raw [nonceLen]byte
-	nonce := raw[:]
-	s.generateNonce(nonce)
-	s.routeInfo.Nonce = string(nonce)
+	s.routeInfo.Nonce = string(s.generateNonce())
 	s.generateRouteInfoJSON()
 	// Clear now that it has been serialized. Will prevent nonce to be included in async INFO that we may send.
 	s.routeInfo.Nonce = _EMPTY_
@@ -0,0 +1,76 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/nats-io/nkeys"
+)
+
+// SeedStore gives access to an nkey seed the server uses for signing,
+// so that the seed does not have to be part of the configuration.
+type SeedStore interface {
+	// KeyPair returns the key pair for the stored seed.
+	KeyPair() (nkeys.KeyPair, error)
+}
+
+// FileSeedStore is a SeedStore reading the seed from a file. The file
+// must only be accessible by its owner.
+type FileSeedStore struct {
+	Path string
+}
+
+// KeyPair implements the SeedStore interface.
+func (f *FileSeedStore) KeyPair() (nkeys.KeyPair, error) {
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	// Windows does not have the same notion of file permissions.
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("seed file %q is accessible by others, permissions are %v", f.Path, fi.Mode().Perm())
+	}
+	contents, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeSlice(contents)
+	kp, err := nkeys.FromSeed(bytes.TrimSpace(contents))
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed in file %q: %v", f.Path, err)
+	}
+	return kp, nil
+}
+
+// EnvSeedStore is a SeedStore reading the seed from an environment variable.
+type EnvSeedStore struct {
+	Name string
+}
+
+// KeyPair implements the SeedStore interface.
+func (e *EnvSeedStore) KeyPair() (nkeys.KeyPair, error) {
+	seed, ok := os.LookupEnv(e.Name)
+	if !ok || seed == _EMPTY_ {
+		return nil, fmt.Errorf("environment variable %q for seed is not set", e.Name)
+	}
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed in environment variable %q: %v", e.Name, err)
+	}
+	return kp, nil
+}
@@ -16,6 +16,7 @@ package server
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -77,12 +78,19 @@ type Info struct {
 	CID               uint64   `json:"client_id,omitempty"`
 	ClientIP          string   `json:"client_ip,omitempty"`
 	Nonce             string   `json:"nonce,omitempty"`
+	NonceSig          string   `json:"nonce_sig,omitempty"` // Signature of the nonce with the server signing key.
 	Cluster           string   `json:"cluster,omitempty"`
 	Dynamic           bool     `json:"cluster_dynamic,omitempty"`
 	Domain            string   `json:"domain,omitempty"`
 	ClientConnectURLs []string `json:"connect_urls,omitempty"`    // Contains URLs a client can connect to.
 	WSConnectURLs     []string `json:"ws_connect_urls,omitempty"` // Contains URLs a ws client can connect to.
 	LameDuckMode      bool     `json:"ldm,omitempty"`
+	// Set in INFO updates sent to clients whose credential is being rotated
+	// and will soon be invalid, so that they can reconnect with a new one.
+	CredentialExpiring bool `json:"credential_expiring,omitempty"`
+	// Set in the INFO sent after CONNECT when the server is configured to
+	// send clients their permissions. Only holds allow and deny subjects.
+	Permissions *Permissions `json:"permissions,omitempty"`
 
 	// Route Specific
 	Import        *SubjectPermission `json:"import,omitempty"`
@@ -114,6 +122,17 @@ type Server struct {
 	stats
 	mu                  sync.RWMutex
 	kp                  nkeys.KeyPair
+	signingKey          nkeys.KeyPair
+	remoteNkeys         []*NkeyUser // Fetched from the users URL.
+	remoteUsers         []*User
+	remoteUsersWarning  string
+	pubACL              atomic.Value            // *publishACL
+	adaptive            atomic.Value            // *adaptiveAuth
+	absDeny             atomic.Value            // *Sublist
+	policy              Policy                  // Loaded policy module.
+	tokenCache          *tokenCache             // Results of the token validator.
+	prevNonces          map[string]*issuedNonce // Last nonce issued per host when previous nonces are allowed.
+	prevNoncesSwept     time.Time
 	info                Info
 	configFile          string
 	optsMu              sync.RWMutex
@@ -128,6 +147,8 @@ type Server struct {
 	accounts            sync.Map
 	tmpAccounts         sync.Map // Temporarily stores accounts that are being built
 	activeAccounts      int32
+	permGrants          int32 // Set once the permission grants expiration loop is started.
+	authHealthErr       error // Last failed health check of the custom authentications.
 	accResolver         AccountResolver
 	clients             map[uint64]*client
 	routes              map[uint64]*client
@@ -138,6 +159,14 @@ type Server struct {
 	nkeys               map[string]*NkeyUser
 	totalClients        uint64
 	closed              *closedRingBuffer
+	authFailures        *authFailureRingBuffer
+	authCounters        *authCounters
+	userIPConns         map[string]int      // Connections per user and IP address.
+	credHashSalt        []byte              // Salt of the logged hashes of rejected credentials, and key of the account token digests.
+	secretDigestKey     []byte              // Key of the digests of the secrets, see secretDigest.
+	tokenAccounts       map[string]*Account // Accounts by the keyed digest of their auth token.
+	optsAuthRequired    bool                // Authentication required by the options, regardless of the account tokens.
+	lastLogins          sync.Map            // Identity to time of the last successful authentication.
 	done                chan bool
 	start               time.Time
 	http                net.Listener
@@ -277,6 +306,33 @@ type Server struct {
 	// Keep track of what that user name is for config reload purposes.
 	sysAccOnlyNoAuthUser string
 
+	// Number of plaintext credentials that were hashed when AutoHashTokens is set.
+	numAutoHashed int
+
+	// Bcrypt hashes of the plaintext secrets computed by autoHashSecrets,
+	// keyed by the digest of the secret. Replaced, not updated, on change.
+	autoHashes map[string]string
+
+	// Decrypted authorization token and password when they are stored
+	// encrypted in the configuration.
+	decryptedToken    string
+	decryptedPassword string
+
+	// Authorization token set with SetAuthorizationToken and the configured
+	// token it replaced. It is kept across reloads until the configured
+	// token changes.
+	runtimeToken    string
+	configuredToken string
+
+	// Cluster passwords set with SetClusterPasswords and the configured
+	// ones they replaced, kept across reloads the same way.
+	runtimeClusterPasswords    []string
+	configuredClusterPasswords []string
+
+	// Set when some users have to sign the nonce, either with their
+	// nkey or with a pre-shared key.
+	usersRequireSig bool
+
 	// IPQueues map
 	ipQueues sync.Map
 
@@ -399,6 +455,36 @@ func NewServer(opts *Options) (*Server, error) {
 		syncOutSem:         make(chan struct{}, maxConcurrentSyncRequests),
 	}
 
+	// For logging the hashes of rejected credentials.
+	s.credHashSalt = make([]byte, 16)
+	if _, err := io.ReadFull(crand.Reader, s.credHashSalt); err != nil {
+		return nil, err
+	}
+	// The digests of the secrets are only comparable across servers when
+	// they share a key.
+	s.secretDigestKey = s.credHashSalt
+	if opts.AuthFingerprintKey != _EMPTY_ {
+		s.secretDigestKey = []byte(opts.AuthFingerprintKey)
+	}
+
+	// Replace the plaintext secrets with their hash, if requested, before
+	// the lock is acquired since this is costly. The options are copied
+	// so that the plaintext is not kept by the server.
+	opts, numAutoHashed := s.autoHashOptions(opts)
+	s.opts = opts
+
+	// Users fetched from a remote endpoint, merged with the configured ones
+	// when the authorization is set up. They are fetched once, a reload
+	// keeps them.
+	if opts.UsersURL != _EMPTY_ {
+		nkeys, users, hashed, err := s.loadRemoteUsers(opts)
+		if err != nil {
+			return nil, err
+		}
+		s.remoteNkeys, s.remoteUsers = nkeys, users
+		numAutoHashed += hashed
+	}
+
 	// Fill up the maximum in flight syncRequests for this server.
 	// Used in JetStream catchup semantics.
 	for i := 0; i < maxConcurrentSyncRequests; i++ {
@@ -409,11 +495,32 @@ func NewServer(opts *Options) (*Server, error) {
 		s.connRateCounter = newRateCounter(opts.tlsConfigOpts.RateLimit)
 	}
 
+	// Load the policy module once, it is shared by all clients.
+	if len(opts.PolicyModule) > 0 {
+		if opts.PolicyRuntime == nil {
+			return nil, errPolicyNoRuntime
+		}
+		p, err := opts.PolicyRuntime.Load(opts.PolicyModule)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading policy module: %v", err)
+		}
+		s.policy = p
+	}
+
 	// Trusted root operator keys.
 	if !s.processTrustedKeys() {
 		return nil, fmt.Errorf("Error processing trusted operator keys")
 	}
 
+	// Key used to sign the nonce presented to clients.
+	if opts.ServerSigningKey != nil {
+		skp, err := opts.ServerSigningKey.KeyPair()
+		if err != nil {
+			return nil, fmt.Errorf("Error loading server signing key: %v", err)
+		}
+		s.signingKey = skp
+	}
+
 	// If we have solicited leafnodes but no clustering and no clustername.
 	// However we may need a stable clustername so use the server name.
 	if len(opts.LeafNode.Remotes) > 0 && opts.Cluster.Port == 0 && opts.Cluster.Name == _EMPTY_ {
@@ -492,6 +599,13 @@ func NewServer(opts *Options) (*Server, error) {
 	// For tracking closed clients.
 	s.closed = newClosedRingBuffer(opts.MaxClosedClients)
 
+	// For tracking authentication failures.
+	s.authFailures = newAuthFailureRingBuffer(maxRecentAuthFailures)
+	s.authCounters = newAuthCounters()
+
+	// For limiting the connections of users per IP address.
+	s.userIPConns = make(map[string]int)
+
 	// For tracking connections that are not yet registered
 	// in s.routes, but for which readLoop has started.
 	s.grTmpClients = make(map[uint64]*client)
@@ -556,7 +670,14 @@ func NewServer(opts *Options) (*Server, error) {
 	}
 
 	// Used to setup Authorization.
+	s.numAutoHashed = numAutoHashed
 	s.configureAuthorization()
+	if opts.UsersURL != _EMPTY_ {
+		// The remote users count towards the maximum as well.
+		if err := validateMaxUsers(opts.MaxUsers, len(s.users)+len(s.nkeys)); err != nil {
+			return nil, err
+		}
+	}
 
 	// Start signal handler
 	s.handleSignals()
@@ -1727,6 +1848,11 @@ func (s *Server) Start() {
 
 	defer s.Noticef("Server is ready")
 
+	// The users are fetched from UsersURL before the logger is set.
+	if s.remoteUsersWarning != _EMPTY_ {
+		s.Warnf("%s", s.remoteUsersWarning)
+	}
+
 	// Check for insecure configurations.
 	s.checkAuthforWarnings()
 
@@ -1976,6 +2102,13 @@ func (s *Server) Start() {
 		s.startGoRoutine(s.logRejectedTLSConns)
 	}
 
+	if len(healthCheckedAuths(opts)) > 0 {
+		s.startGoRoutine(s.authHealthCheckLoop)
+	}
+	if opts.GroupSubjectsResolver != nil {
+		s.startGoRoutine(s.groupSubjectsLoop)
+	}
+
 	// We've finished starting up.
 	close(s.startupComplete)
 
@@ -2030,6 +2163,10 @@ func (s *Server) Shutdown() {
 		accRes.Close()
 	}
 
+	if s.policy != nil {
+		s.policy.Close()
+	}
+
 	// Now check jetstream.
 	s.shutdownJetStream()
 
@@ -2415,6 +2552,7 @@ const (
 	JszPath          = "/jsz"
 	HealthzPath      = "/healthz"
 	IPQueuesPath     = "/ipqueuesz"
+	AuthMetricsPath  = "/metrics/auth"
 )
 
 func (s *Server) basePath(p string) string {
@@ -2525,6 +2663,8 @@ func (s *Server) startMonitoring(secure bool) error {
 	mux.HandleFunc(s.basePath(HealthzPath), s.HandleHealthz)
 	// IPQueuesz
 	mux.HandleFunc(s.basePath(IPQueuesPath), s.HandleIPQueuesz)
+	// Auth metrics
+	mux.HandleFunc(s.basePath(AuthMetricsPath), s.HandleAuthMetrics)
 
 	// Do not set a WriteTimeout because it could cause cURL/browser
 	// to return empty response or unable to display page if the
@@ -2638,12 +2778,14 @@ func (s *Server) createClientEx(conn net.Conn, inProcess bool) *client {
 	info = s.copyInfo()
 	if s.nonceRequired() {
 		// Nonce handling
-		var raw [nonceLen]byte
-		nonce := raw[:]
-		s.generateNonce(nonce)
-		info.Nonce = string(nonce)
+		info.Nonce = string(s.generateNonce())
+		info.NonceSig = s.signNonce(info.Nonce)
 	}
 	c.nonce = []byte(info.Nonce)
+	if opts.AllowPreviousNonce && len(c.nonce) > 0 {
+		s.trackNonce(c)
+	}
+	s.trackConnectRate()
 	authRequired = info.AuthRequired
 
 	// Check to see if we have auth_required set but we also have a no_auth_user.
@@ -2929,6 +3071,21 @@ func tlsVersion(ver uint16) string {
 	return fmt.Sprintf("Unknown [0x%x]", ver)
 }
 
+// tlsVersionFromString is the reverse of tlsVersion.
+func tlsVersionFromString(ver string) (uint16, error) {
+	switch ver {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", ver)
+}
+
 // We use hex here so we don't need multiple versions
 func tlsCipher(cs uint16) string {
 	name, present := cipherMapByID[cs]
@@ -2949,6 +3106,7 @@ func (s *Server) removeClient(c *client) {
 		if c.kind == CLIENT && c.opts.Protocol >= ClientProtoInfo {
 			updateProtoInfoCount = true
 		}
+		userIPConn := c.userIPConn
 		c.mu.Unlock()
 
 		s.mu.Lock()
@@ -2956,6 +3114,9 @@ func (s *Server) removeClient(c *client) {
 		if updateProtoInfoCount {
 			s.cproto--
 		}
+		if userIPConn != _EMPTY_ {
+			s.untrackUserIPConn(userIPConn)
+		}
 		s.mu.Unlock()
 	case ROUTER:
 		s.removeRoute(c)
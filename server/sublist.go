@@ -837,6 +837,56 @@ func (s *Sublist) RemoveBatch(subs []*subscription) error {
 	return err
 }
 
+// addTokens returns the node of the given tokens below the level, adding
+// the missing nodes. It is used to build a sublist that is not shared yet
+// from a prefix tree, see parseSubjectTrie, so that the nodes of a prefix
+// are walked once instead of for each subject. The tokens must be valid.
+func (l *level) addTokens(tokens string) *node {
+	var n *node
+	for tokens != _EMPTY_ {
+		t := tokens
+		if i := strings.IndexByte(tokens, btsep); i >= 0 {
+			t, tokens = tokens[:i], tokens[i+1:]
+		} else {
+			tokens = _EMPTY_
+		}
+		switch t {
+		case pwcs:
+			if l.pwc == nil {
+				l.pwc = newNode()
+			}
+			n = l.pwc
+		case fwcs:
+			if l.fwc == nil {
+				l.fwc = newNode()
+			}
+			n = l.fwc
+		default:
+			if n = l.nodes[t]; n == nil {
+				n = newNode()
+				l.nodes[t] = n
+			}
+		}
+		if n.next == nil {
+			n.next = newLevel()
+		}
+		l = n.next
+	}
+	return n
+}
+
+// insertAt adds a plain subscription to the node of its subject, as
+// returned by addTokens, instead of looking the node up like Insert does.
+// Like addTokens, it is only used on a sublist that is not shared yet, so
+// there is no cache or notification to update.
+func (s *Sublist) insertAt(n *node, sub *subscription) {
+	s.Lock()
+	n.psubs[sub] = struct{}{}
+	s.count++
+	s.inserts++
+	s.Unlock()
+}
+
 // pruneNode is used to prune an empty node from the tree.
 func (l *level) pruneNode(n *node, t string) {
 	if n == nil {
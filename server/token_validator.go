@@ -0,0 +1,119 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// TokenValidator validates the tokens of client connections against an
+// external backend, such as an introspection endpoint, and returns the
+// permissions of the client. A nil Permissions grants full permissions.
+//
+// Validate is called without any server lock held. Returning an error
+// rejects the connection. Successful results are cached by the server for
+// TokenValidatorCacheTTL, so hot tokens are not validated again on every
+// connect.
+type TokenValidator interface {
+	Validate(token string) (*Permissions, error)
+}
+
+// Maximum number of validated tokens kept in the cache.
+const maxTokenCacheSize = 4096
+
+// tokenCache is a bounded cache of the permissions returned by the
+// TokenValidator. Tokens are stored hashed so that the cache does not keep
+// credentials in memory.
+type tokenCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[[sha256.Size]byte]tokenCacheEntry
+}
+
+type tokenCacheEntry struct {
+	perms   *Permissions
+	expires time.Time
+}
+
+func newTokenCache(ttl time.Duration, max int) *tokenCache {
+	return &tokenCache{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[[sha256.Size]byte]tokenCacheEntry),
+	}
+}
+
+// get returns the cached permissions of the token, if they have not expired.
+func (tc *tokenCache) get(token string, now time.Time) (*Permissions, bool) {
+	key := sha256.Sum256([]byte(token))
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	e, ok := tc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(e.expires) {
+		delete(tc.entries, key)
+		return nil, false
+	}
+	return e.perms, true
+}
+
+// set caches the permissions of the token. When the cache is full, expired
+// entries are dropped first, then arbitrary ones.
+func (tc *tokenCache) set(token string, perms *Permissions, now time.Time) {
+	if tc.ttl <= 0 || tc.max <= 0 {
+		return
+	}
+	key := sha256.Sum256([]byte(token))
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, ok := tc.entries[key]; !ok && len(tc.entries) >= tc.max {
+		for k, e := range tc.entries {
+			if !now.Before(e.expires) {
+				delete(tc.entries, k)
+			}
+		}
+		for k := range tc.entries {
+			if len(tc.entries) < tc.max {
+				break
+			}
+			delete(tc.entries, k)
+		}
+	}
+	tc.entries[key] = tokenCacheEntry{perms: perms, expires: now.Add(tc.ttl)}
+}
+
+// validateToken returns the permissions of the client's token from the
+// cache or from the TokenValidator. Errors are returned as is so that the
+// caller fails closed.
+func validateToken(v TokenValidator, tc *tokenCache, token string) (*Permissions, error) {
+	now := time.Now()
+	if tc != nil {
+		if perms, ok := tc.get(token, now); ok {
+			return perms, nil
+		}
+	}
+	perms, err := v.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+	if tc != nil {
+		tc.set(token, perms, now)
+	}
+	return perms, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type testTokenValidator struct {
+	sync.Mutex
+	calls map[string]int
+}
+
+func (v *testTokenValidator) Validate(token string) (*Permissions, error) {
+	v.Lock()
+	v.calls[token]++
+	v.Unlock()
+	switch token {
+	case "restricted":
+		return &Permissions{Publish: &SubjectPermission{Allow: []string{"foo"}}}, nil
+	case "backend-down":
+		return nil, errors.New("backend unavailable")
+	}
+	return nil, errors.New("unknown token")
+}
+
+func (v *testTokenValidator) numCalls(token string) int {
+	v.Lock()
+	defer v.Unlock()
+	return v.calls[token]
+}
+
+func TestTokenValidator(t *testing.T) {
+	v := &testTokenValidator{calls: make(map[string]int)}
+	opts := DefaultOptions()
+	opts.TokenValidator = v
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// The validator returns the permissions of the token.
+	errCh := make(chan error, 1)
+	nc := natsConnect(t, s.ClientURL(), nats.Token("restricted"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	defer nc.Close()
+	natsPub(t, nc, "bar", []byte("hello"))
+	natsFlush(t, nc)
+	select {
+	case err := <-errCh:
+		require_Contains(t, err.Error(), "Permissions Violation for Publish to \"bar\"")
+	case <-time.After(time.Second):
+		t.Fatal("Expected a permissions violation")
+	}
+	require_Equal(t, v.numCalls("restricted"), 1)
+
+	// A cached token is not validated again.
+	nc2 := natsConnect(t, s.ClientURL(), nats.Token("restricted"))
+	nc2.Close()
+	require_Equal(t, v.numCalls("restricted"), 1)
+
+	// Validation errors reject the connection and are not cached.
+	for i := 1; i <= 2; i++ {
+		_, err := nats.Connect(s.ClientURL(), nats.Token("backend-down"))
+		require_Error(t, err)
+		require_Equal(t, v.numCalls("backend-down"), i)
+	}
+
+	// Without the cache every connect is validated.
+	s.Shutdown()
+	opts.TokenValidatorCacheTTL = -1
+	s = RunServer(opts)
+	defer s.Shutdown()
+	for i := 2; i <= 3; i++ {
+		nc := natsConnect(t, s.ClientURL(), nats.Token("restricted"))
+		nc.Close()
+		require_Equal(t, v.numCalls("restricted"), i)
+	}
+}
+
+func TestTokenValidatorCache(t *testing.T) {
+	now := time.Now()
+	perms := &Permissions{}
+	tc := newTokenCache(time.Minute, 2)
+	tc.set("a", perms, now)
+	p, ok := tc.get("a", now.Add(30*time.Second))
+	require_True(t, ok)
+	require_True(t, p == perms)
+	// Entries expire after the TTL.
+	_, ok = tc.get("a", now.Add(time.Minute))
+	require_False(t, ok)
+
+	// The cache is bounded, expired entries are dropped first.
+	tc.set("a", perms, now)
+	tc.set("b", perms, now.Add(time.Minute))
+	tc.set("c", perms, now.Add(time.Minute))
+	require_Len(t, len(tc.entries), 2)
+	_, ok = tc.get("a", now.Add(time.Minute))
+	require_False(t, ok)
+	for _, token := range []string{"b", "c"} {
+		_, ok = tc.get(token, now.Add(time.Minute))
+		require_True(t, ok)
+	}
+	tc.set("d", perms, now.Add(time.Minute))
+	require_Len(t, len(tc.entries), 2)
+}
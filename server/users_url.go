@@ -0,0 +1,254 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Maximum size of the users document fetched from UsersURL.
+const maxUsersURLSize = 16 * 1024 * 1024
+
+// loadRemoteUsers fetches the users from the UsersURL endpoint, to be merged
+// with the configured ones when the authorization is set up. Their secrets
+// are hashed as for the configured users, and the number of hashed ones is
+// returned as well.
+// Lock should not be held since fetching and hashing are costly.
+func (s *Server) loadRemoteUsers(opts *Options) ([]*NkeyUser, []*User, int, error) {
+	nkeys, users, err := s.fetchRemoteUsers(opts)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if err := checkLocalAdminClash(opts, users); err != nil {
+		return nil, nil, 0, err
+	}
+	var numAutoHashed int
+	if opts.AutoHashTokens {
+		for _, u := range users {
+			numAutoHashed += s.autoHashSecrets(opts.SecretDecryptor, autoHashedUserSecrets(opts, u)...)
+		}
+	}
+	return nkeys, users, numAutoHashed, nil
+}
+
+// validateMaxUsersWithRemote checks that the users and nkey users of the
+// options, merged with the ones fetched from UsersURL, do not exceed the
+// maximum. Configured users take precedence over remote ones with the same
+// name, so those are only counted once.
+// Lock should not be held.
+func (s *Server) validateMaxUsersWithRemote(opts *Options) error {
+	users := make(map[string]struct{}, len(opts.Users))
+	for _, u := range opts.Users {
+		users[u.Username] = struct{}{}
+	}
+	nkeys := make(map[string]struct{}, len(opts.Nkeys))
+	for _, nk := range opts.Nkeys {
+		nkeys[nk.Nkey] = struct{}{}
+	}
+	s.mu.RLock()
+	for _, u := range s.remoteUsers {
+		users[u.Username] = struct{}{}
+	}
+	for _, nk := range s.remoteNkeys {
+		nkeys[nk.Nkey] = struct{}{}
+	}
+	s.mu.RUnlock()
+	return validateMaxUsers(opts.MaxUsers, len(users)+len(nkeys))
+}
+
+// fetchRemoteUsers fetches the users from the UsersURL endpoint. The
+// document is a JSON object with a "users" array, which has the same schema
+// as in the authorization block.
+// When a cache file is configured, a successful fetch is written to it
+// and the cached document is used if the endpoint can't be reached.
+func (s *Server) fetchRemoteUsers(opts *Options) ([]*NkeyUser, []*User, error) {
+	data, err := fetchUsersURL(opts)
+	if err == nil {
+		nkeys, users, perr := parseRemoteUsers(data)
+		if perr != nil {
+			return nil, nil, fmt.Errorf("invalid users from %q: %v", opts.UsersURL, perr)
+		}
+		if opts.UsersURLCache != _EMPTY_ {
+			if werr := writeUsersCache(opts.UsersURLCache, data); werr != nil {
+				s.remoteUsersWarning = fmt.Sprintf("Unable to write users cache %q: %v", opts.UsersURLCache, werr)
+			}
+		}
+		return nkeys, users, nil
+	}
+	if opts.UsersURLCache == _EMPTY_ {
+		return nil, nil, fmt.Errorf("unable to fetch users from %q: %v", opts.UsersURL, err)
+	}
+	cached, cerr := os.ReadFile(opts.UsersURLCache)
+	if cerr != nil {
+		return nil, nil, fmt.Errorf("unable to fetch users from %q: %v, and no cached users: %v", opts.UsersURL, err, cerr)
+	}
+	nkeys, users, perr := parseRemoteUsers(cached)
+	if perr != nil {
+		return nil, nil, fmt.Errorf("invalid cached users in %q: %v", opts.UsersURLCache, perr)
+	}
+	s.remoteUsersWarning = fmt.Sprintf("Unable to fetch users from %q, using cached users from %q: %v",
+		opts.UsersURL, opts.UsersURLCache, err)
+	return nkeys, users, nil
+}
+
+// fetchUsersURL returns the body of the UsersURL endpoint.
+func fetchUsersURL(opts *Options) ([]byte, error) {
+	timeout := opts.UsersURLTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_USERS_URL_TIMEOUT
+	}
+	req, err := http.NewRequest(http.MethodGet, opts.UsersURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.UsersURLToken != _EMPTY_ {
+		req.Header.Set("Authorization", "Bearer "+opts.UsersURLToken)
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUsersURLSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUsersURLSize {
+		return nil, fmt.Errorf("users document exceeds %d bytes", maxUsersURLSize)
+	}
+	return data, nil
+}
+
+// usersToken is a value of a users document. The document is parsed as
+// JSON rather than with the configuration parser, so that it can neither
+// include local files nor reference environment variables, and its values
+// are wrapped in tokens so that they are handled like configured ones.
+type usersToken struct {
+	value interface{}
+}
+
+func (t *usersToken) Value() interface{}   { return t.value }
+func (t *usersToken) Line() int            { return 0 }
+func (t *usersToken) IsUsedVariable() bool { return false }
+func (t *usersToken) SourceFile() string   { return "users document" }
+func (t *usersToken) Position() int        { return 0 }
+
+// wrapUsersValue wraps the decoded JSON value and the values it holds in
+// tokens, with numbers converted to the types of the configuration parser.
+func wrapUsersValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, mv := range v {
+			w, err := wrapUsersValue(mv)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = w
+		}
+	case []interface{}:
+		for i, av := range v {
+			w, err := wrapUsersValue(av)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = w
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return &usersToken{n}, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return &usersToken{f}, nil
+	}
+	return &usersToken{v}, nil
+}
+
+// checkRemoteUsersFields returns an error if the decoded JSON value holds
+// one of the fields loading permission subjects from a file.
+func checkRemoteUsersFields(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, mv := range v {
+			switch strings.ToLower(k) {
+			case "allow_file", "deny_file", "allow_trie_file", "deny_trie_file":
+				return fmt.Errorf("field %q is not allowed in a users document", k)
+			}
+			if err := checkRemoteUsersFields(mv); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, av := range v {
+			if err := checkRemoteUsersFields(av); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseRemoteUsers parses and validates a users document.
+func parseRemoteUsers(data []byte) ([]*NkeyUser, []*User, error) {
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, nil, err
+	}
+	// Subjects files would be read from the local file system.
+	if err := checkRemoteUsersFields(m); err != nil {
+		return nil, nil, err
+	}
+	if _, err := wrapUsersValue(m); err != nil {
+		return nil, nil, err
+	}
+	v, ok := m["users"]
+	if !ok {
+		return nil, nil, fmt.Errorf("missing users field")
+	}
+	var errs, warns []error
+	nkeys, users, err := parseUsers(v, &Options{}, &errs, &warns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs[0]
+	}
+	if err := validateAuth(&Options{Nkeys: nkeys, Users: users}); err != nil {
+		return nil, nil, err
+	}
+	return nkeys, users, nil
+}
+
+// writeUsersCache stores the users document in the cache file, which
+// is only readable by its owner since it may contain credentials.
+func writeUsersCache(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestUsersURL(t *testing.T) {
+	body := `{"users": [
+		{"user": "remote", "password": "pwd", "permissions": {"publish": "foo"}},
+		{"user": "alice", "password": "remote"}
+	]}`
+	var fetched atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	cache := filepath.Join(t.TempDir(), "users.json")
+	newOpts := func() *Options {
+		opts := DefaultOptions()
+		opts.Users = []*User{{Username: "alice", Password: "inline"}}
+		opts.UsersURL = ts.URL
+		opts.UsersURLToken = "secret"
+		opts.UsersURLCache = cache
+		return opts
+	}
+	checkUsers := func(t *testing.T, s *Server) {
+		t.Helper()
+		nc := natsConnect(t, s.ClientURL(), nats.UserInfo("remote", "pwd"))
+		defer nc.Close()
+		if _, err := nats.Connect(s.ClientURL(), nats.UserInfo("remote", "bad")); err == nil {
+			t.Fatal("Expected error with wrong password")
+		}
+		// Configured users take precedence over the remote ones.
+		nc2 := natsConnect(t, s.ClientURL(), nats.UserInfo("alice", "inline"))
+		defer nc2.Close()
+		if _, err := nats.Connect(s.ClientURL(), nats.UserInfo("alice", "remote")); err == nil {
+			t.Fatal("Expected error with the remote password of a configured user")
+		}
+		s.mu.RLock()
+		u := s.users["remote"]
+		s.mu.RUnlock()
+		if u == nil || u.Permissions == nil || u.Permissions.Publish.Allow[0] != "foo" {
+			t.Fatalf("Unexpected remote user: %+v", u)
+		}
+	}
+
+	// The users are fetched when the server is created.
+	s, err := NewServer(newOpts())
+	require_NoError(t, err)
+	require_Equal(t, fetched.Load(), 1)
+	s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("Server not ready")
+	}
+	checkUsers(t, s)
+
+	// They are not fetched again on reload.
+	require_NoError(t, s.ReloadOptions(newOpts()))
+	require_Equal(t, fetched.Load(), 1)
+	checkUsers(t, s)
+	s.Shutdown()
+
+	// Failures to load the users are returned when the server is created.
+	startErr := func(opts *Options) string {
+		t.Helper()
+		s, err := NewServer(opts)
+		if err == nil {
+			s.Shutdown()
+			t.Fatal("Expected the server creation to fail")
+		}
+		return err.Error()
+	}
+
+	// The bearer token is required.
+	opts := newOpts()
+	opts.UsersURLToken = _EMPTY_
+	opts.UsersURLCache = _EMPTY_
+	require_Contains(t, startErr(opts), "unable to fetch users", "401")
+
+	// An invalid user list fails the startup.
+	body = `{"users": [{"user": "remote", "password": "pwd", "max_payload": -1}]}`
+	require_Contains(t, startErr(newOpts()), "invalid users")
+	body = `{"users": "remote"}`
+	require_Contains(t, startErr(newOpts()), "invalid users")
+
+	// The document can neither include files nor reference variables.
+	t.Setenv("USERS_URL_PWD", "env")
+	body = "include ./users.conf"
+	require_Contains(t, startErr(newOpts()), "invalid users")
+	body = `users: [{user: remote, password: $USERS_URL_PWD}]`
+	require_Contains(t, startErr(newOpts()), "invalid users")
+	body = `{"users": [{"user": "remote", "password": "$USERS_URL_PWD"}]}`
+	opts = newOpts()
+	opts.UsersURLCache = _EMPTY_
+	s = RunServer(opts)
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("remote", "$USERS_URL_PWD"))
+	nc.Close()
+	s.Shutdown()
+
+	// Nor load permission subjects from local files.
+	subjects := filepath.Join(t.TempDir(), "subjects.txt")
+	require_NoError(t, os.WriteFile(subjects, []byte("secret.*\n"), 0600))
+	for _, field := range []string{"allow_file", "deny_file", "allow_trie_file", "deny_trie_file"} {
+		body = fmt.Sprintf(`{"users": [{"user": "remote", "password": "pwd", "permissions": {"publish": {%q: %q}}}]}`, field, subjects)
+		opts = newOpts()
+		opts.UsersURLCache = _EMPTY_
+		require_Contains(t, startErr(opts), "invalid users", field)
+	}
+
+	// The remote users count towards the maximum.
+	body = `{"users": [{"user": "remote", "password": "pwd"}]}`
+	opts = newOpts()
+	opts.UsersURLCache = _EMPTY_
+	opts.MaxUsers = 1
+	require_Contains(t, startErr(opts), "users")
+
+	// Including on reload.
+	opts = newOpts()
+	opts.UsersURLCache = _EMPTY_
+	opts.MaxUsers = 2
+	s = RunServer(opts)
+	ro := newOpts()
+	ro.UsersURLCache = _EMPTY_
+	ro.MaxUsers = 2
+	ro.Users = append(ro.Users, &User{Username: "bob", Password: "pwd"})
+	err = s.ReloadOptions(ro)
+	require_Error(t, err)
+	require_Contains(t, err.Error(), "exceeding the maximum of 2")
+	// A configured user overriding a remote one is only counted once.
+	ro = newOpts()
+	ro.UsersURLCache = _EMPTY_
+	ro.MaxUsers = 2
+	ro.Users = append(ro.Users, &User{Username: "remote", Password: "other"})
+	require_NoError(t, s.ReloadOptions(ro))
+	s.Shutdown()
+
+	// The cached users are used when the endpoint can't be reached.
+	ts.Close()
+	s = RunServer(newOpts())
+	checkUsers(t, s)
+	s.Shutdown()
+
+	opts = newOpts()
+	opts.UsersURLCache = _EMPTY_
+	require_Contains(t, startErr(opts), "unable to fetch users")
+}
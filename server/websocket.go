@@ -85,6 +85,8 @@ const (
 	wsNoMaskingHeader       = "Nats-No-Masking"
 	wsNoMaskingValue        = "true"
 	wsXForwardedForHeader   = "X-Forwarded-For"
+	wsXForwardedUserHeader  = "X-Forwarded-User"
+	wsXForwardedGroupHeader = "X-Forwarded-Groups"
 	wsNoMaskingFullResponse = wsNoMaskingHeader + ": " + wsNoMaskingValue + CR_LF
 	wsPMCExtension          = "permessage-deflate" // per-message compression
 	wsPMCSrvNoCtx           = "server_no_context_takeover"
@@ -117,7 +119,12 @@ type websocket struct {
 	maskwrite  bool
 	compressor *flate.Writer
 	cookieJwt  string
+	queryToken string
 	clientIP   string
+	// Identity set by an authenticating proxy, only trusted when the
+	// connection comes from a trusted proxy.
+	proxyUser   string
+	proxyGroups []string
 }
 
 type srvWebsocket struct {
@@ -812,6 +819,17 @@ func (s *Server) wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsUpgradeRe
 				ws.cookieJwt = c.Value
 			}
 		}
+		if opts.Websocket.TokenQueryParam != _EMPTY_ && r.URL != nil {
+			ws.queryToken = r.URL.Query().Get(opts.Websocket.TokenQueryParam)
+		}
+		ws.proxyUser = r.Header.Get(wsXForwardedUserHeader)
+		for _, v := range r.Header.Values(wsXForwardedGroupHeader) {
+			for _, g := range strings.Split(v, ",") {
+				if g = strings.TrimSpace(g); g != _EMPTY_ {
+					ws.proxyGroups = append(ws.proxyGroups, g)
+				}
+			}
+		}
 	}
 	return &wsUpgradeResult{conn: conn, ws: ws, kind: kind}, nil
 }
@@ -1199,10 +1217,7 @@ func (s *Server) createWSClient(conn net.Conn, ws *websocket) *client {
 		info.AuthRequired = s.websocket.authOverride
 	}
 	if s.nonceRequired() {
-		var raw [nonceLen]byte
-		nonce := raw[:]
-		s.generateNonce(nonce)
-		info.Nonce = string(nonce)
+		info.Nonce = string(s.generateNonce())
 	}
 	c.nonce = []byte(info.Nonce)
 	authRequired = info.AuthRequired
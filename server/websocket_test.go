@@ -34,6 +34,7 @@ import (
 	"time"
 
 	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 
 	"github.com/klauspost/compress/flate"
@@ -3372,6 +3373,45 @@ func TestWSTokenAuth(t *testing.T) {
 	}
 }
 
+func TestWSQueryTokenAuth(t *testing.T) {
+	o := testWSOptions()
+	o.Websocket.Token = "goodtoken"
+	o.Websocket.TokenQueryParam = "token"
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		name    string
+		path    string
+		connect string
+		err     string
+	}{
+		{"query token", "/?token=goodtoken", `{"verbose":false,"protocol":1}`, ""},
+		{"wrong query token", "/?token=badtoken", `{"verbose":false,"protocol":1}`, "-ERR 'Authorization Violation'"},
+		{"other query parameter", "/?auth=goodtoken", `{"verbose":false,"protocol":1}`, "-ERR 'Authorization Violation'"},
+		{"connect token overrides query token", "/?token=goodtoken",
+			`{"verbose":false,"protocol":1,"auth_token":"badtoken"}`, "-ERR 'Authorization Violation'"},
+		{"connect token with wrong query token", "/?token=badtoken",
+			`{"verbose":false,"protocol":1,"auth_token":"goodtoken"}`, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wsc, br, _ := testNewWSClient(t, testWSClientOptions{host: o.Websocket.Host, port: o.Websocket.Port, path: test.path})
+			defer wsc.Close()
+
+			wsmsg := testWSCreateClientMsg(wsBinaryMessage, 1, true, false, []byte(fmt.Sprintf("CONNECT %s\r\nPING\r\n", test.connect)))
+			if _, err := wsc.Write(wsmsg); err != nil {
+				t.Fatalf("Error sending message: %v", err)
+			}
+			msg := testWSReadFrame(t, br)
+			if test.err == "" && !bytes.HasPrefix(msg, []byte("PONG\r\n")) {
+				t.Fatalf("Expected to receive PONG, got %q", msg)
+			} else if test.err != "" && !bytes.HasPrefix(msg, []byte(test.err)) {
+				t.Fatalf("Expected to receive %q, got %q", test.err, msg)
+			}
+		})
+	}
+}
+
 func TestWSBindToProperAccount(t *testing.T) {
 	conf := createConfFile(t, []byte(fmt.Sprintf(`
 		listen: "127.0.0.1:-1"
@@ -3504,6 +3544,72 @@ func TestWSUsersAuth(t *testing.T) {
 	}
 }
 
+func TestWSProxyHeaderAuthentication(t *testing.T) {
+	groups := map[string]*Permissions{
+		"readers": {Publish: &SubjectPermission{Deny: []string{">"}}},
+	}
+	headers := map[string][]string{
+		wsXForwardedUserHeader:  {"alice"},
+		wsXForwardedGroupHeader: {"others, readers"},
+	}
+	for _, test := range []struct {
+		name    string
+		trusted []string
+		headers map[string][]string
+		pub     string
+		err     string
+	}{
+		{"trusted proxy", []string{"127.0.0.1"}, headers, "PUB foo 2\r\nok\r\n", "-ERR 'Permissions Violation for Publish to \"foo\"'"},
+		{"trusted proxy network", []string{"10.0.0.0/8", "127.0.0.0/8"}, headers, _EMPTY_, _EMPTY_},
+		{"untrusted source", []string{"10.0.0.1"}, headers, _EMPTY_, "-ERR 'Authorization Violation'"},
+		{"missing user header", []string{"127.0.0.1"}, nil, _EMPTY_, "-ERR 'Authorization Violation'"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			auth, err := NewProxyHeaderAuthentication(test.trusted, groups, nil)
+			require_NoError(t, err)
+			o := testWSOptions()
+			o.CustomClientAuthentication = auth
+			s := RunServer(o)
+			defer s.Shutdown()
+
+			wsc, br, _ := testNewWSClient(t, testWSClientOptions{
+				host:         o.Websocket.Host,
+				port:         o.Websocket.Port,
+				extraHeaders: test.headers,
+			})
+			defer wsc.Close()
+
+			connectProto := "CONNECT {\"verbose\":false,\"protocol\":1}\r\n" + test.pub + "PING\r\n"
+			wsmsg := testWSCreateClientMsg(wsBinaryMessage, 1, true, false, []byte(connectProto))
+			if _, err := wsc.Write(wsmsg); err != nil {
+				t.Fatalf("Error sending message: %v", err)
+			}
+			msg := testWSReadFrame(t, br)
+			if test.err == _EMPTY_ && !bytes.HasPrefix(msg, []byte("PONG\r\n")) {
+				t.Fatalf("Expected to receive PONG, got %q", msg)
+			} else if test.err != _EMPTY_ && !bytes.HasPrefix(msg, []byte(test.err)) {
+				t.Fatalf("Expected to receive %q, got %q", test.err, msg)
+			}
+		})
+	}
+
+	// Plain clients can't be authenticated this way.
+	auth, err := NewProxyHeaderAuthentication([]string{"127.0.0.1"}, groups, nil)
+	require_NoError(t, err)
+	o := testWSOptions()
+	o.CustomClientAuthentication = auth
+	s := RunServer(o)
+	defer s.Shutdown()
+	if nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to fail")
+	}
+
+	if _, err := NewProxyHeaderAuthentication([]string{"not an ip"}, nil, nil); err == nil {
+		t.Fatal("Expected error for invalid trusted proxy")
+	}
+}
+
 func TestWSNoAuthUserValidation(t *testing.T) {
 	o := testWSOptions()
 	o.Users = []*User{{Username: "user", Password: "pwd"}}
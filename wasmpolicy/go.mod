@@ -0,0 +1,22 @@
+module github.com/nats-io/nats-server/v2/wasmpolicy
+
+go 1.19
+
+require (
+	github.com/nats-io/nats-server/v2 v2.9.22-RC.3
+	github.com/nats-io/nats.go v1.28.0
+	github.com/tetratelabs/wazero v1.5.0
+)
+
+require (
+	github.com/klauspost/compress v1.16.7 // indirect
+	github.com/minio/highwayhash v1.0.2 // indirect
+	github.com/nats-io/jwt/v2 v2.4.1 // indirect
+	github.com/nats-io/nkeys v0.4.4 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	golang.org/x/crypto v0.11.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/time v0.3.0 // indirect
+)
+
+replace github.com/nats-io/nats-server/v2 => ../
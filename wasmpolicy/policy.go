@@ -0,0 +1,319 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wasmpolicy runs the policy modules of the NATS server as WASM
+// modules. It is a separate module so that the WASM runtime is not a
+// dependency of the server. Set Runtime as the PolicyRuntime of the server
+// options to use it.
+//
+// The module exports a function `allowed` taking the operation, which is
+// server.PolicyPublish or server.PolicySubscribe, and returning 1 to allow
+// it. Any other result, as well as a trap, denies the operation. The module
+// reads the request with the functions of the hostModule host module, which
+// all copy a value to the module's exported memory at ptr, up to size bytes,
+// and return its full length:
+//
+//	subject(ptr, size i32) i32  - the subject.
+//	identity(ptr, size i32) i32 - the user name, nkey or JWT public key
+//	                              verified when the client authenticated,
+//	                              empty for anonymous and token clients.
+//	account(ptr, size i32) i32  - the name of the client's account.
+package wasmpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const (
+	hostModule = "nats"
+	allowedFn  = "allowed"
+)
+
+// Maximum time a call to the policy module may take. The module is closed
+// when it is exceeded, which denies the operation.
+const callTimeout = 100 * time.Millisecond
+
+// Interval at which the calls in progress are checked against their
+// deadline.
+const watchdogInterval = callTimeout / 10
+
+var (
+	errClosed  = errors.New("policy module is closed")
+	errTimeout = errors.New("policy module call timed out")
+)
+
+// Runtime loads WASM policy modules.
+type Runtime struct{}
+
+// Load compiles the policy module and checks that it can be instantiated.
+func (Runtime) Load(module []byte) (server.Policy, error) {
+	return newWASMPolicy(module)
+}
+
+// wasmPolicy is a compiled policy module. The module is compiled once and
+// its instances are cached, each being used by a single caller at a time.
+// The read lock is held while an instance is in use, so that closing the
+// runtime waits for the calls in progress.
+type wasmPolicy struct {
+	mu       sync.RWMutex
+	closed   bool
+	rt       wazero.Runtime
+	compiled wazero.CompiledModule
+	idle     chan *policyInstance
+
+	// The live instances, which the watchdog checks for calls exceeding
+	// their deadline, rather than arming a timer for each call.
+	imu       sync.Mutex
+	instances map[*policyInstance]struct{}
+	quit      chan struct{}
+}
+
+// policyInstance is an instance of the policy module along with the request
+// it is evaluating, which the host functions read.
+type policyInstance struct {
+	mod     api.Module
+	allowed api.Function
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stack   [1]uint64
+
+	// Deadline of the call in progress, zero when the instance is idle.
+	mu       sync.Mutex
+	deadline time.Time
+
+	subject  string
+	identity string
+	account  string
+}
+
+type policyInstanceKey struct{}
+
+// newWASMPolicy compiles the policy module and checks that it can be
+// instantiated.
+func newWASMPolicy(module []byte) (*wasmPolicy, error) {
+	ctx := context.Background()
+	// Closing the module when the context of a call is done is what bounds
+	// the time spent in a module that does not return.
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	p := &wasmPolicy{
+		rt:        rt,
+		idle:      make(chan *policyInstance, runtime.GOMAXPROCS(0)),
+		instances: make(map[*policyInstance]struct{}),
+		quit:      make(chan struct{}),
+	}
+	hostFn := func(field func(pi *policyInstance) string) api.GoModuleFunc {
+		return func(ctx context.Context, m api.Module, stack []uint64) {
+			pi := ctx.Value(policyInstanceKey{}).(*policyInstance)
+			stack[0] = api.EncodeU32(policyWrite(m, field(pi), api.DecodeU32(stack[0]), api.DecodeU32(stack[1])))
+		}
+	}
+	i32 := api.ValueTypeI32
+	host := rt.NewHostModuleBuilder(hostModule)
+	for name, field := range map[string]func(pi *policyInstance) string{
+		"subject":  func(pi *policyInstance) string { return pi.subject },
+		"identity": func(pi *policyInstance) string { return pi.identity },
+		"account":  func(pi *policyInstance) string { return pi.account },
+	} {
+		host.NewFunctionBuilder().
+			WithGoModuleFunction(hostFn(field), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+			Export(name)
+	}
+	if _, err := host.Instantiate(ctx); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	compiled, err := rt.CompileModule(ctx, module)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	p.compiled = compiled
+	fn, ok := compiled.ExportedFunctions()[allowedFn]
+	if !ok {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("function %q is not exported", allowedFn)
+	}
+	if params, results := fn.ParamTypes(), fn.ResultTypes(); len(params) != 1 || params[0] != i32 ||
+		len(results) != 1 || results[0] != i32 {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("function %q must take and return an i32", allowedFn)
+	}
+	go p.watchdog()
+	pi, err := p.instantiate()
+	if err != nil {
+		close(p.quit)
+		rt.Close(ctx)
+		return nil, err
+	}
+	p.release(pi)
+	return p, nil
+}
+
+// policyWrite copies up to size bytes of the value to the memory of the
+// module at ptr, and returns the length of the value. Writing outside of the
+// memory traps.
+func policyWrite(m api.Module, value string, ptr, size uint32) uint32 {
+	n := len(value)
+	if uint32(n) > size {
+		value = value[:size]
+	}
+	if mem := m.Memory(); mem == nil || !mem.WriteString(ptr, value) {
+		panic(errors.New("policy module memory access out of range"))
+	}
+	return uint32(n)
+}
+
+// watchdog cancels the context of the instances whose call exceeded its
+// deadline, which closes them, until the policy is closed.
+func (p *wasmPolicy) watchdog() {
+	t := time.NewTicker(watchdogInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case now := <-t.C:
+			p.imu.Lock()
+			for pi := range p.instances {
+				pi.mu.Lock()
+				if !pi.deadline.IsZero() && now.After(pi.deadline) {
+					pi.cancel()
+				}
+				pi.mu.Unlock()
+			}
+			p.imu.Unlock()
+		}
+	}
+}
+
+// begin sets the deadline of the call about to be made.
+func (pi *policyInstance) begin() {
+	pi.mu.Lock()
+	pi.deadline = time.Now().Add(callTimeout)
+	pi.mu.Unlock()
+}
+
+// end clears the deadline of the call, and returns false if the call
+// exceeded it, in which case the instance can't be used anymore.
+func (pi *policyInstance) end() bool {
+	pi.mu.Lock()
+	pi.deadline = time.Time{}
+	pi.mu.Unlock()
+	return pi.ctx.Err() == nil
+}
+
+// instantiate creates a new instance of the policy module.
+func (p *wasmPolicy) instantiate() (*policyInstance, error) {
+	pi := &policyInstance{}
+	ctx, cancel := context.WithCancel(context.Background())
+	pi.ctx, pi.cancel = context.WithValue(ctx, policyInstanceKey{}, pi), cancel
+	p.imu.Lock()
+	p.instances[pi] = struct{}{}
+	p.imu.Unlock()
+	// The start function, if any, is bounded as well.
+	pi.begin()
+	// Instances are anonymous so that there can be several of them.
+	mod, err := p.rt.InstantiateModule(pi.ctx, p.compiled, wazero.NewModuleConfig().WithName(""))
+	if !pi.end() && err == nil {
+		mod.Close(context.Background())
+		err = errTimeout
+	}
+	if err != nil {
+		p.discard(pi)
+		return nil, err
+	}
+	pi.mod, pi.allowed = mod, mod.ExportedFunction(allowedFn)
+	return pi, nil
+}
+
+// discard closes the instance and stops tracking it.
+func (p *wasmPolicy) discard(pi *policyInstance) {
+	pi.cancel()
+	if pi.mod != nil {
+		pi.mod.Close(context.Background())
+	}
+	p.imu.Lock()
+	delete(p.instances, pi)
+	p.imu.Unlock()
+}
+
+// release returns the instance to the cache, or closes it if the cache is
+// full.
+func (p *wasmPolicy) release(pi *policyInstance) {
+	pi.subject, pi.identity, pi.account = "", "", ""
+	select {
+	case p.idle <- pi:
+	default:
+		p.discard(pi)
+	}
+}
+
+// Allowed evaluates the operation on the subject for the given identity and
+// account. Errors, including a call exceeding callTimeout or the module
+// being closed, are returned along with false so that the policy fails
+// closed.
+func (p *wasmPolicy) Allowed(op server.PolicyOp, subject, identity, account string) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false, errClosed
+	}
+	var pi *policyInstance
+	select {
+	case pi = <-p.idle:
+	default:
+		var err error
+		if pi, err = p.instantiate(); err != nil {
+			return false, err
+		}
+	}
+	pi.subject, pi.identity, pi.account = subject, identity, account
+	pi.stack[0] = api.EncodeU32(uint32(op))
+	pi.begin()
+	err := pi.allowed.CallWithStack(pi.ctx, pi.stack[:])
+	if !pi.end() && err == nil {
+		err = errTimeout
+	}
+	if err != nil {
+		// The instance may be left in any state after a trap, and is
+		// already closed if the call timed out.
+		p.discard(pi)
+		return false, err
+	}
+	allowed := api.DecodeU32(pi.stack[0]) == 1
+	p.release(pi)
+	return allowed, nil
+}
+
+// Close releases the compiled module and its instances. Instances are no
+// longer handed out, and the calls in progress, which are bounded by
+// callTimeout, are waited for before the runtime is closed.
+func (p *wasmPolicy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.quit)
+	p.rt.Close(context.Background())
+}
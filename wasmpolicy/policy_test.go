@@ -0,0 +1,216 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasmpolicy
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// testPolicyModule assembles a policy module importing the given host
+// function, exporting one page of memory with "allow.me" at offset 64, and
+// exporting `allowed` with the given code.
+func testPolicyModule(hostFn string, code []byte) []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	var m []byte
+	m = append(m, 0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00)
+	// Types: (i32, i32) -> i32 for the host function and (i32) -> i32.
+	m = append(m, section(0x01, 0x02, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x01, 0x7f, 0x01, 0x7f)...)
+	imp := append([]byte{0x01, byte(len(hostModule))}, hostModule...)
+	imp = append(append(imp, byte(len(hostFn))), hostFn...)
+	m = append(m, section(0x02, append(imp, 0x00, 0x00)...)...)
+	m = append(m, section(0x03, 0x01, 0x01)...)
+	m = append(m, section(0x05, 0x01, 0x00, 0x01)...)
+	exp := append([]byte{0x02, 0x06}, "memory"...)
+	exp = append(append(exp, 0x02, 0x00, 0x07), "allowed"...)
+	m = append(m, section(0x07, append(exp, 0x00, 0x01)...)...)
+	body := append([]byte{byte(len(code) + 1), 0x00}, code...)
+	m = append(m, section(0x0a, append([]byte{0x01}, body...)...)...)
+	data := append([]byte{0x01, 0x00, 0x41, 0xc0, 0x00, 0x0b, 0x08}, "allow.me"...)
+	return append(m, section(0x0b, data...)...)
+}
+
+var (
+	// Allows the subject "allow.me" only:
+	// (i32.and
+	//   (i32.eq (call $subject (i32.const 0) (i32.const 64)) (i32.const 8))
+	//   (i64.eq (i64.load (i32.const 0)) (i64.load (i32.const 64))))
+	subjectPolicy = testPolicyModule("subject", []byte{
+		0x41, 0x00, 0x41, 0xc0, 0x00, 0x10, 0x00, 0x41, 0x08, 0x46,
+		0x41, 0x00, 0x29, 0x03, 0x00, 0x41, 0xc0, 0x00, 0x29, 0x03, 0x00, 0x51,
+		0x71, 0x0b,
+	})
+	// Allows identities of 4 characters only:
+	// (i32.eq (call $identity (i32.const 0) (i32.const 0)) (i32.const 4))
+	identityPolicy = testPolicyModule("identity", []byte{
+		0x41, 0x00, 0x41, 0x00, 0x10, 0x00, 0x41, 0x04, 0x46, 0x0b,
+	})
+	// Allows accounts of 4 characters only, like identityPolicy.
+	accountPolicy = testPolicyModule("account", []byte{
+		0x41, 0x00, 0x41, 0x00, 0x10, 0x00, 0x41, 0x04, 0x46, 0x0b,
+	})
+	// Traps: (unreachable)
+	trapPolicy = testPolicyModule("subject", []byte{0x00, 0x0b})
+	// Never returns: (loop (br 0)) (i32.const 1)
+	loopPolicy = testPolicyModule("subject", []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x41, 0x01, 0x0b})
+)
+
+func loadTestPolicy(t *testing.T, module []byte) server.Policy {
+	t.Helper()
+	p, err := Runtime{}.Load(module)
+	if err != nil {
+		t.Fatalf("Error loading policy module: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func expectAllowed(t *testing.T, p server.Policy, subject, identity, account string, expected bool) {
+	t.Helper()
+	allowed, err := p.Allowed(server.PolicyPublish, subject, identity, account)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if allowed != expected {
+		t.Fatalf("Expected %q for %q in %q to be allowed=%v", subject, identity, account, expected)
+	}
+}
+
+func TestPolicyModuleRequest(t *testing.T) {
+	p := loadTestPolicy(t, subjectPolicy)
+	expectAllowed(t, p, "allow.me", "", "$G", true)
+	expectAllowed(t, p, "allow.me.not", "", "$G", false)
+	expectAllowed(t, p, "denied", "", "$G", false)
+
+	p = loadTestPolicy(t, identityPolicy)
+	expectAllowed(t, p, "foo", "user", "$G", true)
+	expectAllowed(t, p, "foo", "bob", "$G", false)
+
+	p = loadTestPolicy(t, accountPolicy)
+	expectAllowed(t, p, "foo", "", "ACME", true)
+	expectAllowed(t, p, "foo", "", "$G", false)
+}
+
+func TestPolicyModuleErrors(t *testing.T) {
+	// Traps deny the operation.
+	p := loadTestPolicy(t, trapPolicy)
+	allowed, err := p.Allowed(server.PolicyPublish, "allow.me", "", "$G")
+	if allowed || err == nil {
+		t.Fatalf("Expected the trap to deny the operation, got %v, %v", allowed, err)
+	}
+
+	// And so do calls that do not return in time.
+	p = loadTestPolicy(t, loopPolicy)
+	start := time.Now()
+	allowed, err = p.Allowed(server.PolicySubscribe, "allow.me", "", "$G")
+	if allowed || err == nil {
+		t.Fatalf("Expected the call to time out, got %v, %v", allowed, err)
+	}
+	if dur := time.Since(start); dur > 10*callTimeout {
+		t.Fatalf("Expected the call to be interrupted after %v, took %v", callTimeout, dur)
+	}
+
+	// Closing the module waits for the calls in progress, which fail, and
+	// denies the following ones.
+	p = loadTestPolicy(t, loopPolicy)
+	callErr := make(chan error, 1)
+	go func() {
+		_, err := p.Allowed(server.PolicySubscribe, "allow.me", "", "$G")
+		callErr <- err
+	}()
+	time.Sleep(callTimeout / 2)
+	p.Close()
+	select {
+	case err := <-callErr:
+		if err == nil {
+			t.Fatal("Expected the call in progress to fail")
+		}
+	default:
+		t.Fatal("Expected the call in progress to be done when closed")
+	}
+	allowed, err = p.Allowed(server.PolicySubscribe, "allow.me", "", "$G")
+	if allowed || !errors.Is(err, errClosed) {
+		t.Fatalf("Expected the closed module to deny the operation, got %v, %v", allowed, err)
+	}
+
+	// Invalid modules can't be loaded.
+	for _, test := range []struct {
+		name   string
+		module []byte
+		err    string
+	}{
+		{"invalid", []byte("not wasm"), "invalid magic number"},
+		{"unknown host function", testPolicyModule("user", []byte{0x41, 0x01, 0x0b}), `"user" is not exported in module "nats"`},
+		{"no allowed function", bytes.Replace(subjectPolicy, []byte("allowed"), []byte("decided"), 1), `function "allowed" is not exported`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Runtime{}.Load(test.module)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestPolicyModuleServer(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.PolicyModule = subjectPolicy
+	opts.PolicyRuntime = Runtime{}
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 10)
+	nc, err := nats.Connect(s.ClientURL(), nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	}))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer nc.Close()
+	sub, err := nc.SubscribeSync("allow.me")
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	if err := nc.Publish("denied", []byte("denied")); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if err := nc.Publish("allow.me", []byte("allowed")); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), `Permissions Violation for Publish to "denied"`) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a permissions violation")
+	}
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving the message: %v", err)
+	}
+	if string(msg.Data) != "allowed" {
+		t.Fatalf("Unexpected message: %q", msg.Data)
+	}
+}